@@ -0,0 +1,488 @@
+package papaBot
+
+// Command line administration of the bot's database, for use while the bot is not running.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// Actor recorded in the audit trail for changes made from the command line.
+const adminActor = "admin-cli"
+
+// Input and output of an admin command.
+type adminIO struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// readLine reads a line of the input, e.g. a password, without the line ending.
+func (cli *adminIO) readLine() string {
+	line, _ := cli.in.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Command of the admin command line.
+type adminCommand struct {
+	// Arguments and description shown in the usage.
+	usage string
+	// Number of arguments that must be given.
+	minArgs int
+	run     func(bot *Bot, cli *adminIO, args []string) error
+}
+
+// Admin commands, by name.
+var adminCommands = map[string]adminCommand{
+	"user list":       {"- lists the users with their roles", 0, adminUserList},
+	"user add":        {"<nick> [role...] - adds a user, with the password on input", 1, adminUserAdd},
+	"user remove":     {"<nick> - removes a user", 1, adminUserRemove},
+	"user promote":    {"<nick> <role> [transport;channel] - gives the role to the user", 2, adminUserPromote},
+	"user demote":     {"<nick> <role> [transport;channel] - takes the role from the user", 2, adminUserDemote},
+	"user reset":      {"<nick> - sets a new password, given on input, and unlocks logging in", 1, adminUserReset},
+	"var list":        {"- lists the custom variables", 0, adminVarList},
+	"var get":         {"<name> - shows the variable", 1, adminVarGet},
+	"var set":         {"<name> <value> - sets the variable, empty value deletes it", 2, adminVarSet},
+	"reminder list":   {"- lists the pending reminders", 0, adminReminderList},
+	"reminder delete": {"<id> - deletes the reminder", 1, adminReminderDelete},
+	"counter list":    {"- lists the counters", 0, adminCounterList},
+	"counter delete":  {"<id> - deletes the counter", 1, adminCounterDelete},
+	"url search":      {"[-channel name] [-limit n] <words...> - searches the stored links", 1, adminURLSearch},
+	"export":          {"- writes all of the data above as JSON", 0, adminExport},
+	"import":          {"- reads the data written by export and adds it to the database", 0, adminImport},
+}
+
+// adminUsage lists the admin commands.
+func adminUsage() string {
+	names := []string{}
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{"Commands:"}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %s %s", name, adminCommands[name].usage))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Admin runs an admin command, like "user add alice owner", on the database of the bot. It is meant for managing the
+// bot while it's not running. Passwords and imported data are read from in. Register all extensions before calling
+// it, as the pending migrations are applied first.
+func (bot *Bot) Admin(args []string, in io.Reader, out io.Writer) error {
+	name, cmd, exists := "", adminCommand{}, false
+	if len(args) > 1 {
+		name = args[0] + " " + args[1]
+		cmd, exists = adminCommands[name]
+	}
+	if !exists && len(args) > 0 {
+		name = args[0]
+		cmd, exists = adminCommands[name]
+	}
+	if !exists {
+		return errors.New(adminUsage())
+	}
+	args = args[len(strings.Fields(name)):]
+	if len(args) < cmd.minArgs {
+		return errors.New(fmt.Sprintf("Usage: %s %s", name, cmd.usage))
+	}
+
+	if bot.Storage == nil {
+		if err := bot.initDb(); err != nil {
+			return err
+		}
+		defer func() {
+			bot.Storage.Close()
+			bot.Storage, bot.Db = nil, nil
+		}()
+	}
+	if err := bot.migrate(); err != nil {
+		return err
+	}
+	if err := bot.loadRoles(); err != nil {
+		return err
+	}
+	return cmd.run(bot, &adminIO{bufio.NewReader(in), out}, args)
+}
+
+// adminAssignment builds the role assignment from the arguments of promote and demote.
+func adminAssignment(args []string) (storage.RoleAssignment, error) {
+	assignment := storage.RoleAssignment{Nick: args[0], Role: args[1]}
+	if len(args) > 2 {
+		if !strings.Contains(args[2], ";") {
+			return assignment, errors.New("Channel must be given as transport;channel.")
+		}
+		assignment.ChannelId = args[2]
+	}
+	return assignment, nil
+}
+
+// adminUserList lists the users with their roles.
+func adminUserList(bot *Bot, cli *adminIO, args []string) error {
+	users, err := bot.Storage.Users()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		roles := bot.nickRoles(user.Nick)
+		if len(roles) == 0 {
+			roles = []string{"no roles"}
+		}
+		fmt.Fprintf(cli.out, "%s | %s | joined %s\n", user.Nick, strings.Join(roles, ", "),
+			user.Joined.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+// adminUserAdd adds a user with the roles.
+func adminUserAdd(bot *Bot, cli *adminIO, args []string) error {
+	if err := bot.addUser(args[0], cli.readLine(), args[1:]); err != nil {
+		return err
+	}
+	bot.audit(adminActor, "user.add", args[0], strings.Join(args[1:], ", "))
+	fmt.Fprintf(cli.out, "User %s added.\n", args[0])
+	return nil
+}
+
+// adminUserRemove removes a user.
+func adminUserRemove(bot *Bot, cli *adminIO, args []string) error {
+	if bot.isLastOwner(args[0]) {
+		return errors.New("The last owner can't be removed.")
+	}
+	if deleted, err := bot.Storage.DeleteUser(args[0]); err != nil {
+		return err
+	} else if !deleted {
+		return errors.New(fmt.Sprintf("No user named %s.", args[0]))
+	}
+	bot.audit(adminActor, "user.remove", args[0], "")
+	fmt.Fprintf(cli.out, "User %s removed.\n", args[0])
+	return nil
+}
+
+// adminUserPromote gives a role to a user.
+func adminUserPromote(bot *Bot, cli *adminIO, args []string) error {
+	assignment, err := adminAssignment(args)
+	if err != nil {
+		return err
+	}
+	if err := bot.grantRole(assignment); err != nil {
+		return err
+	}
+	bot.audit(adminActor, "role.grant", assignment.Nick, describeAssignment(assignment))
+	fmt.Fprintln(cli.out, "Role granted.")
+	return nil
+}
+
+// adminUserDemote takes a role from a user.
+func adminUserDemote(bot *Bot, cli *adminIO, args []string) error {
+	assignment, err := adminAssignment(args)
+	if err != nil {
+		return err
+	}
+	if err := bot.revokeRole(assignment); err != nil {
+		return err
+	}
+	bot.audit(adminActor, "role.revoke", assignment.Nick, describeAssignment(assignment))
+	fmt.Fprintln(cli.out, "Role revoked.")
+	return nil
+}
+
+// adminUserReset sets a new password for the user and clears the login lockout.
+func adminUserReset(bot *Bot, cli *adminIO, args []string) error {
+	password := cli.readLine()
+	if password == "" {
+		return errors.New("Password can't be empty.")
+	}
+	if changed, err := bot.Storage.SetPassword(args[0], utils.HashPassword(password)); err != nil {
+		return err
+	} else if !changed {
+		return errors.New(fmt.Sprintf("No user named %s.", args[0]))
+	}
+	if err := bot.Storage.SetLoginFailures(args[0], 0, time.Time{}); err != nil {
+		return err
+	}
+	bot.audit(adminActor, "user.passwd", args[0], "")
+	fmt.Fprintf(cli.out, "Password of %s changed.\n", args[0])
+	return nil
+}
+
+// adminVarList lists the custom variables.
+func adminVarList(bot *Bot, cli *adminIO, args []string) error {
+	vars, err := bot.Storage.Vars()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(cli.out, "%s = %s\n", name, vars[name])
+	}
+	return nil
+}
+
+// adminVarGet shows a custom variable.
+func adminVarGet(bot *Bot, cli *adminIO, args []string) error {
+	vars, err := bot.Storage.Vars()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "%s = %s\n", args[0], vars[args[0]])
+	return nil
+}
+
+// adminVarSet sets or deletes a custom variable.
+func adminVarSet(bot *Bot, cli *adminIO, args []string) error {
+	value := strings.Join(args[1:], " ")
+	if value == "" {
+		return bot.Storage.DeleteVar(args[0])
+	}
+	return bot.Storage.SetVar(args[0], value)
+}
+
+// adminReminderList lists the pending reminders.
+func adminReminderList(bot *Bot, cli *adminIO, args []string) error {
+	reminders, err := bot.Storage.PendingReminders()
+	if err != nil {
+		return err
+	}
+	for _, reminder := range reminders {
+		fmt.Fprintf(cli.out, "%d | %s;%s | %s | %s: %s\n", reminder.Id, reminder.Transport, reminder.Channel,
+			reminder.TargetTime.Format("2006-01-02 15:04:05"), reminder.Creator, reminder.Text)
+	}
+	return nil
+}
+
+// adminReminderDelete deletes a reminder.
+func adminReminderDelete(bot *Bot, cli *adminIO, args []string) error {
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s is not a reminder id.", args[0]))
+	}
+	if err := bot.Storage.DeleteReminder(id); err != nil {
+		return err
+	}
+	fmt.Fprintln(cli.out, "Reminder deleted.")
+	return nil
+}
+
+// adminCounterList lists the counters.
+func adminCounterList(bot *Bot, cli *adminIO, args []string) error {
+	counters, err := bot.Storage.Counters()
+	if err != nil {
+		return err
+	}
+	for _, counter := range counters {
+		fmt.Fprintf(cli.out, "%d | %s;%s | %s, every %d hours | %s: %s\n", counter.Id, counter.Transport,
+			counter.Channel, counter.Date.Format("2006-01-02 15:04:05"), counter.Interval, counter.Creator, counter.Text)
+	}
+	return nil
+}
+
+// adminCounterDelete deletes a counter.
+func adminCounterDelete(bot *Bot, cli *adminIO, args []string) error {
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s is not a counter id.", args[0]))
+	}
+	if deleted, err := bot.Storage.DeleteCounter(id, ""); err != nil {
+		return err
+	} else if !deleted {
+		return errors.New(fmt.Sprintf("No counter with id %d.", id))
+	}
+	fmt.Fprintln(cli.out, "Counter deleted.")
+	return nil
+}
+
+// adminURLSearch searches the stored links, like the find command.
+func adminURLSearch(bot *Bot, cli *adminIO, args []string) error {
+	flags := flag.NewFlagSet("url search", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+	channel := flags.String("channel", "", "Search only the links posted on this channel.")
+	limit := flags.Int("limit", 20, "Maximum number of links to show.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("Usage: url search [-channel name] [-limit n] <words...>")
+	}
+	urls, err := bot.Storage.SearchURLs(*channel, flags.Args(), *limit)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		fmt.Fprintf(cli.out, "%s;%s | %s | %s | %s (%s)\n", url.Transport, url.Channel, url.Nick,
+			url.Timestamp.Format("2006-01-02 15:04:05"), url.Link, url.Title)
+	}
+	return nil
+}
+
+// Data written by export and read by import.
+type adminData struct {
+	Users           []storage.User           `json:"users"`
+	Roles           []storage.Role           `json:"roles"`
+	RoleAssignments []storage.RoleAssignment `json:"role_assignments"`
+	Vars            map[string]string        `json:"vars"`
+	Reminders       []storage.Reminder       `json:"reminders"`
+	Counters        []storage.Counter        `json:"counters"`
+	URLs            []storage.URL            `json:"urls"`
+}
+
+// adminExport writes the users, roles, vars, reminders, counters and links as JSON.
+func adminExport(bot *Bot, cli *adminIO, args []string) error {
+	data := adminData{}
+	var err error
+	if data.Users, err = bot.Storage.Users(); err != nil {
+		return err
+	}
+	if data.Roles, err = bot.Storage.Roles(); err != nil {
+		return err
+	}
+	if data.RoleAssignments, err = bot.Storage.RoleAssignments(); err != nil {
+		return err
+	}
+	if data.Vars, err = bot.Storage.Vars(); err != nil {
+		return err
+	}
+	if data.Reminders, err = bot.Storage.PendingReminders(); err != nil {
+		return err
+	}
+	if data.Counters, err = bot.Storage.Counters(); err != nil {
+		return err
+	}
+	if data.URLs, err = bot.Storage.URLs(); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(cli.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// adminImport adds the exported data to the database. Users, reminders, counters and links that already exist are
+// skipped, so the same data can be imported again.
+func adminImport(bot *Bot, cli *adminIO, args []string) error {
+	data := adminData{}
+	if err := json.NewDecoder(cli.in).Decode(&data); err != nil {
+		return errors.New(fmt.Sprintf("Can't read the data: %s", err))
+	}
+	for _, role := range data.Roles {
+		if role.Name == OwnerRole {
+			continue
+		}
+		if err := bot.Storage.SetRole(role); err != nil {
+			return err
+		}
+	}
+	added := map[string]bool{}
+	for _, user := range data.Users {
+		if err := bot.Storage.AddUser(user); err == storage.ErrUserExists {
+			fmt.Fprintf(cli.out, "User %s already exists, skipped.\n", user.Nick)
+		} else if err != nil {
+			return err
+		} else {
+			added[user.Nick] = true
+		}
+	}
+	// Roles of the existing users are left as they are.
+	for _, assignment := range data.RoleAssignments {
+		if !added[assignment.Nick] {
+			continue
+		}
+		if err := bot.Storage.AssignRole(assignment); err != nil {
+			return err
+		}
+	}
+	for name, value := range data.Vars {
+		if err := bot.Storage.SetVar(name, value); err != nil {
+			return err
+		}
+	}
+	existingReminders, err := bot.Storage.PendingReminders()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, reminder := range existingReminders {
+		seen[reminderKey(reminder)] = true
+	}
+	reminders := 0
+	for _, reminder := range data.Reminders {
+		if seen[reminderKey(reminder)] {
+			continue
+		}
+		if err := bot.Storage.AddReminder(reminder); err != nil {
+			return err
+		}
+		seen[reminderKey(reminder)] = true
+		reminders++
+	}
+	existingCounters, err := bot.Storage.Counters()
+	if err != nil {
+		return err
+	}
+	for _, counter := range existingCounters {
+		seen[counterKey(counter)] = true
+	}
+	counters := 0
+	for _, counter := range data.Counters {
+		if seen[counterKey(counter)] {
+			continue
+		}
+		if err := bot.Storage.AddCounter(counter); err != nil {
+			return err
+		}
+		seen[counterKey(counter)] = true
+		counters++
+	}
+	existingURLs, err := bot.Storage.URLs()
+	if err != nil {
+		return err
+	}
+	for _, url := range existingURLs {
+		seen[urlKey(url)] = true
+	}
+	urls := 0
+	for _, url := range data.URLs {
+		if seen[urlKey(url)] {
+			continue
+		}
+		if err := bot.Storage.AddURL(url); err != nil {
+			return err
+		}
+		seen[urlKey(url)] = true
+		urls++
+	}
+	bot.audit(adminActor, "import", "", fmt.Sprintf("%d users", len(added)))
+	fmt.Fprintf(cli.out, "Imported %d users, %d roles, %d vars, %d reminders, %d counters and %d links.\n", len(added),
+		len(data.Roles), len(data.Vars), reminders, counters, urls)
+	return nil
+}
+
+// reminderKey identifies the reminder regardless of its id.
+func reminderKey(reminder storage.Reminder) string {
+	return fmt.Sprintf("reminder|%s|%s|%s|%d|%s", reminder.Transport, reminder.Channel, reminder.Creator,
+		reminder.TargetTime.Unix(), reminder.Text)
+}
+
+// counterKey identifies the counter regardless of its id.
+func counterKey(counter storage.Counter) string {
+	return fmt.Sprintf("counter|%s|%s|%s|%d|%d|%s", counter.Transport, counter.Channel, counter.Creator,
+		counter.Date.Unix(), counter.Interval, counter.Text)
+}
+
+// urlKey identifies the link regardless of its id.
+func urlKey(url storage.URL) string {
+	return fmt.Sprintf("url|%s|%s|%s|%d|%s", url.Transport, url.Channel, url.Nick, url.Timestamp.Unix(), url.Link)
+}
@@ -0,0 +1,78 @@
+package papaBot_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot"
+)
+
+// Data for import, as written by export.
+const testImport = `{
+	"urls": [{"Transport": "test", "Channel": "#test", "Nick": "bob", "Link": "http://golang.org", "Quote": "q",
+		"Title": "The Go language", "Timestamp": "2020-01-01T12:00:00Z"}],
+	"reminders": [{"Transport": "test", "Channel": "#test", "Creator": "bob", "Text": "Standup",
+		"TargetTime": "2030-01-01T10:00:00Z"}],
+	"counters": [{"Transport": "test", "Channel": "#test", "Creator": "bob", "Text": "Release", "Interval": 24,
+		"Date": "2030-06-01T00:00:00Z"}]
+}`
+
+// TestAdminCommands tests managing the database from the command line, and moving the data to another database.
+func TestAdminCommands(t *testing.T) {
+	bot := newTestBot(t, &testTransport{started: make(chan struct{}), quit: make(chan struct{})})
+	admin := func(bot *papaBot.Bot, input string, args ...string) string {
+		out := &bytes.Buffer{}
+		if err := bot.Admin(args, strings.NewReader(input), out); err != nil {
+			t.Fatalf("%s failed: %s", strings.Join(args, " "), err)
+		}
+		return out.String()
+	}
+
+	admin(bot, "pass\n", "user", "add", "alice", "admin")
+	admin(bot, "", "user", "promote", "alice", "owner", "test;#test")
+	if list := admin(bot, "", "user", "list"); !strings.Contains(list, "alice | admin, owner on test;#test |") {
+		t.Errorf("User should be added with the roles, got: %s", list)
+	}
+	if err := bot.Admin([]string{"user", "remove", "owner"}, nil, &bytes.Buffer{}); err == nil {
+		t.Error("Last owner should not be removed.")
+	}
+	admin(bot, "", "var", "set", "greeting", "hello", "world")
+	if value := admin(bot, "", "var", "get", "greeting"); value != "greeting = hello world\n" {
+		t.Errorf("Unexpected var: %s", value)
+	}
+
+	if result := admin(bot, testImport, "import"); !strings.Contains(result, "1 reminders, 1 counters and 1 links") {
+		t.Errorf("Unexpected import result: %s", result)
+	}
+	if result := admin(bot, testImport, "import"); !strings.Contains(result, "0 reminders, 0 counters and 0 links") {
+		t.Errorf("Existing rows should be skipped, got: %s", result)
+	}
+	if found := admin(bot, "", "url", "search", "-channel", "#test", "go"); !strings.Contains(found,
+		"test;#test | bob | 2020-01-01") {
+		t.Errorf("Imported link should be found, got: %s", found)
+	}
+	if reminders := admin(bot, "", "reminder", "list"); strings.Count(reminders, "bob: Standup") != 1 {
+		t.Errorf("Imported reminder should be listed, got: %s", reminders)
+	}
+	if counters := admin(bot, "", "counter", "list"); strings.Count(counters, "every 24 hours | bob: Release") != 1 {
+		t.Errorf("Imported counter should be listed, got: %s", counters)
+	}
+
+	// Move everything to a new database.
+	exported := admin(bot, "", "export")
+	other := newTestBot(t, &testTransport{started: make(chan struct{}), quit: make(chan struct{})})
+	if result := admin(other, exported, "import"); !strings.Contains(result, "User owner already exists") ||
+		!strings.Contains(result, "Imported 1 users") {
+		t.Errorf("Unexpected import result: %s", result)
+	}
+	if list := admin(other, "", "user", "list"); !strings.Contains(list, "alice | admin, owner on test;#test |") {
+		t.Errorf("User should be imported with the roles, got: %s", list)
+	}
+	if value := admin(other, "", "var", "get", "greeting"); value != "greeting = hello world\n" {
+		t.Errorf("Var should be imported, got: %s", value)
+	}
+	if found := admin(other, "", "url", "search", "language"); !strings.Contains(found, "http://golang.org") {
+		t.Errorf("Link should be imported, got: %s", found)
+	}
+}
@@ -0,0 +1,479 @@
+package papaBot
+
+// Admin HTTP API, for managing the running bot from scripts.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+)
+
+// Actor recorded in the audit trail for changes made through the API.
+const apiActor = "api"
+
+// Settings read from the api section of the config file.
+type apiSettings struct {
+	Enabled bool   `config:"enabled" default:"false"`
+	Listen  string `config:"listen" default:"127.0.0.1:9191"`
+	Token   string `config:"token" default:""`
+}
+
+// APIHandlerFunc handles a request to the admin API. Path holds the parts of the URL path after the resource name.
+// The returned value is sent as JSON. Return an APIError to choose the status code.
+type APIHandlerFunc func(bot *Bot, request *http.Request, path []string) (interface{}, error)
+
+// Handler registered for an API resource, along with the name of the extension that registered it.
+type apiHandler struct {
+	owner   string
+	handler APIHandlerFunc
+}
+
+// APIError is an error returned by the API with the given HTTP status.
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (err APIError) Error() string {
+	return err.Message
+}
+
+// NewAPIError creates an error with the given HTTP status.
+func NewAPIError(status int, format string, args ...interface{}) error {
+	return APIError{status, fmt.Sprintf(format, args...)}
+}
+
+// ErrAPIMethodNotAllowed should be returned by API handlers for unsupported methods.
+var ErrAPIMethodNotAllowed = APIError{http.StatusMethodNotAllowed, "method not allowed"}
+
+// ErrAPINotFound should be returned by API handlers for unknown paths.
+var ErrAPINotFound = APIError{http.StatusNotFound, "not found"}
+
+// DecodeAPIRequest reads the JSON body of the request into target.
+func DecodeAPIRequest(request *http.Request, target interface{}) error {
+	if err := json.NewDecoder(request.Body).Decode(target); err != nil {
+		return NewAPIError(http.StatusBadRequest, "invalid JSON: %s", err)
+	}
+	return nil
+}
+
+// RegisterAPIHandler will register a handler for /api/<resource> and all paths below it. Handlers registered by an
+// extension are unavailable while the extension is disabled.
+func (bot *Bot) RegisterAPIHandler(resource string, handler APIHandlerFunc) {
+	bot.commandsMu.RLock()
+	owner := bot.initializingExtension
+	bot.commandsMu.RUnlock()
+	bot.apiMu.Lock()
+	defer bot.apiMu.Unlock()
+	if _, exists := bot.apiHandlers[resource]; exists {
+		bot.Log.Fatalf("API handler for '%s' already exists.", resource)
+	}
+	bot.apiHandlers[resource] = &apiHandler{owner, handler}
+	bot.Log.Infof("Registered API handler: /api/%s", resource)
+}
+
+// getAPIHandler returns the handler for the resource, or nil if there is none or its extension is disabled.
+func (bot *Bot) getAPIHandler(resource string) APIHandlerFunc {
+	bot.apiMu.RLock()
+	registered := bot.apiHandlers[resource]
+	bot.apiMu.RUnlock()
+	if registered == nil {
+		return nil
+	}
+	if registered.owner != "" {
+		bot.extensionsMu.RLock()
+		defer bot.extensionsMu.RUnlock()
+		if ext := bot.getExtension(registered.owner); ext == nil || !ext.enabled {
+			return nil
+		}
+	}
+	return registered.handler
+}
+
+// APIHandler returns the HTTP handler serving the admin API, for embedding in another server.
+func (bot *Bot) APIHandler() http.Handler {
+	return http.HandlerFunc(bot.serveAPI)
+}
+
+// serveAPI checks the token and passes the request to the handler of the resource.
+func (bot *Bot) serveAPI(w http.ResponseWriter, r *http.Request) {
+	bot.Log.Infof("API request: %s %s", r.Method, r.URL.Path)
+	if !bot.apiAuthorized(r) {
+		writeAPIResponse(w, nil, NewAPIError(http.StatusUnauthorized, "invalid token"))
+		return
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	handler := bot.getAPIHandler(path[0])
+	if handler == nil {
+		writeAPIResponse(w, nil, ErrAPINotFound)
+		return
+	}
+	result, err := bot.runAPIHandler(handler, r, path[1:])
+	writeAPIResponse(w, result, err)
+}
+
+// apiAuthorized checks the admin token from the Authorization header.
+func (bot *Bot) apiAuthorized(r *http.Request) bool {
+	bot.sendTokensMu.RLock()
+	token := bot.apiToken
+	bot.sendTokensMu.RUnlock()
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// runAPIHandler runs the handler, catching its errors.
+func (bot *Bot) runAPIHandler(
+	handler APIHandlerFunc, r *http.Request, path []string) (result interface{}, err error) {
+	defer func() {
+		if Debug {
+			return
+		}
+		if r := recover(); r != nil {
+			bot.Log.Errorf("FATAL ERROR in API handler: %s", r)
+			result, err = nil, errors.New("internal error")
+		}
+	}()
+	return handler(bot, r, path)
+}
+
+// writeAPIResponse sends the result or the error as JSON.
+func writeAPIResponse(w http.ResponseWriter, result interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if apiErr, ok := err.(APIError); ok {
+			status = apiErr.Status
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if result == nil {
+		result = map[string]string{"status": "ok"}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// startAPIServer starts serving the admin API on /api/, if enabled.
+func (bot *Bot) startAPIServer() error {
+	settings := apiSettings{}
+	if err := bot.loader().Load("api", &settings); err != nil {
+		return err
+	}
+	tokens, err := readSendTokens(bot.loader())
+	if err != nil {
+		return err
+	}
+	if err := checkAPITokens(settings, tokens); err != nil {
+		return err
+	}
+	bot.sendTokensMu.Lock()
+	bot.apiToken = settings.Token
+	bot.sendTokens = tokens
+	bot.sendTokensMu.Unlock()
+	if !settings.Enabled {
+		return nil
+	}
+	listener, err := net.Listen("tcp", settings.Listen)
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't listen on %s: %s", settings.Listen, err))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", bot.APIHandler())
+	mux.Handle("/send", bot.SendHandler())
+	bot.apiServer = &http.Server{Handler: mux}
+	bot.Log.Infof("Serving admin API on http://%s/api/ and send endpoint on /send", listener.Addr())
+	go func() {
+		if err := bot.apiServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			bot.Log.Errorf("API server failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+// checkAPITokens makes sure that an enabled API can be used with some token.
+func checkAPITokens(settings apiSettings, sendTokens []*sendToken) error {
+	if settings.Enabled && settings.Token == "" && len(sendTokens) == 0 {
+		return errors.New("api.token or send tokens must be set")
+	}
+	return nil
+}
+
+// stopAPIServer stops the admin API server, if it's running.
+func (bot *Bot) stopAPIServer(ctx context.Context) {
+	if bot.apiServer == nil {
+		return
+	}
+	if err := bot.apiServer.Shutdown(ctx); err != nil {
+		bot.Log.Warningf("Error stopping the API server: %s", err)
+	}
+}
+
+// initAPIHandlers registers the built-in API resources.
+func (bot *Bot) initAPIHandlers() {
+	bot.RegisterAPIHandler("vars", apiVars)
+	bot.RegisterAPIHandler("ignore", apiIgnore)
+	bot.RegisterAPIHandler("users", apiUsers)
+	bot.RegisterAPIHandler("transports", apiTransports)
+	bot.RegisterAPIHandler("send", apiSend)
+}
+
+// apiVars lists, gets and sets custom variables.
+func apiVars(bot *Bot, r *http.Request, path []string) (interface{}, error) {
+	if len(path) == 0 || path[0] == "" {
+		if r.Method != http.MethodGet {
+			return nil, ErrAPIMethodNotAllowed
+		}
+		return bot.Vars(), nil
+	}
+	if len(path) != 1 {
+		return nil, ErrAPINotFound
+	}
+	name := path[0]
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		request := struct{ Value string }{}
+		if err := DecodeAPIRequest(r, &request); err != nil {
+			return nil, err
+		}
+		bot.SetVar(name, request.Value)
+		bot.audit(apiActor, "var.set", name, "")
+	default:
+		return nil, ErrAPIMethodNotAllowed
+	}
+	return map[string]string{"name": name, "value": bot.GetVar(name)}, nil
+}
+
+// Ignore list entry as shown by the API.
+type apiIgnoreEntry struct {
+	Id        int64  `json:"id"`
+	Mask      string `json:"mask"`
+	Transport string `json:"transport"`
+	Channel   string `json:"channel"`
+	Reason    string `json:"reason"`
+	Creator   string `json:"creator"`
+	Created   string `json:"created"`
+	// Empty for entries that don't expire.
+	Expires string `json:"expires"`
+}
+
+// ignoreList returns the entries of the ignore list.
+func (bot *Bot) ignoreList() []apiIgnoreEntry {
+	result := []apiIgnoreEntry{}
+	for _, ignore := range bot.IgnoreList() {
+		expires := ""
+		if !ignore.Expires.IsZero() {
+			expires = ignore.Expires.Format("2006-01-02 15:04:05")
+		}
+		result = append(result, apiIgnoreEntry{ignore.Id, ignore.Mask, ignore.Transport, ignore.Channel, ignore.Reason,
+			ignore.Creator, ignore.Created.Format("2006-01-02 15:04:05"), expires})
+	}
+	return result
+}
+
+// apiIgnore lists and changes the ignore list.
+func apiIgnore(bot *Bot, r *http.Request, path []string) (interface{}, error) {
+	if len(path) == 0 || path[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			return bot.ignoreList(), nil
+		case http.MethodPost:
+			request := struct {
+				Mask, Transport, Channel, Reason string
+				// Duration like "2h", empty for forever.
+				Duration string
+			}{}
+			if err := DecodeAPIRequest(r, &request); err != nil {
+				return nil, err
+			}
+			ignore := storage.Ignore{Mask: request.Mask, Transport: request.Transport, Channel: request.Channel,
+				Reason: request.Reason, Creator: apiActor}
+			if request.Duration != "" {
+				duration, err := time.ParseDuration(request.Duration)
+				if err != nil || duration <= 0 {
+					return nil, NewAPIError(http.StatusBadRequest, "invalid duration %s", request.Duration)
+				}
+				ignore.Expires = time.Now().Add(duration)
+			}
+			if err := bot.AddToIgnoreList(ignore); err != nil {
+				return nil, NewAPIError(http.StatusBadRequest, "%s", err)
+			}
+			bot.audit(apiActor, "ignore.add", ignore.Mask, describeIgnoreScope(ignore))
+			return bot.ignoreList(), nil
+		default:
+			return nil, ErrAPIMethodNotAllowed
+		}
+	}
+	if len(path) != 1 {
+		return nil, ErrAPINotFound
+	}
+	if r.Method != http.MethodDelete {
+		return nil, ErrAPIMethodNotAllowed
+	}
+	id, err := strconv.ParseInt(path[0], 10, 64)
+	if err != nil {
+		return nil, ErrAPINotFound
+	}
+	removed, err := bot.RemoveFromIgnoreList(id)
+	if err != nil {
+		return nil, err
+	}
+	if !removed {
+		return nil, ErrAPINotFound
+	}
+	bot.audit(apiActor, "ignore.remove", path[0], "")
+	return bot.ignoreList(), nil
+}
+
+// User as shown by the API, without the password.
+type apiUser struct {
+	Nick     string   `json:"nick"`
+	AltNicks []string `json:"alt_nicks"`
+	Roles    []string `json:"roles"`
+	Joined   string   `json:"joined"`
+}
+
+func newAPIUser(bot *Bot, user storage.User) apiUser {
+	return apiUser{user.Nick, user.AltNicks, bot.nickRoles(user.Nick), user.Joined.Format("2006-01-02 15:04:05")}
+}
+
+// apiUsers lists, shows, adds and deletes user accounts.
+func apiUsers(bot *Bot, r *http.Request, path []string) (interface{}, error) {
+	if len(path) == 0 || path[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			users, err := bot.Storage.Users()
+			if err != nil {
+				return nil, err
+			}
+			result := []apiUser{}
+			for _, user := range users {
+				result = append(result, newAPIUser(bot, user))
+			}
+			return result, nil
+		case http.MethodPost:
+			request := struct {
+				Nick, Password string
+				Roles          []string
+			}{}
+			if err := DecodeAPIRequest(r, &request); err != nil {
+				return nil, err
+			}
+			if request.Nick == "" {
+				return nil, NewAPIError(http.StatusBadRequest, "nick can't be empty")
+			}
+			if _, err := bot.Storage.GetUser(request.Nick); err == nil {
+				return nil, NewAPIError(http.StatusConflict, "user already exists")
+			}
+			if err := bot.addUser(request.Nick, request.Password, request.Roles); err != nil {
+				return nil, NewAPIError(http.StatusBadRequest, "%s", err)
+			}
+			bot.audit(apiActor, "user.add", request.Nick, strings.Join(request.Roles, ", "))
+			user, err := bot.Storage.GetUser(request.Nick)
+			if err != nil {
+				return nil, err
+			}
+			return newAPIUser(bot, user), nil
+		default:
+			return nil, ErrAPIMethodNotAllowed
+		}
+	}
+	if len(path) != 1 {
+		return nil, ErrAPINotFound
+	}
+	nick := path[0]
+	switch r.Method {
+	case http.MethodGet:
+		user, err := bot.Storage.GetUser(nick)
+		if err == storage.ErrNotFound {
+			return nil, ErrAPINotFound
+		} else if err != nil {
+			return nil, err
+		}
+		return newAPIUser(bot, user), nil
+	case http.MethodDelete:
+		if bot.isLastOwner(nick) {
+			return nil, NewAPIError(http.StatusForbidden, "you cannot delete the last owner")
+		}
+		deleted, err := bot.Storage.DeleteUser(nick)
+		if err != nil {
+			return nil, err
+		}
+		if !deleted {
+			return nil, ErrAPINotFound
+		}
+		bot.deauthenticateNick(nick, "")
+		if err := bot.loadRoles(); err != nil {
+			return nil, err
+		}
+		if err := bot.loadIdentities(); err != nil {
+			return nil, err
+		}
+		bot.audit(apiActor, "user.remove", nick, "")
+		bot.Log.Infof("User %s deleted through the API.", nick)
+		return nil, nil
+	default:
+		return nil, ErrAPIMethodNotAllowed
+	}
+}
+
+// Transport as shown by the API.
+type apiTransport struct {
+	Name     string              `json:"name"`
+	Channels map[string][]string `json:"channels"`
+}
+
+// apiTransports lists the transports with the channels they are on and the nicks on those channels.
+func apiTransports(bot *Bot, r *http.Request, path []string) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, ErrAPIMethodNotAllowed
+	}
+	names := []string{}
+	for name := range bot.Transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []apiTransport{}
+	for _, name := range names {
+		transport := apiTransport{name, map[string][]string{}}
+		for _, channel := range bot.Transports[name].GetChannelsOn() {
+			transport.Channels[channel] = bot.Transports[name].GetNicks(channel)
+		}
+		result = append(result, transport)
+	}
+	return result, nil
+}
+
+// apiSend sends a message or a notice to any channel the bot is on.
+func apiSend(bot *Bot, r *http.Request, path []string) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, ErrAPIMethodNotAllowed
+	}
+	request := struct {
+		Transport, Channel, Message, Format string
+		Notice                              bool
+	}{}
+	if err := DecodeAPIRequest(r, &request); err != nil {
+		return nil, err
+	}
+	format, err := events.ParseFormatting(request.Format)
+	if err != nil {
+		return nil, NewAPIError(http.StatusBadRequest, "%s", err)
+	}
+	if err := bot.SendToChannel(request.Transport, request.Channel, request.Message, format, request.Notice); err != nil {
+		return nil, NewAPIError(http.StatusBadRequest, "%s", err)
+	}
+	return nil, nil
+}
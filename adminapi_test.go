@@ -0,0 +1,190 @@
+package papaBot_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot/extensions"
+)
+
+// apiClient sends requests to the admin API.
+type apiClient struct {
+	t      *testing.T
+	server *httptest.Server
+	token  string
+}
+
+// do sends the request and decodes the response into result, if it's not nil. Returns the status code.
+func (client *apiClient) do(method, path, body string, result interface{}) int {
+	request, err := http.NewRequest(method, client.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		client.t.Fatalf("Can't create request: %s", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+client.token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		client.t.Fatalf("%s %s failed: %s", method, path, err)
+	}
+	defer response.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			client.t.Fatalf("Can't decode response of %s %s: %s", method, path, err)
+		}
+	}
+	return response.StatusCode
+}
+
+// TestAdminAPI runs the admin API operations against a running bot.
+func TestAdminAPI(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	bot.RegisterExtension(&extensions.ExtensionReminders{})
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	server := httptest.NewServer(bot.APIHandler())
+	defer server.Close()
+	client := &apiClient{t, server, "test-token"}
+
+	// Token.
+	if status := (&apiClient{t, server, "wrong"}).do("GET", "/api/vars", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong token, got %d.", status)
+	}
+	if status := client.do("GET", "/api/nothing", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown resource, got %d.", status)
+	}
+
+	// Vars.
+	client.do("PUT", "/api/vars/greeting", `{"value": "hello"}`, nil)
+	vars := map[string]string{}
+	if client.do("GET", "/api/vars", "", &vars); vars["greeting"] != "hello" {
+		t.Errorf("Var not set: %v", vars)
+	}
+	if status := client.do("POST", "/api/vars/greeting", "{}", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d.", status)
+	}
+
+	// Ignore list.
+	ignored := []map[string]interface{}{}
+	client.do("POST", "/api/ignore", `{"mask": "*@*.badisp.net", "channel": "#test", "duration": "2h"}`, &ignored)
+	if len(ignored) != 1 || ignored[0]["mask"] != "*@*.badisp.net" || ignored[0]["expires"] == "" {
+		t.Fatalf("Unexpected ignore list: %v", ignored)
+	}
+	if status := client.do("POST", "/api/ignore", `{"mask": "/(/"}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid mask, got %d.", status)
+	}
+	if client.do("DELETE", fmt.Sprintf("/api/ignore/%v", ignored[0]["id"]), "", &ignored); len(ignored) != 0 {
+		t.Errorf("Unexpected ignore list: %v", ignored)
+	}
+
+	// Users.
+	if status := client.do("POST", "/api/users", `{"nick": "admin", "password": "pass", "roles": ["admin"]}`,
+		nil); status != http.StatusOK {
+		t.Errorf("Can't add user: %d", status)
+	}
+	if status := client.do("POST", "/api/users", `{"nick": "admin", "password": "pass"}`,
+		nil); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate user, got %d.", status)
+	}
+	users := []map[string]interface{}{}
+	if client.do("GET", "/api/users", "", &users); len(users) != 2 || users[0]["nick"] != "admin" {
+		t.Errorf("Unexpected users: %v", users)
+	}
+	if _, ok := users[0]["password"]; ok {
+		t.Error("Password should not be exposed.")
+	}
+	client.do("DELETE", "/api/users/admin", "", nil)
+	if status := client.do("GET", "/api/users/admin", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted user, got %d.", status)
+	}
+
+	// Audit trail.
+	entries, err := bot.Storage.AuditEntries(10)
+	if err != nil {
+		t.Fatalf("Can't read the audit trail: %s", err)
+	}
+	actions := []string{}
+	for _, entry := range entries {
+		if entry.Actor == "api" {
+			actions = append(actions, entry.Action)
+		}
+	}
+	if strings.Join(actions, " ") != "user.remove user.add ignore.remove ignore.add var.set" {
+		t.Errorf("Changes made through the API should be audited, got: %v", actions)
+	}
+
+	// Transports and sending.
+	transports := []struct {
+		Name     string
+		Channels map[string][]string
+	}{}
+	client.do("GET", "/api/transports", "", &transports)
+	if len(transports) != 1 || transports[0].Name != "test" || transports[0].Channels["#test"] == nil {
+		t.Errorf("Unexpected transports: %+v", transports)
+	}
+	client.do("POST", "/api/send", `{"transport": "test", "channel": "#test", "message": "Hello from API"}`, nil)
+	if transport.count("#test: Hello from API") != 1 {
+		t.Error("Message was not sent.")
+	}
+
+	// Extension resources.
+	client.do("POST", "/api/reminders",
+		`{"transport": "test", "channel": "#test", "creator": "cron", "text": "deploy", "delay": "2 days"}`, nil)
+	reminders := []map[string]interface{}{}
+	if client.do("GET", "/api/reminders", "", &reminders); len(reminders) != 1 || reminders[0]["text"] != "deploy" {
+		t.Errorf("Unexpected reminders: %v", reminders)
+	}
+	bot.DisableExtension("reminders")
+	if status := client.do("GET", "/api/reminders", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a disabled extension, got %d.", status)
+	}
+
+	// Token rotation on reload.
+	writeConfig(t, bot, strings.NewReplacer(`token = "test-token"`, `token = "new-token"`))
+	if err := bot.Reload(); err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	if status := client.do("GET", "/api/vars", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the old token after reload, got %d.", status)
+	}
+	if status := (&apiClient{t, server, "new-token"}).do("GET", "/api/vars", "", nil); status != http.StatusOK {
+		t.Errorf("New token should work after reload, got %d.", status)
+	}
+}
+
+// TestSendEndpoint checks the tokens and formatting of the send endpoint.
+func TestSendEndpoint(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	server := httptest.NewServer(bot.SendHandler())
+	defer server.Close()
+	client := &apiClient{t, server, "send-token"}
+
+	if status := (&apiClient{t, server, "test-token"}).do("POST", "/send",
+		`{"transport": "test", "channel": "#test", "message": "hi"}`, nil); status != http.StatusUnauthorized {
+		t.Errorf("Admin token should not work for sending, got %d.", status)
+	}
+	if status := client.do("GET", "/send", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d.", status)
+	}
+	if status := client.do("POST", "/send",
+		`{"transport": "test", "channel": "#other", "message": "hi"}`, nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a channel not allowed for the token, got %d.", status)
+	}
+	if status := client.do("POST", "/send", `{"transport": "test", "channel": "#test", "message": "hi",
+		"format": "html"}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d.", status)
+	}
+	if status := client.do("POST", "/send", `{"transport": "test", "channel": "#test", "format": "markdown",
+		"message": "Build **passed**, see [logs](http://ci/1)"}`, nil); status != http.StatusOK {
+		t.Errorf("Can't send: %d", status)
+	}
+	if transport.count("#test: Build passed, see logs (http://ci/1)") != 1 {
+		t.Error("Markdown was not stripped for a plain text transport.")
+	}
+}
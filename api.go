@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/transports"
 	"github.com/pawelszydlo/papa-bot/utils"
 	"golang.org/x/net/html/charset"
@@ -14,17 +15,20 @@ import (
 	"html"
 	"io"
 	"net/http"
-	"reflect"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
 // RegisterTransport will register a new transport with the bot.
-func (bot *Bot) RegisterTransport(transport transports.Transport) {
+func (bot *Bot) RegisterTransport(transport transports.Transport) error {
 	// Is the transport enabled in the config?
 	name := transport.Name()
-	if bot.fullConfig.GetDefault(fmt.Sprintf("%s.enabled", name), false).(bool) {
+	settings := transportSettings{}
+	if err := bot.loader().Load(name, &settings); err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	if settings.Enabled {
 		for existingName := range bot.Transports {
 			if name == existingName {
 				bot.Log.Fatalf("Transport with name '%s' is already registered.", name)
@@ -33,8 +37,11 @@ func (bot *Bot) RegisterTransport(transport transports.Transport) {
 		bot.Transports[name] = transport
 		bot.Log.Infof("Added transport: %s", name)
 	} else {
+		// Settings of a disabled transport are not read, so don't complain about them.
+		bot.loader().Ignore(name)
 		bot.Log.Infof("Transport with name '%s' disabled in the config.", name)
 	}
+	return nil
 }
 
 // RegisterExtension will register a new extension with the bot.
@@ -42,18 +49,40 @@ func (bot *Bot) RegisterExtension(ext extension) {
 	if ext == nil {
 		bot.Log.Fatal("Nil extension provided.")
 	}
-	bot.extensions = append(bot.extensions, ext)
-	bot.Log.Debugf("Added extension: %T", ext)
+	name := extensionName(ext)
+	bot.extensionsMu.Lock()
+	for _, existing := range bot.extensions {
+		if existing.name == name {
+			bot.Log.Fatalf("Extension with name '%s' is already registered.", name)
+		}
+	}
+	registered := &registeredExtension{ext, name, false}
+	bot.extensions = append(bot.extensions, registered)
+	bot.extensionsMu.Unlock()
+	bot.Log.Debugf("Added extension: %s (%T)", name, ext)
 	// If bot's init was already done, all other extensions have already been initialized.
 	if bot.initDone {
-		if err := ext.Init(bot); err != nil {
-			bot.Log.Fatalf("Error initializing extension: %s", err)
+		if err := bot.migrate(); err != nil {
+			bot.Log.Fatalf("Can't migrate database for extension %s: %s", name, err)
+		}
+		if err := bot.initExtension(registered, !bot.disabledExtensionNames()[name]); err != nil {
+			bot.Log.Fatalf("Error initializing extension %s: %s", name, err)
 		}
 	}
 }
 
 // RegisterCommand will register a new command with the bot.
 func (bot *Bot) RegisterCommand(cmd *BotCommand) {
+	if cmd.Spec != nil {
+		if err := cmd.Spec.validate(); err != nil {
+			bot.Log.Fatalf("Invalid spec of command '%s': %s", cmd.CommandNames[0], err)
+		}
+	}
+	if cmd.Permission != "" { // Permissions not registered by the extension get a generic description.
+		bot.RegisterPermission(cmd.Permission, fmt.Sprintf("Use the %s command.", cmd.CommandNames[0]))
+	}
+	bot.commandsMu.Lock()
+	defer bot.commandsMu.Unlock()
 	for _, name := range cmd.CommandNames {
 		for existingName := range bot.commands {
 			if name == existingName {
@@ -61,6 +90,7 @@ func (bot *Bot) RegisterCommand(cmd *BotCommand) {
 			}
 		}
 		bot.commands[name] = cmd
+		bot.commandOwners[name] = bot.initializingExtension
 		bot.Log.Infof("Registered new command: %s", name)
 	}
 }
@@ -86,6 +116,56 @@ func (bot *Bot) SendNotice(sourceEvent *events.EventMessage, message string) {
 	transport.SendNotice(sourceEvent, message)
 }
 
+// SendToChannel sends a message or a notice to a channel the bot is on, without an event to reply to. If the
+// transport doesn't accept the formatting of the message, the message is converted to plain text.
+func (bot *Bot) SendToChannel(transportName, channel, message string, format events.Formatting, notice bool) error {
+	transport, ok := bot.Transports[transportName]
+	if !ok {
+		return errors.New(fmt.Sprintf("no transport named '%s'", transportName))
+	}
+	if message == "" {
+		return errors.New("message can't be empty")
+	}
+	onChannel := false
+	for _, channelOn := range transport.GetChannelsOn() {
+		if channelOn == channel {
+			onChannel = true
+		}
+	}
+	if !onChannel {
+		return errors.New(fmt.Sprintf("not on channel '%s'", channel))
+	}
+	transportFormat := events.FormatPlain
+	if formatter, ok := transport.(transports.Formatter); ok {
+		transportFormat = formatter.Formatting()
+	}
+	if format != transportFormat {
+		switch format {
+		case events.FormatIRC:
+			message = utils.StripIRCFormatting(message)
+		case events.FormatMarkdown:
+			message = utils.StripMarkdown(message)
+		}
+	}
+	sourceEvent := &events.EventMessage{
+		transportName,
+		transportFormat,
+		events.EventChatMessage,
+		bot.Config().Name,
+		"",
+		channel,
+		"",
+		"",
+		false,
+	}
+	if notice {
+		bot.SendNotice(sourceEvent, message)
+	} else {
+		bot.SendMessage(sourceEvent, message)
+	}
+	return nil
+}
+
 // SendMassNotice sends a notice to all the channels bot is on, on all transports.
 func (bot *Bot) SendMassNotice(message string) {
 	bot.Log.Debugf("Sending mass notice: %s", message)
@@ -108,7 +188,7 @@ func (bot *Bot) GetPageBody(URL string, customHeaders map[string]string) (error,
 		customHeaders = map[string]string{}
 	}
 	if customHeaders["User-Agent"] == "" {
-		customHeaders["User-Agent"] = bot.Config.HttpDefaultUserAgent
+		customHeaders["User-Agent"] = bot.Config().HttpDefaultUserAgent
 	}
 	for k, v := range customHeaders {
 		req.Header.Set(k, v)
@@ -117,10 +197,14 @@ func (bot *Bot) GetPageBody(URL string, customHeaders map[string]string) (error,
 
 	// Get response.
 	bot.Log.Debugf("Fetching page: %s", URL)
+	start := time.Now()
 	resp, err := bot.HTTPClient.Do(req)
+	httpSeconds.Observe(time.Since(start).Seconds(), req.URL.Hostname())
 	if err != nil {
+		httpRequests.Inc(req.URL.Hostname(), "error")
 		return err, "", nil
 	}
+	httpRequests.Inc(req.URL.Hostname(), strconv.Itoa(resp.StatusCode))
 	if resp.StatusCode >= 400 {
 		bot.Log.Warnf("Got HTTP response: %s", resp.Status)
 		return errors.New(resp.Status), "", nil
@@ -135,7 +219,8 @@ func (bot *Bot) GetPageBody(URL string, customHeaders map[string]string) (error,
 	}
 
 	// Load the body up to PageBodyMaxSize.
-	body := make([]byte, bot.Config.PageBodyMaxSize, bot.Config.PageBodyMaxSize)
+	maxSize := bot.Config().PageBodyMaxSize
+	body := make([]byte, maxSize, maxSize)
 	if num, err := io.ReadFull(resp.Body, body); err != nil && err != io.ErrUnexpectedEOF {
 		return err, URL, nil
 	} else {
@@ -181,99 +266,123 @@ func (bot *Bot) GetPageBody(URL string, customHeaders map[string]string) (error,
 // LoadTexts loads texts from a section of a config file into a struct, auto handling templates and lists.
 // The name of the field in the data struct defines the name in the config file.
 // The type of the field determines the expected config value.
+// The struct is filled with the texts of the default language. Texts in other languages are loaded into copies of
+// it, with keys missing in a language taken from the default one. Get them with LocalTexts.
 func (bot *Bot) LoadTexts(section string, data interface{}) error {
-
-	reflectedData := reflect.ValueOf(data).Elem()
-
-	for i := 0; i < reflectedData.NumField(); i++ {
-		fieldDef := reflectedData.Type().Field(i)
-		// Get the field name.
-		fieldName := fieldDef.Name
-		// Get the field type name.
-		fieldType := fmt.Sprint(fieldDef.Type)
-		// Get the field itself.
-		field := reflectedData.FieldByName(fieldName)
-		if !field.CanSet() {
-			bot.Log.Fatalf("Field %s is not settable.", fieldName)
-		}
-
-		// Load configured text for the field.
-		key := fmt.Sprintf("%s.%s", section, fieldName)
-		if !bot.fullTexts.Has(key) {
-			bot.Log.Fatalf("Couldn't load text for field %s, key %s.", fieldName, key)
-		}
-
-		if fieldType == "*template.Template" { // This field is a template.
-			temp, err := template.New(fieldName).Parse(bot.fullTexts.Get(key).(string))
-			if err != nil {
-				return err
-			} else {
-				field.Set(reflect.ValueOf(temp))
-			}
-		} else if fieldType == "string" { // Regular text field.
-			field.Set(reflect.ValueOf(bot.fullTexts.Get(key).(string)))
-		} else if fieldType == "[]string" {
-			field.Set(reflect.ValueOf(utils.ToStringSlice(bot.fullTexts.Get(key).([]interface{}))))
-		} else {
-			bot.Log.Fatalf("Unsupported type of text field: %s", fieldType)
-		}
+	texts, err := bot.loadTexts(bot.bundles(), section, data)
+	if err != nil {
+		return err
 	}
-
+	bot.textsMu.Lock()
+	defer bot.textsMu.Unlock()
+	bot.localTexts[section] = texts
 	return nil
 }
 
+// LoadConfig loads a section of the config file into a struct, using the field tags:
+//
+//	Threshold float64 `config:"threshold" default:"0.5" min:"0"`
+//
+// See config.Loader for the supported types and tags. All invalid keys are reported in the returned error.
+func (bot *Bot) LoadConfig(section string, data interface{}) error {
+	return bot.loader().Load(section, data)
+}
+
 // SetVar will set a custom variable. Set to empty string to delete.
 func (bot *Bot) SetVar(name, value string) {
 	if name == "" {
 		return
 	}
+	bot.varsMu.Lock()
+	defer bot.varsMu.Unlock()
 	// Delete.
 	if value == "" {
 		delete(bot.customVars, name)
-		if _, err := bot.Db.Exec(`DELETE FROM vars WHERE name=?`, name); err != nil {
+		if err := bot.Storage.DeleteVar(name); err != nil {
 			bot.Log.Errorf("Can't delete custom variable %s: %s", name, err)
 		}
 		return
 	}
 	bot.customVars[name] = value
-	if _, err := bot.Db.Exec(`INSERT OR REPLACE INTO vars VALUES(?, ?)`, name, value); err != nil {
+	if err := bot.Storage.SetVar(name, value); err != nil {
 		bot.Log.Errorf("Can't add custom variable %s: %s", name, err)
 	}
 }
 
 // GetVar returns the value of a custom variable.
 func (bot *Bot) GetVar(name string) string {
+	bot.varsMu.RLock()
+	defer bot.varsMu.RUnlock()
 	return bot.customVars[name]
 }
 
+// Vars returns a copy of all custom variables.
+func (bot *Bot) Vars() map[string]string {
+	bot.varsMu.RLock()
+	defer bot.varsMu.RUnlock()
+	vars := make(map[string]string, len(bot.customVars))
+	for name, value := range bot.customVars {
+		vars[name] = value
+	}
+	return vars
+}
+
 // AddMoreInfo will set more information to be viewed for the channel.
 func (bot *Bot) AddMoreInfo(transport, channel, info string) error {
+	bot.urlsMu.Lock()
+	defer bot.urlsMu.Unlock()
 	bot.urlMoreInfo[transport+channel] = info
 	return nil
 }
 
+// takeMoreInfo returns the more information for the channel and forgets it.
+func (bot *Bot) takeMoreInfo(transport, channel string) string {
+	bot.urlsMu.Lock()
+	defer bot.urlsMu.Unlock()
+	info := bot.urlMoreInfo[transport+channel]
+	delete(bot.urlMoreInfo, transport+channel)
+	return info
+}
+
 // NextDailyTick will get the time for bot's next daily tick.
 func (bot *Bot) NextDailyTick() time.Time {
-	tick := bot.nextDailyTick
-	return tick
+	bot.tickMu.Lock()
+	defer bot.tickMu.Unlock()
+	return bot.nextDailyTick
 }
 
-// AddToIgnoreList will add a user to the ignore list.
-func (bot *Bot) AddToIgnoreList(userId string) {
-	ignored := strings.Split(bot.GetVar("_ignored"), " ")
-	ignored = utils.RemoveDuplicates(append(ignored, userId))
-	bot.SetVar("_ignored", strings.Join(ignored, " "))
-	// Update the actual blocklist in the event handler.
-	bot.EventDispatcher.SetBlackList(ignored)
-	bot.Log.Infof("%s added to ignore list.", userId)
+// AddToIgnoreList will add an entry to the ignore list.
+func (bot *Bot) AddToIgnoreList(ignore storage.Ignore) error {
+	if _, err := compileMask(ignore.Mask); err != nil {
+		return err
+	}
+	if err := bot.Storage.AddIgnore(ignore); err != nil {
+		return err
+	}
+	bot.Log.Infof("%s added to ignore list %s.", ignore.Mask, describeIgnoreScope(ignore))
+	return bot.loadIgnores()
 }
 
-// RemoveFromIgnoreList will remove user from the ignore list.
-func (bot *Bot) RemoveFromIgnoreList(userId string) {
-	ignored := strings.Split(bot.GetVar("_ignored"), " ")
-	ignored = utils.RemoveFromSlice(ignored, userId)
-	bot.SetVar("_ignored", strings.Join(ignored, " "))
-	// Update the actual blocklist in the event handler.
-	bot.EventDispatcher.SetBlackList(ignored)
-	bot.Log.Infof("%s removed from ignore list.", userId)
+// RemoveFromIgnoreList will remove an entry from the ignore list. Returns false if there was no such entry.
+func (bot *Bot) RemoveFromIgnoreList(id int64) (bool, error) {
+	removed, err := bot.Storage.DeleteIgnore(id)
+	if err != nil || !removed {
+		return removed, err
+	}
+	bot.Log.Infof("Entry %d removed from ignore list.", id)
+	return true, bot.loadIgnores()
+}
+
+// IgnoreList returns the entries of the ignore list that did not expire yet.
+func (bot *Bot) IgnoreList() []storage.Ignore {
+	now := time.Now()
+	bot.ignoreMu.RLock()
+	defer bot.ignoreMu.RUnlock()
+	ignores := []storage.Ignore{}
+	for _, entry := range bot.ignores {
+		if entry.Expires.IsZero() || now.Before(entry.Expires) {
+			ignores = append(ignores, entry.Ignore)
+		}
+	}
+	return ignores
 }
@@ -2,25 +2,30 @@
 package papaBot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pawelszydlo/humanize"
+	"github.com/pawelszydlo/papa-bot/config"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/transports"
 	"github.com/pawelszydlo/papa-bot/transports/irc"
 	"github.com/pawelszydlo/papa-bot/transports/mattermost"
 	"github.com/pawelszydlo/papa-bot/utils"
-	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
 	"net/http/cookiejar"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // Use: go build -ldflags "-X github.com/pawelszydlo/papa-bot/papaBot.BuildDate=`date -u +.%Y%m%d.%H%M%S`"
@@ -35,63 +40,69 @@ func New(configFile, textsFile string) (error, *Bot) {
 	rand.Seed(time.Now().Unix())
 
 	// Load config file.
-	fullConfig, err := toml.LoadFile(configFile)
+	configLoader, err := config.LoadFile(configFile)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Can't load config: %s", err)), nil
 	}
-	// Load texts file.
-	fullTexts, err := toml.LoadFile(textsFile)
+	// Prepare configuration.
+	configuration, err := loadConfiguration(configLoader)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err)), nil
+	}
+	// Load texts files, the given one has texts in the default language.
+	bundles, err := loadTextBundles(textsFile, configuration.Language)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Can't load texts: %s", err)), nil
 	}
-
-	// Prepare configuration.
-	config := Configuration{
-		ChatLogging:                fullConfig.GetDefault("bot.chat_logging", true).(bool),
-		UrlAnnounceIntervalMinutes: time.Duration(fullConfig.GetDefault("bot.url_announce_interval_minutes", 15).(int64)),
-		CommandsPer5:               10,
-		UrlAnnounceIntervalLines:   int(fullConfig.GetDefault("bot.url_announce_interval_lines", 50).(int64)),
-		PageBodyMaxSize:            1024 * 1024,
-		HttpDefaultUserAgent:       fullConfig.GetDefault("bot.http_user_agent", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)").(string),
-		DailyTickHour:              int(fullConfig.GetDefault("bot.daily_tick_hour", 8).(int64)),
-		DailyTickMinute:            0,
-		Language:                   fullConfig.GetDefault("bot.language", "en").(string),
-		Name:                       fullConfig.GetDefault("bot.name", "papaBot").(string),
-		LogLevel:                   logrus.DebugLevel,
+	eventConfig := eventSettings{}
+	if err := configLoader.Load("events", &eventConfig); err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err)), nil
 	}
 
 	// Init bot struct.
 	bot := &Bot{
-		initDone:            false,
-		Log:                 logrus.New(),
-		authenticatedUsers:  map[string]string{},
-		authenticatedAdmins: map[string]string{},
-		authenticatedOwners: map[string]string{},
-
-		fullTexts: fullTexts,
-		Texts:     &botTexts{},
+		initDone:        false,
+		Log:             logrus.New(),
+		sessions:        map[string]*session{},
+		permissions:     map[string]string{},
+		rolePermissions: map[string]map[string]bool{},
+		userRoles:       map[string][]storage.RoleAssignment{},
+		identityNicks:   map[string]string{},
+		identityUserIds: map[string]string{},
+		pendingLinks:    map[string]*pendingLink{},
+
+		textBundles: bundles,
+		localTexts:  map[string]map[string]interface{}{},
+		humanizers:  map[string]*humanize.Humanizer{},
+		languages:   map[string]string{},
 
 		lastURLAnnouncedTime:        map[string]time.Time{},
 		lastURLAnnouncedLinesPassed: map[string]int{},
 		urlMoreInfo:                 map[string]string{},
 
-		fullConfig: fullConfig,
-		Config:     &config,
+		configLoader: configLoader,
+		config:       &configuration,
+
+		configFile: configFile,
+		textsFile:  textsFile,
 
 		commands:           map[string]*BotCommand{},
-		commandUseLimit:    map[string]int{},
-		commandWarn:        map[string]bool{},
+		commandOwners:      map[string]string{},
+		disabledCommands:   map[string]map[string]*BotCommand{},
+		rateLimits:         newRateLimiter(),
 		commandsHideParams: map[string]bool{},
+		commandsAuditSelf:  map[string]bool{},
+		apiHandlers:        map[string]*apiHandler{},
 
 		customVars:         map[string]string{},
 		webContentSampleRe: regexp.MustCompile(`(?i)<[^>]*?description[^<]*?>|<title>.*?</title>`),
 
-		extensions: []extension{},
+		extensions: []*registeredExtension{},
 		Transports: map[string]transports.Transport{},
 	}
 	// Logging configuration.
 	log.Println("Switching to logging module now.")
-	bot.Log.Level = bot.Config.LogLevel
+	bot.Log.SetLevel(configuration.LogLevel)
 	bot.Log.Formatter = &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: "2006-01-02 15:04:05"}
 
 	// Setup HTTP client.
@@ -102,27 +113,140 @@ func New(configFile, textsFile string) (error, *Bot) {
 	}
 
 	// Setup event dispatcher.
-	bot.EventDispatcher = events.New(bot.Log)
-
-	// Create value humanizer.
-	if humanizer, err := humanize.New(bot.Config.Language); err != nil {
-		bot.Log.Fatalf("Can't init humanizer: %s", err)
-	} else {
-		bot.Humanizer = humanizer
+	bot.EventDispatcher = events.NewWithPool(bot.Log, events.PoolOptions{
+		Workers:         eventConfig.Workers,
+		QueueSize:       eventConfig.QueueSize,
+		QueueTimeout:    eventConfig.QueueTimeout,
+		ListenerTimeout: eventConfig.ListenerTimeout,
+	})
+
+	// Create value humanizers.
+	if bot.humanizers, err = bot.newHumanizers(bundles); err != nil {
+		return errors.New(fmt.Sprintf("Can't init humanizer: %s", err)), nil
 	}
 
 	// Register built-in transports.
-	bot.RegisterTransport(new(ircTransport.IRCTransport))
-	bot.RegisterTransport(new(mattermostTransport.MattermostTransport))
+	if err := bot.RegisterTransport(new(ircTransport.IRCTransport)); err != nil {
+		return err, nil
+	}
+	if err := bot.RegisterTransport(new(mattermostTransport.MattermostTransport)); err != nil {
+		return err, nil
+	}
 
 	// Load texts.
-	if err := bot.LoadTexts("bot", bot.Texts); err != nil {
+	if err := bot.LoadTexts("bot", &botTexts{}); err != nil {
 		return errors.New(fmt.Sprintf("Can't load bot texts: %s", err)), nil
 	}
 
 	return nil, bot
 }
 
+// loadConfiguration prepares bot's configuration from the bot section of the config file.
+func loadConfiguration(configLoader *config.Loader) (Configuration, error) {
+	configuration := Configuration{}
+	err := configLoader.Load("bot", &configuration)
+	return configuration, err
+}
+
+// Config returns the bot's configuration. Reload replaces it, so don't keep it for long.
+func (bot *Bot) Config() *Configuration {
+	bot.configMu.RLock()
+	defer bot.configMu.RUnlock()
+	return bot.config
+}
+
+// loader returns the loader of the config file.
+func (bot *Bot) loader() *config.Loader {
+	bot.configMu.RLock()
+	defer bot.configMu.RUnlock()
+	return bot.configLoader
+}
+
+// Reload re-reads the config and texts files and reloads texts of the bot and all extensions.
+// Transports are not restarted, so settings used only on connection (like the bot's name) will not change.
+// If anything in the bot's own settings or texts is wrong, nothing is changed.
+func (bot *Bot) Reload() error {
+	configLoader, err := config.LoadFile(bot.configFile)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't load config: %s", err))
+	}
+
+	// Build everything first.
+	configuration, err := loadConfiguration(configLoader)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	configuration.Name = bot.Config().Name
+	bundles, err := loadTextBundles(bot.textsFile, configuration.Language)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't load texts: %s", err))
+	}
+	humanizers, err := bot.newHumanizers(bundles)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: can't init humanizer: %s", err))
+	}
+	transportPolicies, err := bot.readTransportPolicies(configLoader)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	triggers, err := bot.readCommandTriggers(configLoader)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	sendTokens, err := readSendTokens(configLoader)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	api := apiSettings{}
+	if err := configLoader.Load("api", &api); err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	if err := checkAPITokens(api, sendTokens); err != nil {
+		return errors.New(fmt.Sprintf("Invalid config: %s", err))
+	}
+	texts, err := bot.loadTexts(bundles, "bot", &botTexts{})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Can't load bot texts: %s", err))
+	}
+
+	// Swap it in at once.
+	bot.configMu.Lock()
+	bot.configLoader = configLoader
+	bot.config = &configuration
+	bot.textsMu.Lock()
+	bot.textBundles = bundles
+	bot.humanizers = humanizers
+	bot.localTexts["bot"] = texts
+	bot.textsMu.Unlock()
+	bot.policiesMu.Lock()
+	bot.transportPolicies = transportPolicies
+	bot.policiesMu.Unlock()
+	bot.triggersMu.Lock()
+	bot.commandTriggers = triggers
+	bot.triggersMu.Unlock()
+	bot.sendTokensMu.Lock()
+	bot.apiToken = api.Token
+	bot.sendTokens = sendTokens
+	bot.sendTokensMu.Unlock()
+	bot.configMu.Unlock()
+	bot.Log.SetLevel(configuration.LogLevel)
+
+	// Extensions read their texts from the new files.
+	failed := []string{}
+	for _, ext := range bot.extensionList() {
+		if reloader, ok := ext.extension.(extensionReloader); ok {
+			if err := reloader.Reload(bot); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", ext.name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("Failed to reload: %s", strings.Join(failed, "; ")))
+	}
+	bot.Log.Infof("Configuration and texts reloaded.")
+	return nil
+}
+
 // version returns the bot version string.
 func (bot *Bot) version() string {
 	return fmt.Sprintf("I am papaBot, version %s, build %s", Version, BuildDate)
@@ -136,10 +260,22 @@ func (bot *Bot) initialize() {
 	if err := bot.initDb(); err != nil {
 		bot.Log.Fatalf("Can't init database: %s", err)
 	}
+	if err := bot.migrate(); err != nil {
+		bot.Log.Fatalf("Can't migrate database: %s", err)
+	}
+	if err := bot.loadRoles(); err != nil {
+		bot.Log.Fatalf("Can't load roles: %s", err)
+	}
+	if err := bot.loadIdentities(); err != nil {
+		bot.Log.Fatalf("Can't load linked identities: %s", err)
+	}
+	if err := bot.loadLanguages(); err != nil {
+		bot.Log.Fatalf("Can't load chosen languages: %s", err)
+	}
 	bot.ensureOwnerExists()
 
 	// Create log folder.
-	if bot.Config.ChatLogging {
+	if bot.Config().ChatLogging {
 		exists, err := utils.DirExists("logs")
 		if err != nil {
 			bot.Log.Fatalf("Can't check if logs dir exists: %s", err)
@@ -157,16 +293,33 @@ func (bot *Bot) initialize() {
 	// Init the transports.
 	for transportName, transport := range bot.Transports {
 		bot.Log.Infof("Initializing transport %s...", transportName)
-		transport.Init(bot.Config.Name, bot.fullConfig, bot.Log, bot.EventDispatcher)
+		if err := transport.Init(bot.Config().Name, bot.loader(), bot.Log, bot.EventDispatcher); err != nil {
+			bot.Log.Fatalf("Can't init transport %s: %s", transportName, err)
+		}
+	}
+
+	// Load channel settings.
+	bot.loadChannelPolicies()
+	if err := bot.loadTransportPolicies(); err != nil {
+		bot.Log.Fatalf("Invalid config: %s", err)
+	}
+	if err := bot.loadCommandTriggers(); err != nil {
+		bot.Log.Fatalf("Invalid config: %s", err)
 	}
+	bot.EventDispatcher.SetFilter(bot.listenerAllowed)
 
 	// Init the ignore list.
-	ignored := strings.Split(bot.GetVar("_ignored"), " ")
-	bot.EventDispatcher.SetBlackList(ignored)
-	bot.Log.Infof("Ignoring users: %s", strings.Join(ignored, ", "))
+	if err := bot.importIgnoredVar(); err != nil {
+		bot.Log.Fatalf("Can't import the ignore list: %s", err)
+	}
+	if err := bot.loadIgnores(); err != nil {
+		bot.Log.Fatalf("Can't load the ignore list: %s", err)
+	}
+	bot.EventDispatcher.SetIgnoreFilter(bot.isIgnored)
 
-	// Init bot commands.
+	// Init bot commands and API handlers.
 	bot.initBotCommands()
+	bot.initAPIHandlers()
 
 	// Attach event listeners.
 	bot.attachEventListeners()
@@ -174,19 +327,35 @@ func (bot *Bot) initialize() {
 	// Get next daily tick.
 	now := time.Now()
 	bot.nextDailyTick = time.Date(
-		now.Year(), now.Month(), now.Day(), bot.Config.DailyTickHour, bot.Config.DailyTickMinute, 0, 0, now.Location())
+		now.Year(), now.Month(), now.Day(), bot.Config().DailyTickHour, bot.Config().DailyTickMinute, 0, 0, now.Location())
 	if time.Since(bot.nextDailyTick) >= 0 {
 		bot.nextDailyTick = bot.nextDailyTick.Add(24 * time.Hour)
 	}
 	bot.Log.Debugf("Next daily tick: %s", bot.nextDailyTick)
 
 	// Init extensions.
-	for i := range bot.extensions {
-		if err := bot.extensions[i].Init(bot); err != nil {
-			bot.Log.Fatalf("Error loading extensions: %s", err)
+	disabled := bot.disabledExtensionNames()
+	for _, ext := range bot.extensionList() {
+		if err := bot.initExtension(ext, !disabled[ext.name]); err != nil {
+			bot.Log.Fatalf("Error loading extension %s: %s", ext.name, err)
 		}
 	}
 
+	// Start the metrics server.
+	bot.registerDispatcherMetrics()
+	if err := bot.startMetricsServer(); err != nil {
+		bot.Log.Fatalf("Can't start metrics server: %s", err)
+	}
+	// Start the admin API server.
+	if err := bot.startAPIServer(); err != nil {
+		bot.Log.Fatalf("Can't start API server: %s", err)
+	}
+
+	// Everything that reads the config is done now.
+	for _, key := range bot.loader().UnknownKeys() {
+		bot.Log.Warningf("Unknown config key: %s", key)
+	}
+
 	bot.initDone = true
 	bot.Log.Infof("Bot init done.")
 }
@@ -202,24 +371,22 @@ func (bot *Bot) attachEventListeners() {
 	// URLs.
 	bot.EventDispatcher.RegisterListener(events.EventChatMessage, bot.handleURLsListener)
 	bot.EventDispatcher.RegisterListener(events.EventPrivateMessage, bot.handleURLsListener)
+	// Sessions.
+	bot.EventDispatcher.RegisterListener(events.EventPartChannel, bot.sessionsListener)
+	bot.EventDispatcher.RegisterListener(events.EventUserQuit, bot.sessionsListener)
+	bot.EventDispatcher.RegisterListener(events.EventNickChange, bot.sessionsListener)
 }
 
 // loadVars loads all custom variables from the database.
 func (bot *Bot) loadVars() {
-	result, err := bot.Db.Query(`SELECT name, value FROM vars`)
+	vars, err := bot.Storage.Vars()
 	if err != nil {
+		bot.Log.Warningf("Can't load vars: %s", err)
 		return
 	}
-	defer result.Close()
-
-	// Get vars.
-	for result.Next() {
-		var name string
-		var value string
-		if err = result.Scan(&name, &value); err != nil {
-			bot.Log.Warningf("Can't load var: %s", err)
-			continue
-		}
+	bot.varsMu.Lock()
+	defer bot.varsMu.Unlock()
+	for name, value := range vars {
 		bot.customVars[name] = value
 	}
 }
@@ -234,51 +401,114 @@ func (bot *Bot) getTransportOrDie(name string) transports.Transport {
 
 // cleanUp cleans up after the bot.
 func (bot *Bot) cleanUp() {
-	bot.Db.Close()
+	if err := bot.Storage.Close(); err != nil {
+		bot.Log.Errorf("Error closing the database: %s", err)
+	}
+}
+
+// tick triggers the periodic tick event, or the daily one if it's time.
+func (bot *Bot) tick() {
+	// Forget the unused rate limits, expired sessions and ignores.
+	bot.rateLimits.prune(time.Now())
+	bot.pruneSessions(time.Now())
+	bot.pruneIgnores(time.Now())
+	// Check if it's time for a daily ticker.
+	bot.tickMu.Lock()
+	daily := time.Since(bot.nextDailyTick) >= 0
+	if daily {
+		bot.nextDailyTick = bot.nextDailyTick.Add(24 * time.Hour)
+		bot.Log.Debugf("Daily tick now. Next at %s.", bot.nextDailyTick)
+	}
+	bot.tickMu.Unlock()
+	if daily {
+		bot.EventDispatcher.Trigger(events.EventMessage{
+			"bot", events.FormatPlain, events.EventDailyTick, "", "", "", "", "", true})
+	} else {
+		bot.EventDispatcher.Trigger(events.EventMessage{
+			"bot", events.FormatPlain, events.EventTick, "", "", "", "", "", true})
+	}
+}
+
+// shutdown stops the transports and waits for running event handlers, up to the configured timeout.
+func (bot *Bot) shutdown(transportsDone *sync.WaitGroup) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bot.Config().ShutdownTimeout)
+	defer cancel()
+	defer bot.stopMetricsServer(ctx)
+	defer bot.stopAPIServer(ctx)
+
+	// Stop the transports, so that no new events come in.
+	for transportName, transport := range bot.Transports {
+		bot.Log.Infof("Stopping transport %s...", transportName)
+		if err := transport.Shutdown(ctx); err != nil {
+			bot.Log.Warningf("Error stopping transport %s: %s", transportName, err)
+		}
+	}
+	bot.EventDispatcher.Close()
+
+	// Wait for the transports' main loops to return.
+	transportsStopped := make(chan struct{})
+	go func() {
+		transportsDone.Wait()
+		close(transportsStopped)
+	}()
+	select {
+	case <-transportsStopped:
+	case <-ctx.Done():
+		return errors.New("timed out waiting for transports to stop")
+	}
+
+	// Let the running handlers finish their work.
+	bot.Log.Infof("Waiting for event handlers to finish...")
+	if err := bot.EventDispatcher.Drain(ctx); err != nil {
+		return errors.New(fmt.Sprintf("event handlers did not finish in time: %s", err))
+	}
+
+	bot.shutdownExtensions()
+	return nil
 }
 
-// Run starts the bot's main loop.
-func (bot *Bot) Run() {
+// Run starts the bot's main loop. It returns when the context is done and the bot has shut down.
+func (bot *Bot) Run(ctx context.Context) error {
 	// Initialize bot mechanisms.
 	bot.initialize()
 	defer bot.cleanUp()
 
 	// Start transports.
+	var transportsDone sync.WaitGroup
 	for transportName, transport := range bot.Transports {
 		bot.Log.Infof("Starting transport %s...", transportName)
-		go transport.Run()
+		transportsDone.Add(1)
+		go func(transport transports.Transport) {
+			defer transportsDone.Done()
+			transport.Run()
+		}(transport)
 	}
 
 	// 5 minute ticker.
-	ticker2 := time.NewTicker(time.Minute * 5)
-	defer ticker2.Stop()
-	go func() {
-		for range ticker2.C {
-			// Clear command use.
-			for k := range bot.commandUseLimit {
-				delete(bot.commandUseLimit, k)
-			}
-			for k := range bot.commandWarn {
-				delete(bot.commandWarn, k)
-			}
-			// Check if it's time for a daily ticker.
-			if time.Since(bot.nextDailyTick) >= 0 {
-				bot.nextDailyTick = bot.nextDailyTick.Add(24 * time.Hour)
-				bot.Log.Debugf("Daily tick now. Next at %s.", bot.nextDailyTick)
-				bot.EventDispatcher.Trigger(events.EventMessage{
-					"bot", events.FormatPlain, events.EventDailyTick, "", "", "", "", "", true})
-			} else {
-				bot.EventDispatcher.Trigger(events.EventMessage{
-					"bot", events.FormatPlain, events.EventTick, "", "", "", "", "", true})
-			}
-		}
-	}()
+	ticker := time.NewTicker(time.Minute * 5)
+	defer ticker.Stop()
 	// First tick, before ticker goes off.
 	bot.EventDispatcher.Trigger(events.EventMessage{
 		"bot", events.FormatPlain, events.EventTick, "", "", "", "", "", true})
 
-	// Wait for all the transports to finish.
-	select {}
-
-	bot.Log.Infof("Exiting...")
+	// Reload configuration and texts on SIGHUP.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// Wait for the stop signal.
+	for {
+		select {
+		case <-ticker.C:
+			bot.tick()
+		case <-reload:
+			bot.Log.Infof("Got SIGHUP, reloading...")
+			if err := bot.Reload(); err != nil {
+				bot.Log.Errorf("Reload failed: %s", err)
+			}
+		case <-ctx.Done():
+			bot.Log.Infof("Exiting...")
+			return bot.shutdown(&transportsDone)
+		}
+	}
 }
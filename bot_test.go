@@ -1,7 +1,13 @@
 package papaBot
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/sirupsen/logrus"
 )
 
 // TestBotNewWrongFiles tests creation failing if config files are not found.
@@ -11,3 +17,61 @@ func TestBotNewWrongFiles(t *testing.T) {
 		t.Fatal("Bot creation should have failed.")
 	}
 }
+
+// TestClaimURLAnnouncementConcurrent tests that a link posted at the same time by many people is announced once.
+func TestClaimURLAnnouncementConcurrent(t *testing.T) {
+	configuration := &Configuration{UrlAnnounceIntervalMinutes: 15 * time.Minute, UrlAnnounceIntervalLines: 50}
+	bot := &Bot{
+		config:                      configuration,
+		lastURLAnnouncedTime:        map[string]time.Time{},
+		lastURLAnnouncedLinesPassed: map[string]int{},
+	}
+	var claimed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if bot.claimURLAnnouncement("http://example.com#chan") {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed != 1 {
+		t.Errorf("Link should be claimed once, was claimed %d times.", claimed)
+	}
+}
+
+// TestUseCommandConcurrent tests that the command limit and the warning hold for concurrent commands.
+func TestUseCommandConcurrent(t *testing.T) {
+	bot := &Bot{
+		config: &Configuration{
+			UserCommandsBurst: 10, UserCommandsRefill: time.Hour, ChannelCommandsBurst: 10,
+			ChannelCommandsRefill: time.Hour, CommandUsesBurst: 3, CommandUsesRefill: time.Hour},
+		textBundles: &textBundles{defaultLanguage: "en"},
+		localTexts:  map[string]map[string]interface{}{"bot": {"en": &botTexts{CommandLimit: "limit"}}},
+		rateLimits:  newRateLimiter(),
+		Log:         logrus.New(),
+	}
+	event := &events.EventMessage{Nick: "nick", UserId: "id", Channel: "#chan"}
+	var allowed, warned int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, warning := bot.useCommand("cmd", event)
+			if ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+			if warning != "" {
+				atomic.AddInt32(&warned, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 || warned != 1 {
+		t.Errorf("Expected 3 allowed commands and 1 warning, got %d and %d.", allowed, warned)
+	}
+}
@@ -0,0 +1,226 @@
+package papaBot
+
+// Per-channel enablement of extensions, commands and URL announcements.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/config"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+)
+
+// Kinds of things that can be switched on and off per channel.
+const (
+	PolicyExtension = "extension"
+	PolicyCommand   = "command"
+	PolicyURLs      = "urls"
+)
+
+// channelPolicy holds the enabled state, keyed by kind and name (e.g. "extension:btc").
+type channelPolicy map[string]bool
+
+// policyKey builds a key for the channel policy map.
+func policyKey(kind, name string) string {
+	return kind + ":" + name
+}
+
+// loadChannelPolicies loads per-channel settings from the database.
+func (bot *Bot) loadChannelPolicies() {
+	policies := map[string]channelPolicy{}
+	settings, err := bot.Storage.ChannelSettings()
+	if err != nil {
+		bot.Log.Warningf("Can't load channel settings: %s", err)
+	}
+	for _, setting := range settings {
+		if policies[setting.ChannelId] == nil {
+			policies[setting.ChannelId] = channelPolicy{}
+		}
+		policies[setting.ChannelId][policyKey(setting.Kind, setting.Name)] = setting.Enabled
+	}
+	bot.policiesMu.Lock()
+	defer bot.policiesMu.Unlock()
+	bot.channelPolicies = policies
+}
+
+// loadTransportPolicies loads per-transport defaults from the config file.
+func (bot *Bot) loadTransportPolicies() error {
+	policies, err := bot.readTransportPolicies(bot.loader())
+	if err != nil {
+		return err
+	}
+	bot.policiesMu.Lock()
+	defer bot.policiesMu.Unlock()
+	bot.transportPolicies = policies
+	return nil
+}
+
+// readTransportPolicies reads per-transport defaults from the config.
+func (bot *Bot) readTransportPolicies(loader *config.Loader) (map[string]channelPolicy, error) {
+	policies := map[string]channelPolicy{}
+	for name := range bot.Transports {
+		settings := transportSettings{}
+		if err := loader.Load(name, &settings); err != nil {
+			return nil, err
+		}
+		policy := channelPolicy{}
+		for _, ext := range settings.DisabledExtensions {
+			policy[policyKey(PolicyExtension, ext)] = false
+		}
+		for _, cmd := range settings.DisabledCommands {
+			policy[policyKey(PolicyCommand, cmd)] = false
+		}
+		policy[policyKey(PolicyURLs, "")] = settings.AnnounceURLs
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+// ChannelAllows checks whether the extension, command or URL announcements are enabled on the channel.
+// Channel setting takes precedence over the transport's defaults from the config file.
+func (bot *Bot) ChannelAllows(transportName, channel, kind, name string) bool {
+	key := policyKey(kind, name)
+	bot.policiesMu.RLock()
+	defer bot.policiesMu.RUnlock()
+	if enabled, exists := bot.channelPolicies[transportName+";"+channel][key]; exists {
+		return enabled
+	}
+	if enabled, exists := bot.transportPolicies[transportName][key]; exists {
+		return enabled
+	}
+	return true
+}
+
+// SetChannelPolicy switches an extension, command or URL announcements on or off for the channel.
+func (bot *Bot) SetChannelPolicy(channelId, kind, name string, enabled bool) error {
+	if err := bot.Storage.SetChannelSetting(storage.ChannelSetting{
+		ChannelId: channelId, Kind: kind, Name: name, Enabled: enabled}); err != nil {
+		return err
+	}
+	bot.policiesMu.Lock()
+	defer bot.policiesMu.Unlock()
+	if bot.channelPolicies[channelId] == nil {
+		bot.channelPolicies[channelId] = channelPolicy{}
+	}
+	bot.channelPolicies[channelId][policyKey(kind, name)] = enabled
+	return nil
+}
+
+// ClearChannelPolicy removes the channel setting, so that the transport's default applies again.
+func (bot *Bot) ClearChannelPolicy(channelId, kind, name string) error {
+	if err := bot.Storage.DeleteChannelSetting(channelId, kind, name); err != nil {
+		return err
+	}
+	bot.policiesMu.Lock()
+	defer bot.policiesMu.Unlock()
+	delete(bot.channelPolicies[channelId], policyKey(kind, name))
+	return nil
+}
+
+// listenerAllowed is the event dispatcher filter that skips listeners of extensions disabled on the channel.
+func (bot *Bot) listenerAllowed(owner string, message events.EventMessage) bool {
+	if message.Channel == "" {
+		return true
+	}
+	return bot.ChannelAllows(message.TransportName, message.Channel, PolicyExtension, owner)
+}
+
+// commandAllowed checks whether the command and the extension it comes from are enabled on the channel.
+func (bot *Bot) commandAllowed(sourceEvent *events.EventMessage, command string) bool {
+	bot.commandsMu.RLock()
+	cmd, owner := bot.commands[command], bot.commandOwners[command]
+	bot.commandsMu.RUnlock()
+	if cmd == nil {
+		return true
+	}
+	if owner != "" &&
+		!bot.ChannelAllows(sourceEvent.TransportName, sourceEvent.Channel, PolicyExtension, owner) {
+		return false
+	}
+	return bot.ChannelAllows(sourceEvent.TransportName, sourceEvent.Channel, PolicyCommand, cmd.CommandNames[0])
+}
+
+// commandChannelList lists the settings of the channel.
+func commandChannelList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	channelId := sourceEvent.ChannelId()
+	settings := []string{}
+	bot.policiesMu.RLock()
+	for key, enabled := range bot.channelPolicies[channelId] {
+		state := "on"
+		if !enabled {
+			state = "off"
+		}
+		settings = append(settings, fmt.Sprintf("%s %s", strings.TrimSuffix(key, ":"), state))
+	}
+	bot.policiesMu.RUnlock()
+	if len(settings) == 0 {
+		bot.SendMessage(sourceEvent, "This channel uses default settings.")
+		return
+	}
+	sort.Strings(settings)
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Channel settings: %s", strings.Join(settings, ", ")))
+}
+
+// commandChannel switches an extension, a command or URL announcements on the channel.
+func commandChannel(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	channelId := sourceEvent.ChannelId()
+	kind, name, state := PolicyURLs, args.String("name"), args.String("state")
+	switch args.Subcommand {
+	case "ext":
+		kind = PolicyExtension
+	case "cmd":
+		kind = PolicyCommand
+	}
+	if err := bot.validatePolicyTarget(kind, name); err != nil {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s", err))
+		return
+	}
+
+	var err error
+	switch state {
+	case "on", "off":
+		err = bot.SetChannelPolicy(channelId, kind, name, state == "on")
+	case "default":
+		err = bot.ClearChannelPolicy(channelId, kind, name)
+	default:
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, state must be on, off or default.", sourceEvent.Nick))
+		return
+	}
+	if err != nil {
+		bot.Log.Warningf("Can't change channel setting: %s", err)
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	bot.SendMessage(sourceEvent, "Channel settings changed.")
+}
+
+// validatePolicyTarget makes sure that the extension or command exists and can be switched off.
+func (bot *Bot) validatePolicyTarget(kind, name string) error {
+	switch kind {
+	case PolicyExtension:
+		bot.extensionsMu.RLock()
+		ext := bot.getExtension(name)
+		bot.extensionsMu.RUnlock()
+		if ext == nil {
+			return errors.New(fmt.Sprintf("No extension named '%s'.", name))
+		}
+	case PolicyCommand:
+		cmd := bot.getCommand(name)
+		if cmd == nil {
+			return errors.New(fmt.Sprintf("No command named '%s'.", name))
+		}
+		if name != cmd.CommandNames[0] {
+			return errors.New(fmt.Sprintf("Use the main name of the command: %s.", cmd.CommandNames[0]))
+		}
+		if name == "chan" {
+			return errors.New("This command can't be switched off.")
+		}
+	case PolicyURLs:
+	default:
+		return errors.New("Setting must be one of: ext, cmd, urls.")
+	}
+	return nil
+}
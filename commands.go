@@ -5,64 +5,244 @@ package papaBot
 import (
 	"fmt"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/utils"
 	"github.com/sirupsen/logrus"
 	"math/rand"
+	"sort"
 	"strings"
+	"time"
 )
 
 // initBotCommands registers bot commands.
 func (bot *Bot) initBotCommands() {
+	bot.initPermissions()
 	// Help.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"help", "h"},
-		false, false, false,
-		"[pub]", "Send help text to you privately. Adding [pub] will print help on the same channel you asked.",
-		commandHelp})
+		false, "",
+		"[pub] [page] / <command>",
+		"Send help text to you privately. Adding [pub] will print help on the same channel you asked.",
+		nil, &CommandSpec{
+			Args:     []CommandArg{{"topic", ArgString, true}, {"page", ArgInt, true}},
+			Run:      commandHelp,
+			Details:  "Long help is split into pages on IRC. Give a command name to see its details.",
+			Examples: []string{"help pub", "help 2", "help remind"},
+		}, nil})
 	// Auth.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"auth"},
-		true, false, false,
-		"<username> <password>", "Authenticate with the bot.",
-		commandAuth})
+		true, "",
+		"", "Authenticate with the bot.",
+		nil, &CommandSpec{Args: []CommandArg{{"username", ArgNick, false}, {"password", ArgString, false}},
+			Run: commandAuth}, nil})
+	// Logout.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"logout"},
+		false, "",
+		"", "Ends your session with the bot.",
+		commandLogout, nil, nil})
+	// Password change.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"passwd"},
+		true, "",
+		"", "Changes your password and ends your other sessions.",
+		nil, &CommandSpec{Args: []CommandArg{{"old password", ArgString, false}, {"new password", ArgString, false}},
+			Run: commandPasswd}, nil})
+	// Whoami.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"whoami"},
+		false, "",
+		"", "Tells who you are logged in as.",
+		commandWhoami, nil, nil})
+	// Sessions.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"sessions"},
+		true, PermSessions,
+		"", "Lists and ends the sessions of users.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"list", nil, "Lists the active sessions.", commandSessionList},
+			{"end", []CommandArg{{"nick", ArgNick, false}}, "Logs the user out everywhere.", commandSessionEnd},
+		}, Run: commandSessionList,
+			Details: "Sessions end when they expire, or when the user leaves a channel, quits or changes nick."},
+		nil})
+	// Identity linking.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"link"},
+		true, "",
+		"", "Links your nicks on the transports to your account.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"start", []CommandArg{{"transport", ArgString, false}, {"nick", ArgNick, false}},
+				"Sends a code to your nick on the transport.", commandLinkStart},
+			{"confirm", []CommandArg{{"code", ArgString, false}}, "Confirms the link with the code.", commandLinkConfirm},
+			{"list", nil, "Lists the linked identities.", commandLinkList},
+			{"remove", []CommandArg{{"transport", ArgString, false}, {"nick", ArgNick, false}},
+				"Unlinks your nick on the transport.", commandLinkRemove},
+		}, Run: commandLinkList,
+			Details: "Start while logged in, then confirm from the other identity. Linked people are recognized " +
+				"across transports, and on Mattermost they are logged in without a password.",
+			Examples: []string{"link start mattermost alice", "link confirm 123456"}}, nil})
 	// Useradd.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"useradd"},
-		true, false, false,
-		"<username> <password>", "Create user account.",
-		commandUserAdd})
+		true, "",
+		"", "Create user account.",
+		nil, &CommandSpec{Args: []CommandArg{{"username", ArgNick, false}, {"password", ArgString, false}},
+			Run: commandUserAdd}, nil})
+	// Claim.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"claim"},
+		true, "",
+		"", "Become the owner of a new bot, with the setup token from the log.",
+		nil, &CommandSpec{Args: []CommandArg{{"token", ArgString, false}}, Run: commandClaim}, nil})
 	// Find.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"f", "find"},
-		false, false, false,
+		false, "",
 		"<token1> <token2> <token3> ...", "Look for URLs containing all the tokens.",
-		commandFindUrl})
+		commandFindUrl, nil, nil})
 	// More.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"m", "more", "moar"},
-		false, false, false,
+		false, "",
 		"", "Say more about last link.",
-		commandSayMore})
+		commandSayMore, nil, nil})
 	// Var.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"var", "v"},
-		true, true, false,
-		"list / get <name> / set <name> <value>", "Controls custom variables.",
-		commandVar})
+		true, PermVars,
+		"", "Controls custom variables.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"list", nil, "Lists the variables.", commandVarList},
+			{"get", []CommandArg{{"name", ArgString, false}}, "Shows the variable.", commandVarGet},
+			{"set", []CommandArg{{"name", ArgString, false}, {"value", ArgRest, false}}, "Sets the variable.",
+				commandVarSet},
+		}, Examples: []string{"var set aqicnToken 1234abcd"}}, nil})
 	// Ignore.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"ignore"},
-		false, true, true,
-		"add <userName> / remove <userName>", "Manages ignore list.",
-		commandIgnore})
+		false, PermIgnore,
+		"", "Manages ignore list.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"list", nil, "Lists the ignore list.", commandIgnoreList},
+			{"add", []CommandArg{{"mask", ArgString, false}, {"scope", ArgString, false}, {"time", ArgString, false},
+				{"reason", ArgRest, true}}, "Ignores people matching the mask.", commandIgnoreAdd},
+			{"remove", []CommandArg{{"id", ArgInt, false}}, "Removes the entry from the ignore list.",
+				commandIgnoreRemove},
+		}, Details: "Mask is matched against nick, user id and nick!user id. It can use * and ?, or be a regular " +
+			"expression between slashes. Scope is everywhere, here, a channel, transport; or transport;channel. " +
+			"Time is forever or a duration. Logged in owners are never ignored.",
+			Examples: []string{"ignore add *@*.badisp.net everywhere forever spam", "ignore add troll #bot 2h"}}, nil})
+	// Language.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"lang", "language"},
+		false, "",
+		"", "Shows or chooses the language of the bot's replies.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"me", []CommandArg{{"language", ArgString, false}}, "Chooses your language.", commandLanguageUser},
+			{"channel", []CommandArg{{"language", ArgString, false}},
+				"Chooses the language of this channel. Needs the channels permission.", commandLanguageChannel},
+		}, Run: commandLanguageShow,
+			Details: "Without a subcommand shows the current and available languages. Language of the channel comes " +
+				"before yours. Use default to go back to the default language.",
+			Examples: []string{"lang me pl", "lang channel default"}}, nil})
 	// Version.
 	bot.RegisterCommand(&BotCommand{
 		[]string{"ver", "version"},
-		false, false, false,
+		false, "",
 		"", "Prints bot's version.",
-		commandVer})
+		commandVer, nil, nil})
+
+	// Reload.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"reload"},
+		false, PermReload,
+		"", "Reloads configuration and texts.",
+		commandReload, nil, nil})
+
+	// Stats.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"stats"},
+		false, PermStats,
+		"", "Shows the event queue statistics.",
+		commandStats, nil, nil})
+
+	// Extensions.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"ext", "extension"},
+		false, PermExtensions,
+		"", "Manages extensions.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"list", nil, "Lists the extensions.", commandExtensionList},
+			{"enable", []CommandArg{{"name", ArgString, false}}, "Enables the extension.", commandExtensionSwitch},
+			{"disable", []CommandArg{{"name", ArgString, false}}, "Disables the extension.", commandExtensionSwitch},
+		}}, nil})
+
+	// Channel settings.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"chan"},
+		false, PermChannels,
+		"list / ext <name> on|off|default / cmd <name> on|off|default / urls on|off|default",
+		"Manages extensions, commands and URL announcements on this channel.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"list", nil, "Lists the settings of this channel.", commandChannelList},
+			{"ext", []CommandArg{{"name", ArgString, false}, {"state", ArgString, false}},
+				"Switches the extension on this channel.", commandChannel},
+			{"cmd", []CommandArg{{"name", ArgString, false}, {"state", ArgString, false}},
+				"Switches the command on this channel.", commandChannel},
+			{"urls", []CommandArg{{"state", ArgString, false}},
+				"Switches URL announcements on this channel.", commandChannel},
+		}, Details: "State is on, off or default. Default follows disabled_extensions, disabled_commands and " +
+			"announce_urls in the section of the channel's transport in the config file.",
+			Examples: []string{"chan ext reddit off", "chan urls default"}}, nil})
+
+	// Roles.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"role"},
+		false, PermRoles,
+		"", "Manages roles and their permissions.",
+		nil, &CommandSpec{Subcommands: []*Subcommand{
+			{"list", nil, "Lists the roles with their permissions.", commandRoleList},
+			{"perms", nil, "Lists the permissions roles can have.", commandRolePermissions},
+			{"set", []CommandArg{{"name", ArgString, false}, {"permissions", ArgRest, false}},
+				"Creates the role or replaces its permissions.", commandRoleSet},
+			{"delete", []CommandArg{{"name", ArgString, false}}, "Deletes the role.", commandRoleDelete},
+			{"grant", []CommandArg{{"nick", ArgNick, false}, {"role", ArgString, false}, {"channel", ArgChannel, true}},
+				"Gives the role to the user, everywhere or on the channel.", commandRoleGrant},
+			{"revoke", []CommandArg{{"nick", ArgNick, false}, {"role", ArgString, false}, {"channel", ArgChannel, true}},
+				"Takes the role from the user.", commandRoleRevoke},
+			{"show", []CommandArg{{"nick", ArgNick, false}}, "Lists the roles of the user.", commandRoleShow},
+		}, Details: "Channel is a channel of this transport, or transport;channel. " +
+			"You can only give out permissions you have yourself.",
+			Examples: []string{"role set mod reminders.manage ignore", "role grant alice mod #bot"}}, nil})
+
+	// Audit trail.
+	bot.RegisterCommand(&BotCommand{
+		[]string{"audit"},
+		true, PermAudit,
+		"", "Shows the latest privileged actions.",
+		nil, &CommandSpec{Args: []CommandArg{{"count", ArgInt, true}}, Run: commandAudit}, nil})
 
 	bot.commandsHideParams["auth"] = true
 	bot.commandsHideParams["useradd"] = true
+	bot.commandsHideParams["passwd"] = true
+	bot.commandsHideParams["claim"] = true
+	bot.commandsHideParams["var set"] = true
+
+	bot.commandsAuditSelf["sessions"] = true
+	bot.commandsAuditSelf["ignore"] = true
+	bot.commandsAuditSelf["lang"] = true
+	bot.commandsAuditSelf["role"] = true
+}
+
+// paramsHidden tells if the params of the command should not be shown in the logs and the audit trail.
+func (bot *Bot) paramsHidden(command string, params []string) bool {
+	if cmd := bot.getCommand(command); cmd != nil { // Aliases are hidden too.
+		command = cmd.CommandNames[0]
+	}
+	if bot.commandsHideParams[command] {
+		return true
+	}
+	return len(params) > 0 && bot.commandsHideParams[command+" "+strings.ToLower(params[0])]
 }
 
 // handleBotCommand handles commands directed at the bot.
@@ -70,7 +250,7 @@ func (bot *Bot) handleBotCommand(sourceEvent *events.EventMessage) {
 	// Catch errors.
 	defer func() {
 		// Run a work done event.
-		bot.EventDispatcher.Trigger(events.EventMessage{
+		bot.EventDispatcher.TriggerFromListener(events.EventMessage{
 			sourceEvent.TransportName,
 			sourceEvent.TransportFormatting,
 			events.EventBotDone,
@@ -84,47 +264,65 @@ func (bot *Bot) handleBotCommand(sourceEvent *events.EventMessage) {
 		}
 	}()
 
-	// Was the command sent by the owner?
-	owner := bot.UserIsOwner(sourceEvent.UserId)
-	admin := bot.UserIsAdmin(sourceEvent.UserId)
-
-	params := strings.Split(sourceEvent.Message, " ")
-	command := params[0]
-	params = params[1:]
+	// Split the command from its parameters.
+	tokens := splitCommandLine(sourceEvent.Message)
+	command := ""
+	if len(tokens) > 0 {
+		command = tokens[0].text
+		tokens = tokens[1:]
+	}
+	params := tokenTexts(tokens)
 
 	paramsDisplay := fmt.Sprintf("%+v", params)
-	if bot.commandsHideParams[command] {
+	if bot.paramsHidden(command, params) {
 		paramsDisplay = "<hidden>"
 	}
 	bot.Log.WithFields(
 		logrus.Fields{"channel": sourceEvent.Channel, "cmd": command, "params": paramsDisplay},
 	).Infof("Received command from %s.", sourceEvent.Nick)
 
-	if !sourceEvent.IsPrivate() && !owner && !admin { // Command limits apply.
-		if bot.commandUseLimit[command+sourceEvent.Nick] >= bot.Config.CommandsPer5 { // Per command+person.
-			if !bot.commandWarn[sourceEvent.Channel] { // Warning was not yet sent.
-				bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.Texts.CommandLimit))
-				bot.commandWarn[sourceEvent.Channel] = true
+	// Make sure the session, if any, is still valid for this sender.
+	bot.checkSession(sourceEvent)
+
+	cmd := bot.getCommand(command)
+	if !sourceEvent.IsPrivate() && !bot.UserCan(sourceEvent, PermNoLimits) { // Rate limits apply.
+		limitName := command
+		if cmd != nil { // Aliases share the limit.
+			limitName = cmd.CommandNames[0]
+		}
+		if allowed, warning := bot.useCommand(limitName, sourceEvent); !allowed {
+			if warning != "" {
+				bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, warning))
 			}
 			return
-		} else {
-			bot.commandUseLimit[command+sourceEvent.Nick] += 1
 		}
 	}
 
-	if cmd, exists := bot.commands[command]; exists {
+	if cmd != nil {
+		// Check if command is enabled on this channel.
+		if !bot.commandAllowed(sourceEvent, command) {
+			bot.Log.Debugf("Command %s is disabled on %s.", command, sourceEvent.ChannelId())
+			return
+		}
 		// Check if command needs to be run through private message.
 		if cmd.Private && !sourceEvent.IsPrivate() {
-			bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.Texts.NeedsPriv))
+			bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.texts(sourceEvent).NeedsPriv))
 			return
 		}
-		// Check if command needs to be run by the owner.
-		if cmd.Owner && !owner || cmd.Admin && !admin {
-			bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.Texts.NeedsAdmin))
+		// Check if the user has the permission needed.
+		if !bot.UserCan(sourceEvent, cmd.Permission) {
+			bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.texts(sourceEvent).NeedsAdmin))
+			return
+		}
+		// Check if the command is on cooldown.
+		if allowed, warning := bot.useCooldown(cmd, sourceEvent, params); !allowed {
+			if warning != "" {
+				bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, warning))
+			}
 			return
 		}
 		// Run a work start event.
-		bot.EventDispatcher.Trigger(events.EventMessage{
+		bot.EventDispatcher.TriggerFromListener(events.EventMessage{
 			sourceEvent.TransportName,
 			sourceEvent.TransportFormatting,
 			events.EventBotWorking,
@@ -132,234 +330,149 @@ func (bot *Bot) handleBotCommand(sourceEvent *events.EventMessage) {
 		})
 
 		// Execute the command.
-		cmd.CommandFunc(bot, sourceEvent, params)
-	} else { // Unknown command.
-		if sourceEvent.IsPrivate() && rand.Int()%10 > 5 { // Talk back only on private chats.
-			bot.SendMessage(
-				sourceEvent, fmt.Sprintf("%s", bot.Texts.WrongCommand[rand.Intn(len(bot.Texts.WrongCommand))]))
-
+		commandInvocations.Inc(cmd.CommandNames[0])
+		start := time.Now()
+		bot.runCommand(cmd, command, sourceEvent, tokens)
+		commandSeconds.Observe(time.Since(start).Seconds(), cmd.CommandNames[0])
+		if cmd.Permission != "" && !bot.commandsAuditSelf[cmd.CommandNames[0]] {
+			bot.Audit(sourceEvent, "command", cmd.CommandNames[0], paramsDisplay)
 		}
+	} else if suggestion := bot.suggestCommand(sourceEvent, command); suggestion != "" { // Mistyped command.
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick,
+			utils.Format(bot.texts(sourceEvent).TempDidYouMean, map[string]string{"command": suggestion})))
+	} else if sourceEvent.IsPrivate() { // Unknown command. Talk back only on private chats.
+		texts := bot.texts(sourceEvent)
+		bot.SendMessage(sourceEvent, fmt.Sprintf(
+			"%s %s", texts.WrongCommand[rand.Intn(len(texts.WrongCommand))], texts.SeeHelp))
 	}
 }
 
-// commandHelp will print help for all the commands.
-func commandHelp(bot *Bot, sourceEvent *events.EventMessage, params []string) {
-	forcePriv := false
-	if len(params) == 0 || params[0] != "pub" { // By default help only gets sent on priv.
-		forcePriv = true
-	}
-
-	owner := bot.UserIsOwner(sourceEvent.UserId)
-	admin := bot.UserIsAdmin(sourceEvent.UserId)
-	// Build a list of all command aliases.
-	helpCommandKeys := map[string][]string{}
-	helpCommands := map[string]*BotCommand{}
-	for key, cmd := range bot.commands {
-		pointerStr := fmt.Sprintf("%p", cmd)
-		helpCommandKeys[pointerStr] = append(helpCommandKeys[pointerStr], key)
-		helpCommands[pointerStr] = cmd
-	}
-	// Print help.
-	results := []string{}
-	for pointerStr, cmd := range helpCommands {
-		commands := strings.Join(helpCommandKeys[pointerStr], ", ")
-		options := ""
-		if cmd.Private {
-			if sourceEvent.TransportFormatting == events.FormatIRC {
-				options = " \x0300(private only)\x03"
-			} else if sourceEvent.TransportFormatting == events.FormatMarkdown {
-				options = " **(private only)**"
-			} else {
-				options = " (private only)"
-			}
-		}
-		if cmd.Owner && !owner {
-			continue
-		}
-		if cmd.Admin && !admin {
-			continue
-		}
-		result := ""
-		if sourceEvent.TransportFormatting == events.FormatIRC {
-			result = fmt.Sprintf(
-				"\x0308%s\x03 \x0310%s\x03 - %s%s", commands, cmd.HelpParams, cmd.HelpDescription, options)
-		} else if sourceEvent.TransportFormatting == events.FormatMarkdown {
-			result = fmt.Sprintf("| %s | %s | %s%s |", commands, cmd.HelpParams, cmd.HelpDescription, options)
-		} else {
-			result = fmt.Sprintf("%s %s - %s%s", commands, cmd.HelpParams, cmd.HelpDescription, options)
-		}
-		results = append(results, result)
+// runCommand runs the command with the words given after its name. Usage errors are sent back to the user.
+func (bot *Bot) runCommand(cmd *BotCommand, name string, sourceEvent *events.EventMessage, tokens []commandToken) {
+	if cmd.Spec == nil {
+		cmd.CommandFunc(bot, sourceEvent, tokenTexts(tokens))
+		return
 	}
-	// Send the help messages.
-	if sourceEvent.TransportFormatting == events.FormatMarkdown {
-		result := "\n\n| Command | Parameters | Help |\n| :-- | :-- | :-- |\n"
-		result += strings.Join(results, "\n")
-		if forcePriv {
-			bot.SendPrivateMessage(sourceEvent, sourceEvent.Nick, result)
-		} else {
-			bot.SendMessage(sourceEvent, result)
-		}
-	} else {
-		for _, result := range results {
-			if forcePriv {
-				bot.SendPrivateMessage(sourceEvent, sourceEvent.Nick, result)
-			} else {
-				bot.SendMessage(sourceEvent, result)
-			}
-		}
+	run, args, err := bot.parseCommand(cmd.Spec, sourceEvent.Message, tokens, bot.LocalHumanizer(sourceEvent))
+	if err != nil {
+		usage := strings.TrimSpace(name + " " + err.(usageError).usage)
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s. Usage: %s", sourceEvent.Nick, err, usage))
+		return
 	}
+	run(bot, sourceEvent, args)
+}
 
-	return
+// getCommand returns the registered command, or nil.
+func (bot *Bot) getCommand(name string) *BotCommand {
+	bot.commandsMu.RLock()
+	defer bot.commandsMu.RUnlock()
+	return bot.commands[name]
 }
 
 // commandAuth is a command for authenticating an user with the bot.
-func commandAuth(bot *Bot, sourceEvent *events.EventMessage, params []string) {
-	if len(params) == 2 {
-		if err := bot.authenticateUser(params[0], sourceEvent.UserId, params[1]); err != nil {
-			bot.Log.Warningf("Couldn't authenticate %s: %s", params[0], err)
-			bot.SendMessage(sourceEvent, "That's not right.")
+func commandAuth(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	username := args.String("username")
+	if err := bot.authenticateUser(sourceEvent, username, args.String("password")); err != nil {
+		bot.Log.Warningf("Couldn't authenticate %s: %s", username, err)
+		if locked, ok := err.(loginLockedError); ok {
+			wait := bot.LocalHumanizer(sourceEvent).TimeDiff(time.Now(), locked.until, false)
+			bot.SendMessage(sourceEvent, utils.Format(texts.TempLoginLocked, map[string]string{"wait": wait}))
 			return
 		}
-		bot.SendMessage(sourceEvent, "You are now logged in.")
-	} else {
-		bot.SendMessage(sourceEvent, bot.Texts.SeeHelp)
-	}
-}
-
-// commandIgnore will control the ignore list.
-func commandIgnore(bot *Bot, sourceEvent *events.EventMessage, params []string) {
-	if len(params) == 2 {
-		command := params[0]
-		userId := params[1]
-		if command == "add" {
-			if bot.UserIsOwner(userId) {
-				bot.SendMessage(sourceEvent, "You cannot ignore the owner.")
-				return
-			}
-			bot.AddToIgnoreList(userId)
-		} else if command == "remove" {
-			bot.RemoveFromIgnoreList(userId)
-		}
-		bot.SendMessage(sourceEvent, "Ignore list changed.")
-	} else {
-		bot.SendMessage(sourceEvent, bot.Texts.SeeHelp)
+		bot.SendMessage(sourceEvent, texts.NotRight)
+		return
 	}
+	bot.SendMessage(sourceEvent, texts.LoggedIn)
 }
 
 // commandUserAdd will add a new user to bot's database and authenticate.
-func commandUserAdd(bot *Bot, sourceEvent *events.EventMessage, params []string) {
-	if len(params) == 2 {
-		if bot.UserIsAuthenticated(sourceEvent.UserId) {
-			bot.SendMessage(sourceEvent, "You are already authenticated.")
-			return
-		}
-
-		if err := bot.addUser(params[0], params[1], false, false); err != nil {
-			bot.Log.Warningf("Couldn't add user %s: %s", params[0], err)
-			bot.SendMessage(sourceEvent, fmt.Sprintf("Can't add user: %s", err))
-			return
-		}
-		if err := bot.authenticateUser(params[0], sourceEvent.UserId, params[1]); err != nil {
-			bot.Log.Warningf("Couldn't authenticate %s: %s", params[0], err)
-			return
-		}
-		bot.SendMessage(sourceEvent, "User added. You are now logged in.")
+func commandUserAdd(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	if bot.UserIsAuthenticated(sourceEvent.UserId) {
+		bot.SendMessage(sourceEvent, texts.AlreadyLoggedIn)
 		return
 	}
-	bot.SendMessage(sourceEvent, bot.Texts.SeeHelp)
-
-}
-
-// commandVar gets, sets and lists custom variables.
-func commandVar(bot *Bot, sourceEvent *events.EventMessage, params []string) {
-	if len(params) < 1 {
+	username, password := args.String("username"), args.String("password")
+	if err := bot.addUser(username, password, nil); err != nil {
+		bot.Log.Warningf("Couldn't add user %s: %s", username, err)
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempUserAddFailed, map[string]string{"error": err.Error()}))
 		return
 	}
-	command := params[0]
-	if command == "list" {
-		bot.SendMessage(sourceEvent, "Custom variables:")
-		for key, val := range bot.customVars {
-			bot.SendMessage(sourceEvent, fmt.Sprintf("%s = %s", key, val))
-		}
+	if err := bot.authenticateUser(sourceEvent, username, password); err != nil {
+		bot.Log.Warningf("Couldn't authenticate %s: %s", username, err)
 		return
 	}
+	bot.SendMessage(sourceEvent, texts.UserAdded)
+}
 
-	if len(params) == 2 && command == "get" {
-		name := params[1]
-		bot.SendMessage(sourceEvent, fmt.Sprintf("%s = %s", name, bot.GetVar(name)))
-		return
+// commandVarList lists custom variables.
+func commandVarList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	bot.SendMessage(sourceEvent, "Custom variables:")
+	for key, val := range bot.Vars() {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s = %s", key, val))
 	}
+}
 
-	if len(params) >= 3 && command == "set" {
-		name := params[1]
-		value := strings.Join(params[2:], " ")
-		bot.SetVar(name, value)
-		bot.SendMessage(sourceEvent, fmt.Sprintf("%s = %s", name, bot.GetVar(name)))
-		return
-	}
-	bot.SendMessage(sourceEvent, bot.Texts.SeeHelp)
+// commandVarGet shows a custom variable.
+func commandVarGet(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	name := args.String("name")
+	bot.SendMessage(sourceEvent, fmt.Sprintf("%s = %s", name, bot.GetVar(name)))
+}
+
+// commandVarSet sets a custom variable.
+func commandVarSet(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	name := args.String("name")
+	bot.SetVar(name, args.String("value"))
+	bot.SendMessage(sourceEvent, fmt.Sprintf("%s = %s", name, bot.GetVar(name)))
 }
 
 // commandSayMore gives more info, if bot has any.
 func commandSayMore(bot *Bot, sourceEvent *events.EventMessage, params []string) {
-
-	if bot.urlMoreInfo[sourceEvent.TransportName+sourceEvent.Channel] == "" {
-		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.Texts.NothingToAdd))
+	info := bot.takeMoreInfo(sourceEvent.TransportName, sourceEvent.Channel)
+	if info == "" {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.texts(sourceEvent).NothingToAdd))
 		return
-	} else {
-		bot.SendMessage(sourceEvent, bot.urlMoreInfo[sourceEvent.TransportName+sourceEvent.Channel])
-		delete(bot.urlMoreInfo, sourceEvent.TransportName+sourceEvent.Channel)
 	}
+	bot.SendMessage(sourceEvent, info)
 }
 
 // commandFindUrl searches bot's database using FTS for links matching the query.
 func commandFindUrl(bot *Bot, sourceEvent *events.EventMessage, params []string) {
 	if len(params) == 0 {
-		bot.SendMessage(sourceEvent, bot.Texts.SeeHelp)
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).SeeHelp)
 		return
 	}
-	token := strings.Join(params, " AND ")
-
-	query1 := "SELECT nick, timestamp, link, title FROM urls_search WHERE "
-	query2 := ""
+	channel := ""
 	if !sourceEvent.IsPrivate() {
-		query2 = fmt.Sprintf("channel=\"%s\" AND ", sourceEvent.Channel)
+		channel = sourceEvent.Channel
 	}
-	query3 := "search MATCH ? GROUP BY link ORDER BY timestamp DESC LIMIT 5"
-
-	// Query FTS table.
-	result, err := bot.Db.Query(query1+query2+query3, token)
+	urls, err := bot.Storage.SearchURLs(channel, params, 5)
 	if err != nil {
 		bot.Log.Warningf("Can't search for URLs: %s", err)
 		return
 	}
 
-	defer result.Close()
-
 	// Announce results.
 	found := []string{}
-	for result.Next() {
-		var nick, timestr, link, title string
-		if err = result.Scan(&nick, &timestr, &link, &title); err != nil {
-			bot.Log.Warningf("Error getting search results: %s", err)
+	for _, url := range urls {
+		if sourceEvent.IsPrivate() { // skip the author and time when not on a channel.
+			found = append(found, fmt.Sprintf("%s (%s)", url.Link, url.Title))
 		} else {
-			if sourceEvent.IsPrivate() { // skip the author and time when not on a channel.
-				found = append(found, fmt.Sprintf("%s (%s)", link, title))
-			} else {
-				found = append(found, fmt.Sprintf("%s | %s | %s (%s)", nick, timestr, link, title))
-			}
+			found = append(found, fmt.Sprintf("%s | %s | %s (%s)",
+				url.Nick, url.Timestamp.Format("2006-01-02 15:04:05"), url.Link, url.Title))
 		}
 	}
 	if len(found) > 0 {
 		if sourceEvent.IsPrivate() {
-			bot.SendMessage(sourceEvent, bot.Texts.SearchPrivateNotice)
+			bot.SendMessage(sourceEvent, bot.texts(sourceEvent).SearchPrivateNotice)
 		}
-		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.Texts.SearchResults))
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.texts(sourceEvent).SearchResults))
 		for i := range found {
 			bot.SendMessage(sourceEvent, found[i])
 		}
 	} else {
-		bot.SendMessage(sourceEvent, fmt.Sprintf("%s", bot.Texts.SearchNoResults))
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s", bot.texts(sourceEvent).SearchNoResults))
 	}
 }
 
@@ -367,3 +480,50 @@ func commandFindUrl(bot *Bot, sourceEvent *events.EventMessage, params []string)
 func commandVer(bot *Bot, sourceEvent *events.EventMessage, params []string) {
 	bot.SendMessage(sourceEvent, bot.version())
 }
+
+// commandReload will reload the configuration and texts.
+func commandReload(bot *Bot, sourceEvent *events.EventMessage, params []string) {
+	if err := bot.Reload(); err != nil {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s", err))
+		return
+	}
+	bot.SendMessage(sourceEvent, "Configuration and texts reloaded.")
+}
+
+// commandStats will print the event queue statistics.
+func commandStats(bot *Bot, sourceEvent *events.EventMessage, params []string) {
+	stats := bot.EventDispatcher.Stats()
+	bot.SendMessage(sourceEvent, fmt.Sprintf(
+		"Events queued: %d %v (max %d per worker), handled: %d, dropped: %d, listener timeouts: %d.",
+		stats.QueueDepth, stats.QueueDepths, stats.QueueSize, stats.Processed, stats.Dropped, stats.TimedOut))
+}
+
+// commandExtensionList lists extensions.
+func commandExtensionList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	names := []string{}
+	for name, enabled := range bot.ExtensionNames() {
+		if enabled {
+			names = append(names, name)
+		} else {
+			names = append(names, name+" (disabled)")
+		}
+	}
+	sort.Strings(names)
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Extensions: %s", strings.Join(names, ", ")))
+}
+
+// commandExtensionSwitch enables or disables an extension.
+func commandExtensionSwitch(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	name := args.String("name")
+	var err error
+	if args.Subcommand == "enable" {
+		err = bot.EnableExtension(name)
+	} else {
+		err = bot.DisableExtension(name)
+	}
+	if err != nil {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Can't %s extension: %s", args.Subcommand, err))
+		return
+	}
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Extension %s %sd.", name, args.Subcommand))
+}
@@ -0,0 +1,380 @@
+package papaBot
+
+// Declarative command arguments: quoting, typed parameters and subcommands.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pawelszydlo/humanize"
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// ArgType is the type of a command argument.
+type ArgType int
+
+const (
+	// Single word, or text in double quotes.
+	ArgString ArgType = iota
+	// Integer number.
+	ArgInt
+	// Duration like "5 days" or "2h30m". Number and unit can be given as separate words.
+	ArgDuration
+	// Date in format 2006-01-02, optionally followed by time in format 15:04:05 or 15:04.
+	ArgDate
+	// Nick of a user. Leading @ is removed.
+	ArgNick
+	// Name of a channel.
+	ArgChannel
+	// Rest of the line, as typed. Must be the last argument.
+	ArgRest
+)
+
+// CommandArg describes an argument of a command.
+type CommandArg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+}
+
+// CommandRunFunc runs a command with the parsed arguments.
+type CommandRunFunc func(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs)
+
+// Subcommand is a subcommand of a bot command, e.g. "list" in "var list".
+type Subcommand struct {
+	Name string
+	Args []CommandArg
+	// Help string with the description.
+	HelpDescription string
+	Run             CommandRunFunc
+}
+
+// CommandSpec describes the arguments of a command. The arguments are parsed and checked before the command is run,
+// and the help is generated from the spec.
+type CommandSpec struct {
+	// Arguments of the command, when it has no subcommands.
+	Args []CommandArg
+	// Subcommands, each with its own arguments. The first word after the command selects the subcommand.
+	Subcommands []*Subcommand
+	// Function run with Args, or when the command is called without a subcommand. Can be nil for commands that
+	// require a subcommand.
+	Run CommandRunFunc
+	// Longer description, shown by "help <command>".
+	Details string
+	// Examples of use, shown by "help <command>".
+	Examples []string
+}
+
+// CommandArgs holds the parsed arguments of a command.
+type CommandArgs struct {
+	// Name of the subcommand, empty if there was none.
+	Subcommand string
+	values     map[string]interface{}
+}
+
+// Has returns whether the argument was given.
+func (args *CommandArgs) Has(name string) bool {
+	_, ok := args.values[name]
+	return ok
+}
+
+// String returns a text argument (string, nick, channel or rest of the line), or "" if it wasn't given.
+func (args *CommandArgs) String(name string) string {
+	value, _ := args.values[name].(string)
+	return value
+}
+
+// Int returns an integer argument, or 0 if it wasn't given.
+func (args *CommandArgs) Int(name string) int {
+	value, _ := args.values[name].(int)
+	return value
+}
+
+// Duration returns a duration argument, or 0 if it wasn't given.
+func (args *CommandArgs) Duration(name string) time.Duration {
+	value, _ := args.values[name].(time.Duration)
+	return value
+}
+
+// Time returns a date argument, or zero time if it wasn't given.
+func (args *CommandArgs) Time(name string) time.Time {
+	value, _ := args.values[name].(time.Time)
+	return value
+}
+
+// Word of a command line, with its position in the line.
+type commandToken struct {
+	text  string
+	start int
+}
+
+// splitCommandLine splits the line into words. Text in double quotes is one word and \" inside of it is a quote.
+// A quote without a pair is taken literally.
+func splitCommandLine(line string) []commandToken {
+	tokens := []commandToken{}
+	current := strings.Builder{}
+	start, inToken := 0, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			if inToken {
+				tokens = append(tokens, commandToken{current.String(), start})
+				current.Reset()
+				inToken = false
+			}
+			continue
+		}
+		if !inToken {
+			start, inToken = i, true
+		}
+		if c == '"' {
+			if end := closingQuote(line, i+1); end != -1 {
+				current.WriteString(strings.Replace(line[i+1:end], `\"`, `"`, -1))
+				i = end
+				continue
+			}
+		}
+		current.WriteByte(c)
+	}
+	if inToken {
+		tokens = append(tokens, commandToken{current.String(), start})
+	}
+	return tokens
+}
+
+// closingQuote returns the position of the quote closing the one before from, or -1.
+func closingQuote(line string, from int) int {
+	for i := from; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) && line[i+1] == '"' {
+			i++
+		} else if line[i] == '"' {
+			return i
+		}
+	}
+	return -1
+}
+
+// tokenTexts returns the texts of the tokens.
+func tokenTexts(tokens []commandToken) []string {
+	texts := make([]string, len(tokens))
+	for i := range tokens {
+		texts[i] = tokens[i].text
+	}
+	return texts
+}
+
+// validate checks the spec when the command is registered.
+func (spec *CommandSpec) validate() error {
+	if err := validateArgs(spec.Args); err != nil {
+		return err
+	}
+	if len(spec.Args) > 0 && len(spec.Subcommands) > 0 {
+		return errors.New("command can't have both arguments and subcommands")
+	}
+	if spec.Run == nil && len(spec.Subcommands) == 0 {
+		return errors.New("command needs a Run function or subcommands")
+	}
+	for _, sub := range spec.Subcommands {
+		if sub.Run == nil {
+			return errors.New(fmt.Sprintf("subcommand %s has no Run function", sub.Name))
+		}
+		if err := validateArgs(sub.Args); err != nil {
+			return errors.New(fmt.Sprintf("subcommand %s: %s", sub.Name, err))
+		}
+	}
+	return nil
+}
+
+// validateArgs checks that the rest of the line is the last argument and that optional arguments come last.
+func validateArgs(args []CommandArg) error {
+	optional := false
+	for i, arg := range args {
+		if arg.Type == ArgRest && i != len(args)-1 {
+			return errors.New(fmt.Sprintf("argument %s takes the rest of the line and must be the last one", arg.Name))
+		}
+		if optional && !arg.Optional {
+			return errors.New(fmt.Sprintf("required argument %s can't follow optional ones", arg.Name))
+		}
+		optional = arg.Optional
+	}
+	return nil
+}
+
+// Usage returns the parameters of the command, e.g. "list / get <name> / set <name> <value...>".
+func (spec *CommandSpec) Usage() string {
+	if len(spec.Subcommands) == 0 {
+		return formatArgs(spec.Args)
+	}
+	usages := []string{}
+	for _, sub := range spec.Subcommands {
+		usages = append(usages, strings.TrimSpace(sub.Name+" "+formatArgs(sub.Args)))
+	}
+	return strings.Join(usages, " / ")
+}
+
+// formatArgs lists the arguments, with required ones in <> and optional ones in [].
+func formatArgs(args []CommandArg) string {
+	formatted := []string{}
+	for _, arg := range args {
+		name := arg.Name
+		if arg.Type == ArgRest {
+			name += "..."
+		}
+		if arg.Optional {
+			formatted = append(formatted, "["+name+"]")
+		} else {
+			formatted = append(formatted, "<"+name+">")
+		}
+	}
+	return strings.Join(formatted, " ")
+}
+
+// helpParams returns the parameters to show in the help.
+func (cmd *BotCommand) helpParams() string {
+	if cmd.HelpParams == "" && cmd.Spec != nil {
+		return cmd.Spec.Usage()
+	}
+	return cmd.HelpParams
+}
+
+// subcommand returns the subcommand with the given name, or nil.
+func (spec *CommandSpec) subcommand(name string) *Subcommand {
+	for _, sub := range spec.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// usageError is a wrong argument given to a command, along with the usage to show.
+type usageError struct {
+	message string
+	usage   string
+}
+
+func (err usageError) Error() string {
+	return err.message
+}
+
+// parseCommand picks the subcommand and parses its arguments. Line is the whole command line and tokens are the
+// words after the command name. Durations are read in the language of the humanizer, or in the default one.
+func (bot *Bot) parseCommand(spec *CommandSpec, line string, tokens []commandToken,
+	humanizer *humanize.Humanizer) (CommandRunFunc, *CommandArgs, error) {
+	args := &CommandArgs{values: map[string]interface{}{}}
+	if len(spec.Subcommands) == 0 {
+		if err := bot.parseArgs(spec.Args, line, tokens, humanizer, args); err != nil {
+			return nil, nil, usageError{err.Error(), formatArgs(spec.Args)}
+		}
+		return spec.Run, args, nil
+	}
+	if len(tokens) == 0 {
+		if spec.Run == nil {
+			return nil, nil, usageError{"subcommand missing", spec.Usage()}
+		}
+		return spec.Run, args, nil
+	}
+	sub := spec.subcommand(tokens[0].text)
+	if sub == nil {
+		return nil, nil, usageError{fmt.Sprintf("unknown subcommand '%s'", tokens[0].text), spec.Usage()}
+	}
+	args.Subcommand = sub.Name
+	if err := bot.parseArgs(sub.Args, line, tokens[1:], humanizer, args); err != nil {
+		return nil, nil, usageError{err.Error(), strings.TrimSpace(sub.Name + " " + formatArgs(sub.Args))}
+	}
+	return sub.Run, args, nil
+}
+
+// parseArgs parses the words into the arguments.
+func (bot *Bot) parseArgs(
+	specs []CommandArg, line string, tokens []commandToken, humanizer *humanize.Humanizer, args *CommandArgs) error {
+	pos := 0
+	for _, spec := range specs {
+		if pos >= len(tokens) {
+			if spec.Optional {
+				continue
+			}
+			return errors.New(fmt.Sprintf("missing %s", spec.Name))
+		}
+		text := tokens[pos].text
+		switch spec.Type {
+		case ArgString:
+			args.values[spec.Name] = text
+		case ArgNick:
+			nick := strings.TrimPrefix(text, "@")
+			if nick == "" {
+				return errors.New(fmt.Sprintf("%s must be a nick", spec.Name))
+			}
+			args.values[spec.Name] = nick
+		case ArgChannel:
+			if text == "" {
+				return errors.New(fmt.Sprintf("%s must be a channel", spec.Name))
+			}
+			args.values[spec.Name] = text
+		case ArgInt:
+			number, err := strconv.Atoi(text)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s must be a number", spec.Name))
+			}
+			args.values[spec.Name] = number
+		case ArgDuration:
+			// Join the number with the unit, as in "5 days".
+			if _, err := strconv.ParseFloat(text, 64); err == nil && pos+1 < len(tokens) {
+				pos++
+				text += " " + tokens[pos].text
+			}
+			duration, err := humanizer.ParseDuration(text)
+			if defaultHumanizer := bot.Humanizer(); err != nil && humanizer != defaultHumanizer {
+				duration, err = defaultHumanizer.ParseDuration(text)
+			}
+			if err != nil {
+				duration, err = time.ParseDuration(text)
+			}
+			if err != nil || duration <= 0 {
+				return errors.New(fmt.Sprintf("%s must be a duration, e.g. \"5 days\"", spec.Name))
+			}
+			args.values[spec.Name] = duration
+		case ArgDate:
+			// Join the date with the time, if given as a separate word.
+			if pos+1 < len(tokens) && !strings.Contains(text, " ") {
+				if _, err := parseArgDate("2006-01-02 " + tokens[pos+1].text); err == nil {
+					pos++
+					text += " " + tokens[pos].text
+				}
+			}
+			date, err := parseArgDate(text)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s must be a date in format 2006-01-02 15:04:05", spec.Name))
+			}
+			args.values[spec.Name] = date
+		case ArgRest:
+			// Keep the text as typed, unless it's a single word or quoted text.
+			if pos < len(tokens)-1 {
+				text = strings.TrimSpace(line[tokens[pos].start:])
+			}
+			args.values[spec.Name] = text
+			pos = len(tokens)
+			continue
+		}
+		pos++
+	}
+	if pos < len(tokens) {
+		return errors.New("too many arguments")
+	}
+	return nil
+}
+
+// parseArgDate parses the date with an optional time, in local time zone.
+func parseArgDate(text string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		var date time.Time
+		if date, err = time.ParseInLocation(layout, text, time.Local); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, err
+}
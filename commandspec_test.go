@@ -0,0 +1,113 @@
+package papaBot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pawelszydlo/humanize"
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestSplitCommandLine tests splitting on whitespace and quoting.
+func TestSplitCommandLine(t *testing.T) {
+	cases := map[string]string{
+		`var  set   name value`:       "var|set|name|value",
+		`var set name "two  words"`:   "var|set|name|two  words",
+		`say "with \"quotes\"" x`:     `say|with "quotes"|x`,
+		`a "" b`:                      "a||b",
+		`pre"quoted text"post`:        "prequoted textpost",
+		`unpaired "quote stays`:       `unpaired|"quote|stays`,
+		"  tabs\tand\nnewlines  ":     "tabs|and|newlines",
+		`it's "fine" isn't it`:        "it's|fine|isn't|it",
+		`unicode "zażółć gęślą" jaźń`: "unicode|zażółć gęślą|jaźń",
+	}
+	for line, expected := range cases {
+		if got := strings.Join(tokenTexts(splitCommandLine(line)), "|"); got != expected {
+			t.Errorf("Split of %q: expected %q, got %q", line, expected, got)
+		}
+	}
+}
+
+// TestParseCommand tests subcommands, typed arguments and usage errors.
+func TestParseCommand(t *testing.T) {
+	humanizer, err := humanize.New("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := &Bot{
+		textBundles: &textBundles{defaultLanguage: "en"},
+		humanizers:  map[string]*humanize.Humanizer{"en": humanizer},
+	}
+	run := func(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {}
+	spec := &CommandSpec{Subcommands: []*Subcommand{
+		{"del", []CommandArg{{"id", ArgInt, false}}, "", run},
+		{"add", []CommandArg{
+			{"when", ArgDate, false}, {"delay", ArgDuration, false}, {"who", ArgNick, false},
+			{"text", ArgRest, true}}, "", run},
+	}}
+	if err := spec.validate(); err != nil {
+		t.Fatalf("Spec should be valid: %s", err)
+	}
+	if usage := spec.Usage(); usage != "del <id> / add <when> <delay> <who> [text...]" {
+		t.Errorf("Unexpected usage: %s", usage)
+	}
+
+	parse := func(line string) (*CommandArgs, error) {
+		tokens := splitCommandLine(line)
+		_, args, err := bot.parseCommand(spec, line, tokens[1:], humanizer)
+		return args, err
+	}
+	args, err := parse(`cmd add 2020-01-02 10:30 5 days @nick  keep  "the" spacing`)
+	if err != nil {
+		t.Fatalf("Can't parse: %s", err)
+	}
+	expectedDate := time.Date(2020, 1, 2, 10, 30, 0, 0, time.Local)
+	if args.Subcommand != "add" || !args.Time("when").Equal(expectedDate) ||
+		args.Duration("delay") != 5*24*time.Hour || args.String("who") != "nick" ||
+		args.String("text") != `keep  "the" spacing` {
+		t.Errorf("Unexpected args: %+v", args)
+	}
+	args, err = parse(`cmd add "2020-01-02 10:30:15" 2h nick "quoted text"`)
+	if err != nil || args.String("text") != "quoted text" || args.Duration("delay") != 2*time.Hour {
+		t.Errorf("Unexpected args: %+v, %v", args, err)
+	}
+	if args, err = parse(`cmd add 2020-01-02 1 hour nick`); err != nil || args.Has("text") {
+		t.Errorf("Optional argument should be skipped: %+v, %v", args, err)
+	}
+
+	errorCases := map[string]string{
+		"cmd":                        "subcommand missing",
+		"cmd nope":                   "unknown subcommand 'nope'",
+		"cmd del":                    "missing id",
+		"cmd del x":                  "id must be a number",
+		"cmd del 1 2":                "too many arguments",
+		"cmd add 2020-13-01 1h nick": "when must be a date in format 2006-01-02 15:04:05",
+		"cmd add 2020-01-01 soon x":  `delay must be a duration, e.g. "5 days"`,
+	}
+	for line, expected := range errorCases {
+		if _, err := parse(line); err == nil || err.Error() != expected {
+			t.Errorf("Parsing %q: expected error %q, got %v", line, expected, err)
+		}
+	}
+	if _, err := parse("cmd del x"); err.(usageError).usage != "del <id>" {
+		t.Errorf("Usage should be for the subcommand: %s", err.(usageError).usage)
+	}
+}
+
+// TestInvalidSpecs tests the checks done when commands are registered.
+func TestInvalidSpecs(t *testing.T) {
+	run := func(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {}
+	specs := []*CommandSpec{
+		{},
+		{Args: []CommandArg{{"text", ArgRest, false}, {"id", ArgInt, false}}, Run: run},
+		{Args: []CommandArg{{"id", ArgInt, true}, {"name", ArgString, false}}, Run: run},
+		{Args: []CommandArg{{"id", ArgInt, false}}, Subcommands: []*Subcommand{{"list", nil, "", run}}, Run: run},
+		{Subcommands: []*Subcommand{{"list", nil, "", nil}}},
+	}
+	for i, spec := range specs {
+		if spec.validate() == nil {
+			t.Errorf("Spec %d should be invalid.", i)
+		}
+	}
+}
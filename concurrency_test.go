@@ -0,0 +1,442 @@
+package papaBot_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot"
+	"github.com/pawelszydlo/papa-bot/config"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/extensions"
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const testConfig = `
+[bot]
+name = "papaBot"
+chat_logging = false
+log_level = "warning"
+
+[events]
+queue_size = 1000
+
+[api]
+token = "test-token"
+
+[send_tokens.ci]
+token = "send-token"
+channels = ["test;#test"]
+
+[owner]
+prompt = false
+
+[database]
+driver = "sqlite"
+dsn = "%s"
+
+[test]
+enabled = true
+private_commands = "always"
+
+[test.channel_settings."#quiet"]
+command_prefixes = ["!"]
+mention_trigger = false
+`
+
+// Number of goroutines sending events and number of rounds each of them sends.
+const (
+	testWorkers = 5
+	testRounds  = 5
+)
+
+// testTransport records everything the bot sends.
+type testTransport struct {
+	mu      sync.Mutex
+	sent    []string
+	started chan struct{}
+	quit    chan struct{}
+}
+
+func (transport *testTransport) Name() string { return "test" }
+
+func (transport *testTransport) Init(botName string, cfg *config.Loader, logger *logrus.Logger,
+	eventDispatcher *events.EventDispatcher) error {
+	return nil
+}
+
+func (transport *testTransport) Run() {
+	close(transport.started)
+	<-transport.quit
+}
+
+func (transport *testTransport) Shutdown(ctx context.Context) error {
+	close(transport.quit)
+	return nil
+}
+
+func (transport *testTransport) NickIsMe(nick string) bool        { return nick == "papaBot" }
+func (transport *testTransport) GetChannelsOn() []string          { return []string{"#test"} }
+func (transport *testTransport) GetNicks(channel string) []string { return []string{} }
+
+func (transport *testTransport) send(channel, message string) {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	transport.sent = append(transport.sent, channel+": "+message)
+}
+
+func (transport *testTransport) SendMessage(sourceEvent *events.EventMessage, message string) {
+	transport.send(sourceEvent.Channel, message)
+}
+
+func (transport *testTransport) SendPrivateMessage(sourceEvent *events.EventMessage, nick, message string) {
+	transport.send(nick, message)
+}
+
+func (transport *testTransport) SendNotice(sourceEvent *events.EventMessage, message string) {
+	transport.send(sourceEvent.Channel, message)
+}
+
+func (transport *testTransport) SendMassNotice(message string) {
+	transport.send("*", message)
+}
+
+// count returns the number of sent messages containing the text.
+func (transport *testTransport) count(text string) int {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	count := 0
+	for _, sent := range transport.sent {
+		if strings.Contains(sent, text) {
+			count++
+		}
+	}
+	return count
+}
+
+// redirectTransport sends all HTTP requests to the test server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (redirect redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = redirect.target.Scheme
+	req.URL.Host = redirect.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// testServer serves fake responses for the bundled extensions and HTML pages for all other paths.
+func testServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/ticker/":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"last": "100.0", "open": 90.0, "high": "110.0", "low": "80.0"}`)
+		case r.URL.Path == "/search/":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status": "ok", "data": [{"uid": 1}]}`)
+		case strings.HasPrefix(r.URL.Path, "/feed/"):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status": "ok", "data": {"aqi": 20, "city": {"name": "Test"}, "iaqi": {"pm10": {"v": 10}}}}`)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintf(w, `<html><head><title>Page %s</title><meta name="description" content="About %s">`+
+				`</head></html>`, r.URL.Path, r.URL.Path)
+		}
+	}))
+}
+
+// newTestBot creates a bot with a temporary database that already has an owner.
+func newTestBot(t *testing.T, transport *testTransport) *papaBot.Bot {
+	return newTestBotWithConfig(t, transport, "")
+}
+
+// newTestBotWithConfig creates a test bot with more sections added to the test config.
+func newTestBotWithConfig(t *testing.T, transport *testTransport, extraConfig string) *papaBot.Bot {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	configPath := filepath.Join(dir, "config.ini")
+	content := fmt.Sprintf(testConfig, dbPath) + extraConfig
+	if err := ioutil.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatalf("Can't write config: %s", err)
+	}
+
+	// Create the owner, so that the bot doesn't ask for one.
+	store, err := storage.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Can't open the database: %s", err)
+	}
+	pending, err := store.PendingMigrations(store.BuiltinMigrations())
+	if err != nil {
+		t.Fatalf("Can't list migrations: %s", err)
+	}
+	for _, migration := range pending {
+		if err := store.ApplyMigration(migration); err != nil {
+			t.Fatalf("Can't apply migration %s: %s", migration.Name, err)
+		}
+	}
+	if err := store.AddUser(storage.User{Nick: "owner", Password: utils.HashPassword("secret")}); err != nil {
+		t.Fatalf("Can't add owner: %s", err)
+	}
+	if err := store.AssignRole(storage.RoleAssignment{Nick: "owner", Role: "owner"}); err != nil {
+		t.Fatalf("Can't make the owner: %s", err)
+	}
+	store.Close()
+
+	err, bot := papaBot.New(configPath, filepath.Join("example", "texts.ini"))
+	if err != nil {
+		t.Fatalf("Can't create bot: %s", err)
+	}
+	if err := bot.RegisterTransport(transport); err != nil {
+		t.Fatalf("Can't register transport: %s", err)
+	}
+	return bot
+}
+
+// runTestBot starts the bot and returns a function stopping it.
+func runTestBot(t *testing.T, bot *papaBot.Bot, transport *testTransport) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- bot.Run(ctx)
+	}()
+	select {
+	case <-transport.started:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Bot didn't start.")
+	}
+	return func() {
+		cancel()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Fatalf("Bot didn't stop cleanly: %s", err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("Bot didn't stop.")
+		}
+	}
+}
+
+// message builds an event from the test transport.
+func message(code events.EventCode, nick, channel, text string, atBot bool) events.EventMessage {
+	return events.EventMessage{
+		TransportName: "test", TransportFormatting: events.FormatPlain, EventCode: code,
+		Nick: nick, UserId: nick + "-id", Channel: channel, Message: text, AtBot: atBot,
+	}
+}
+
+// TestConcurrentEvents fires chat messages, commands, ticks and API calls at the bot from many goroutines at once.
+// Run with -race to check the shared state.
+func TestConcurrentEvents(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	bot.HTTPClient.Transport = redirectTransport{target}
+	lastSpoken := &extensions.ExtensionLastSpoken{}
+	for _, ext := range []interface{ Init(*papaBot.Bot) error }{
+		lastSpoken,
+		&extensions.ExtensionAqicn{},
+		&extensions.ExtensionBtc{},
+		&extensions.ExtensionDuplicates{},
+		&extensions.ExtensionCounters{},
+		&extensions.ExtensionReminders{},
+		&extensions.ExtensionTwitterThread{},
+	} {
+		bot.RegisterExtension(ext)
+	}
+
+	stop := runTestBot(t, bot, transport)
+
+	bot.SetVar("aqicnToken", "token")
+	sharedLink := server.URL + "/shared"
+	var wg sync.WaitGroup
+	for i := 0; i < testWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nick := fmt.Sprintf("user%d", i)
+			channel := fmt.Sprintf("#chan%d", i%2)
+			trigger := bot.EventDispatcher.Trigger
+			trigger(message(events.EventPrivateMessage, nick, nick, "auth owner secret", true))
+			for j := 0; j < testRounds; j++ {
+				trigger(message(events.EventChatMessage, nick, "#test", "look: "+sharedLink, false))
+				trigger(message(events.EventChatMessage, nick, channel,
+					fmt.Sprintf("%s/page%d https://twitter.com/a/status/%d", server.URL, j, j), false))
+				trigger(message(events.EventChatMessage, nick, channel, ".more", false))
+				trigger(message(events.EventChatMessage, nick, channel, "papaBot: ls user1", true))
+				trigger(message(events.EventChatMessage, nick, channel, ".aq city", false))
+				trigger(message(events.EventChatMessage, nick, channel, "@papaBot btc", true))
+				trigger(message(events.EventChatMessage, nick, channel, ".tt", false))
+				trigger(message(events.EventChatMessage, nick, channel, ".help pub", false))
+				trigger(message(events.EventPrivateMessage, nick, nick, "var list", true))
+				trigger(message(events.EventPrivateMessage, nick, nick, "rm list", true))
+				trigger(message(events.EventPrivateMessage, nick, nick, "c list", true))
+				trigger(message(events.EventTick, "", "", "", true))
+				if j == 0 {
+					trigger(message(events.EventDailyTick, "", "", "", true))
+				}
+
+				bot.SetVar(fmt.Sprintf("var%d", i), fmt.Sprintf("%d", j))
+				bot.GetVar("var0")
+				bot.UserIsOwner(nick + "-id")
+				if j%2 == 0 {
+					bot.AddToIgnoreList(storage.Ignore{Mask: fmt.Sprintf("ignored%d", i)})
+					bot.DisableExtension("twitter_thread")
+				} else {
+					for _, ignore := range bot.IgnoreList() {
+						if ignore.Mask == fmt.Sprintf("ignored%d", i) {
+							bot.RemoveFromIgnoreList(ignore.Id)
+						}
+					}
+					bot.EnableExtension("twitter_thread")
+				}
+				bot.ExtensionNames()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Let the handlers finish and stop the bot.
+	stop()
+
+	if transport.count("Page /shared") == 0 {
+		t.Error("Shared link title was not announced.")
+	}
+	if len(lastSpoken.LastSpoken["test;#test"]) != testWorkers {
+		t.Errorf("Expected %d speakers on #test, got %v.", testWorkers, lastSpoken.LastSpoken["test;#test"])
+	}
+	for i := 0; i < testWorkers; i++ {
+		if value := bot.GetVar(fmt.Sprintf("var%d", i)); value != fmt.Sprint(testRounds-1) {
+			t.Errorf("Expected var%d to be %d, got '%s'.", i, testRounds-1, value)
+		}
+	}
+}
+
+// fakeIRCServer accepts one connection, welcomes the bot and then keeps telling it that its nick is taken. Closes
+// done when it stops.
+func fakeIRCServer(t *testing.T, done chan struct{}) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			close(done)
+			return
+		}
+		defer conn.Close()
+		go func() {
+			defer close(done)
+			fmt.Fprint(conn, ":server 001 papaBot :Welcome\r\n")
+			for i := 0; i < 20; i++ {
+				fmt.Fprint(conn, ":server 433 * papaBot :Nickname is already in use\r\n")
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+		io.Copy(ioutil.Discard, conn)
+	}()
+	return listener.Addr().String()
+}
+
+// fakeMattermostServer answers the calls the Mattermost transport makes when connecting, and says hello over the
+// websocket. Closes connected when the websocket is open.
+func fakeMattermostServer(connected chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/users/login":
+			w.Header().Set("Token", "token")
+			fmt.Fprint(w, `{"id": "bot-id", "username": "papabot", "first_name": "papaBot"}`)
+		case "/api/v4/teams/name/team":
+			fmt.Fprint(w, `{"id": "team-id", "name": "team"}`)
+		case "/api/v4/teams/team-id/channels/name/town-square":
+			fmt.Fprint(w, `{"id": "channel-id", "name": "town-square", "type": "O"}`)
+		case "/api/v4/websocket":
+			hash := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+			conn, buffer, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			hello := `{"event": "hello", "data": {}, "seq": 0}`
+			fmt.Fprintf(buffer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: %s\r\n\r\n\x81%c%s", base64.StdEncoding.EncodeToString(hash[:]), len(hello), hello)
+			buffer.Flush()
+			close(connected)
+			io.Copy(ioutil.Discard, buffer)
+		default:
+			fmt.Fprint(w, "{}")
+		}
+	}))
+}
+
+// TestTransportState connects the IRC and Mattermost transports to fake servers and uses their state from many
+// goroutines while they change it. Run with -race to check the shared state.
+func TestTransportState(t *testing.T) {
+	ircDone := make(chan struct{})
+	ircServer := fakeIRCServer(t, ircDone)
+	mattermostConnected := make(chan struct{})
+	mattermostServer := fakeMattermostServer(mattermostConnected)
+	defer mattermostServer.Close()
+
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBotWithConfig(t, transport, fmt.Sprintf(`
+[irc]
+enabled = true
+server = "%s"
+channels = []
+
+[mattermost]
+enabled = true
+server = "%s"
+websocket = "%s"
+channels = ["town-square"]
+`, ircServer, mattermostServer.URL, "ws"+strings.TrimPrefix(mattermostServer.URL, "http")))
+	stop := runTestBot(t, bot, transport)
+
+	var wg sync.WaitGroup
+	for i := 0; i < testWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Mentions of the bot check its IRC nick, work events make it type on Mattermost.
+				bot.EventDispatcher.Trigger(events.EventMessage{TransportName: "irc", EventCode: events.EventChatMessage,
+					Nick: "user", UserId: "user", Channel: "#test", Message: "papaBot:", AtBot: true})
+				bot.EventDispatcher.Trigger(events.EventMessage{TransportName: "mattermost",
+					EventCode: events.EventBotWorking, Channel: "town-square"})
+				select {
+				case <-ircDone:
+					select {
+					case <-mattermostConnected:
+						return
+					default:
+					}
+				default:
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	stop()
+}
@@ -0,0 +1,383 @@
+// Package config loads sections of the TOML configuration file into typed structs.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+Loader maps configuration keys onto struct fields using tags:
+
+	Server   string        `config:"server" default:"localhost:6667"`
+	Channels []string      `config:"channels" default:"#papabot,#other"`
+	Timeout  time.Duration `config:"timeout_seconds" default:"10" unit:"s"`
+	Hour     int           `config:"hour" default:"8" min:"0" max:"23"`
+
+Fields without the config tag are not touched. If a key is missing and there is no default, the field keeps its
+current value. Supported types are string, bool, all int and uint types, float64, time.Duration (a number
+multiplied by the unit, or a string like "1h30m"), logrus.Level and []string.
+
+Loader remembers which keys were read, so that it can report keys nobody asked for.
+*/
+type Loader struct {
+	tree *toml.Tree
+	// Guards used and ignored.
+	mu   sync.Mutex
+	used map[string]bool
+	// Sections that should not be reported as unknown, even if nothing was read from them.
+	ignored map[string]bool
+}
+
+// Errors is a list of all problems found while loading a section.
+type Errors []error
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var levelType = reflect.TypeOf(logrus.Level(0))
+
+// New creates a loader for the config tree.
+func New(tree *toml.Tree) *Loader {
+	return &Loader{tree: tree, used: map[string]bool{}, ignored: map[string]bool{}}
+}
+
+// LoadFile creates a loader for the config file.
+func LoadFile(path string) (*Loader, error) {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(tree), nil
+}
+
+// splitPath splits a section name into a path, respecting quoted parts, e.g. channels."irc;#chan".
+func splitPath(section string) []string {
+	path := []string{}
+	current := ""
+	quoted := false
+	for _, r := range section {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '.' && !quoted:
+			path = append(path, current)
+			current = ""
+		default:
+			current += string(r)
+		}
+	}
+	if current != "" {
+		path = append(path, current)
+	}
+	return path
+}
+
+// keyName builds the full name of a key, used in messages.
+func keyName(path []string) string {
+	return strings.Join(path, ".")
+}
+
+// HasSection checks whether the section exists in the config.
+func (loader *Loader) HasSection(section string) bool {
+	_, ok := loader.tree.GetPath(splitPath(section)).(*toml.Tree)
+	return ok
+}
+
+// Sections returns names of sub-sections of the section.
+func (loader *Loader) Sections(section string) []string {
+	tree := loader.tree
+	if section != "" {
+		sub, ok := loader.tree.GetPath(splitPath(section)).(*toml.Tree)
+		if !ok {
+			return []string{}
+		}
+		tree = sub
+	}
+	sections := []string{}
+	for _, key := range tree.Keys() {
+		if _, ok := tree.GetPath([]string{key}).(*toml.Tree); ok {
+			sections = append(sections, key)
+		}
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+// Ignore marks the section as known, so that its keys will not be reported by UnknownKeys.
+func (loader *Loader) Ignore(section string) {
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+	loader.ignored[keyName(splitPath(section))] = true
+}
+
+// Load fills the struct pointed to by target with values from the section.
+// All problems are returned together as Errors, each naming the full key.
+func (loader *Loader) Load(section string, target interface{}) error {
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return errors.New(fmt.Sprintf("config target for %s must be a pointer to a struct", section))
+	}
+	value = value.Elem()
+	sectionPath := splitPath(section)
+
+	errs := Errors{}
+	for i := 0; i < value.NumField(); i++ {
+		fieldDef := value.Type().Field(i)
+		key, ok := fieldDef.Tag.Lookup("config")
+		if !ok {
+			continue
+		}
+		path := append(append([]string{}, sectionPath...), key)
+		loader.mu.Lock()
+		loader.used[keyName(path)] = true
+		loader.mu.Unlock()
+		field := value.Field(i)
+		if !field.CanSet() {
+			errs = append(errs, errors.New(fmt.Sprintf("%s: field %s is not settable", keyName(path), fieldDef.Name)))
+			continue
+		}
+
+		var raw interface{}
+		if loader.tree.HasPath(path) {
+			raw = loader.tree.GetPath(path)
+		} else if def, hasDefault := fieldDef.Tag.Lookup("default"); hasDefault {
+			raw = def
+		} else {
+			continue
+		}
+		if err := setField(field, raw, fieldDef.Tag); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %s", keyName(path), err)))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// UnknownKeys returns all keys from the config that were never read and are not in ignored sections.
+func (loader *Loader) UnknownKeys() []string {
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+	unknown := []string{}
+	loader.collectUnknown(loader.tree, []string{}, &unknown)
+	sort.Strings(unknown)
+	return unknown
+}
+
+// collectUnknown walks the tree looking for unused keys.
+func (loader *Loader) collectUnknown(tree *toml.Tree, path []string, unknown *[]string) {
+	if loader.ignored[keyName(path)] {
+		return
+	}
+	for _, key := range tree.Keys() {
+		keyPath := append(append([]string{}, path...), key)
+		if sub, ok := tree.GetPath([]string{key}).(*toml.Tree); ok {
+			loader.collectUnknown(sub, keyPath, unknown)
+		} else if !loader.used[keyName(keyPath)] {
+			*unknown = append(*unknown, keyName(keyPath))
+		}
+	}
+}
+
+// setField converts the raw config value (or default string) and sets it on the field.
+func setField(field reflect.Value, raw interface{}, tag reflect.StructTag) error {
+	switch {
+	case field.Type() == durationType:
+		return setDuration(field, raw, tag.Get("unit"))
+	case field.Type() == levelType:
+		text, ok := raw.(string)
+		if !ok {
+			return errors.New(fmt.Sprintf("expected a log level name, got %s", describe(raw)))
+		}
+		level, err := logrus.ParseLevel(text)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(level))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		text, ok := raw.(string)
+		if !ok {
+			return errors.New(fmt.Sprintf("expected a string, got %s", describe(raw)))
+		}
+		field.SetString(text)
+	case reflect.Bool:
+		switch value := raw.(type) {
+		case bool:
+			field.SetBool(value)
+		case string:
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.New(fmt.Sprintf("expected true or false, got %s", describe(raw)))
+			}
+			field.SetBool(parsed)
+		default:
+			return errors.New(fmt.Sprintf("expected true or false, got %s", describe(raw)))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, err := toInt(raw)
+		if err != nil {
+			return err
+		}
+		if err := checkRange(float64(number), tag); err != nil {
+			return err
+		}
+		if field.OverflowInt(number) {
+			return errors.New(fmt.Sprintf("value %d is out of range", number))
+		}
+		field.SetInt(number)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, err := toInt(raw)
+		if err != nil {
+			return err
+		}
+		if number < 0 {
+			return errors.New(fmt.Sprintf("value %d can't be negative", number))
+		}
+		if err := checkRange(float64(number), tag); err != nil {
+			return err
+		}
+		if field.OverflowUint(uint64(number)) {
+			return errors.New(fmt.Sprintf("value %d is out of range", number))
+		}
+		field.SetUint(uint64(number))
+	case reflect.Float32, reflect.Float64:
+		var number float64
+		switch value := raw.(type) {
+		case float64:
+			number = value
+		case int64:
+			number = float64(value)
+		case string:
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("expected a number, got %s", describe(raw)))
+			}
+			number = parsed
+		default:
+			return errors.New(fmt.Sprintf("expected a number, got %s", describe(raw)))
+		}
+		if err := checkRange(number, tag); err != nil {
+			return err
+		}
+		field.SetFloat(number)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New(fmt.Sprintf("unsupported field type %s", field.Type()))
+		}
+		strs := []string{}
+		switch value := raw.(type) {
+		case []interface{}:
+			for i, elem := range value {
+				text, ok := elem.(string)
+				if !ok {
+					return errors.New(fmt.Sprintf("element %d: expected a string, got %s", i, describe(elem)))
+				}
+				strs = append(strs, text)
+			}
+		case []string:
+			strs = value
+		case string: // Default value, comma separated.
+			if value != "" {
+				strs = strings.Split(value, ",")
+			}
+		default:
+			return errors.New(fmt.Sprintf("expected a list of strings, got %s", describe(raw)))
+		}
+		field.Set(reflect.ValueOf(strs).Convert(field.Type()))
+	default:
+		return errors.New(fmt.Sprintf("unsupported field type %s", field.Type()))
+	}
+	return nil
+}
+
+// setDuration sets a duration field from a number of units or a duration string.
+func setDuration(field reflect.Value, raw interface{}, unit string) error {
+	if text, ok := raw.(string); ok {
+		if duration, err := time.ParseDuration(text); err == nil {
+			field.SetInt(int64(duration))
+			return nil
+		}
+	}
+	number, err := toInt(raw)
+	if err != nil {
+		return errors.New(fmt.Sprintf("expected a number or a duration like \"1h30m\", got %s", describe(raw)))
+	}
+	multiplier := time.Duration(1)
+	if unit != "" {
+		if multiplier, err = time.ParseDuration("1" + unit); err != nil {
+			return errors.New(fmt.Sprintf("invalid unit %q", unit))
+		}
+	}
+	field.SetInt(int64(time.Duration(number) * multiplier))
+	return nil
+}
+
+// toInt converts a raw value into an integer.
+func toInt(raw interface{}) (int64, error) {
+	switch value := raw.(type) {
+	case int64:
+		return value, nil
+	case string:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("expected an integer, got %s", describe(raw)))
+		}
+		return number, nil
+	}
+	return 0, errors.New(fmt.Sprintf("expected an integer, got %s", describe(raw)))
+}
+
+// checkRange validates the number against min and max tags.
+func checkRange(number float64, tag reflect.StructTag) error {
+	if min, ok := tag.Lookup("min"); ok {
+		if limit, err := strconv.ParseFloat(min, 64); err == nil && number < limit {
+			return errors.New(fmt.Sprintf("value %v is lower than %s", number, min))
+		}
+	}
+	if max, ok := tag.Lookup("max"); ok {
+		if limit, err := strconv.ParseFloat(max, 64); err == nil && number > limit {
+			return errors.New(fmt.Sprintf("value %v is higher than %s", number, max))
+		}
+	}
+	return nil
+}
+
+// describe names the type of a raw config value for error messages.
+func describe(raw interface{}) string {
+	switch value := raw.(type) {
+	case string:
+		return fmt.Sprintf("string %q", value)
+	case int64:
+		return fmt.Sprintf("integer %d", value)
+	case float64:
+		return fmt.Sprintf("number %v", value)
+	case bool:
+		return fmt.Sprintf("boolean %v", value)
+	case []interface{}:
+		return "a list"
+	case *toml.Tree:
+		return "a section"
+	}
+	return fmt.Sprintf("%T", raw)
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/sirupsen/logrus"
+)
+
+// Section with all supported field types.
+type testSettings struct {
+	Name     string        `config:"name" default:"papaBot"`
+	Enabled  bool          `config:"enabled" default:"true"`
+	Port     int           `config:"port" default:"6667" min:"1" max:"65535"`
+	Workers  uint          `config:"workers" default:"4"`
+	Ratio    float64       `config:"ratio" default:"0.5" min:"0" max:"1"`
+	Timeout  time.Duration `config:"timeout_seconds" default:"10" unit:"s"`
+	Interval time.Duration `config:"interval" default:"1h30m"`
+	Level    logrus.Level  `config:"log_level" default:"info"`
+	Channels []string      `config:"channels" default:"#papabot,#other"`
+	Nicks    []string      `config:"nicks" default:""`
+	Keep     string        `config:"keep"`
+	Untagged string
+}
+
+// newTestLoader creates a loader for the TOML text.
+func newTestLoader(t *testing.T, text string) *Loader {
+	tree, err := toml.Load(text)
+	if err != nil {
+		t.Fatalf("Can't parse config: %s", err)
+	}
+	return New(tree)
+}
+
+// TestLoad tests converting the values of all supported types, along with the defaults.
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		check  func(settings testSettings) bool
+	}{
+		{"defaults", "[bot]", func(s testSettings) bool {
+			return s.Name == "papaBot" && s.Enabled && s.Port == 6667 && s.Workers == 4 && s.Ratio == 0.5 &&
+				s.Level == logrus.InfoLevel && s.Keep == "kept" && s.Untagged == "kept"
+		}},
+		{"values", `[bot]
+name = "David"
+enabled = false
+port = 7000
+workers = 8
+ratio = 1
+log_level = "debug"
+keep = "changed"`, func(s testSettings) bool {
+			return s.Name == "David" && !s.Enabled && s.Port == 7000 && s.Workers == 8 && s.Ratio == 1 &&
+				s.Level == logrus.DebugLevel && s.Keep == "changed"
+		}},
+		{"strings converted", `[bot]
+enabled = "false"
+port = "7000"
+ratio = "0.25"`, func(s testSettings) bool {
+			return !s.Enabled && s.Port == 7000 && s.Ratio == 0.25
+		}},
+		{"default durations", "[bot]", func(s testSettings) bool {
+			return s.Timeout == 10*time.Second && s.Interval == 90*time.Minute
+		}},
+		{"durations in units", "[bot]\ntimeout_seconds = 30\ninterval = 60", func(s testSettings) bool {
+			return s.Timeout == 30*time.Second && s.Interval == 60
+		}},
+		{"durations with units", "[bot]\ntimeout_seconds = \"2m\"\ninterval = \"45s\"", func(s testSettings) bool {
+			return s.Timeout == 2*time.Minute && s.Interval == 45*time.Second
+		}},
+		{"default lists", "[bot]", func(s testSettings) bool {
+			return reflect.DeepEqual(s.Channels, []string{"#papabot", "#other"}) && len(s.Nicks) == 0
+		}},
+		{"lists", "[bot]\nchannels = [\"#go\"]\nnicks = [\"a\", \"b\"]", func(s testSettings) bool {
+			return reflect.DeepEqual(s.Channels, []string{"#go"}) && reflect.DeepEqual(s.Nicks, []string{"a", "b"})
+		}},
+	}
+	for _, test := range tests {
+		settings := testSettings{Keep: "kept", Untagged: "kept"}
+		if err := newTestLoader(t, test.config).Load("bot", &settings); err != nil {
+			t.Errorf("%s: can't load: %s", test.name, err)
+			continue
+		}
+		if !test.check(settings) {
+			t.Errorf("%s: unexpected settings: %+v", test.name, settings)
+		}
+	}
+}
+
+// TestLoadErrors tests that every problem is reported with the full key.
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errors []string
+	}{
+		{"below min", "[bot]\nport = 0", []string{"bot.port: value 0 is lower than 1"}},
+		{"above max", "[bot]\nport = 70000", []string{"bot.port: value 70000 is higher than 65535"}},
+		{"float above max", "[bot]\nratio = 1.5", []string{"bot.ratio: value 1.5 is higher than 1"}},
+		{"negative uint", "[bot]\nworkers = -1", []string{"bot.workers: value -1 can't be negative"}},
+		{"wrong type", "[bot]\nname = 5", []string{"bot.name: expected a string, got integer 5"}},
+		{"wrong bool", "[bot]\nenabled = \"maybe\"", []string{`bot.enabled: expected true or false, got string "maybe"`}},
+		{"wrong int", "[bot]\nport = \"many\"", []string{`bot.port: expected an integer, got string "many"`}},
+		{"wrong duration", "[bot]\ntimeout_seconds = \"soon\"",
+			[]string{`bot.timeout_seconds: expected a number or a duration like "1h30m", got string "soon"`}},
+		{"wrong level", "[bot]\nlog_level = 3", []string{"bot.log_level: expected a log level name, got integer 3"}},
+		{"wrong list element", "[bot]\nchannels = [1]",
+			[]string{"bot.channels: element 0: expected a string, got integer 1"}},
+		{"section instead of value", "[bot]\n[bot.name]\nfirst = \"a\"",
+			[]string{"bot.name: expected a string, got a section"}},
+		{"all problems", "[bot]\nport = 0\nname = true", []string{
+			"bot.name: expected a string, got boolean true", "bot.port: value 0 is lower than 1"}},
+	}
+	for _, test := range tests {
+		err := newTestLoader(t, test.config).Load("bot", &testSettings{})
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Errorf("%s: expected Errors, got: %v", test.name, err)
+			continue
+		}
+		if err.Error() != strings.Join(test.errors, "; ") {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if len(errs) != len(test.errors) {
+			t.Errorf("%s: expected %d errors, got %d", test.name, len(test.errors), len(errs))
+		}
+	}
+
+	if err := newTestLoader(t, "").Load("bot", testSettings{}); err == nil {
+		t.Error("Target that is not a pointer to a struct should be refused.")
+	}
+}
+
+// TestQuotedSections tests sections with dots in their names.
+func TestQuotedSections(t *testing.T) {
+	loader := newTestLoader(t, "[channels.\"irc;#papa.bot\"]\nname = \"quoted\"\n[channels.other]\nname = \"x\"")
+	settings := testSettings{}
+	if err := loader.Load(`channels."irc;#papa.bot"`, &settings); err != nil || settings.Name != "quoted" {
+		t.Errorf("Quoted section not loaded: %v, %+v", err, settings)
+	}
+	if !loader.HasSection(`channels."irc;#papa.bot"`) || loader.HasSection("channels.missing") {
+		t.Error("HasSection should find only existing sections.")
+	}
+	if sections := loader.Sections("channels"); !reflect.DeepEqual(sections, []string{"irc;#papa.bot", "other"}) {
+		t.Errorf("Unexpected sections: %v", sections)
+	}
+}
+
+// TestUnknownKeys tests reporting keys that nobody read.
+func TestUnknownKeys(t *testing.T) {
+	loader := newTestLoader(t, `[bot]
+name = "papaBot"
+nmae = "typo"
+[extra]
+key = 1
+[plugins.one]
+key = 2`)
+	if err := loader.Load("bot", &testSettings{}); err != nil {
+		t.Fatalf("Can't load: %s", err)
+	}
+	loader.Ignore("plugins")
+	if unknown := loader.UnknownKeys(); !reflect.DeepEqual(unknown, []string{"bot.nmae", "extra.key"}) {
+		t.Errorf("Unexpected unknown keys: %v", unknown)
+	}
+}
@@ -1,12 +1,27 @@
 package events
 
 // Events and dispatcher.
-//go:generate stringer -type=EventCode
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pawelszydlo/papa-bot/metrics"
 	"github.com/sirupsen/logrus"
 )
 
+// Dispatcher metrics.
+var (
+	eventsTriggered = metrics.NewCounterVec(
+		"papabot_events_triggered_total", "Events triggered, per event code.", "event")
+	listenerPanics = metrics.NewCounterVec(
+		"papabot_listener_panics_total", "Panics recovered in event listeners, per event code.", "event")
+)
+
 type EventCode int
 
 // Single event codes.
@@ -39,6 +54,10 @@ const (
 	EventBannedFromChannel
 	// Other channel operations.
 	EventChannelOps
+	// Someone disconnected from the server. Not tied to a channel.
+	EventUserQuit
+	// Someone changed their nick. Message holds the new nick.
+	EventNickChange
 
 	// Bot tick.
 	EventTick
@@ -46,6 +65,24 @@ const (
 	EventDailyTick
 )
 
+// Names of the event codes, used in logs and metrics.
+var eventCodeNames = map[EventCode]string{
+	EventChatMessage: "ChatMessage", EventChatNotice: "ChatNotice", EventPrivateMessage: "PrivateMessage",
+	EventURLFound: "URLFound", EventBotWorking: "BotWorking", EventBotDone: "BotDone", EventConnected: "Connected",
+	EventJoinedChannel: "JoinedChannel", EventReJoinedChannel: "ReJoinedChannel", EventPartChannel: "PartChannel",
+	EventKickedFromChannel: "KickedFromChannel", EventBannedFromChannel: "BannedFromChannel",
+	EventChannelOps: "ChannelOps", EventUserQuit: "UserQuit", EventNickChange: "NickChange", EventTick: "Tick",
+	EventDailyTick: "DailyTick",
+}
+
+// String returns the name of the event code.
+func (code EventCode) String() string {
+	if name, ok := eventCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventCode(%d)", int(code))
+}
+
 // Event code groups, for convenience.
 var EventsChannelActivity = []EventCode{
 	EventChannelOps, EventJoinedChannel, EventReJoinedChannel, EventPartChannel, EventKickedFromChannel,
@@ -61,6 +98,19 @@ const (
 	FormatMarkdown
 )
 
+// ParseFormatting returns the formatting with the given name: plain, irc or markdown. Empty name means plain.
+func ParseFormatting(name string) (Formatting, error) {
+	switch strings.ToLower(name) {
+	case "", "plain":
+		return FormatPlain, nil
+	case "irc":
+		return FormatIRC, nil
+	case "markdown":
+		return FormatMarkdown, nil
+	}
+	return FormatPlain, errors.New(fmt.Sprintf("unknown formatting '%s'", name))
+}
+
 // Message for the events channel.
 type EventMessage struct {
 	// Name of the transport that triggered the event.
@@ -75,8 +125,8 @@ type EventMessage struct {
 	Message      string
 	// Context for the message, will be passed back if any listener sends a message.
 	Context string
-	// Was the message directed at the bot? If yes, bot will check for commands.
-	// Message directed at the bot should be stripped of the prefixes like dot or bot's name.
+	// For chat messages, transports set it when the bot was mentioned and leave the text as it was written. The bot
+	// decides whether the message is a command.
 	// In case of join, part etc. this will indicate whether bot was the subject.
 	AtBot bool
 }
@@ -97,71 +147,387 @@ func (message *EventMessage) ChannelId() string {
 // Type for a valid event listener function.
 type EventListenerFunc func(message EventMessage)
 
+// Type for a listener that can consume the event. Returning true stops the event from reaching the listeners with
+// lower priority. Only synchronous listeners can consume events.
+type EventHandlerFunc func(message EventMessage) (consumed bool)
+
+// Type for a function deciding whether listeners of the owner should receive the event.
+type ListenerFilterFunc func(owner string, message EventMessage) bool
+
+// Type for a function deciding whether the event comes from an ignored person.
+type IgnoreFilterFunc func(message EventMessage) bool
+
+// Listener priorities, for convenience. Any int can be used.
+const (
+	PriorityHigh   = 100
+	PriorityNormal = 0
+	PriorityLow    = -100
+)
+
+// ListenerOptions control the order and the way a listener is run.
+type ListenerOptions struct {
+	// Listeners with higher priority get the event first. Listeners with the same priority get it in the order of
+	// registration.
+	Priority int
+	// Synchronous listeners are run in the goroutine calling TriggerSync and can consume the event. Asynchronous
+	// ones are handed to the worker pool. Events sent with Trigger are handled entirely by the worker pool.
+	Sync bool
+}
+
+// Listener registered with the dispatcher, along with the name of its owner (e.g. an extension).
+type registeredListener struct {
+	owner     string
+	eventCode EventCode
+	handler   EventHandlerFunc
+	options   ListenerOptions
+}
+
+// ListenerHandle is returned on registration and allows removing the listeners.
+type ListenerHandle struct {
+	dispatcher *EventDispatcher
+	listeners  []*registeredListener
+}
+
 // Event dispatcher.
 type EventDispatcher struct {
-	listeners map[EventCode][]EventListenerFunc
-	log       *logrus.Logger
-	// List of people whos events will be ignored, in the form of transport~nick.
-	blackList []string
+	// Counters for Stats, updated atomically. Kept first for 64-bit alignment.
+	processed, dropped, timedOut uint64
+	// Listeners per event, sorted by priority.
+	listeners map[EventCode][]*registeredListener
+	// Listeners of owners that were detached, per owner.
+	detached map[string]map[EventCode][]*registeredListener
+	// Owner that will be assigned to newly registered listeners.
+	owner string
+	// Guards listeners, detached, owner, filter and ignoreFilter.
+	listenersMu sync.RWMutex
+	// Filter for listeners that have an owner.
+	filter ListenerFilterFunc
+	log    *logrus.Logger
+	// Function telling whether events of a person are ignored.
+	ignoreFilter IgnoreFilterFunc
+	// Event handlers currently running.
+	inFlight sync.WaitGroup
+	// Set when the dispatcher no longer accepts events.
+	closed   bool
+	closedMu sync.RWMutex
+	// Worker pool settings and one queue per worker.
+	options PoolOptions
+	queues  []chan *job
+	// Counter for spreading events without a channel over the workers.
+	nextQueue uint32
 }
 
 // RegisterMultiListener will attach a listener to multiple events.
-func (dispatcher *EventDispatcher) RegisterMultiListener(eventCodes []EventCode, listener EventListenerFunc) {
+func (dispatcher *EventDispatcher) RegisterMultiListener(
+	eventCodes []EventCode, listener EventListenerFunc) *ListenerHandle {
+	handle := &ListenerHandle{dispatcher: dispatcher}
 	for _, eventCode := range eventCodes {
-		dispatcher.RegisterListener(eventCode, listener)
+		handle.listeners = append(handle.listeners, dispatcher.RegisterListener(eventCode, listener).listeners...)
 	}
+	return handle
 }
 
-// RegisterListener will register a listener to an event.
-func (dispatcher *EventDispatcher) RegisterListener(eventCode EventCode, listener EventListenerFunc) {
-	// RegisterExtension will register a new extension with the bot.
-	dispatcher.listeners[eventCode] = append(dispatcher.listeners[eventCode], listener)
-	dispatcher.log.Debugf("Added listener for event \"%s\": %v", eventCode, listener)
+// RegisterListener will register an asynchronous listener with normal priority to an event.
+func (dispatcher *EventDispatcher) RegisterListener(eventCode EventCode, listener EventListenerFunc) *ListenerHandle {
+	return dispatcher.RegisterHandler(eventCode, func(message EventMessage) bool {
+		listener(message)
+		return false
+	}, ListenerOptions{})
 }
 
-// Trigger will trigger an event.
-func (dispatcher *EventDispatcher) Trigger(eventMessage EventMessage) {
-	if dispatcher.isIgnored(eventMessage) {
-		dispatcher.log.Infof(
-			"Ignoring event %s from %s (%s)", eventMessage.EventCode, eventMessage.Nick, eventMessage.UserId)
+// RegisterHandler will register a listener to an event, with the given priority and way of running.
+func (dispatcher *EventDispatcher) RegisterHandler(
+	eventCode EventCode, handler EventHandlerFunc, options ListenerOptions) *ListenerHandle {
+	dispatcher.listenersMu.Lock()
+	defer dispatcher.listenersMu.Unlock()
+	registered := &registeredListener{dispatcher.owner, eventCode, handler, options}
+	if detached, ok := dispatcher.detached[dispatcher.owner]; ok {
+		detached[eventCode] = append(detached[eventCode], registered)
+	} else {
+		dispatcher.listeners[eventCode] = insertListener(dispatcher.listeners[eventCode], registered)
+	}
+	dispatcher.log.Debugf("Added listener for event \"%v\": %v (%+v)", eventCode, handler, options)
+	return &ListenerHandle{dispatcher, []*registeredListener{registered}}
+}
+
+// Unregister will remove the listeners. Calling it more than once is harmless.
+func (handle *ListenerHandle) Unregister() {
+	dispatcher := handle.dispatcher
+	dispatcher.listenersMu.Lock()
+	defer dispatcher.listenersMu.Unlock()
+	for _, registered := range handle.listeners {
+		eventCode := registered.eventCode
+		dispatcher.listeners[eventCode] = removeListener(dispatcher.listeners[eventCode], registered)
+		if detached, ok := dispatcher.detached[registered.owner]; ok {
+			detached[eventCode] = removeListener(detached[eventCode], registered)
+		}
+	}
+}
+
+// insertListener returns a copy of the list with the listener added after all listeners with the same or higher
+// priority. The list is copied, because the old one may be in use by Trigger.
+func insertListener(listeners []*registeredListener, registered *registeredListener) []*registeredListener {
+	position := sort.Search(len(listeners), func(i int) bool {
+		return listeners[i].options.Priority < registered.options.Priority
+	})
+	inserted := make([]*registeredListener, 0, len(listeners)+1)
+	inserted = append(inserted, listeners[:position]...)
+	inserted = append(inserted, registered)
+	return append(inserted, listeners[position:]...)
+}
+
+// removeListener returns a copy of the list without the listener.
+func removeListener(listeners []*registeredListener, registered *registeredListener) []*registeredListener {
+	kept := []*registeredListener{}
+	for _, existing := range listeners {
+		if existing != registered {
+			kept = append(kept, existing)
+		}
+	}
+	return kept
+}
+
+// WithOwner will run the register function and mark all listeners registered by it as belonging to the owner.
+// Listeners registered from other goroutines in the meantime will also be assigned to the owner.
+func (dispatcher *EventDispatcher) WithOwner(owner string, register func()) {
+	dispatcher.listenersMu.Lock()
+	previous := dispatcher.owner
+	dispatcher.owner = owner
+	dispatcher.listenersMu.Unlock()
+	defer func() {
+		dispatcher.listenersMu.Lock()
+		dispatcher.owner = previous
+		dispatcher.listenersMu.Unlock()
+	}()
+	register()
+}
+
+// Detach will remove all listeners of the owner, until Attach is called.
+func (dispatcher *EventDispatcher) Detach(owner string) {
+	dispatcher.listenersMu.Lock()
+	defer dispatcher.listenersMu.Unlock()
+	if _, ok := dispatcher.detached[owner]; ok {
 		return
 	}
-	for _, listener := range dispatcher.listeners[eventMessage.EventCode] {
-		go func(listener EventListenerFunc) {
-			// Catch errors.
-			defer func() {
-				if r := recover(); r != nil {
-					dispatcher.log.Errorf("FATAL ERROR in event handler for %v: %v", eventMessage.EventCode, r)
-				}
-			}()
-			listener(eventMessage)
-		}(listener)
+	detached := map[EventCode][]*registeredListener{}
+	for eventCode, listeners := range dispatcher.listeners {
+		kept := []*registeredListener{}
+		for _, registered := range listeners {
+			if registered.owner == owner {
+				detached[eventCode] = append(detached[eventCode], registered)
+			} else {
+				kept = append(kept, registered)
+			}
+		}
+		dispatcher.listeners[eventCode] = kept
 	}
+	dispatcher.detached[owner] = detached
 }
 
-// isIgnored will check whether the message comes from an ignored person.
-func (dispatcher *EventDispatcher) isIgnored(eventMessage EventMessage) bool {
-	if eventMessage.UserId == "" {
+// Attach will restore listeners of the owner removed with Detach.
+func (dispatcher *EventDispatcher) Attach(owner string) {
+	dispatcher.listenersMu.Lock()
+	defer dispatcher.listenersMu.Unlock()
+	for eventCode, listeners := range dispatcher.detached[owner] {
+		for _, registered := range listeners {
+			dispatcher.listeners[eventCode] = insertListener(dispatcher.listeners[eventCode], registered)
+		}
+	}
+	delete(dispatcher.detached, owner)
+}
+
+// Trigger will trigger an event. Listeners are run one after another by the worker responsible for the event's
+// channel, so it doesn't block the caller unless the queue is full.
+func (dispatcher *EventDispatcher) Trigger(eventMessage EventMessage) {
+	dispatcher.trigger(eventMessage, false)
+}
+
+// TriggerFromListener is Trigger for use inside listeners. The listener may be run by the very worker that would
+// drain the full queue, so instead of waiting for space the event is handled right away in the calling goroutine.
+func (dispatcher *EventDispatcher) TriggerFromListener(eventMessage EventMessage) {
+	dispatcher.trigger(eventMessage, true)
+}
+
+// trigger hands the event to the worker pool. Nested events are handled inline when the queue is full.
+func (dispatcher *EventDispatcher) trigger(eventMessage EventMessage, nested bool) {
+	dispatcher.closedMu.RLock()
+	listeners, filter, ok := dispatcher.prepare(eventMessage)
+	if ok {
+		dispatcher.inFlight.Add(1)
+	}
+	dispatcher.closedMu.RUnlock()
+	if ok {
+		dispatcher.enqueue(&job{eventMessage, listeners, filter}, nested)
+	}
+}
+
+// TriggerSync will trigger an event, running the synchronous listeners in the calling goroutine. Asynchronous
+// listeners are handed to the worker pool. It returns true if one of the synchronous listeners consumed the event.
+func (dispatcher *EventDispatcher) TriggerSync(eventMessage EventMessage) bool {
+	return dispatcher.triggerSync(eventMessage, false)
+}
+
+// TriggerSyncFromListener is TriggerSync for use inside listeners, see TriggerFromListener.
+func (dispatcher *EventDispatcher) TriggerSyncFromListener(eventMessage EventMessage) bool {
+	return dispatcher.triggerSync(eventMessage, true)
+}
+
+// triggerSync runs the synchronous listeners and hands the rest to the worker pool.
+func (dispatcher *EventDispatcher) triggerSync(eventMessage EventMessage, nested bool) bool {
+	dispatcher.closedMu.RLock()
+	listeners, filter, ok := dispatcher.prepare(eventMessage)
+	if ok {
+		dispatcher.inFlight.Add(1)
+	}
+	dispatcher.closedMu.RUnlock()
+	if !ok {
 		return false
 	}
-	for _, person := range dispatcher.blackList {
-		if person == eventMessage.UserId {
+	consumed := false
+	async := []*registeredListener{}
+	for _, registered := range listeners {
+		if !registered.options.Sync {
+			async = append(async, registered)
+			continue
+		}
+		if dispatcher.runFiltered(registered, eventMessage, filter) {
+			consumed = true
+			break
+		}
+	}
+	if len(async) > 0 {
+		dispatcher.enqueue(&job{eventMessage, async, filter}, nested)
+	} else {
+		dispatcher.inFlight.Done()
+	}
+	return consumed
+}
+
+// prepare checks whether the event should be dispatched and returns the listeners for it.
+// Must be called with closedMu held.
+func (dispatcher *EventDispatcher) prepare(eventMessage EventMessage) (
+	listeners []*registeredListener, filter ListenerFilterFunc, ok bool) {
+	eventsTriggered.Inc(eventMessage.EventCode.String())
+	if dispatcher.closed {
+		dispatcher.log.Debugf("Dispatcher closed, dropping event %v.", eventMessage.EventCode)
+		return nil, nil, false
+	}
+	dispatcher.listenersMu.RLock()
+	ignored := dispatcher.isIgnored(eventMessage)
+	listeners = dispatcher.listeners[eventMessage.EventCode]
+	filter = dispatcher.filter
+	dispatcher.listenersMu.RUnlock()
+	if ignored {
+		dispatcher.log.Infof(
+			"Ignoring event %v from %s (%s)", eventMessage.EventCode, eventMessage.Nick, eventMessage.UserId)
+		return nil, nil, false
+	}
+	return listeners, filter, true
+}
+
+// dispatch runs the listeners in the order of priority, until one of the synchronous ones consumes the event.
+func (dispatcher *EventDispatcher) dispatch(
+	eventMessage EventMessage, listeners []*registeredListener, filter ListenerFilterFunc) bool {
+	for _, registered := range listeners {
+		if dispatcher.runFiltered(registered, eventMessage, filter) && registered.options.Sync {
 			return true
 		}
 	}
 	return false
 }
 
-// SetBlackList sets the ignore list.
-func (dispatcher *EventDispatcher) SetBlackList(blackList []string) {
-	dispatcher.blackList = blackList
+// runFiltered runs the listener if the filter allows it, returning whether the event was consumed.
+func (dispatcher *EventDispatcher) runFiltered(
+	registered *registeredListener, eventMessage EventMessage, filter ListenerFilterFunc) bool {
+	if registered.owner != "" && filter != nil && !filter(registered.owner, eventMessage) {
+		return false
+	}
+	if dispatcher.runWithTimeout(registered, eventMessage) && registered.options.Sync {
+		dispatcher.log.Debugf("Event %v consumed by a listener of '%s'.", eventMessage.EventCode, registered.owner)
+		return true
+	}
+	return false
+}
+
+// run runs a single listener, catching its errors.
+func (dispatcher *EventDispatcher) run(registered *registeredListener, eventMessage EventMessage) (consumed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			dispatcher.log.Errorf("FATAL ERROR in event handler for %v: %v", eventMessage.EventCode, r)
+			listenerPanics.Inc(eventMessage.EventCode.String())
+			consumed = false
+		}
+	}()
+	return registered.handler(eventMessage)
+}
+
+// Close will make the dispatcher drop all further events. Handlers already running are not affected.
+func (dispatcher *EventDispatcher) Close() {
+	dispatcher.closedMu.Lock()
+	defer dispatcher.closedMu.Unlock()
+	dispatcher.closed = true
+}
+
+// Drain will wait for all running event handlers to finish, or for the context to be done.
+func (dispatcher *EventDispatcher) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		dispatcher.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isIgnored will check whether the message comes from an ignored person. Must be called with listenersMu held.
+func (dispatcher *EventDispatcher) isIgnored(eventMessage EventMessage) bool {
+	if eventMessage.UserId == "" || dispatcher.ignoreFilter == nil {
+		return false
+	}
+	return dispatcher.ignoreFilter(eventMessage)
+}
+
+// SetFilter sets the function deciding whether listeners of an owner should receive an event.
+func (dispatcher *EventDispatcher) SetFilter(filter ListenerFilterFunc) {
+	dispatcher.listenersMu.Lock()
+	defer dispatcher.listenersMu.Unlock()
+	dispatcher.filter = filter
+}
+
+// SetIgnoreFilter sets the function deciding whose events are ignored.
+func (dispatcher *EventDispatcher) SetIgnoreFilter(ignoreFilter IgnoreFilterFunc) {
+	dispatcher.listenersMu.Lock()
+	defer dispatcher.listenersMu.Unlock()
+	dispatcher.ignoreFilter = ignoreFilter
 }
 
-// New will create a new event dispatcher instance.
+// New will create a new event dispatcher instance with the default worker pool.
 func New(logger *logrus.Logger) *EventDispatcher {
+	return NewWithPool(logger, DefaultPoolOptions())
+}
+
+// NewWithPool will create a new event dispatcher instance and start its workers.
+func NewWithPool(logger *logrus.Logger, options PoolOptions) *EventDispatcher {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.QueueSize < 1 {
+		options.QueueSize = 1
+	}
 	dispatcher := &EventDispatcher{
-		listeners: map[EventCode][]EventListenerFunc{},
+		listeners: map[EventCode][]*registeredListener{},
+		detached:  map[string]map[EventCode][]*registeredListener{},
 		log:       logger,
+		options:   options,
+	}
+	for i := 0; i < options.Workers; i++ {
+		queue := make(chan *job, options.QueueSize)
+		dispatcher.queues = append(dispatcher.queues, queue)
+		go dispatcher.worker(queue)
 	}
 	return dispatcher
 }
@@ -0,0 +1,237 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestDispatcher creates a dispatcher with a silent logger and the default pool.
+func newTestDispatcher() *EventDispatcher {
+	return newTestPool(DefaultPoolOptions())
+}
+
+// recorder collects the names of the listeners that were run.
+type recorder struct {
+	mu  sync.Mutex
+	ran []string
+}
+
+func (rec *recorder) handler(name string, consume bool) EventHandlerFunc {
+	return func(message EventMessage) bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.ran = append(rec.ran, name)
+		return consume
+	}
+}
+
+func (rec *recorder) String() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return strings.Join(rec.ran, ",")
+}
+
+func TestSyncListenersRunInPriorityOrder(t *testing.T) {
+	dispatcher := newTestDispatcher()
+	rec := &recorder{}
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("normal1", false), ListenerOptions{Sync: true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("low", false), ListenerOptions{PriorityLow, true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("high", false), ListenerOptions{PriorityHigh, true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("normal2", false), ListenerOptions{Sync: true})
+
+	if dispatcher.TriggerSync(EventMessage{EventCode: EventURLFound}) {
+		t.Error("Event should not be consumed.")
+	}
+	if order := rec.String(); order != "high,normal1,normal2,low" {
+		t.Errorf("Unexpected order: %s", order)
+	}
+}
+
+func TestConsumedEventSkipsLowerPriorities(t *testing.T) {
+	dispatcher := newTestDispatcher()
+	rec := &recorder{}
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("high", false), ListenerOptions{PriorityHigh, true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("consumer", true), ListenerOptions{Sync: true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("low", false), ListenerOptions{PriorityLow, true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("async", false), ListenerOptions{Priority: PriorityLow})
+
+	if !dispatcher.TriggerSync(EventMessage{EventCode: EventURLFound}) {
+		t.Error("Event should be consumed.")
+	}
+	dispatcher.Drain(context.Background())
+	if order := rec.String(); order != "high,consumer" {
+		t.Errorf("Unexpected listeners run: %s", order)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	dispatcher := newTestDispatcher()
+	rec := &recorder{}
+	handle := dispatcher.RegisterMultiListener([]EventCode{EventChatMessage, EventTick}, func(message EventMessage) {
+		rec.handler("multi", false)(message)
+	})
+	dispatcher.RegisterListener(EventTick, func(message EventMessage) { rec.handler("other", false)(message) })
+
+	// Unregistering works for detached listeners too and can be repeated.
+	dispatcher.Detach("")
+	handle.Unregister()
+	dispatcher.Attach("")
+	handle.Unregister()
+
+	dispatcher.Trigger(EventMessage{EventCode: EventChatMessage})
+	dispatcher.Trigger(EventMessage{EventCode: EventTick})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dispatcher.Drain(ctx); err != nil {
+		t.Fatalf("Listeners didn't finish: %s", err)
+	}
+	if ran := rec.String(); ran != "other" {
+		t.Errorf("Unexpected listeners run: %s", ran)
+	}
+}
+
+func TestPanickingListener(t *testing.T) {
+	dispatcher := newTestDispatcher()
+	rec := &recorder{}
+	dispatcher.RegisterHandler(EventURLFound, func(message EventMessage) bool {
+		panic("boom")
+	}, ListenerOptions{PriorityHigh, true})
+	dispatcher.RegisterHandler(EventURLFound, rec.handler("next", false), ListenerOptions{Sync: true})
+
+	if dispatcher.TriggerSync(EventMessage{EventCode: EventURLFound}) {
+		t.Error("Panicking listener should not consume the event.")
+	}
+	if ran := rec.String(); ran != "next" {
+		t.Errorf("Unexpected listeners run: %s", ran)
+	}
+}
+
+// newTestPool creates a dispatcher with a silent logger and the given pool.
+func newTestPool(options PoolOptions) *EventDispatcher {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return NewWithPool(logger, options)
+}
+
+func TestPerChannelOrder(t *testing.T) {
+	dispatcher := newTestPool(PoolOptions{Workers: 4, QueueSize: 1000, QueueTimeout: time.Second})
+	var mu sync.Mutex
+	received := map[string][]string{}
+	dispatcher.RegisterListener(EventChatMessage, func(message EventMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[message.Channel] = append(received[message.Channel], message.Message)
+	})
+
+	expected := map[string][]string{}
+	for i := 0; i < 100; i++ {
+		for _, channel := range []string{"#a", "#b", "#c"} {
+			text := fmt.Sprint(i)
+			expected[channel] = append(expected[channel], text)
+			dispatcher.Trigger(EventMessage{EventCode: EventChatMessage, Channel: channel, Message: text})
+		}
+	}
+	dispatcher.Drain(context.Background())
+	for channel, texts := range expected {
+		if strings.Join(received[channel], ",") != strings.Join(texts, ",") {
+			t.Errorf("Messages on %s out of order: %v", channel, received[channel])
+		}
+	}
+	if stats := dispatcher.Stats(); stats.Processed != 300 || stats.Dropped != 0 || stats.QueueDepth != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestFullQueueDropsEvents(t *testing.T) {
+	dispatcher := newTestPool(PoolOptions{Workers: 1, QueueSize: 1})
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	dispatcher.RegisterListener(EventTick, func(message EventMessage) {
+		started <- struct{}{}
+		<-release
+	})
+
+	// First event is taken by the worker, second waits in the queue, third is dropped.
+	dispatcher.Trigger(EventMessage{EventCode: EventTick})
+	<-started
+	dispatcher.Trigger(EventMessage{EventCode: EventTick})
+	dispatcher.Trigger(EventMessage{EventCode: EventTick})
+	if stats := dispatcher.Stats(); stats.Dropped != 1 || stats.QueueDepth != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	close(release)
+	dispatcher.Drain(context.Background())
+	if stats := dispatcher.Stats(); stats.Processed != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestListenerTimeout(t *testing.T) {
+	dispatcher := newTestPool(PoolOptions{Workers: 1, QueueSize: 10, ListenerTimeout: 50 * time.Millisecond})
+	rec := &recorder{}
+	release := make(chan struct{})
+	dispatcher.RegisterHandler(EventTick, func(message EventMessage) bool {
+		<-release
+		return true
+	}, ListenerOptions{PriorityHigh, true})
+	dispatcher.RegisterHandler(EventTick, rec.handler("next", false), ListenerOptions{})
+
+	dispatcher.Trigger(EventMessage{EventCode: EventTick})
+	deadline := time.Now().Add(5 * time.Second)
+	for rec.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ran := rec.String(); ran != "next" {
+		t.Errorf("Worker should move on after the timeout, ran: %s", ran)
+	}
+	if stats := dispatcher.Stats(); stats.TimedOut != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	close(release)
+	dispatcher.Drain(context.Background())
+}
+
+func TestTriggerFromListener(t *testing.T) {
+	dispatcher := newTestPool(PoolOptions{Workers: 1, QueueSize: 1, QueueTimeout: 5 * time.Second})
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	done := make(chan struct{}, 10)
+	var elapsed time.Duration
+	dispatcher.RegisterListener(EventChatMessage, func(message EventMessage) {
+		if message.Message != "command" {
+			return
+		}
+		started <- struct{}{}
+		<-release
+		// The queue of this worker is full, so waiting for space would only time out.
+		start := time.Now()
+		dispatcher.TriggerFromListener(EventMessage{EventCode: EventBotDone, Channel: message.Channel})
+		dispatcher.TriggerSyncFromListener(EventMessage{EventCode: EventBotDone, Channel: message.Channel})
+		elapsed = time.Since(start)
+	})
+	dispatcher.RegisterListener(EventBotDone, func(message EventMessage) {
+		done <- struct{}{}
+	})
+
+	dispatcher.Trigger(EventMessage{EventCode: EventChatMessage, Channel: "#a", Message: "command"})
+	<-started
+	dispatcher.Trigger(EventMessage{EventCode: EventChatMessage, Channel: "#a", Message: "filler"})
+	if stats := dispatcher.Stats(); stats.QueueDepth != 1 {
+		t.Fatalf("Queue should be full: %+v", stats)
+	}
+	close(release)
+	dispatcher.Drain(context.Background())
+	if elapsed > time.Second {
+		t.Errorf("Nested triggers should not wait for the queue, took %s.", elapsed)
+	}
+	if stats := dispatcher.Stats(); len(done) != 2 || stats.Dropped != 0 || stats.Processed != 4 {
+		t.Errorf("Nested events should be handled, got %d: %+v", len(done), stats)
+	}
+}
@@ -0,0 +1,139 @@
+package events
+
+// Worker pool running the event listeners.
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// PoolOptions control the worker pool of the dispatcher.
+type PoolOptions struct {
+	// Number of workers. Events from one channel are always handled by the same worker, in order.
+	Workers int
+	// Number of events waiting for each worker.
+	QueueSize int
+	// How long Trigger waits for space in a full queue before dropping the event. Zero drops it right away.
+	QueueTimeout time.Duration
+	// How long a worker waits for a listener before moving on to the next one. Zero waits forever.
+	ListenerTimeout time.Duration
+}
+
+// DefaultPoolOptions returns the settings used by New.
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{Workers: 4, QueueSize: 100, QueueTimeout: 5 * time.Second, ListenerTimeout: 30 * time.Second}
+}
+
+// Stats describe the load of the dispatcher.
+type Stats struct {
+	Workers int
+	// Events waiting in all the queues, and per worker.
+	QueueDepth  int
+	QueueDepths []int
+	QueueSize   int
+	// Events handled by the workers, dropped because of full queues and listeners that ran over the timeout.
+	Processed, Dropped, TimedOut uint64
+}
+
+// Event waiting for a worker, with the listeners that should get it.
+type job struct {
+	eventMessage EventMessage
+	listeners    []*registeredListener
+	filter       ListenerFilterFunc
+}
+
+// worker handles the events from the queue, one at a time.
+func (dispatcher *EventDispatcher) worker(queue chan *job) {
+	for job := range queue {
+		dispatcher.runJob(job)
+	}
+}
+
+// runJob dispatches the event to the job's listeners and marks the job as done.
+func (dispatcher *EventDispatcher) runJob(job *job) {
+	dispatcher.dispatch(job.eventMessage, job.listeners, job.filter)
+	atomic.AddUint64(&dispatcher.processed, 1)
+	dispatcher.inFlight.Done()
+}
+
+// queueFor picks the queue of the worker responsible for the event's channel. Events without a channel are spread
+// over all the workers.
+func (dispatcher *EventDispatcher) queueFor(eventMessage EventMessage) chan *job {
+	if eventMessage.Channel == "" {
+		return dispatcher.queues[atomic.AddUint32(&dispatcher.nextQueue, 1)%uint32(len(dispatcher.queues))]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(eventMessage.ChannelId()))
+	return dispatcher.queues[hash.Sum32()%uint32(len(dispatcher.queues))]
+}
+
+// enqueue hands the job to a worker, waiting for space in the queue up to the queue timeout. Nested jobs, triggered
+// from inside listeners, don't wait: they are run by the caller when the queue is full. The job must already be
+// counted in inFlight.
+func (dispatcher *EventDispatcher) enqueue(job *job, nested bool) {
+	queue := dispatcher.queueFor(job.eventMessage)
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+	if nested {
+		dispatcher.runJob(job)
+		return
+	}
+	if dispatcher.options.QueueTimeout > 0 {
+		timer := time.NewTimer(dispatcher.options.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case queue <- job:
+			return
+		case <-timer.C:
+		}
+	}
+	atomic.AddUint64(&dispatcher.dropped, 1)
+	dispatcher.inFlight.Done()
+	dispatcher.log.Warningf("Event queue full, dropping event %v on %s.",
+		job.eventMessage.EventCode, job.eventMessage.ChannelId())
+}
+
+// runWithTimeout runs a single listener, giving up waiting for it after the listener timeout. A listener that timed
+// out keeps running in the background and cannot consume the event.
+func (dispatcher *EventDispatcher) runWithTimeout(registered *registeredListener, eventMessage EventMessage) bool {
+	if dispatcher.options.ListenerTimeout <= 0 {
+		return dispatcher.run(registered, eventMessage)
+	}
+	result := make(chan bool, 1)
+	dispatcher.inFlight.Add(1)
+	go func() {
+		defer dispatcher.inFlight.Done()
+		result <- dispatcher.run(registered, eventMessage)
+	}()
+	timer := time.NewTimer(dispatcher.options.ListenerTimeout)
+	defer timer.Stop()
+	select {
+	case consumed := <-result:
+		return consumed
+	case <-timer.C:
+		atomic.AddUint64(&dispatcher.timedOut, 1)
+		dispatcher.log.Warningf("Listener of '%s' for event %v is taking longer than %s, moving on.",
+			registered.owner, eventMessage.EventCode, dispatcher.options.ListenerTimeout)
+		return false
+	}
+}
+
+// Stats returns the current queue depths and counters.
+func (dispatcher *EventDispatcher) Stats() Stats {
+	stats := Stats{
+		Workers:   len(dispatcher.queues),
+		QueueSize: dispatcher.options.QueueSize,
+		Processed: atomic.LoadUint64(&dispatcher.processed),
+		Dropped:   atomic.LoadUint64(&dispatcher.dropped),
+		TimedOut:  atomic.LoadUint64(&dispatcher.timedOut),
+	}
+	for _, queue := range dispatcher.queues {
+		stats.QueueDepths = append(stats.QueueDepths, len(queue))
+		stats.QueueDepth += len(queue)
+	}
+	return stats
+}
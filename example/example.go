@@ -2,18 +2,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/pawelszydlo/papa-bot"
 	"github.com/pawelszydlo/papa-bot/events"
 	"github.com/pawelszydlo/papa-bot/extensions"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 var (
 	configFile = flag.String("c", "config.ini", "Path to TOML configuration file for the bot.")
 	textsFile  = flag.String("t", "texts.ini", "Path to TOML configuration file with the bot texts.")
+	dryRun     = flag.Bool("migrate-dry-run", false, "Print pending database migrations and exit.")
 )
 
 func init() {
@@ -33,12 +37,30 @@ func (ext *MyExtension) Init(bot *papaBot.Bot) error {
 	ext.startTime = time.Now()
 	// This is an example event listener registration. You can find a list of events in the "events" package.
 	bot.EventDispatcher.RegisterListener(events.EventTick, ext.TickListener)
+	// Use RegisterHandler for a listener with a priority, that runs synchronously and can consume the event. The
+	// returned handle can be used to unregister it.
+	bot.EventDispatcher.RegisterHandler(events.EventURLFound, func(message events.EventMessage) bool {
+		return false // Returning true would stop the title announcement for this link.
+	}, events.ListenerOptions{Priority: events.PriorityNormal, Sync: true})
 	// Register new command. See the struct for field descriptions.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"hello"},
-		false, false, false,
-		"", "Say hello!",
-		ext.commandHello})
+		CommandNames:    []string{"hello"},
+		HelpDescription: "Say hello!",
+		CommandFunc:     ext.commandHello,
+	})
+	// Commands with a spec get their arguments parsed and checked, and their help generated. Quoted text is one
+	// argument. This one takes "greet" or "greet all <text...>".
+	bot.RegisterCommand(&papaBot.BotCommand{
+		CommandNames:    []string{"greet"},
+		HelpDescription: "Greet someone.",
+		Spec: &papaBot.CommandSpec{
+			Subcommands: []*papaBot.Subcommand{
+				{Name: "all", Args: []papaBot.CommandArg{{Name: "text", Type: papaBot.ArgRest}},
+					HelpDescription: "Greet everyone.", Run: ext.commandGreetAll},
+			},
+			Run: ext.commandGreet,
+		},
+	})
 	return nil
 }
 
@@ -48,11 +70,32 @@ func (ext *MyExtension) TickListener(message events.EventMessage) {
 		fmt.Sprintf("I have been running for %.0f minutes now.", time.Since(ext.startTime).Minutes()))
 }
 
+// Name is optional. It is used to refer to the extension, e.g. when disabling it with ".ext disable myext".
+func (ext *MyExtension) Name() string {
+	return "myext"
+}
+
+// Shutdown is optional. It will be run when the bot stops.
+func (ext *MyExtension) Shutdown(bot *papaBot.Bot) error {
+	bot.Log.Infof("MyExtension was running for %s.", time.Since(ext.startTime))
+	return nil
+}
+
 // commandHello is a command for saying hello.
 func (ext *MyExtension) commandHello(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
 	bot.SendMessage(sourceEvent, "Hello!")
 }
 
+// commandGreetAll greets everyone on the channel.
+func (ext *MyExtension) commandGreetAll(bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Hello everyone, %s", args.String("text")))
+}
+
+// commandGreet is run when no subcommand was given.
+func (ext *MyExtension) commandGreet(bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Hello %s!", sourceEvent.Nick))
+}
+
 // Entry point
 func main() {
 	// This will create bot's structures. Feel free to modify what you need afterwards.
@@ -63,7 +106,7 @@ func main() {
 	}
 
 	// As an example, change the name.
-	bot.Config.Name = "David"
+	bot.Config().Name = "David"
 
 	// Add all built-in extensions.
 	extensions.RegisterBuiltinExtensions(bot)
@@ -71,6 +114,32 @@ func main() {
 	// Add your own custom extension.
 	bot.RegisterExtension(new(MyExtension))
 
-	// This will init the bot's mechanisms and run the bot's main loop.
-	bot.Run()
+	// Only show what would change in the database.
+	if *dryRun {
+		if err := bot.DryRunMigrations(os.Stdout); err != nil {
+			fmt.Printf("Can't check migrations: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Manage the database without running the bot, e.g. the first owner on a server without a terminal:
+	// echo "password" | papabot admin user add alice owner
+	if flag.Arg(0) == "admin" {
+		if err := bot.Admin(flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Stop the bot gracefully on interrupt or termination.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// This will init the bot's mechanisms and run the bot's main loop, until the context is done.
+	if err := bot.Run(ctx); err != nil {
+		fmt.Printf("Bot did not shut down cleanly: %s", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,188 @@
+package papaBot
+
+// Extension lifecycle handling.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// extensionName returns the name of the extension. If the extension doesn't provide one, it will be derived from
+// the type, e.g. ExtensionBtc becomes "btc".
+func extensionName(ext extension) string {
+	if namer, ok := ext.(extensionNamer); ok {
+		return namer.Name()
+	}
+	extType := reflect.TypeOf(ext)
+	for extType.Kind() == reflect.Ptr {
+		extType = extType.Elem()
+	}
+	return strings.ToLower(strings.TrimPrefix(extType.Name(), "Extension"))
+}
+
+// initExtension initializes the extension, marking all listeners and commands it registers as its own.
+func (bot *Bot) initExtension(ext *registeredExtension, enabled bool) error {
+	var err error
+	bot.setInitializingExtension(ext.name)
+	bot.EventDispatcher.WithOwner(ext.name, func() {
+		err = ext.Init(bot)
+	})
+	bot.setInitializingExtension("")
+	if err != nil {
+		return err
+	}
+	bot.extensionsMu.Lock()
+	defer bot.extensionsMu.Unlock()
+	ext.enabled = true
+	if !enabled {
+		bot.detachExtension(ext)
+		bot.Log.Infof("Extension %s is disabled.", ext.name)
+	}
+	return nil
+}
+
+// setInitializingExtension sets the extension that will own the commands registered from now on.
+func (bot *Bot) setInitializingExtension(name string) {
+	bot.commandsMu.Lock()
+	defer bot.commandsMu.Unlock()
+	bot.initializingExtension = name
+}
+
+// extensionList returns a copy of the list of registered extensions.
+func (bot *Bot) extensionList() []*registeredExtension {
+	bot.extensionsMu.RLock()
+	defer bot.extensionsMu.RUnlock()
+	return append([]*registeredExtension{}, bot.extensions...)
+}
+
+// shutdownExtensions lets the extensions clean up after themselves.
+func (bot *Bot) shutdownExtensions() {
+	for _, ext := range bot.extensionList() {
+		if shutdowner, ok := ext.extension.(extensionShutdowner); ok {
+			if err := shutdowner.Shutdown(bot); err != nil {
+				bot.Log.Warningf("Error shutting down extension %s: %s", ext.name, err)
+			}
+		}
+	}
+}
+
+// disabledExtensionNames returns the names of extensions disabled by the owner.
+func (bot *Bot) disabledExtensionNames() map[string]bool {
+	disabled := utils.SliceToMap(strings.Split(bot.GetVar("_disabledExtensions"), " "))
+	delete(disabled, "")
+	return disabled
+}
+
+// getExtension finds a registered extension by name. Must be called with extensionsMu held.
+func (bot *Bot) getExtension(name string) *registeredExtension {
+	for _, ext := range bot.extensions {
+		if ext.name == name {
+			return ext
+		}
+	}
+	return nil
+}
+
+// detachExtension removes extension's listeners and commands. Must be called with extensionsMu held.
+func (bot *Bot) detachExtension(ext *registeredExtension) {
+	bot.EventDispatcher.Detach(ext.name)
+	bot.commandsMu.Lock()
+	defer bot.commandsMu.Unlock()
+	commands := map[string]*BotCommand{}
+	for name, owner := range bot.commandOwners {
+		if owner == ext.name {
+			commands[name] = bot.commands[name]
+			delete(bot.commands, name)
+			delete(bot.commandOwners, name)
+		}
+	}
+	bot.disabledCommands[ext.name] = commands
+	ext.enabled = false
+}
+
+// attachExtension restores extension's listeners and commands. Must be called with extensionsMu held.
+func (bot *Bot) attachExtension(ext *registeredExtension) error {
+	bot.commandsMu.Lock()
+	for name := range bot.disabledCommands[ext.name] {
+		if _, exists := bot.commands[name]; exists {
+			bot.commandsMu.Unlock()
+			return errors.New(fmt.Sprintf("command '%s' is now taken by another extension", name))
+		}
+	}
+	for name, cmd := range bot.disabledCommands[ext.name] {
+		bot.commands[name] = cmd
+		bot.commandOwners[name] = ext.name
+	}
+	delete(bot.disabledCommands, ext.name)
+	bot.commandsMu.Unlock()
+	bot.EventDispatcher.Attach(ext.name)
+	ext.enabled = true
+	return nil
+}
+
+// saveDisabledExtensions persists the list of disabled extensions. Must be called with extensionsMu held.
+func (bot *Bot) saveDisabledExtensions() {
+	disabled := bot.disabledExtensionNames()
+	for _, ext := range bot.extensions {
+		if ext.enabled {
+			delete(disabled, ext.name)
+		} else {
+			disabled[ext.name] = true
+		}
+	}
+	names := utils.MapToSlice(disabled)
+	sort.Strings(names)
+	bot.SetVar("_disabledExtensions", strings.Join(names, " "))
+}
+
+// EnableExtension will attach a disabled extension back to the bot.
+func (bot *Bot) EnableExtension(name string) error {
+	bot.extensionsMu.Lock()
+	defer bot.extensionsMu.Unlock()
+	ext := bot.getExtension(name)
+	if ext == nil {
+		return errors.New(fmt.Sprintf("no extension named '%s'", name))
+	}
+	if ext.enabled {
+		return nil
+	}
+	if err := bot.attachExtension(ext); err != nil {
+		return err
+	}
+	bot.saveDisabledExtensions()
+	bot.Log.Infof("Extension %s enabled.", name)
+	return nil
+}
+
+// DisableExtension will detach extension's listeners and commands from the bot. The setting is persistent.
+func (bot *Bot) DisableExtension(name string) error {
+	bot.extensionsMu.Lock()
+	defer bot.extensionsMu.Unlock()
+	ext := bot.getExtension(name)
+	if ext == nil {
+		return errors.New(fmt.Sprintf("no extension named '%s'", name))
+	}
+	if !ext.enabled {
+		return nil
+	}
+	bot.detachExtension(ext)
+	bot.saveDisabledExtensions()
+	bot.Log.Infof("Extension %s disabled.", name)
+	return nil
+}
+
+// ExtensionNames returns names of all registered extensions, along with their state.
+func (bot *Bot) ExtensionNames() map[string]bool {
+	bot.extensionsMu.RLock()
+	defer bot.extensionsMu.RUnlock()
+	names := map[string]bool{}
+	for _, ext := range bot.extensions {
+		names[ext.name] = ext.enabled
+	}
+	return names
+}
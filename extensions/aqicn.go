@@ -7,6 +7,7 @@ import (
 	"github.com/pawelszydlo/papa-bot/events"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 /*
@@ -18,6 +19,11 @@ Used custom variables:
 type ExtensionAqicn struct {
 	bot         *papaBot.Bot
 	resultCache map[string]string
+	cacheMu     sync.Mutex
+}
+
+type extensionAqicnTexts struct {
+	NothingFound string
 }
 
 // Structs for Aqicn responses.
@@ -54,17 +60,26 @@ type aqiValue struct {
 // Init inits the extension.
 func (ext *ExtensionAqicn) Init(bot *papaBot.Bot) error {
 	ext.resultCache = map[string]string{}
+	if err := ext.Reload(bot); err != nil {
+		return err
+	}
 	// Register new command.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"aq"},
-		false, false, false,
-		"<station>", "Show air quality for <station>.",
-		ext.commandAqicn})
+		CommandNames:    []string{"aq"},
+		HelpParams:      "<station>",
+		HelpDescription: "Show air quality for <station>.",
+		CommandFunc:     ext.commandAqicn,
+	})
 	ext.bot = bot
 	bot.EventDispatcher.RegisterListener(events.EventTick, ext.TickListener)
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionAqicn) Reload(bot *papaBot.Bot) error {
+	return bot.LoadTexts("aqicn", &extensionAqicnTexts{})
+}
+
 //qualityIndex shows how the value qualifies.
 func (ext *ExtensionAqicn) qualityIndexLevel(stat string, value float64) int {
 	norms := map[string][]int{
@@ -104,6 +119,7 @@ func (ext *ExtensionAqicn) format(stat string, value float64) string {
 }
 
 // queryAqicn will query aqicn.org first for stations matching "city", then for results for those stations.
+// Returns an empty string if nothing was found.
 func (ext *ExtensionAqicn) queryAqicn(city, transport string) string {
 	token := ext.bot.GetVar("aqicnToken")
 	if token == "" {
@@ -112,7 +128,10 @@ func (ext *ExtensionAqicn) queryAqicn(city, transport string) string {
 
 	// Check if we have this cached.
 	cacheKey := transport + city
-	if cached, exists := ext.resultCache[cacheKey]; exists {
+	ext.cacheMu.Lock()
+	cached, exists := ext.resultCache[cacheKey]
+	ext.cacheMu.Unlock()
+	if exists {
 		return cached
 	}
 
@@ -135,7 +154,7 @@ func (ext *ExtensionAqicn) queryAqicn(city, transport string) string {
 
 	// Check response.
 	if len(searchResult.Data) == 0 {
-		return ext.bot.Texts.SearchNoResults
+		return ""
 	} else {
 		ext.bot.Log.Infof("Found %d stations for city '%s'.", len(searchResult.Data), city)
 	}
@@ -187,14 +206,18 @@ func (ext *ExtensionAqicn) queryAqicn(city, transport string) string {
 	} else {
 		finalResult = strings.Join(result, " | ")
 	}
+	ext.cacheMu.Lock()
 	ext.resultCache[cacheKey] = finalResult
+	ext.cacheMu.Unlock()
 	return finalResult
 }
 
 // TickListener will clear announce cache.
 func (ext *ExtensionAqicn) TickListener(message events.EventMessage) {
 	// Clear the announcement cache.
+	ext.cacheMu.Lock()
 	ext.resultCache = map[string]string{}
+	ext.cacheMu.Unlock()
 }
 
 // commandAqicn is a command for manually searching for movies.
@@ -204,6 +227,9 @@ func (ext *ExtensionAqicn) commandAqicn(bot *papaBot.Bot, sourceEvent *events.Ev
 	}
 	search := strings.Join(params, " ")
 	result := ext.queryAqicn(search, sourceEvent.TransportName)
+	if result == "" {
+		result = bot.LocalTexts(sourceEvent, "aqicn").(*extensionAqicnTexts).NothingFound
+	}
 
 	bot.SendMessage(sourceEvent, result)
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/pawelszydlo/papa-bot/utils"
 	"math"
 	"strconv"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -16,10 +17,10 @@ import (
 type ExtensionBtc struct {
 	HourlyData map[string]interface{}
 
-	LastAsk map[string]time.Time
-	Warned  map[string]bool
+	priceSeries []float64
+	// Guards HourlyData and priceSeries.
+	dataMu sync.Mutex
 
-	priceSeries          []float64
 	seriousChangePercent float64
 
 	Texts *extensionBtcTexts
@@ -27,6 +28,10 @@ type ExtensionBtc struct {
 	bot *papaBot.Bot
 }
 
+type extensionBtcSettings struct {
+	SeriousChangePercent float64 `config:"serious_change_percent" default:"5" min:"0"`
+}
+
 type extensionBtcTexts struct {
 	NothingHasChanged  string
 	NoData             string
@@ -38,25 +43,39 @@ type extensionBtcTexts struct {
 func (ext *ExtensionBtc) Init(bot *papaBot.Bot) error {
 	// Register new command.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"b", "btc", "k", "kierda"},
-		false, false, false,
-		"", "Show current BTC price.",
-		ext.commandBtc})
+		CommandNames:    []string{"b", "btc", "k", "kierda"},
+		HelpDescription: "Show current BTC price.",
+		CommandFunc:     ext.commandBtc,
+		// Answer only once per 5 minutes per channel.
+		Cooldown: &papaBot.Cooldown{
+			Period: 5 * time.Minute, Scope: papaBot.CooldownChannel, Warning: ext.cooldownWarning},
+	})
 	// Init variables.
-	ext.LastAsk = map[string]time.Time{}
-	ext.Warned = map[string]bool{}
-	ext.seriousChangePercent = 5
 	ext.priceSeries = make([]float64, 12, 12)
 	ext.bot = bot
+	if err := ext.Reload(bot); err != nil {
+		return err
+	}
+	// Attach to events.
+	bot.EventDispatcher.RegisterListener(events.EventTick, ext.TickListener)
+	bot.EventDispatcher.RegisterListener(events.EventDailyTick, ext.DailyTickListener)
+	return nil
+}
+
+// Reload loads the extension's settings and texts.
+func (ext *ExtensionBtc) Reload(bot *papaBot.Bot) error {
+	// Load settings.
+	settings := extensionBtcSettings{}
+	if err := bot.LoadConfig("btc", &settings); err != nil {
+		return err
+	}
+	ext.seriousChangePercent = settings.SeriousChangePercent
 	// Load texts.
 	texts := new(extensionBtcTexts)
 	if err := bot.LoadTexts("btc", texts); err != nil {
 		return err
 	}
 	ext.Texts = texts
-	// Attach to events.
-	bot.EventDispatcher.RegisterListener(events.EventTick, ext.TickListener)
-	bot.EventDispatcher.RegisterListener(events.EventDailyTick, ext.DailyTickListener)
 	return nil
 }
 
@@ -71,11 +90,15 @@ func (ext *ExtensionBtc) diffStr(diff float64) string {
 	return diffstr
 }
 
-func (ext *ExtensionBtc) simpleAnnounceMessage() string {
+// simpleAnnounceMessage describes the current price in the language of the event, or the default one if it's nil.
+func (ext *ExtensionBtc) simpleAnnounceMessage(sourceEvent *events.EventMessage) string {
+	texts := ext.bot.LocalTexts(sourceEvent, "btc").(*extensionBtcTexts)
+	ext.dataMu.Lock()
+	defer ext.dataMu.Unlock()
 	if ext.HourlyData == nil {
 		// No data yet received? This can happen only if bot didn't tick the extension!
 		ext.bot.Log.Error("BTC extension wasn't ticked before if was asked a price!")
-		return ext.Texts.NoData
+		return texts.NoData
 	}
 
 	price, _ := strconv.ParseFloat(ext.HourlyData["last"].(string), 64)
@@ -83,7 +106,7 @@ func (ext *ExtensionBtc) simpleAnnounceMessage() string {
 	high, _ := strconv.ParseFloat(ext.HourlyData["high"].(string), 64)
 	low, _ := strconv.ParseFloat(ext.HourlyData["low"].(string), 64)
 
-	return utils.Format(ext.Texts.TempBtcNotice, map[string]string{
+	return utils.Format(texts.TempBtcNotice, map[string]string{
 		"price": fmt.Sprintf("$%.0f", price),
 		"diff":  ext.diffStr(diff),
 		"low":   fmt.Sprintf("$%.0f", low),
@@ -91,9 +114,14 @@ func (ext *ExtensionBtc) simpleAnnounceMessage() string {
 	})
 }
 
+// cooldownWarning tells the user that the price was just given.
+func (ext *ExtensionBtc) cooldownWarning(sourceEvent *events.EventMessage) string {
+	return ext.bot.LocalTexts(sourceEvent, "btc").(*extensionBtcTexts).NothingHasChanged
+}
+
 // DailyTickListener announce the price.
 func (ext *ExtensionBtc) DailyTickListener(message events.EventMessage) {
-	ext.bot.SendMassNotice(ext.simpleAnnounceMessage())
+	ext.bot.SendMassNotice(ext.simpleAnnounceMessage(nil))
 }
 
 // TickListener will monitor BTC price and warn if anything serious happens.
@@ -112,6 +140,8 @@ func (ext *ExtensionBtc) TickListener(message events.EventMessage) {
 		return
 	}
 	data := raw_data.(map[string]interface{})
+	ext.dataMu.Lock()
+	defer ext.dataMu.Unlock()
 	ext.HourlyData = data
 
 	// Get current price.
@@ -169,18 +199,5 @@ func (ext *ExtensionBtc) TickListener(message events.EventMessage) {
 }
 
 func (ext *ExtensionBtc) commandBtc(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
-	// Answer only once per 5 minutes per channel.
-	if time.Since(ext.LastAsk[sourceEvent.ChannelId()]) > 5*time.Minute {
-		ext.LastAsk[sourceEvent.ChannelId()] = time.Now()
-		ext.Warned[sourceEvent.ChannelId()] = false
-		bot.SendNotice(sourceEvent, ext.simpleAnnounceMessage())
-
-	} else {
-		// Only warn once.
-		if !ext.Warned[sourceEvent.ChannelId()] {
-			bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, ext.Texts.NothingHasChanged))
-			ext.Warned[sourceEvent.ChannelId()] = true
-		}
-	}
-
+	bot.SendNotice(sourceEvent, ext.simpleAnnounceMessage(sourceEvent))
 }
@@ -4,17 +4,29 @@ import (
 	"fmt"
 	"github.com/pawelszydlo/papa-bot"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/utils"
 	"math"
+	"net/http"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
+// Permissions of the counters.
+const (
+	// Use the counters and delete own ones.
+	PermCounters = "counters"
+	// Delete counters of other people.
+	PermCountersManage = "counters.manage"
+)
+
 // ExtensionCounters - enables the creation of custom counters.
 type ExtensionCounters struct {
 	counters map[int]*extensionCountersCounter
+	mu       sync.Mutex
 	bot      *papaBot.Bot
 }
 
@@ -29,8 +41,8 @@ type extensionCountersCounter struct {
 	nextTick  time.Time
 }
 
-// message will produce an announcement message for the counter.
-func (cs *extensionCountersCounter) message(ext *ExtensionCounters) string {
+// message will produce an announcement message for the counter, in the language of the channel.
+func (cs *extensionCountersCounter) message(ext *ExtensionCounters, sourceEvent *events.EventMessage) string {
 	diff := time.Since(cs.date)
 	days := int(math.Abs(diff.Hours())) / 24
 	hours := int(math.Abs(diff.Hours())) - days*24
@@ -39,7 +51,7 @@ func (cs *extensionCountersCounter) message(ext *ExtensionCounters) string {
 		"days":    fmt.Sprintf("%d", days),
 		"hours":   fmt.Sprintf("%d", hours),
 		"minutes": fmt.Sprintf("%d", minutes),
-		"since":   ext.bot.Humanizer.TimeDiffNow(cs.date, false),
+		"since":   ext.bot.LocalHumanizer(sourceEvent).TimeDiffNow(cs.date, false),
 	}
 	return utils.Format(cs.textTmp, vars)
 }
@@ -47,31 +59,37 @@ func (cs *extensionCountersCounter) message(ext *ExtensionCounters) string {
 // Init initializes the extension.
 func (ext *ExtensionCounters) Init(bot *papaBot.Bot) error {
 	ext.bot = bot
-	// Create database table to hold the counters.
-	query := `
-		-- Main URLs table.
-		CREATE TABLE IF NOT EXISTS "counters" (
-			"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
-			"transport" VARCHAR NOT NULL,
-			"channel" VARCHAR NOT NULL,
-			"creator" VARCHAR NOT NULL,
-			"announce_text" VARCHAR NOT NULL,
-			"interval" INTEGER NOT NULL,
-			"target_date" VARCHAR NOT NULL,
-			"created" DATETIME DEFAULT (datetime('now','localtime')),
-			FOREIGN KEY(creator) REFERENCES users(nick)
-		);`
-	if _, err := bot.Db.Exec(query); err != nil {
-		bot.Log.Panic(err)
-	}
-
+	bot.RegisterPermission(PermCounters, "Add counters and delete own ones.")
+	bot.RegisterPermission(PermCountersManage, "Delete counters of other people.")
 	// Add commands for handling the counters.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"c", "counter"},
-		true, false, true,
-		"help / list / announce <id> / del <id> / add <date> <time> <interval> <channel> <text>",
-		"Controls custom counters.",
-		ext.commandCounters})
+		CommandNames:    []string{"c", "counter"},
+		Private:         true,
+		Permission:      PermCounters,
+		HelpDescription: "Controls custom counters.",
+		Spec: &papaBot.CommandSpec{Subcommands: []*papaBot.Subcommand{
+			{Name: "help", HelpDescription: "Explains how to add counters.", Run: ext.commandCountersHelp},
+			{Name: "list", HelpDescription: "Lists the counters.", Run: ext.commandCountersList},
+			{Name: "announce", Args: []papaBot.CommandArg{{Name: "id", Type: papaBot.ArgInt}},
+				HelpDescription: "Announces the counter now.", Run: ext.commandCountersAnnounce},
+			{Name: "del", Args: []papaBot.CommandArg{{Name: "id", Type: papaBot.ArgInt}},
+				HelpDescription: "Deletes the counter.", Run: ext.commandCountersDel},
+			{Name: "add", Args: []papaBot.CommandArg{
+				{Name: "date", Type: papaBot.ArgDate},
+				{Name: "interval", Type: papaBot.ArgInt},
+				{Name: "channel", Type: papaBot.ArgChannel},
+				{Name: "text", Type: papaBot.ArgRest},
+			}, HelpDescription: "Adds a counter.", Run: ext.commandCountersAdd},
+		},
+			Run: ext.commandCountersHelp,
+			Details: "Counters are announced on the channel every <interval> hours. The text may contain placeholders: " +
+				"{{ .days }}, {{ .hours }}, {{ .minutes }}, {{ .since }}",
+			Examples: []string{`c add 2030-01-01 00:00 24 #general "{{ .days }} days to the new year"`},
+		},
+	})
+
+	// Expose the counters in the admin API.
+	bot.RegisterAPIHandler("counters", ext.apiCounters)
 
 	// Load counters from the db.
 	ext.loadCounters()
@@ -85,60 +103,69 @@ func (ext *ExtensionCounters) Init(bot *papaBot.Bot) error {
 // TickListener will announce all the counters if needed.
 func (ext *ExtensionCounters) TickListener(message events.EventMessage) {
 	// Check if it's time to announce the counter.
+	due := []*extensionCountersCounter{}
+	ext.mu.Lock()
 	for id, c := range ext.counters {
 		if time.Since(c.nextTick) > 0 {
-			sourceEvent := &events.EventMessage{
-				c.transport,
-				events.FormatPlain,
-				events.EventChannelOps,
-				ext.bot.Config.Name,
-				"",
-				c.channel,
-				"",
-				message.Context,
-				false,
-			}
-			ext.bot.SendNotice(sourceEvent, c.message(ext))
+			due = append(due, c)
 			c.nextTick = c.nextTick.Add(c.interval * time.Hour)
 			ext.bot.Log.Debugf("Counter %d, next tick: %s", id, c.nextTick)
 		}
 	}
+	ext.mu.Unlock()
+	for _, c := range due {
+		sourceEvent := &events.EventMessage{
+			c.transport,
+			events.FormatPlain,
+			events.EventChannelOps,
+			ext.bot.Config().Name,
+			"",
+			c.channel,
+			"",
+			message.Context,
+			false,
+		}
+		ext.bot.SendNotice(sourceEvent, c.message(ext, sourceEvent))
+	}
+}
+
+// getCounter returns the loaded counter with the given id, or nil.
+func (ext *ExtensionCounters) getCounter(id int) *extensionCountersCounter {
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	return ext.counters[id]
 }
 
 // loadCounters will load the counters from the database.
 func (ext *ExtensionCounters) loadCounters() {
-	ext.counters = map[int]*extensionCountersCounter{}
+	loaded := map[int]*extensionCountersCounter{}
+	defer func() {
+		ext.mu.Lock()
+		ext.counters = loaded
+		ext.mu.Unlock()
+	}()
 
-	result, err := ext.bot.Db.Query(
-		`SELECT id, channel, transport, creator, announce_text, interval, target_date FROM counters`)
+	counters, err := ext.bot.Storage.Counters()
 	if err != nil {
 		ext.bot.Log.Warningf("Error while loading counters: %s", err)
 		return
 	}
-	defer result.Close()
 
-	// Get vars.
-	for result.Next() {
-		var c extensionCountersCounter
-		var dateStr string
-		var id int
-		var interval int
-		if err = result.Scan(&id, &c.channel, &c.transport, &c.creator, &c.text, &interval, &dateStr); err != nil {
-			ext.bot.Log.Warningf("Can't load counter: %s", err)
-			continue
+	for _, counter := range counters {
+		id := int(counter.Id)
+		c := extensionCountersCounter{
+			transport: counter.Transport,
+			channel:   counter.Channel,
+			creator:   counter.Creator,
+			text:      counter.Text,
+			interval:  time.Duration(counter.Interval),
+			date:      counter.Date,
 		}
-		c.interval = time.Duration(interval)
 		// Parse the text template.
 		c.textTmp, err = template.New(fmt.Sprintf("counter_%d", id)).Parse(c.text)
 		if err != nil {
 			ext.bot.Log.Warningf("Can't parse counter template '%s': %s", c.text, err)
 		}
-		// Handle the date.
-		c.date, err = time.Parse("2006-01-02 15:04:05", dateStr)
-		if err != nil {
-			ext.bot.Log.Fatalf("Can't parse counter date %s: %s", dateStr, err)
-		}
-		c.date = utils.MustForceLocalTimezone(c.date)
 		// Calculate next tick. Start from next daily tick and move backwards.
 		nextTick := ext.bot.NextDailyTick()
 		for {
@@ -150,121 +177,206 @@ func (ext *ExtensionCounters) loadCounters() {
 		}
 		ext.bot.Log.Debugf("Counter %d, next tick: %s", id, c.nextTick)
 
-		ext.counters[id] = &c
+		loaded[id] = &c
 	}
 }
 
-// commandCounters is a command for handling the counters.
-func (ext *ExtensionCounters) commandCounters(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
-
-	if len(params) < 1 {
+// commandCountersList lists the counters.
+func (ext *ExtensionCounters) commandCountersList(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	lines := []string{}
+	ext.mu.Lock()
+	for id, c := range ext.counters {
+		lines = append(lines, fmt.Sprintf(
+			"%d: %s (%s) | %s | interval %dh | %s", id, c.channel, c.transport, c.date, c.interval, c.text))
+	}
+	ext.mu.Unlock()
+	if len(lines) == 0 {
+		bot.SendMessage(sourceEvent, "No counters yet.")
 		return
 	}
-	command := params[0]
+	bot.SendMessage(sourceEvent, "Counters:")
+	for _, line := range lines {
+		bot.SendMessage(sourceEvent, line)
+	}
+}
 
-	// List.
-	if command == "list" {
-		if len(ext.counters) > 0 {
-			bot.SendMessage(sourceEvent, "Counters:")
-			for id, c := range ext.counters {
-				bot.SendMessage(sourceEvent, fmt.Sprintf(
-					"%d: %s (%s) | %s | interval %dh | %s", id, c.channel, c.transport, c.date, c.interval, c.text))
-			}
-		} else {
-			bot.SendMessage(sourceEvent, "No counters yet.")
-		}
+// commandCountersHelp explains how to add counters.
+func (ext *ExtensionCounters) commandCountersHelp(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	bot.SendMessage(sourceEvent, "To add a new counter:")
+	bot.SendMessage(sourceEvent, "add <date> <time> <interval> <channel> <text>")
+	bot.SendMessage(
+		sourceEvent, `Where: date in format 'YYYY-MM-DD', time in format 'HH:MM:SS', interval is annouce`+
+			` interval in hours, channel is the name of the channel to announce on (on this transport),`+
+			`text is the announcement text.`)
+	bot.SendMessage(
+		sourceEvent,
+		"Announcement text may contain placeholders: {{ .days }}, {{ .hours }}, {{ .minutes }}, {{ .since }}")
+}
+
+// commandCountersAnnounce announces the counter right away.
+func (ext *ExtensionCounters) commandCountersAnnounce(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	id := args.Int("id")
+	counter := ext.getCounter(id)
+	if counter == nil {
+		bot.SendMessage(sourceEvent, "Wrong id.")
 		return
 	}
+	bot.SendMessage(sourceEvent,
+		fmt.Sprintf("Announcing counter %d to %s...", id, counter.channel))
+	fakeEvent := &events.EventMessage{
+		counter.transport,
+		events.FormatPlain,
+		events.EventChannelOps,
+		ext.bot.Config().Name,
+		"",
+		counter.channel,
+		"",
+		sourceEvent.Context,
+		false,
+	}
+	bot.SendMessage(fakeEvent, counter.message(ext, fakeEvent))
+}
 
-	if command == "help" {
-		bot.SendMessage(sourceEvent, "To add a new counter:")
-		bot.SendMessage(sourceEvent, "add <date> <time> <interval> <channel> <text>")
-		bot.SendMessage(
-			sourceEvent, `Where: date in format 'YYYY-MM-DD', time in format 'HH:MM:SS', interval is annouce`+
-				` interval in hours, channel is the name of the channel to announce on (on this transport),`+
-				`text is the announcement text.`)
-		bot.SendMessage(
-			sourceEvent,
-			"Announcement text may contain placeholders: {{ .days }}, {{ .hours }}, {{ .minutes }}, {{ .since }}")
+// commandCountersDel deletes a counter.
+func (ext *ExtensionCounters) commandCountersDel(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	id := args.Int("id")
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Deleting counter number %d...", id))
+	// Managers can delete all counters, others only their own.
+	manager := bot.UserCan(sourceEvent, PermCountersManage)
+	creator := ""
+	if !manager {
+		creator = bot.GetAuthenticatedNick(sourceEvent.UserId)
+	}
+	deleted, err := bot.Storage.DeleteCounter(int64(id), creator)
+	if err != nil {
+		bot.Log.Warningf("Error while deleting a counter: %s", err)
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
 		return
 	}
-
-	// Force announce.
-	if len(params) == 2 && command == "announce" {
-		id, err := strconv.Atoi(params[1])
-		if err != nil || ext.counters[id] == nil {
-			bot.SendMessage(sourceEvent, "Wrong id.")
-			return
-		}
-		bot.SendMessage(sourceEvent,
-			fmt.Sprintf("Announcing counter %d to %s...", id, ext.counters[id].channel))
-		fakeEvent := &events.EventMessage{
-			ext.counters[id].transport,
-			events.FormatPlain,
-			events.EventChannelOps,
-			ext.bot.Config.Name,
-			"",
-			ext.counters[id].channel,
-			"",
-			sourceEvent.Context,
-			false,
+	if !deleted {
+		bot.SendMessage(sourceEvent, "No such counter, or it's not yours.")
+		return
+	}
+	if manager {
+		ext.mu.Lock()
+		owner := ""
+		if counter, exists := ext.counters[id]; exists {
+			owner = counter.creator
 		}
-		bot.SendMessage(fakeEvent, ext.counters[id].message(ext))
+		ext.mu.Unlock()
+		bot.Audit(sourceEvent, "counter.delete", fmt.Sprintf("counter %d", id), "created by "+owner)
 	}
+	// Reload  counters.
+	ext.loadCounters()
+}
 
-	// Delete.
-	if len(params) == 2 && command == "del" {
-		id := params[1]
-		bot.SendMessage(sourceEvent, fmt.Sprintf("Deleting counter number %s...", id))
-		query := ""
-		// Bot owner can delete all counters.
-		if bot.UserIsOwner(sourceEvent.UserId) {
-			query = `DELETE FROM counters WHERE id=?;`
-		} else {
-			// User must be an admin, he can delete only his own counters.
-			nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
-			query = fmt.Sprintf(`DELETE FROM counters WHERE id=? AND creator="%s";`, nick)
-		}
-		if _, err := bot.Db.Exec(query, id); err != nil {
-			bot.Log.Warningf("Error while deleting a counter: %s", err)
-			bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
-			return
-		}
-		// Reload  counters.
-		ext.loadCounters()
+// commandCountersAdd adds a counter.
+func (ext *ExtensionCounters) commandCountersAdd(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	if args.Int("interval") < 1 {
+		bot.SendMessage(sourceEvent, "Interval parameter must be a positive number of hours.")
+		return
+	}
+	nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	// Add counter to database.
+	if err := bot.Storage.AddCounter(storage.Counter{
+		Transport: sourceEvent.TransportName,
+		Channel:   args.String("channel"),
+		Creator:   nick,
+		Text:      args.String("text"),
+		Interval:  args.Int("interval"),
+		Date:      args.Time("date"),
+	}); err != nil {
+		bot.Log.Warningf("Error while adding a counter: %s", err)
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
 		return
 	}
+	bot.SendMessage(sourceEvent, "Counter created.")
+	// Reload  counters.
+	ext.loadCounters()
+}
 
-	// Add.
-	if len(params) > 5 && command == "add" {
-		// Sanity check parameters.
-		if _, err := time.Parse("2006-01-0215:04:05", params[1]+params[2]); err != nil {
-			bot.SendMessage(sourceEvent, "Date and time must be in format: 2015-12-31 12:54:00")
-			return
-		}
-		dateStr := params[1] + " " + params[2]
-		interval, err := strconv.ParseInt(params[3], 10, 32)
-		if err != nil {
-			bot.SendMessage(sourceEvent, "Interval parameter must be a number of hours.")
-			return
-		}
-		channel := params[4]
+// Counter as shown by the admin API.
+type extensionCountersAPICounter struct {
+	Id        int    `json:"id"`
+	Transport string `json:"transport"`
+	Channel   string `json:"channel"`
+	Creator   string `json:"creator"`
+	Text      string `json:"text"`
+	Interval  int    `json:"interval"`
+	Date      string `json:"date"`
+}
 
-		text := strings.Join(params[5:], " ")
-		nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
-		// Add counter to database.
-		query := `
-			INSERT INTO counters (channel, transport, creator, announce_text, interval, target_date)
-			VALUES (?, ?, ?, ?, ?, ?);
-			`
-		if _, err := bot.Db.Exec(query, channel, sourceEvent.TransportName, nick, text, interval, dateStr); err != nil {
-			bot.Log.Warningf("Error while adding a counter: %s", err)
-			bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
-			return
+// apiCounters lists, adds and deletes counters through the admin API.
+func (ext *ExtensionCounters) apiCounters(bot *papaBot.Bot, r *http.Request, path []string) (interface{}, error) {
+	if len(path) == 0 || path[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			result := []extensionCountersAPICounter{}
+			ext.mu.Lock()
+			for id, c := range ext.counters {
+				result = append(result, extensionCountersAPICounter{
+					id, c.transport, c.channel, c.creator, c.text, int(c.interval), c.date.Format("2006-01-02 15:04:05")})
+			}
+			ext.mu.Unlock()
+			sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+			return result, nil
+		case http.MethodPost:
+			request := struct {
+				Transport, Channel, Creator, Text, Date string
+				Interval                                int
+			}{}
+			if err := papaBot.DecodeAPIRequest(r, &request); err != nil {
+				return nil, err
+			}
+			if _, ok := bot.Transports[request.Transport]; !ok {
+				return nil, papaBot.NewAPIError(http.StatusBadRequest, "no transport named '%s'", request.Transport)
+			}
+			if request.Channel == "" || request.Text == "" || request.Interval < 1 {
+				return nil, papaBot.NewAPIError(
+					http.StatusBadRequest, "channel and text can't be empty and interval must be positive")
+			}
+			date, err := time.ParseInLocation("2006-01-02 15:04:05", request.Date, time.Local)
+			if err != nil {
+				return nil, papaBot.NewAPIError(http.StatusBadRequest, "date must be in format: 2015-12-31 12:54:00")
+			}
+			if err := bot.Storage.AddCounter(storage.Counter{
+				Transport: request.Transport,
+				Channel:   request.Channel,
+				Creator:   request.Creator,
+				Text:      request.Text,
+				Interval:  request.Interval,
+				Date:      date,
+			}); err != nil {
+				return nil, err
+			}
+			ext.loadCounters()
+			return nil, nil
+		default:
+			return nil, papaBot.ErrAPIMethodNotAllowed
 		}
-		bot.SendMessage(sourceEvent, "Counter created.")
-		// Reload  counters.
-		ext.loadCounters()
-		return
 	}
+	if len(path) != 1 {
+		return nil, papaBot.ErrAPINotFound
+	}
+	if r.Method != http.MethodDelete {
+		return nil, papaBot.ErrAPIMethodNotAllowed
+	}
+	id, err := strconv.ParseInt(path[0], 10, 64)
+	if err != nil {
+		return nil, papaBot.NewAPIError(http.StatusBadRequest, "id must be a number")
+	}
+	deleted, err := bot.Storage.DeleteCounter(id, "")
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, papaBot.ErrAPINotFound
+	}
+	ext.loadCounters()
+	return nil, nil
 }
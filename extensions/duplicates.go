@@ -5,6 +5,7 @@ import (
 	"github.com/pawelszydlo/papa-bot"
 	"github.com/pawelszydlo/papa-bot/events"
 	"github.com/pawelszydlo/papa-bot/utils"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -13,6 +14,7 @@ import (
 type ExtensionDuplicates struct {
 	Texts     *extensionDuplicatesTexts
 	announced map[string]time.Time
+	mu        sync.Mutex
 	bot       *papaBot.Bot
 }
 
@@ -25,72 +27,76 @@ type extensionDuplicatesTexts struct {
 
 // Init inits the extension.
 func (ext *ExtensionDuplicates) Init(bot *papaBot.Bot) error {
-	texts := new(extensionDuplicatesTexts) // Can't load directly because of reflection issues.
-	if err := bot.LoadTexts("duplicates", texts); err != nil {
+	if err := ext.Reload(bot); err != nil {
 		return err
 	}
-	ext.Texts = texts
 	ext.announced = map[string]time.Time{}
 	ext.bot = bot
 	bot.EventDispatcher.RegisterListener(events.EventURLFound, ext.ProcessURLListener)
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionDuplicates) Reload(bot *papaBot.Bot) error {
+	texts := new(extensionDuplicatesTexts) // Can't load directly because of reflection issues.
+	if err := bot.LoadTexts("duplicates", texts); err != nil {
+		return err
+	}
+	ext.Texts = texts
+	return nil
+}
+
 // checkForDuplicates checks for duplicates of the url in the database.
 func (ext *ExtensionDuplicates) ProcessURLListener(message events.EventMessage) {
-	// TODO: make this query prettier.
-	result, err := ext.bot.Db.Query(`
-		SELECT IFNULL(nick, ""), IFNULL(timestamp, datetime('now')), (
-			SELECT count(*) FROM urls WHERE link=? AND channel=? AND transport=?
-		)
-		FROM urls WHERE link=? AND channel=? AND transport=?
-		ORDER BY timestamp DESC LIMIT 1,1`,
-		message.Message, message.Channel, message.TransportName,
-		message.Message, message.Channel, message.TransportName,
-	)
+	count, previous, err := ext.bot.Storage.URLHistory(message.TransportName, message.Channel, message.Message)
 	if err != nil {
 		ext.bot.Log.Warningf("Can't query the database for duplicates: %s", err)
 		return
 	}
-	defer result.Close()
 
-	// Because bot already recorded this occurrence, we are interested in the one before, hence LIMIT 1,1.
-	if result.Next() {
-		var nick string
-		var timestr string
-		var count uint
-		if err = result.Scan(&nick, &timestr, &count); err != nil {
-			ext.bot.Log.Warningf("Error getting duplicates: %s", err)
-			return
-		}
-		timestamp, _ := time.Parse("2006-01-02 15:04:05", timestr)
-		elapsed := ext.bot.Humanizer.TimeDiffNow(utils.MustForceLocalTimezone(timestamp), false)
+	// Because bot already recorded this occurrence, we are interested in the one before.
+	if previous != nil {
+		texts := ext.bot.LocalTexts(&message, "duplicates").(*extensionDuplicatesTexts)
+		nick := previous.Nick
+		elapsed := ext.bot.LocalHumanizer(&message).TimeDiffNow(previous.Timestamp, false)
 		duplicate := ""
 		// Only one duplicate.
 		if count == 2 {
-			if ext.bot.AreSamePeople(nick, message.Nick) {
-				nick = ext.Texts.DuplicateYou
+			if ext.bot.AreSamePeople(message.TransportName, nick, message.Nick) {
+				nick = texts.DuplicateYou
 			}
-			duplicate = utils.Format(ext.Texts.TempDuplicateFirst, map[string]string{"nick": nick, "elapsed": elapsed})
+			duplicate = utils.Format(texts.TempDuplicateFirst, map[string]string{"nick": nick, "elapsed": elapsed})
 		} else if count > 2 { // More duplicates exist
-			if ext.bot.AreSamePeople(nick, message.Nick) {
-				nick = ext.Texts.DuplicateYou
+			if ext.bot.AreSamePeople(message.TransportName, nick, message.Nick) {
+				nick = texts.DuplicateYou
 			}
-			duplicate = utils.Format(ext.Texts.TempDuplicateMulti,
+			duplicate = utils.Format(texts.TempDuplicateMulti,
 				map[string]string{"nick": nick, "elapsed": elapsed, "count": fmt.Sprintf("%d", count-1)})
 		}
 		// Only announce once per 5 minutes per link.
-		if duplicate != "" && time.Since(ext.announced[message.ChannelId()+message.Message]) > 5*time.Minute {
+		if duplicate != "" && ext.claimAnnouncement(message.ChannelId()+message.Message) {
 			ext.bot.SendNotice(&message, duplicate)
-			ext.announced[message.ChannelId()+message.Message] = time.Now()
 		}
 	}
 	return
 }
 
+// claimAnnouncement checks whether the duplicate can be announced and if so, marks it as announced now.
+func (ext *ExtensionDuplicates) claimAnnouncement(key string) bool {
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	if time.Since(ext.announced[key]) <= 5*time.Minute {
+		return false
+	}
+	ext.announced[key] = time.Now()
+	return true
+}
+
 // Tick will clean announces table once per day.
 func (ext *ExtensionDuplicates) Tick(bot *papaBot.Bot, daily bool) {
 	if daily {
+		ext.mu.Lock()
 		ext.announced = map[string]time.Time{}
+		ext.mu.Unlock()
 	}
 }
@@ -3,7 +3,8 @@ package extensions
 
 import "github.com/pawelszydlo/papa-bot"
 
-// All extensions need to fit papaBot.extension interface.
+// All extensions need to fit papaBot.extension interface. Optionally, they can also have Name() string,
+// Reload(bot *papaBot.Bot) error and Shutdown(bot *papaBot.Bot) error methods.
 
 // RegisterBuiltinExtensions will do exactly what you think it will do.
 func RegisterBuiltinExtensions(bot *papaBot.Bot) {
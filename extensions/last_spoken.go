@@ -6,14 +6,16 @@ import (
 	"github.com/pawelszydlo/papa-bot/events"
 	"github.com/pawelszydlo/papa-bot/utils"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
 // ExtensionLastSpoken tracks when a person has last spoken.
 type ExtensionLastSpoken struct {
-	LastAsk    map[string]map[string]time.Time
 	LastSpoken map[string]map[string]time.Time
+	// Guards LastSpoken.
+	mu sync.Mutex
 
 	Texts *ExtensionLastSpokenTexts
 	bot   *papaBot.Bot
@@ -28,19 +30,18 @@ type ExtensionLastSpokenTexts struct {
 func (ext *ExtensionLastSpoken) Init(bot *papaBot.Bot) error {
 	// Register new command.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"ls", "lastspoken"},
-		false, false, false,
-		"<nick>", "Show when the person was last seen speaking.",
-		ext.commandLastSpoken})
-	// Load texts.
-	texts := new(ExtensionLastSpokenTexts) // Can't load directly because of reflection issues.
-	if err := bot.LoadTexts("last_spoken", texts); err != nil {
+		CommandNames:    []string{"ls", "lastspoken"},
+		HelpParams:      "<nick>",
+		HelpDescription: "Show when the person was last seen speaking.",
+		CommandFunc:     ext.commandLastSpoken,
+		// Answer only once per 5 minutes per channel and nick.
+		Cooldown: &papaBot.Cooldown{Period: 5 * time.Minute, Scope: papaBot.CooldownChannel, PerParams: true, Silent: true},
+	})
+	if err := ext.Reload(bot); err != nil {
 		return err
 	}
-	ext.Texts = texts
 	ext.bot = bot
 	// Init first level maps.
-	ext.LastAsk = map[string]map[string]time.Time{}
 	ext.LastSpoken = map[string]map[string]time.Time{}
 	// Attach event handler.
 	bot.EventDispatcher.RegisterListener(events.EventChatMessage, ext.ChatListener)
@@ -53,6 +54,31 @@ func (ext *ExtensionLastSpoken) Init(bot *papaBot.Bot) error {
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionLastSpoken) Reload(bot *papaBot.Bot) error {
+	// Load texts.
+	texts := new(ExtensionLastSpokenTexts) // Can't load directly because of reflection issues.
+	if err := bot.LoadTexts("last_spoken", texts); err != nil {
+		return err
+	}
+	ext.Texts = texts
+	return nil
+}
+
+// Name of the extension.
+func (ext *ExtensionLastSpoken) Name() string {
+	return "last_spoken"
+}
+
+// Shutdown saves the last spoken data.
+func (ext *ExtensionLastSpoken) Shutdown(bot *papaBot.Bot) error {
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	ext.saveLastSpoken()
+	return nil
+}
+
+// saveLastSpoken stores the last spoken data in a custom variable. Must be called with mu held.
 func (ext *ExtensionLastSpoken) saveLastSpoken() {
 	jsonString, err := json.Marshal(ext.LastSpoken)
 	if err != nil {
@@ -65,6 +91,8 @@ func (ext *ExtensionLastSpoken) saveLastSpoken() {
 
 // ChatListener listens to chat messages and records who has spoken.
 func (ext *ExtensionLastSpoken) ChatListener(message events.EventMessage) {
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
 	// Make sure the channel map is initialized.
 	if ext.LastSpoken[message.ChannelId()] == nil {
 		ext.LastSpoken[message.ChannelId()] = map[string]time.Time{}
@@ -78,24 +106,23 @@ func (ext *ExtensionLastSpoken) commandLastSpoken(bot *papaBot.Bot, sourceEvent
 		return
 	}
 	nick := strings.Join(params, " ")
-	// Make sure the channel maps are initialized.
-	if ext.LastAsk[sourceEvent.ChannelId()] == nil {
-		ext.LastAsk[sourceEvent.ChannelId()] = map[string]time.Time{}
-	}
-	if ext.LastSpoken[sourceEvent.ChannelId()] == nil {
-		ext.LastSpoken[sourceEvent.ChannelId()] = map[string]time.Time{}
-	}
-	// Answer only once per 5 minutes per channel.
-	if time.Since(ext.LastAsk[sourceEvent.ChannelId()][nick]) > 5*time.Minute {
-		message := ext.Texts.NeverSpoken
-		ext.LastAsk[sourceEvent.ChannelId()][nick] = time.Now()
-		if !ext.LastSpoken[sourceEvent.ChannelId()][nick].IsZero() {
-			message = utils.Format(ext.Texts.TempLastSpoken, map[string]string{
-				"heard": ext.bot.Humanizer.TimeDiffNow(
-					utils.MustForceLocalTimezone(ext.LastSpoken[sourceEvent.ChannelId()][nick]), true),
-				"nick": nick,
-			})
+	// The person could have spoken under any of their linked nicks.
+	nicks := bot.LinkedNicks(sourceEvent.TransportName, nick)
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	heard := time.Time{}
+	for _, linkedNick := range nicks {
+		if spoken := ext.LastSpoken[sourceEvent.ChannelId()][linkedNick]; spoken.After(heard) {
+			heard = spoken
 		}
-		bot.SendMessage(sourceEvent, message)
 	}
+	texts := bot.LocalTexts(sourceEvent, "last_spoken").(*ExtensionLastSpokenTexts)
+	message := texts.NeverSpoken
+	if !heard.IsZero() {
+		message = utils.Format(texts.TempLastSpoken, map[string]string{
+			"heard": bot.LocalHumanizer(sourceEvent).TimeDiffNow(utils.MustForceLocalTimezone(heard), true),
+			"nick":  nick,
+		})
+	}
+	bot.SendMessage(sourceEvent, message)
 }
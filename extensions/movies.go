@@ -7,6 +7,7 @@ import (
 	"github.com/pawelszydlo/papa-bot/events"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 /* ExtensionMovies - finds movie titles in the messages and provides other movie related commands.
@@ -17,6 +18,7 @@ Used custom variables:
 
 type ExtensionMovies struct {
 	announced map[string]bool
+	mu        sync.Mutex
 	bot       *papaBot.Bot
 }
 
@@ -43,10 +45,11 @@ func (ext *ExtensionMovies) Init(bot *papaBot.Bot) error {
 
 	// Register new command.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"i", "imdb"},
-		false, false, false,
-		"<title>", "Get movie info for <title>.",
-		ext.commandMovie})
+		CommandNames:    []string{"i", "imdb"},
+		HelpParams:      "<title>",
+		HelpDescription: "Get movie info for <title>.",
+		CommandFunc:     ext.commandMovie,
+	})
 	ext.bot = bot
 	return nil
 }
@@ -78,12 +81,14 @@ func (ext *ExtensionMovies) commandMovie(bot *papaBot.Bot, sourceEvent *events.E
 	if len(params) < 1 {
 		return
 	}
-	title := strings.Join(params, " ")
+	title := strings.Replace(strings.Join(params, " "), `"`, "", -1)
 	// Announce each movie only once.
-	if ext.announced[sourceEvent.ChannelId()+title] {
+	ext.mu.Lock()
+	announced := ext.announced[sourceEvent.ChannelId()+title]
+	ext.mu.Unlock()
+	if announced {
 		return
 	}
-	title = strings.Replace(title, `"`, "", -1)
 	var data movieStruct
 	ext.searchOmdb(bot, title, &data)
 	if data.Error != "" {
@@ -99,5 +104,7 @@ func (ext *ExtensionMovies) commandMovie(bot *papaBot.Bot, sourceEvent *events.E
 	notice := fmt.Sprintf("%s (%s, %s) | %s | http://www.imdb.com/title/%s | %s",
 		data.Title, data.Genre, data.Year, data.ImdbRating, data.ImdbID, data.Plot)
 	bot.SendNotice(sourceEvent, notice)
+	ext.mu.Lock()
 	ext.announced[sourceEvent.ChannelId()+title] = true
+	ext.mu.Unlock()
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/pawelszydlo/papa-bot/utils"
 	"math/rand"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -26,6 +27,7 @@ Used custom variables:
 type ExtensionReddit struct {
 	announced     map[string]bool
 	announcedLive map[string]bool
+	mu            sync.Mutex
 	Texts         *extensionRedditTexts
 	bot           *papaBot.Bot
 }
@@ -66,10 +68,10 @@ func (postData *redditPostData) toStrings(ext *ExtensionReddit) map[string]strin
 	}
 	return map[string]string{
 		"id":           postData.Id,
-		"created":      ext.bot.Humanizer.TimeDiffNow(time.Unix(int64(postData.Created_utc), 0), false),
+		"created":      ext.bot.Humanizer().TimeDiffNow(time.Unix(int64(postData.Created_utc), 0), false),
 		"author":       postData.Author,
 		"subreddit":    postData.Subreddit,
-		"score":        ext.bot.Humanizer.SiPrefixFast(float64(postData.Score)),
+		"score":        ext.bot.Humanizer().SiPrefixFast(float64(postData.Score)),
 		"comments_url": "http://redd.it/" + postData.Id,
 		"comments":     fmt.Sprintf("%d", postData.Comments),
 		"title":        postData.Title,
@@ -189,19 +191,17 @@ func (ext *ExtensionReddit) Init(bot *papaBot.Bot) error {
 
 	// Add command for getting an interesting article.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"reddit", "r"},
-		false, false, false,
-		"", "Will try to find something interesting to read from Reddit.",
-		ext.commandReddit})
+		CommandNames:    []string{"reddit", "r"},
+		HelpDescription: "Will try to find something interesting to read from Reddit.",
+		CommandFunc:     ext.commandReddit,
+	})
 
-	// Load texts.
+	// Init variables and load texts.
 	ext.announced = map[string]bool{}
 	ext.announcedLive = map[string]bool{}
-	texts := &extensionRedditTexts{}
-	if err := bot.LoadTexts("reddit", texts); err != nil {
+	if err := ext.Reload(bot); err != nil {
 		return err
 	}
-	ext.Texts = texts
 	ext.bot = bot
 	bot.EventDispatcher.RegisterListener(events.EventTick, ext.TickListener)
 	bot.EventDispatcher.RegisterListener(events.EventDailyTick, ext.DailyTickListener)
@@ -209,10 +209,22 @@ func (ext *ExtensionReddit) Init(bot *papaBot.Bot) error {
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionReddit) Reload(bot *papaBot.Bot) error {
+	texts := &extensionRedditTexts{}
+	if err := bot.LoadTexts("reddit", texts); err != nil {
+		return err
+	}
+	ext.Texts = texts
+	return nil
+}
+
 // DailyTickListener will clear the announces table and give post of the day.
 func (ext *ExtensionReddit) DailyTickListener(message events.EventMessage) {
 	// Clear the announced list.
+	ext.mu.Lock()
 	ext.announced = map[string]bool{}
+	ext.mu.Unlock()
 	if ext.bot.GetVar("redditDaily") != "" {
 		post := ext.getRedditHot()
 		if post != nil {
@@ -228,10 +240,13 @@ func (ext *ExtensionReddit) TickListener(message events.EventMessage) {
 	if url == "" || title == "" {
 		return
 	}
-	if ext.announcedLive[url] {
+	ext.mu.Lock()
+	announced := ext.announcedLive[url]
+	ext.announcedLive[url] = true
+	ext.mu.Unlock()
+	if announced {
 		return
 	}
-	ext.announcedLive[url] = true
 	ext.bot.SendMassNotice(utils.Format(ext.Texts.TempRedditBreaking, map[string]string{"url": url, "title": title}))
 
 }
@@ -239,11 +254,14 @@ func (ext *ExtensionReddit) TickListener(message events.EventMessage) {
 // ProcessURLListener will try to check if link was ever on reddit.
 func (ext *ExtensionReddit) ProcessURLListener(message events.EventMessage) {
 	// Announce each link only once.
-	if ext.announced[message.ChannelId()+message.Message] {
+	ext.mu.Lock()
+	announced := ext.announced[message.ChannelId()+message.Message]
+	ext.announced[message.ChannelId()+message.Message] = true
+	ext.mu.Unlock()
+	if announced {
 		ext.bot.Log.Debugf("Not looking up on reddit, too soon.")
 		return
 	}
-	ext.announced[message.ChannelId()+message.Message] = true
 	// Send a notice with URL info.
 	go func() {
 		reddit := ext.getRedditInfo(message.Message, message.Channel, message.TransportFormatting)
@@ -4,16 +4,24 @@ import (
 	"fmt"
 	"github.com/pawelszydlo/papa-bot"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/utils"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
+// Permission to see and delete reminders of all channels.
+const PermRemindersManage = "reminders.manage"
+
 // ExtensionReminders - enables the creation of custom reminders.
 type ExtensionReminders struct {
 	reminders map[int]*extensionRemindersReminder
+	mu        sync.Mutex
 	bot       *papaBot.Bot
 	texts     *extensionRemindersTexts
 }
@@ -35,36 +43,33 @@ type extensionRemindersTexts struct {
 // Init initializes the extension.
 func (ext *ExtensionReminders) Init(bot *papaBot.Bot) error {
 	ext.bot = bot
-	// Create database table to hold the remainders.
-	query := `
-		CREATE TABLE IF NOT EXISTS "reminders" (
-			"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
-			"transport" VARCHAR NOT NULL,
-			"channel" VARCHAR NOT NULL,
-			"creator" VARCHAR NOT NULL,
-			"announce_text" VARCHAR NOT NULL,
-			"announced" INTEGER DEFAULT 0,
-			"target_time" VARCHAR NOT NULL,
-			"created_time" VARCHAR NOT NULL
-		);`
-	if _, err := bot.Db.Exec(query); err != nil {
-		bot.Log.Panic(err)
-	}
-
-	// Load texts.
-	texts := &extensionRemindersTexts{}
-	if err := bot.LoadTexts("reminders", texts); err != nil {
+	if err := ext.Reload(bot); err != nil {
 		return err
 	}
-	ext.texts = texts
 
+	bot.RegisterPermission(PermRemindersManage, "See and delete reminders of all channels.")
 	// Add commands for handling the counters.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"rm", "remind"},
-		false, false, false,
-		"help / list / del <id> / add <time to wait> <text>",
-		"Creates and manages reminders.",
-		ext.commandRemind})
+		CommandNames:    []string{"rm", "remind"},
+		HelpDescription: "Creates and manages reminders.",
+		Spec: &papaBot.CommandSpec{Subcommands: []*papaBot.Subcommand{
+			{Name: "help", HelpDescription: "Explains how to add reminders.", Run: ext.commandRemindHelp},
+			{Name: "list", HelpDescription: "Lists the reminders.", Run: ext.commandRemindList},
+			{Name: "del", Args: []papaBot.CommandArg{{Name: "id", Type: papaBot.ArgInt}},
+				HelpDescription: "Deletes the reminder.", Run: ext.commandRemindDel},
+			{Name: "add", Args: []papaBot.CommandArg{
+				{Name: "time to wait", Type: papaBot.ArgDuration},
+				{Name: "text", Type: papaBot.ArgRest},
+			}, HelpDescription: "Adds a reminder.", Run: ext.commandRemindAdd},
+		},
+			Run:      ext.commandRemindHelp,
+			Details:  `Time to wait is in format "X units", e.g. "5 days" or "2 years". Reminders are checked every 5 minutes.`,
+			Examples: []string{"rm add 2 hours check the oven", `rm add "1 day 6 hours" renew the domain`, "rm del 3"},
+		},
+	})
+
+	// Expose the reminders in the admin API.
+	bot.RegisterAPIHandler("reminders", ext.apiReminders)
 
 	// Load reminders from the db.
 	ext.loadReminders()
@@ -75,14 +80,19 @@ func (ext *ExtensionReminders) Init(bot *papaBot.Bot) error {
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionReminders) Reload(bot *papaBot.Bot) error {
+	// Load texts.
+	texts := &extensionRemindersTexts{}
+	if err := bot.LoadTexts("reminders", texts); err != nil {
+		return err
+	}
+	ext.texts = texts
+	return nil
+}
+
 // announce will announce the reminder.
-func (ext *ExtensionReminders) announce(id int) {
-	r := ext.reminders[id]
-	message := utils.Format(ext.texts.TempAnnounce, map[string]string{
-		"who":  r.creator,
-		"what": r.text,
-		"when": ext.bot.Humanizer.TimeDiffNow(r.createdTime, false),
-	})
+func (ext *ExtensionReminders) announce(id int, r *extensionRemindersReminder) {
 	sourceEvent := &events.EventMessage{
 		r.transport,
 		events.FormatPlain,
@@ -94,11 +104,16 @@ func (ext *ExtensionReminders) announce(id int) {
 		"",
 		false,
 	}
+	texts := ext.bot.LocalTexts(sourceEvent, "reminders").(*extensionRemindersTexts)
+	message := utils.Format(texts.TempAnnounce, map[string]string{
+		"who":  r.creator,
+		"what": r.text,
+		"when": ext.bot.LocalHumanizer(sourceEvent).TimeDiffNow(r.createdTime, false),
+	})
 	ext.bot.SendMessage(sourceEvent, message)
 
 	// Mark as announced in the db.
-	query := `UPDATE reminders SET announced = 1 WHERE id=?;`
-	if _, err := ext.bot.Db.Exec(query, id); err != nil {
+	if err := ext.bot.Storage.MarkReminderAnnounced(int64(id)); err != nil {
 		ext.bot.Log.Errorf("Error while marking reminder as announced: %s", err)
 		return
 	}
@@ -109,59 +124,63 @@ func (ext *ExtensionReminders) announce(id int) {
 
 // TickListener will trigger the reminder if needed.
 func (ext *ExtensionReminders) TickListener(message events.EventMessage) {
+	due := map[int]*extensionRemindersReminder{}
+	ext.mu.Lock()
 	for id, reminder := range ext.reminders {
 		if reminder.announced {
 			continue
 		}
 		if time.Now().After(reminder.targetTime) {
-			ext.announce(id)
+			// Mark right away, so that an overlapping tick won't announce it again.
+			reminder.announced = true
+			due[id] = reminder
 		}
 	}
+	ext.mu.Unlock()
+	for id, reminder := range due {
+		ext.announce(id, reminder)
+	}
+}
+
+// getReminder returns the loaded reminder with the given id.
+func (ext *ExtensionReminders) getReminder(id int) (*extensionRemindersReminder, bool) {
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	reminder, exists := ext.reminders[id]
+	return reminder, exists
 }
 
 // loadReminders will load the reminders from the database.
 func (ext *ExtensionReminders) loadReminders() {
-	ext.reminders = map[int]*extensionRemindersReminder{}
+	loaded := map[int]*extensionRemindersReminder{}
+	defer func() {
+		ext.mu.Lock()
+		ext.reminders = loaded
+		ext.mu.Unlock()
+	}()
 
-	result, err := ext.bot.Db.Query(
-		`SELECT id, channel, transport, creator, announce_text, announced, target_time, created_time ` +
-			`FROM reminders WHERE announced = 0 ORDER BY id ASC`)
+	reminders, err := ext.bot.Storage.PendingReminders()
 	if err != nil {
 		ext.bot.Log.Warningf("Error while loading reminders: %s", err)
 		return
 	}
-	defer result.Close()
-
-	// Get vars.
-	for result.Next() {
-		var r extensionRemindersReminder
-		var createdTimeStr, targetTimeStr string
-		var id int
-		if err = result.Scan(
-			&id, &r.channel, &r.transport, &r.creator, &r.text, &r.announced, &targetTimeStr, &createdTimeStr,
-		); err != nil {
-			ext.bot.Log.Warningf("Can't load reminder: %s", err)
-			continue
-		}
-		// Handle the dates.
-		r.targetTime, err = time.Parse("2006-01-02 15:04:05", targetTimeStr)
-		if err != nil {
-			ext.bot.Log.Fatalf("Can't parse reminder date %s: %s", targetTimeStr, err)
+	for _, reminder := range reminders {
+		loaded[int(reminder.Id)] = &extensionRemindersReminder{
+			transport:   reminder.Transport,
+			channel:     reminder.Channel,
+			creator:     reminder.Creator,
+			text:        reminder.Text,
+			announced:   reminder.Announced,
+			createdTime: reminder.CreatedTime,
+			targetTime:  reminder.TargetTime,
 		}
-		r.targetTime = utils.MustForceLocalTimezone(r.targetTime)
-		r.createdTime, err = time.Parse("2006-01-02 15:04:05", createdTimeStr)
-		if err != nil {
-			ext.bot.Log.Fatalf("Can't parse reminder date %s: %s", createdTimeStr, err)
-		}
-		r.createdTime = utils.MustForceLocalTimezone(r.createdTime)
-
-		ext.reminders[id] = &r
 	}
 }
 
 // printReminders is a helper function for preparing reminder lists.
 func (ext *ExtensionReminders) printReminders(bot *papaBot.Bot, sourceEvent *events.EventMessage, all bool) {
 	reminders := []string{}
+	ext.mu.Lock()
 	for id, reminder := range ext.reminders {
 		if !all && (reminder.transport != sourceEvent.TransportName || reminder.channel != sourceEvent.Channel) {
 			continue
@@ -172,13 +191,14 @@ func (ext *ExtensionReminders) printReminders(bot *papaBot.Bot, sourceEvent *eve
 		reminders = append(reminders, fmt.Sprintf(
 			"| %d | %s | %s | %s | %s |",
 			id,
-			bot.Humanizer.TimeDiffNow(reminder.createdTime, false),
+			bot.LocalHumanizer(sourceEvent).TimeDiffNow(reminder.createdTime, false),
 			reminder.creator,
-			bot.Humanizer.TimeDiffNow(reminder.targetTime, false),
+			bot.LocalHumanizer(sourceEvent).TimeDiffNow(reminder.targetTime, false),
 			reminder.text,
 		))
 
 	}
+	ext.mu.Unlock()
 	result := ""
 	if sourceEvent.TransportFormatting == events.FormatMarkdown {
 		result = "\n\n| id | set | by | announce | |\n| -:- | :-- | :-- | :-- | :-- |\n"
@@ -187,99 +207,168 @@ func (ext *ExtensionReminders) printReminders(bot *papaBot.Bot, sourceEvent *eve
 	bot.SendMessage(sourceEvent, result)
 }
 
-// commandRemind is a command for handling the reminders.
-func (ext *ExtensionReminders) commandRemind(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
-
-	command := "help"
-	if len(params) > 0 {
-		command = params[0]
+// commandRemindList lists the reminders.
+func (ext *ExtensionReminders) commandRemindList(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	ext.mu.Lock()
+	count := len(ext.reminders)
+	ext.mu.Unlock()
+	if count == 0 {
+		bot.SendMessage(sourceEvent, "No reminders yet.")
+		return
 	}
+	bot.SendMessage(sourceEvent, "Active reminders:")
+	// If user is a manager and conversation is private - show all reminders.
+	if sourceEvent.IsPrivate() && bot.UserCan(sourceEvent, PermRemindersManage) {
+		ext.printReminders(bot, sourceEvent, true)
+	} else { // If not, show only reminders for this channel.
+		ext.printReminders(bot, sourceEvent, false)
+	}
+}
 
-	// List.
-	if command == "list" {
-		if len(ext.reminders) > 0 {
-			bot.SendMessage(sourceEvent, "Active reminders:")
-			// If user is an admin and conversation is private - show all reminders.
-			if sourceEvent.IsPrivate() && bot.UserIsOwnerOrAdmin(sourceEvent.UserId) {
-				ext.printReminders(bot, sourceEvent, true)
-			} else { // If not, show only reminders for this channel.
-				ext.printReminders(bot, sourceEvent, false)
-			}
-		} else {
-			bot.SendMessage(sourceEvent, "No reminders yet.")
-		}
+// commandRemindHelp explains how to add reminders.
+func (ext *ExtensionReminders) commandRemindHelp(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	bot.SendMessage(sourceEvent, "To add a new reminder: .rm add <time to wait> <text>")
+	bot.SendMessage(
+		sourceEvent, `Where time to wait is in format "X units", e.g. "5 days" or "2 years". `+
+			`Please note that actual announce granularity is 5 minutes.`)
+}
+
+// commandRemindDel deletes a reminder.
+func (ext *ExtensionReminders) commandRemindDel(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	id := args.Int("id")
+	reminder, exists := ext.getReminder(id)
+	if !exists {
+		bot.SendMessage(sourceEvent, "Reminder not found.")
 		return
 	}
 
-	if command == "help" {
-		bot.SendMessage(sourceEvent, "To add a new reminder: .rm add <time to wait> <text>")
-		bot.SendMessage(
-			sourceEvent, `Where time to wait is in format "X units", e.g. "5 days" or "2 years". `+
-				`Please note that actual announce granularity is 5 minutes.`)
+	// Is the reminder set for different channel?
+	elsewhere := reminder.transport != sourceEvent.TransportName || reminder.channel != sourceEvent.Channel
+	if elsewhere && !bot.UserCan(sourceEvent, PermRemindersManage) {
+		bot.SendMessage(sourceEvent, "You don't have permission to do that.")
 		return
 	}
 
-	// Delete.
-	if len(params) == 2 && command == "del" {
-		id, err := strconv.ParseInt(params[1], 10, 32)
-		if err != nil {
-			bot.SendMessage(sourceEvent, "id must be a number.")
-			return
-		}
-		reminder, exists := ext.reminders[int(id)]
-		if !exists {
-			bot.SendMessage(sourceEvent, "Reminder not found.")
-			return
-		}
-
-		// Is the reminder set for different channel?
-		if reminder.transport != sourceEvent.TransportName || reminder.channel != sourceEvent.Channel {
-			if !bot.UserIsOwnerOrAdmin(sourceEvent.UserId) {
-				bot.SendMessage(sourceEvent, "You don't have permission to do that.")
-				return
-			}
-		}
+	if err := bot.Storage.DeleteReminder(int64(id)); err != nil {
+		bot.Log.Warningf("Error while deleting a reminder: %s", err)
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	if elsewhere {
+		bot.Audit(sourceEvent, "reminder.delete", fmt.Sprintf("reminder %d", id),
+			fmt.Sprintf("on %s;%s", reminder.transport, reminder.channel))
+	}
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Removed reminder number %d.", id))
+	// Reload reminders.
+	ext.loadReminders()
+}
 
-		query := `DELETE FROM reminders WHERE id=?;`
+// commandRemindAdd adds a reminder.
+func (ext *ExtensionReminders) commandRemindAdd(
+	bot *papaBot.Bot, sourceEvent *events.EventMessage, args *papaBot.CommandArgs) {
+	createTime := time.Now()
+	targetTime := createTime.Add(args.Duration("time to wait"))
 
-		if _, err := bot.Db.Exec(query, id); err != nil {
-			bot.Log.Warningf("Error while deleting a reminder: %s", err)
-			bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
-			return
-		}
-		bot.SendMessage(sourceEvent, fmt.Sprintf("Removed reminder number %d.", id))
-		// Reload  counters.
-		ext.loadReminders()
+	// Add reminder to database.
+	if err := bot.Storage.AddReminder(storage.Reminder{
+		Transport:   sourceEvent.TransportName,
+		Channel:     sourceEvent.Channel,
+		Creator:     sourceEvent.Nick,
+		Text:        args.String("text"),
+		TargetTime:  targetTime,
+		CreatedTime: createTime,
+	}); err != nil {
+		bot.Log.Warningf("Error while adding a reminder: %s", err)
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
 		return
 	}
+	bot.SendMessage(sourceEvent, fmt.Sprintf("Reminder set for %s.", targetTime.Format("2006-01-02 15:04:05")))
+	// Reload reminders.
+	ext.loadReminders()
+}
 
-	// Add.
-	if len(params) > 3 && command == "add" {
-		// Sanity check parameters.
-		delay, err := bot.Humanizer.ParseDuration(params[1] + " " + params[2])
-		if err != nil {
-			bot.SendMessage(sourceEvent, fmt.Sprintf("%s", err))
-			return
-		}
-		createTime := time.Now()
-		targetTime := createTime.Add(delay)
+// Reminder as shown by the admin API.
+type extensionRemindersAPIReminder struct {
+	Id        int    `json:"id"`
+	Transport string `json:"transport"`
+	Channel   string `json:"channel"`
+	Creator   string `json:"creator"`
+	Text      string `json:"text"`
+	Created   string `json:"created"`
+	Target    string `json:"target"`
+}
 
-		text := strings.Join(params[3:], " ")
-		// Add reminder to database.
-		query := `
-			INSERT INTO reminders (transport, channel, creator, announce_text, announced, target_time, created_time)
-			VALUES (?, ?, ?, ?, ?, ?, ?);
-			`
-		if _, err := bot.Db.Exec(query, sourceEvent.TransportName, sourceEvent.Channel, sourceEvent.Nick, text,
-			0, targetTime.Format("2006-01-02 15:04:05"), createTime.Format("2006-01-02 15:04:05")); err != nil {
-			bot.Log.Warningf("Error while adding a reminder: %s", err)
-			bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
-			return
+// apiReminders lists, adds and deletes reminders through the admin API.
+func (ext *ExtensionReminders) apiReminders(bot *papaBot.Bot, r *http.Request, path []string) (interface{}, error) {
+	if len(path) == 0 || path[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			result := []extensionRemindersAPIReminder{}
+			ext.mu.Lock()
+			for id, reminder := range ext.reminders {
+				if reminder.announced {
+					continue
+				}
+				result = append(result, extensionRemindersAPIReminder{
+					id, reminder.transport, reminder.channel, reminder.creator, reminder.text,
+					reminder.createdTime.Format("2006-01-02 15:04:05"),
+					reminder.targetTime.Format("2006-01-02 15:04:05"),
+				})
+			}
+			ext.mu.Unlock()
+			sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+			return result, nil
+		case http.MethodPost:
+			request := struct{ Transport, Channel, Creator, Text, Delay string }{}
+			if err := papaBot.DecodeAPIRequest(r, &request); err != nil {
+				return nil, err
+			}
+			if _, ok := bot.Transports[request.Transport]; !ok {
+				return nil, papaBot.NewAPIError(http.StatusBadRequest, "no transport named '%s'", request.Transport)
+			}
+			if request.Channel == "" || request.Text == "" {
+				return nil, papaBot.NewAPIError(http.StatusBadRequest, "channel and text can't be empty")
+			}
+			delay, err := bot.Humanizer().ParseDuration(request.Delay)
+			if err != nil {
+				return nil, papaBot.NewAPIError(http.StatusBadRequest, "%s", err)
+			}
+			createTime := time.Now()
+			if err := bot.Storage.AddReminder(storage.Reminder{
+				Transport:   request.Transport,
+				Channel:     request.Channel,
+				Creator:     request.Creator,
+				Text:        request.Text,
+				TargetTime:  createTime.Add(delay),
+				CreatedTime: createTime,
+			}); err != nil {
+				return nil, err
+			}
+			ext.loadReminders()
+			return map[string]string{"target": createTime.Add(delay).Format("2006-01-02 15:04:05")}, nil
+		default:
+			return nil, papaBot.ErrAPIMethodNotAllowed
 		}
-		bot.SendMessage(sourceEvent, fmt.Sprintf("Reminder set for %s.", targetTime.Format("2006-01-02 15:04:05")))
-		// Reload reminders.
-		ext.loadReminders()
-		return
 	}
-	bot.SendMessage(sourceEvent, "Try `.rm help`")
+	if len(path) != 1 {
+		return nil, papaBot.ErrAPINotFound
+	}
+	if r.Method != http.MethodDelete {
+		return nil, papaBot.ErrAPIMethodNotAllowed
+	}
+	id, err := strconv.ParseInt(path[0], 10, 32)
+	if err != nil {
+		return nil, papaBot.NewAPIError(http.StatusBadRequest, "id must be a number")
+	}
+	if _, exists := ext.getReminder(int(id)); !exists {
+		return nil, papaBot.ErrAPINotFound
+	}
+	if err := bot.Storage.DeleteReminder(id); err != nil {
+		return nil, err
+	}
+	ext.loadReminders()
+	return nil, nil
 }
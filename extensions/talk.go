@@ -19,23 +19,32 @@ type extensionTalkTexts struct {
 
 // Init inits the extension.
 func (ext *ExtensionTalk) Init(bot *papaBot.Bot) error {
-	texts := new(extensionTalkTexts) // Can't load directly because of reflection issues.
-	if err := bot.LoadTexts("talk", texts); err != nil {
+	if err := ext.Reload(bot); err != nil {
 		return err
 	}
-	ext.Texts = texts
 	ext.bot = bot
 	bot.EventDispatcher.RegisterListener(events.EventJoinedChannel, ext.JoinedListener)
 	bot.EventDispatcher.RegisterListener(events.EventReJoinedChannel, ext.ReJoinedListener)
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionTalk) Reload(bot *papaBot.Bot) error {
+	texts := new(extensionTalkTexts) // Can't load directly because of reflection issues.
+	if err := bot.LoadTexts("talk", texts); err != nil {
+		return err
+	}
+	ext.Texts = texts
+	return nil
+}
+
 // JoinedListener says something when bot joins a channel.
 func (ext *ExtensionTalk) JoinedListener(message events.EventMessage) {
-	if !message.AtBot || message.TransportName == "mattermost" {
+	if !message.AtBot {
 		return
 	}
-	ext.bot.SendMessage(&message, ext.Texts.Hellos[rand.Intn(len(ext.Texts.Hellos))])
+	texts := ext.bot.LocalTexts(&message, "talk").(*extensionTalkTexts)
+	ext.bot.SendMessage(&message, texts.Hellos[rand.Intn(len(texts.Hellos))])
 }
 
 // ReJoinedListener says something when bot joins a channel.
@@ -43,5 +52,6 @@ func (ext *ExtensionTalk) ReJoinedListener(message events.EventMessage) {
 	if !message.AtBot {
 		return
 	}
-	ext.bot.SendMessage(&message, ext.Texts.HellosAfterKick[rand.Intn(len(ext.Texts.HellosAfterKick))])
+	texts := ext.bot.LocalTexts(&message, "talk").(*extensionTalkTexts)
+	ext.bot.SendMessage(&message, texts.HellosAfterKick[rand.Intn(len(texts.HellosAfterKick))])
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/pawelszydlo/papa-bot/events"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // ExtensionTwitterThread - extension for getting thread links from tweets.
@@ -13,6 +14,7 @@ type ExtensionTwitterThread struct {
 	twitterRe *regexp.Regexp
 	bot       *papaBot.Bot
 	lastTweet string
+	mu        sync.Mutex
 }
 
 // Init inits the extension.
@@ -24,13 +26,19 @@ func (ext *ExtensionTwitterThread) Init(bot *papaBot.Bot) error {
 
 	// Register new command.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"tt", "tthread"},
-		false, false, false,
-		"[url]", "Get a link to a thread version of the last tweet.",
-		ext.commandTThread})
+		CommandNames:    []string{"tt", "tthread"},
+		HelpParams:      "[url]",
+		HelpDescription: "Get a link to a thread version of the last tweet.",
+		CommandFunc:     ext.commandTThread,
+	})
 	return nil
 }
 
+// Name of the extension.
+func (ext *ExtensionTwitterThread) Name() string {
+	return "twitter_thread"
+}
+
 func (ext *ExtensionTwitterThread) extractTweetId(message string) string {
 	match := ext.twitterRe.FindStringSubmatch(message)
 	if len(match) < 3 {
@@ -43,19 +51,25 @@ func (ext *ExtensionTwitterThread) extractTweetId(message string) string {
 
 // UrlListener will check for Twitter links and store them.
 func (ext *ExtensionTwitterThread) UrlListener(message events.EventMessage) {
-	ext.lastTweet = ext.extractTweetId(message.Message)
+	tweet := ext.extractTweetId(message.Message)
+	ext.mu.Lock()
+	ext.lastTweet = tweet
+	ext.mu.Unlock()
 }
 
 // commandMovie is a command for getting a readable thread from last tweet.
 func (ext *ExtensionTwitterThread) commandTThread(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
 	text := strings.Join(params, " ")
+	ext.mu.Lock()
 	if text != "" {
 		ext.lastTweet = ext.extractTweetId(text)
 	}
-	if ext.lastTweet == "" {
+	tweet := ext.lastTweet
+	ext.lastTweet = ""
+	ext.mu.Unlock()
+	if tweet == "" {
 		return
 	}
-	notice := fmt.Sprintf("%s: https://threadreaderapp.com/thread/%s", sourceEvent.Nick, ext.lastTweet)
+	notice := fmt.Sprintf("%s: https://threadreaderapp.com/thread/%s", sourceEvent.Nick, tweet)
 	bot.SendMessage(sourceEvent, notice)
-	ext.lastTweet = ""
 }
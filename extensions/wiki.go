@@ -8,11 +8,13 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // ExtensionWiki - finds Wikipedia articles.
 type ExtensionWiki struct {
 	announced map[string]bool
+	mu        sync.Mutex
 	linkRe    *regexp.Regexp
 	cleanupRe *regexp.Regexp
 	Texts     *extensionWikiTexts
@@ -54,26 +56,35 @@ type WikiPage struct {
 
 // Init inits the extension.
 func (ext *ExtensionWiki) Init(bot *papaBot.Bot) error {
-	// Load texts.
-	texts := &extensionWikiTexts{}
-	if err := bot.LoadTexts("wiki", texts); err != nil {
+	if err := ext.Reload(bot); err != nil {
 		return err
 	}
-	ext.Texts = texts
 	// Init variables.
 	ext.announced = map[string]bool{}
 	ext.linkRe = regexp.MustCompile(`\[\[[^\[\]]+?\|(.+?)\]\]|\[\[([^\[\]]+?)\]\]`)
 	ext.cleanupRe = regexp.MustCompile(`\{\{[^\{]*?\}\}|<ref.*?ref>`)
 	// Register new command.
 	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"w", "wiki"},
-		false, false, false,
-		"<article>", "Search wikipedia for <article>.",
-		ext.commandWiki})
+		CommandNames:    []string{"w", "wiki"},
+		HelpParams:      "<article>",
+		HelpDescription: "Search wikipedia for <article>.",
+		CommandFunc:     ext.commandWiki,
+	})
 	ext.bot = bot
 	return nil
 }
 
+// Reload loads the extension's texts.
+func (ext *ExtensionWiki) Reload(bot *papaBot.Bot) error {
+	// Load texts.
+	texts := &extensionWikiTexts{}
+	if err := bot.LoadTexts("wiki", texts); err != nil {
+		return err
+	}
+	ext.Texts = texts
+	return nil
+}
+
 // searchWiki will query Wikipedia database for information.
 func (ext *ExtensionWiki) searchWiki(lang, search string) (string, string) {
 	// Fetch search result data.
@@ -133,11 +144,14 @@ func (ext *ExtensionWiki) commandWiki(bot *papaBot.Bot, sourceEvent *events.Even
 	search := strings.Join(params, " ")
 
 	// Announce each article only once.
-	if ext.announced[sourceEvent.ChannelId()+search] {
+	ext.mu.Lock()
+	announced := ext.announced[sourceEvent.ChannelId()+search]
+	ext.mu.Unlock()
+	if announced {
 		return
 	}
 
-	_, content := ext.searchWiki(bot.Config.Language, search)
+	_, content := ext.searchWiki(bot.Config().Language, search)
 
 	maxLen := 300
 	if sourceEvent.TransportName == "mattermost" {
@@ -154,7 +168,9 @@ func (ext *ExtensionWiki) commandWiki(bot *papaBot.Bot, sourceEvent *events.Even
 
 	notice := fmt.Sprintf("%s, %s", sourceEvent.Nick, contentPreview)
 	bot.SendMessage(sourceEvent, notice)
+	ext.mu.Lock()
 	ext.announced[sourceEvent.ChannelId()+search] = true
+	ext.mu.Unlock()
 
 	if contentFull != "" {
 		bot.AddMoreInfo(sourceEvent.TransportName, sourceEvent.Channel, contentFull)
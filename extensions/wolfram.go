@@ -7,6 +7,7 @@ import (
 	"github.com/pawelszydlo/papa-bot/events"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 /*
@@ -17,6 +18,7 @@ Used custom variables:
 */
 type ExtensionWolfram struct {
 	announced map[string]string
+	mu        sync.Mutex
 	Texts     *extensionWolframTexts
 	bot       *papaBot.Bot
 }
@@ -50,23 +52,32 @@ type subPod struct {
 func (ext *ExtensionWolfram) Init(bot *papaBot.Bot) error {
 	// Init variables.
 	ext.announced = map[string]string{}
+	if err := ext.Reload(bot); err != nil {
+		return err
+	}
+	// Register new command.
+	bot.RegisterCommand(&papaBot.BotCommand{
+		CommandNames:    []string{"wa", "wolfram"},
+		HelpParams:      "<query>",
+		HelpDescription: "Search Wolfram Alpha for <query>.",
+		CommandFunc:     ext.commandWolfram,
+	})
+	ext.bot = bot
+	return nil
+}
+
+// Reload loads the extension's texts.
+func (ext *ExtensionWolfram) Reload(bot *papaBot.Bot) error {
 	// Load texts.
 	texts := &extensionWolframTexts{}
 	if err := bot.LoadTexts("wolfram", texts); err != nil {
 		return err
 	}
 	ext.Texts = texts
-	// Register new command.
-	bot.RegisterCommand(&papaBot.BotCommand{
-		[]string{"wa", "wolfram"},
-		false, false, false,
-		"<query>", "Search Wolfram Alpha for <query>.",
-		ext.commandWolfram})
-	ext.bot = bot
 	return nil
 }
 
-func (ext *ExtensionWolfram) queryWolfram(query string, format events.Formatting) string {
+func (ext *ExtensionWolfram) queryWolfram(query string, format events.Formatting, texts *extensionWolframTexts) string {
 	appId := ext.bot.GetVar("WolframKey")
 	if appId == "" {
 		ext.bot.Log.Error("Wolfram Alpha AppID key not set! Set the 'WolframKey' variable in the bot.")
@@ -93,7 +104,7 @@ func (ext *ExtensionWolfram) queryWolfram(query string, format events.Formatting
 
 	// Did the query succeed?
 	if data.Error || !data.Success {
-		return ext.Texts.NoResult
+		return texts.NoResult
 	}
 
 	input := ""
@@ -120,7 +131,7 @@ func (ext *ExtensionWolfram) queryWolfram(query string, format events.Formatting
 		}
 	}
 
-	return fmt.Sprintf("%s = %s", input, strings.Join(result, ext.Texts.Or))
+	return fmt.Sprintf("%s = %s", input, strings.Join(result, texts.Or))
 }
 
 // commandMovie is a command for manually searching for movies.
@@ -131,12 +142,16 @@ func (ext *ExtensionWolfram) commandWolfram(bot *papaBot.Bot, sourceEvent *event
 	search := strings.Join(params, " ")
 
 	// Check if we have the result cached.
-	if val, exists := ext.announced[sourceEvent.ChannelId()+search]; exists {
+	ext.mu.Lock()
+	val, exists := ext.announced[sourceEvent.ChannelId()+search]
+	ext.mu.Unlock()
+	if exists {
 		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, val))
 		return
 	}
 
-	content := ext.queryWolfram(search, sourceEvent.TransportFormatting)
+	texts := bot.LocalTexts(sourceEvent, "wolfram").(*extensionWolframTexts)
+	content := ext.queryWolfram(search, sourceEvent.TransportFormatting, texts)
 
 	// Error occured.
 	if content == "" {
@@ -157,7 +172,9 @@ func (ext *ExtensionWolfram) commandWolfram(bot *papaBot.Bot, sourceEvent *event
 	}
 
 	bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, contentPreview))
+	ext.mu.Lock()
 	ext.announced[sourceEvent.ChannelId()+search] = contentPreview
+	ext.mu.Unlock()
 
 	if contentFull != "" {
 		bot.AddMoreInfo(sourceEvent.TransportName, sourceEvent.Channel, contentFull)
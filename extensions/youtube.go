@@ -28,66 +28,78 @@ type ExtensionYoutubeTexts struct {
 func (ext *ExtensionYoutube) Init(bot *papaBot.Bot) error {
 	ext.youTubeRe = regexp.MustCompile(`(?i)youtu(?:be\.com/watch\?v=|\.be/)([\w\-_]*)(&(amp;)?‌​[\w?‌​=]*)?`)
 	ext.bot = bot
+	if err := ext.Reload(bot); err != nil {
+		return err
+	}
+	// Run after other link listeners and suppress the generic title announcement when video info was sent.
+	bot.EventDispatcher.RegisterHandler(
+		events.EventURLFound, ext.UrlListener, events.ListenerOptions{Priority: events.PriorityLow, Sync: true})
+	return nil
+}
+
+// Reload loads the extension's texts.
+func (ext *ExtensionYoutube) Reload(bot *papaBot.Bot) error {
 	// Load texts.
 	texts := new(ExtensionYoutubeTexts)
 	if err := bot.LoadTexts("youtube", texts); err != nil {
 		return err
 	}
 	ext.Texts = texts
-	bot.EventDispatcher.RegisterListener(events.EventURLFound, ext.UrlListener)
 	return nil
 }
 
-// UrlListener will try to get more info on GitHub links.
-func (ext *ExtensionYoutube) UrlListener(message events.EventMessage) {
+// UrlListener will try to get more info on YouTube links. Returns true if the info was announced.
+func (ext *ExtensionYoutube) UrlListener(message events.EventMessage) bool {
 	match := ext.youTubeRe.FindStringSubmatch(message.Message)
 	if len(match) < 2 {
-		return
+		return false
 	}
-	go func() {
-		video_no := match[1]
-		// Get response
-		err, _, body := ext.bot.GetPageBody(fmt.Sprintf("https://youtube.com/get_video_info?video_id=%s", video_no), nil)
-		if err != nil {
-			ext.bot.Log.Warningf("Error getting response from YouTube: %s", err)
-			return
-		}
-		// Extract data from www-from-urlencoded.
-		params, err := url.ParseQuery(string(body))
-		if err != nil {
-			ext.bot.Log.Error(err)
-			return
-		}
-		// Intersting stuff is only in the "player_response" -> "videoDetails".
-		response, ok := params["player_response"]
-		if !ok {
-			ext.bot.Log.Error("Player response not found.")
-		}
-		// Convert from JSON
-		var raw_data interface{}
-		if err := json.Unmarshal([]byte(response[0]), &raw_data); err != nil {
-			ext.bot.Log.Warningf("Error parsing JSON from YouTube get info: %s", err)
-			return
-		}
-		data := raw_data.(map[string]interface{})["videoDetails"].(map[string]interface{})
+	video_no := match[1]
+	// Get response
+	err, _, body := ext.bot.GetPageBody(fmt.Sprintf("https://youtube.com/get_video_info?video_id=%s", video_no), nil)
+	if err != nil {
+		ext.bot.Log.Warningf("Error getting response from YouTube: %s", err)
+		return false
+	}
+	// Extract data from www-from-urlencoded.
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		ext.bot.Log.Error(err)
+		return false
+	}
+	// Intersting stuff is only in the "player_response" -> "videoDetails".
+	response, ok := params["player_response"]
+	if !ok {
+		ext.bot.Log.Error("Player response not found.")
+		return false
+	}
+	// Convert from JSON
+	var raw_data interface{}
+	if err := json.Unmarshal([]byte(response[0]), &raw_data); err != nil {
+		ext.bot.Log.Warningf("Error parsing JSON from YouTube get info: %s", err)
+		return false
+	}
+	data := raw_data.(map[string]interface{})["videoDetails"].(map[string]interface{})
 
-		// Map that the user will be able to use for formatting.
-		duration, err := time.ParseDuration(fmt.Sprintf("%ss", data["lengthSeconds"]))
-		views, _ := strconv.Atoi(data["viewCount"].(string))
+	// Map that the user will be able to use for formatting.
+	duration, err := time.ParseDuration(fmt.Sprintf("%ss", data["lengthSeconds"]))
+	views, _ := strconv.Atoi(data["viewCount"].(string))
 
-		values := map[string]string{
-			"title":       fmt.Sprintf("%s", data["title"]),
-			"length":      ext.bot.Humanizer.SecondsToTimeString(int64(duration.Seconds())),
-			"description": fmt.Sprintf("%s", data["shortDescription"]),
-			"rating":      fmt.Sprintf("%.2f", data["averageRating"]),
-			"views":       ext.bot.Humanizer.HumanizeNumber(float64(views), 0),
-			"author":      fmt.Sprintf("%s", data["author"]),
-		}
+	humanizer := ext.bot.LocalHumanizer(&message)
+	values := map[string]string{
+		"title":       fmt.Sprintf("%s", data["title"]),
+		"length":      humanizer.SecondsToTimeString(int64(duration.Seconds())),
+		"description": fmt.Sprintf("%s", data["shortDescription"]),
+		"rating":      fmt.Sprintf("%.2f", data["averageRating"]),
+		"views":       humanizer.HumanizeNumber(float64(views), 0),
+		"author":      fmt.Sprintf("%s", data["author"]),
+	}
 
-		// Add "more".
-		ext.bot.AddMoreInfo(message.TransportName, message.Channel, values["description"])
+	// Add "more".
+	ext.bot.AddMoreInfo(message.TransportName, message.Channel, values["description"])
 
-		// Send the notice.
-		ext.bot.SendNotice(&message, utils.Format(ext.Texts.TempNotice, values))
-	}()
+	// Send the notice.
+	texts := ext.bot.LocalTexts(&message, "youtube").(*ExtensionYoutubeTexts)
+	ext.bot.SendNotice(&message, utils.Format(texts.TempNotice, values))
+	return true
 }
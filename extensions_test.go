@@ -0,0 +1,225 @@
+package papaBot_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot"
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// probeExtension answers a command and a message, and records the order of what happened to it.
+type probeExtension struct {
+	transport *testTransport
+	// Closed when the slow message handler starts.
+	slowStarted chan struct{}
+
+	mu      sync.Mutex
+	history []string
+}
+
+func (ext *probeExtension) Name() string { return "probe" }
+
+func (ext *probeExtension) Init(bot *papaBot.Bot) error {
+	bot.RegisterCommand(&papaBot.BotCommand{
+		CommandNames:    []string{"probe"},
+		HelpDescription: "Answers the probe.",
+		CommandFunc: func(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
+			bot.SendMessage(sourceEvent, "probe command")
+		},
+	})
+	bot.RegisterCommand(&papaBot.BotCommand{
+		CommandNames:    []string{"once"},
+		HelpDescription: "Answers once an hour.",
+		CommandFunc: func(bot *papaBot.Bot, sourceEvent *events.EventMessage, params []string) {
+			bot.SendMessage(sourceEvent, "once command")
+		},
+		Cooldown: &papaBot.Cooldown{Period: time.Hour, Scope: papaBot.CooldownUser,
+			Warning: func(sourceEvent *events.EventMessage) string { return "only once an hour." }},
+	})
+	bot.EventDispatcher.RegisterListener(events.EventChatMessage, ext.messageListener)
+	return nil
+}
+
+func (ext *probeExtension) Migrations() []papaBot.Migration {
+	return []papaBot.Migration{{Name: "001_probes", Up: "CREATE TABLE probes (id INTEGER PRIMARY KEY);"}}
+}
+
+func (ext *probeExtension) Shutdown(bot *papaBot.Bot) error {
+	ext.record("extension shut down")
+	return nil
+}
+
+// record adds the entry to the history.
+func (ext *probeExtension) record(entry string) {
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	ext.history = append(ext.history, entry)
+}
+
+// messageListener answers the "probe" message. The "slow" message takes a while and notes if the transport
+// was stopped in the meantime.
+func (ext *probeExtension) messageListener(message events.EventMessage) {
+	switch message.Message {
+	case "probe":
+		ext.transport.send(message.Channel, "probe listener")
+	case "slow":
+		close(ext.slowStarted)
+		time.Sleep(200 * time.Millisecond)
+		select {
+		case <-ext.transport.quit:
+			ext.record("transport stopped")
+		default:
+		}
+		ext.record("handler done")
+	}
+}
+
+// newProbeBot creates a test bot with the probe extension registered.
+func newProbeBot(t *testing.T) (*papaBot.Bot, *testTransport, *probeExtension) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	ext := &probeExtension{transport: transport, slowStarted: make(chan struct{})}
+	bot.RegisterExtension(ext)
+	return bot, transport, ext
+}
+
+// TestShutdownOrder tests that on shutdown the transports stop first, then the running handlers finish and only
+// then the extensions are shut down.
+func TestShutdownOrder(t *testing.T) {
+	bot, transport, ext := newProbeBot(t)
+	stop := runTestBot(t, bot, transport)
+
+	bot.EventDispatcher.Trigger(message(events.EventChatMessage, "bob", "#test", "slow", false))
+	select {
+	case <-ext.slowStarted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Handler didn't start.")
+	}
+	stop()
+
+	if history := strings.Join(ext.history, ", "); history != "transport stopped, handler done, extension shut down" {
+		t.Errorf("Unexpected shutdown order: %s", history)
+	}
+}
+
+// TestCooldownWarning tests that a command can give its own cooldown warning.
+func TestCooldownWarning(t *testing.T) {
+	bot, transport, _ := newProbeBot(t)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		bot.EventDispatcher.Trigger(message(events.EventChatMessage, "bob", "#test", ".once", false))
+	}
+	if !transport.waitFor("#test: once command") || !transport.waitFor("#test: bob, only once an hour.") {
+		t.Error("Second use should get the command's warning.")
+	}
+}
+
+// TestExtensionSwitch tests that disabling an extension detaches its commands and listeners, and that the setting
+// is kept in the database.
+func TestExtensionSwitch(t *testing.T) {
+	bot, transport, _ := newProbeBot(t)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, channel, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, channel, text, false))
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "auth owner secret")
+	if !transport.waitFor("owner: You are now logged in.") {
+		t.Fatal("Owner should be logged in.")
+	}
+	run(events.EventChatMessage, "owner", "#test", ".ext disable probe")
+	if !transport.waitFor("#test: Extension probe disabled.") {
+		t.Fatal("Owner should disable the extension.")
+	}
+	if disabled := bot.GetVar("_disabledExtensions"); disabled != "probe" {
+		t.Errorf("Disabled extensions should be saved, got: %q", disabled)
+	}
+	run(events.EventChatMessage, "bob", "#test", "probe")
+	run(events.EventChatMessage, "bob", "#test", ".probe")
+	run(events.EventChatMessage, "owner", "#test", ".ext enable probe")
+	if !transport.waitFor("#test: Extension probe enabled.") {
+		t.Fatal("Owner should enable the extension.")
+	}
+	if transport.count("probe listener") > 0 || transport.count("probe command") > 0 {
+		t.Error("Disabled extension should not get any events or commands.")
+	}
+	if disabled := bot.GetVar("_disabledExtensions"); disabled != "" {
+		t.Errorf("Enabled extension should be removed from the saved list, got: %q", disabled)
+	}
+
+	run(events.EventChatMessage, "bob", "#test", "probe")
+	run(events.EventChatMessage, "alice", "#test", ".probe")
+	if !transport.waitFor("#test: probe listener") || !transport.waitFor("#test: probe command") {
+		t.Error("Enabled extension should get events and commands again.")
+	}
+}
+
+// TestChannelPolicies tests switching extensions and commands on one channel.
+func TestChannelPolicies(t *testing.T) {
+	bot, transport, _ := newProbeBot(t)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, channel, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, channel, text, false))
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "auth owner secret")
+	if !transport.waitFor("owner: You are now logged in.") {
+		t.Fatal("Owner should be logged in.")
+	}
+	run(events.EventChatMessage, "owner", "#test", ".chan cmd probe off")
+	run(events.EventChatMessage, "owner", "#test", ".chan ext probe off")
+	run(events.EventChatMessage, "owner", "#test", ".chan cmd chan off")
+	if !transport.waitForCount("#test: Channel settings changed.", 2) ||
+		!transport.waitFor("#test: This command can't be switched off.") {
+		t.Fatal("Owner should change the channel settings.")
+	}
+	run(events.EventChatMessage, "owner", "#test", ".chan list")
+	if !transport.waitFor("#test: Channel settings: command:probe off, extension:probe off") {
+		t.Error("Channel settings should be listed.")
+	}
+
+	run(events.EventChatMessage, "bob", "#test", "probe")
+	run(events.EventChatMessage, "bob", "#test", ".probe")
+	run(events.EventChatMessage, "bob", "#other", "probe")
+	run(events.EventChatMessage, "bob", "#other", ".probe")
+	if !transport.waitFor("#other: probe listener") || !transport.waitFor("#other: probe command") {
+		t.Error("Extension should work on other channels.")
+	}
+	if transport.count("#test: probe") > 0 {
+		t.Error("Extension should not work on the channel where it's switched off.")
+	}
+
+	run(events.EventChatMessage, "owner", "#test", ".chan ext probe default")
+	run(events.EventChatMessage, "owner", "#test", ".chan cmd probe default")
+	if !transport.waitForCount("#test: Channel settings changed.", 4) {
+		t.Fatal("Owner should bring back the default settings.")
+	}
+	run(events.EventChatMessage, "alice", "#test", "probe")
+	run(events.EventChatMessage, "alice", "#test", ".probe")
+	if !transport.waitFor("#test: probe listener") || !transport.waitFor("#test: probe command") {
+		t.Error("Extension should work again with the default settings.")
+	}
+}
+
+// TestDryRunMigrations tests that the dry run lists pending migrations without applying them.
+func TestDryRunMigrations(t *testing.T) {
+	bot, _, _ := newProbeBot(t)
+	for i := 0; i < 2; i++ {
+		out := &bytes.Buffer{}
+		if err := bot.DryRunMigrations(out); err != nil {
+			t.Fatalf("Dry run failed: %s", err)
+		}
+		if out.String() != "1 pending migrations (sqlite):\n\n-- probe/001_probes\n"+
+			"CREATE TABLE probes (id INTEGER PRIMARY KEY);\n" {
+			t.Errorf("Unexpected dry run output:\n%s", out.String())
+		}
+	}
+}
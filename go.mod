@@ -3,6 +3,7 @@ module github.com/pawelszydlo/papa-bot
 go 1.17
 
 require (
+	github.com/lib/pq v1.10.4
 	github.com/mattermost/mattermost-server v5.11.1+incompatible
 	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/pawelszydlo/humanize v0.0.0-20200522003854-142c3fe71478
@@ -26,7 +27,6 @@ require (
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
 	github.com/google/uuid v1.0.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/lib/pq v1.10.4 // indirect
 	github.com/mattermost/gorp v2.0.0+incompatible // indirect
 	github.com/nicksnyder/go-i18n v1.10.1 // indirect
 	github.com/pborman/uuid v1.2.1 // indirect
@@ -0,0 +1,258 @@
+package papaBot
+
+// Help for the bot commands and suggestions for mistyped ones.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// Number of lines per help page on IRC.
+const helpPageSize = 15
+
+// Category of commands that are not registered by an extension.
+const helpBuiltInCategory = "bot"
+
+// Command shown in the help.
+type helpEntry struct {
+	cmd *BotCommand
+	// Name of the extension that registered the command, or helpBuiltInCategory.
+	category string
+}
+
+// visibleCommands returns the commands the user can run on the channel, sorted by category and name.
+func (bot *Bot) visibleCommands(sourceEvent *events.EventMessage) []*helpEntry {
+	entries := []*helpEntry{}
+	seen := map[*BotCommand]bool{}
+	bot.commandsMu.RLock()
+	for _, cmd := range bot.commands {
+		if seen[cmd] || !bot.UserCan(sourceEvent, cmd.Permission) {
+			continue
+		}
+		seen[cmd] = true
+		category := bot.commandOwners[cmd.CommandNames[0]]
+		if category == "" {
+			category = helpBuiltInCategory
+		}
+		entries = append(entries, &helpEntry{cmd, category})
+	}
+	bot.commandsMu.RUnlock()
+	visible := []*helpEntry{}
+	for _, entry := range entries {
+		if bot.commandAllowed(sourceEvent, entry.cmd.CommandNames[0]) {
+			visible = append(visible, entry)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		if visible[i].category != visible[j].category {
+			// Built-in commands go first.
+			if visible[i].category == helpBuiltInCategory || visible[j].category == helpBuiltInCategory {
+				return visible[i].category == helpBuiltInCategory
+			}
+			return visible[i].category < visible[j].category
+		}
+		return visible[i].cmd.CommandNames[0] < visible[j].cmd.CommandNames[0]
+	})
+	return visible
+}
+
+// findVisibleCommand returns the command under the name, if the user can run it on the channel.
+func (bot *Bot) findVisibleCommand(sourceEvent *events.EventMessage, name string) *helpEntry {
+	for _, entry := range bot.visibleCommands(sourceEvent) {
+		for _, commandName := range entry.cmd.CommandNames {
+			if commandName == name {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// suggestCommand returns the name of a command the user can run that is the closest to the mistyped name, or "".
+func (bot *Bot) suggestCommand(sourceEvent *events.EventMessage, name string) string {
+	// Allow one typo for short names and two for longer ones.
+	maxDistance := 1
+	if len([]rune(name)) > 4 {
+		maxDistance = 2
+	}
+	suggestion, bestDistance := "", maxDistance+1
+	for _, entry := range bot.visibleCommands(sourceEvent) {
+		for _, commandName := range entry.cmd.CommandNames {
+			distance := utils.EditDistance(name, commandName)
+			if distance < bestDistance && distance < len([]rune(commandName)) {
+				suggestion, bestDistance = commandName, distance
+			}
+		}
+	}
+	return suggestion
+}
+
+// formatHelpLine formats the names, parameters and description of the command.
+func formatHelpLine(format events.Formatting, cmd *BotCommand) string {
+	names := strings.Join(cmd.CommandNames, ", ")
+	switch format {
+	case events.FormatIRC:
+		line := fmt.Sprintf("\x0308%s\x03 \x0310%s\x03 - %s", names, cmd.helpParams(), cmd.HelpDescription)
+		if cmd.Private {
+			line += " \x0300(private only)\x03"
+		}
+		return line
+	case events.FormatMarkdown:
+		private := ""
+		if cmd.Private {
+			private = " **(private only)**"
+		}
+		return fmt.Sprintf("| %s | %s | %s%s |", names, cmd.helpParams(), cmd.HelpDescription, private)
+	}
+	line := fmt.Sprintf("%s %s - %s", names, cmd.helpParams(), cmd.HelpDescription)
+	if cmd.Private {
+		line += " (private only)"
+	}
+	return line
+}
+
+// helpOverview returns the help for all the commands, grouped by category. On markdown transports it is one message.
+func helpOverview(format events.Formatting, entries []*helpEntry) []string {
+	lines := []string{}
+	category := ""
+	for _, entry := range entries {
+		if entry.category != category {
+			category = entry.category
+			switch format {
+			case events.FormatIRC:
+				lines = append(lines, fmt.Sprintf("\x02%s\x02", category))
+			case events.FormatMarkdown:
+				lines = append(lines, fmt.Sprintf("\n#### %s\n| Command | Parameters | Help |\n| :-- | :-- | :-- |", category))
+			default:
+				lines = append(lines, fmt.Sprintf("[%s]", category))
+			}
+		}
+		lines = append(lines, formatHelpLine(format, entry.cmd))
+	}
+	if format == events.FormatMarkdown {
+		return []string{strings.Join(lines, "\n") + "\n\nSay `help <command>` for details."}
+	}
+	return lines
+}
+
+// helpPage returns the lines of the page, counted from 1, and the number of pages.
+func helpPage(lines []string, page int) ([]string, int) {
+	pages := (len(lines) + helpPageSize - 1) / helpPageSize
+	if page < 1 || page > pages {
+		return nil, pages
+	}
+	end := page * helpPageSize
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return lines[(page-1)*helpPageSize : end], pages
+}
+
+// helpDetails returns the detailed help of the command.
+func helpDetails(format events.Formatting, entry *helpEntry) []string {
+	cmd := entry.cmd
+	lines := []string{formatHelpLine(format, cmd)}
+	if format == events.FormatMarkdown {
+		lines = []string{strings.Join(cmd.CommandNames, ", ") + " - " + cmd.HelpDescription}
+	}
+	if entry.category != helpBuiltInCategory {
+		lines = append(lines, fmt.Sprintf("Extension: %s", entry.category))
+	}
+	if cmd.Spec == nil {
+		if format == events.FormatMarkdown {
+			lines = append(lines, fmt.Sprintf("Usage: `%s %s`", cmd.CommandNames[0], cmd.helpParams()))
+		}
+		return lines
+	}
+	if cmd.Spec.Details != "" {
+		lines = append(lines, cmd.Spec.Details)
+	}
+	// Usage of the command and its subcommands, with descriptions.
+	usages := [][2]string{}
+	if len(cmd.Spec.Subcommands) == 0 || cmd.Spec.Run != nil {
+		usages = append(usages, [2]string{cmd.CommandNames[0] + " " + formatArgs(cmd.Spec.Args), ""})
+	}
+	for _, sub := range cmd.Spec.Subcommands {
+		usages = append(usages, [2]string{
+			fmt.Sprintf("%s %s %s", cmd.CommandNames[0], sub.Name, formatArgs(sub.Args)), sub.HelpDescription})
+	}
+	for _, usage := range usages {
+		line := strings.TrimSpace(usage[0])
+		if format == events.FormatMarkdown {
+			line = "* `" + line + "`"
+		}
+		if usage[1] != "" {
+			line += " - " + usage[1]
+		}
+		lines = append(lines, line)
+	}
+	for _, example := range cmd.Spec.Examples {
+		if format == events.FormatMarkdown {
+			example = "`" + example + "`"
+		}
+		lines = append(lines, "Example: "+example)
+	}
+	if format == events.FormatMarkdown {
+		return []string{strings.Join(lines, "\n")}
+	}
+	return lines
+}
+
+// commandHelp will print help for all the commands, or the details of one command.
+func commandHelp(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	topic, page := args.String("topic"), 1
+	if args.Has("page") {
+		page = args.Int("page")
+	}
+	if number, err := strconv.Atoi(topic); err == nil && !args.Has("page") {
+		topic, page = "", number
+	}
+
+	// Details of a command are sent where asked.
+	if topic != "" && topic != "pub" {
+		entry := bot.findVisibleCommand(sourceEvent, topic)
+		if entry == nil {
+			reply := fmt.Sprintf("No command named '%s'.", topic)
+			if suggestion := bot.suggestCommand(sourceEvent, topic); suggestion != "" {
+				reply += " " + utils.Format(bot.texts(sourceEvent).TempDidYouMean, map[string]string{"command": suggestion})
+			}
+			bot.SendMessage(sourceEvent, reply)
+			return
+		}
+		for _, line := range helpDetails(sourceEvent.TransportFormatting, entry) {
+			bot.SendMessage(sourceEvent, line)
+		}
+		return
+	}
+
+	// By default help only gets sent on priv.
+	send := func(message string) {
+		bot.SendPrivateMessage(sourceEvent, sourceEvent.Nick, message)
+	}
+	if topic == "pub" {
+		send = func(message string) {
+			bot.SendMessage(sourceEvent, message)
+		}
+	}
+	lines := helpOverview(sourceEvent.TransportFormatting, bot.visibleCommands(sourceEvent))
+	if sourceEvent.TransportFormatting == events.FormatIRC {
+		var pages int
+		if lines, pages = helpPage(lines, page); lines == nil {
+			send(fmt.Sprintf("There are only %d pages of help.", pages))
+			return
+		}
+		if pages > 1 {
+			lines = append(lines, fmt.Sprintf(
+				"Page %d/%d. Say \"help %d\" for the next one, \"help <command>\" for details.",
+				page, pages, page%pages+1))
+		}
+	}
+	for _, line := range lines {
+		send(line)
+	}
+}
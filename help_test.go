@@ -0,0 +1,63 @@
+package papaBot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/extensions"
+)
+
+// waitFor waits for a sent message containing the text.
+func (transport *testTransport) waitFor(text string) bool {
+	return transport.waitForCount(text, 1)
+}
+
+// waitForCount waits for the number of sent messages containing the text.
+func (transport *testTransport) waitForCount(text string, count int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for transport.count(text) < count {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// TestHelpAndSuggestions tests the command help and the suggestions for mistyped commands.
+func TestHelpAndSuggestions(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	bot.RegisterExtension(&extensions.ExtensionReminders{})
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(text string) {
+		bot.EventDispatcher.Trigger(message(events.EventChatMessage, "user", "#test", "."+text, false))
+	}
+
+	run("help pub")
+	if !transport.waitFor("#test: [reminders]") || transport.count("#test: [bot]") != 1 {
+		t.Error("Help should be grouped by extension.")
+	}
+	if transport.count("#test: ignore") != 0 {
+		t.Error("Admin commands should not be listed for regular users.")
+	}
+	run("help rm")
+	if !transport.waitFor("#test: rm add <time to wait> <text...> - Adds a reminder.") ||
+		transport.count("#test: Example: rm add 2 hours") != 1 || transport.count("#test: Extension: reminders") != 1 {
+		t.Error("Details of the command were not sent.")
+	}
+	run("help ignore")
+	if !transport.waitFor("#test: No command named 'ignore'.") {
+		t.Error("Details of admin commands should not be shown to regular users.")
+	}
+	run("xyzzy")
+	run("remnd list")
+	if !transport.waitFor("#test: user, Did you mean remind?") {
+		t.Error("Mistyped command should get a suggestion.")
+	}
+	if transport.count("xyzzy") != 0 || transport.count("Did you mean") != 1 {
+		t.Error("Unknown command on a channel should be ignored.")
+	}
+}
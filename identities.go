@@ -0,0 +1,351 @@
+package papaBot
+
+// Identities of people on the transports, linked to their accounts through a code sent over the other identity.
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/transports"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// How long the link verification code is valid.
+const linkCodeLifetime = 10 * time.Minute
+
+// Identity of a person on a transport. User id is only kept for transports where it identifies the person for good.
+type identity struct {
+	transport string
+	nick      string
+	userId    string
+}
+
+// parseIdentity reads the identity stored as transport;nick or transport;nick;user id.
+func parseIdentity(text string) (identity, bool) {
+	parts := strings.Split(text, ";")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return identity{}, false
+	}
+	id := identity{transport: parts[0], nick: parts[1]}
+	if len(parts) == 3 {
+		id.userId = parts[2]
+	}
+	return id, true
+}
+
+// String formats the identity the way it's stored.
+func (id identity) String() string {
+	if id.userId == "" {
+		return id.transport + ";" + id.nick
+	}
+	return id.transport + ";" + id.nick + ";" + id.userId
+}
+
+// sameAs checks whether both identities are the same person on the same transport.
+func (id identity) sameAs(other identity) bool {
+	if id.transport != other.transport {
+		return false
+	}
+	if id.userId != "" && other.userId != "" {
+		return id.userId == other.userId
+	}
+	return nickKey(id.transport, id.nick) == nickKey(other.transport, other.nick)
+}
+
+// nickKey normalizes the nick on the transport for lookups. Decorations like trailing underscores are ignored.
+func nickKey(transportName, nick string) string {
+	return transportName + ";" + strings.ToLower(strings.Trim(nick, "_~"))
+}
+
+// Link waiting for verification by the other identity.
+type pendingLink struct {
+	// Account and the identity that asked for the link.
+	account string
+	from    identity
+	// Identity that has to confirm the link.
+	transport string
+	nick      string
+	expires   time.Time
+}
+
+// hasStableUserIds checks whether the transport's user ids identify people for good.
+func (bot *Bot) hasStableUserIds(transportName string) bool {
+	if transport, ok := bot.Transports[transportName].(transports.StableUserIds); ok {
+		return transport.StableUserIds()
+	}
+	return false
+}
+
+// senderIdentity returns the identity of the sender of the event.
+func (bot *Bot) senderIdentity(sourceEvent *events.EventMessage) identity {
+	id := identity{transport: sourceEvent.TransportName, nick: sourceEvent.Nick}
+	if bot.hasStableUserIds(sourceEvent.TransportName) {
+		id.userId = sourceEvent.UserId
+	}
+	return id
+}
+
+// loadIdentities loads the linked identities of all users from the database.
+func (bot *Bot) loadIdentities() error {
+	users, err := bot.Storage.Users()
+	if err != nil {
+		return err
+	}
+	byNick := map[string]string{}
+	byUserId := map[string]string{}
+	for _, user := range users {
+		for _, altNick := range user.AltNicks {
+			id, ok := parseIdentity(altNick)
+			if !ok {
+				bot.Log.Warningf("Invalid identity %q of %s.", altNick, user.Nick)
+				continue
+			}
+			byNick[nickKey(id.transport, id.nick)] = user.Nick
+			if id.userId != "" {
+				byUserId[id.transport+";"+id.userId] = user.Nick
+			}
+		}
+	}
+	bot.identitiesMu.Lock()
+	defer bot.identitiesMu.Unlock()
+	bot.identityNicks = byNick
+	bot.identityUserIds = byUserId
+	return nil
+}
+
+// AccountOf returns the account the nick on the transport is linked to, or an empty string.
+func (bot *Bot) AccountOf(transportName, nick string) string {
+	bot.identitiesMu.RLock()
+	defer bot.identitiesMu.RUnlock()
+	return bot.identityNicks[nickKey(transportName, nick)]
+}
+
+// accountOfUserId returns the account the user id on the transport is linked to, or an empty string.
+func (bot *Bot) accountOfUserId(transportName, userId string) string {
+	bot.identitiesMu.RLock()
+	defer bot.identitiesMu.RUnlock()
+	return bot.identityUserIds[transportName+";"+userId]
+}
+
+// AreSamePeople checks if two nicks on the transport belong to the same person.
+func (bot *Bot) AreSamePeople(transportName, nick1, nick2 string) bool {
+	if nickKey(transportName, nick1) == nickKey(transportName, nick2) {
+		return true
+	}
+	account := bot.AccountOf(transportName, nick1)
+	return account != "" && account == bot.AccountOf(transportName, nick2)
+}
+
+// LinkedNicks returns the nicks on the transport that belong to the same person as the nick, the nick included.
+func (bot *Bot) LinkedNicks(transportName, nick string) []string {
+	nicks := []string{nick}
+	account := bot.AccountOf(transportName, nick)
+	if account == "" {
+		return nicks
+	}
+	user, err := bot.Storage.GetUser(account)
+	if err != nil {
+		return nicks
+	}
+	for _, altNick := range user.AltNicks {
+		if id, ok := parseIdentity(altNick); ok && id.transport == transportName &&
+			nickKey(transportName, id.nick) != nickKey(transportName, nick) {
+			nicks = append(nicks, id.nick)
+		}
+	}
+	return nicks
+}
+
+// linkIdentities adds the identities to the account, replacing the ones of the same people.
+func (bot *Bot) linkIdentities(account string, ids ...identity) error {
+	for _, id := range ids {
+		if owner := bot.AccountOf(id.transport, id.nick); owner != "" && owner != account {
+			return errors.New(fmt.Sprintf("%s is linked to another account.", id.nick))
+		}
+	}
+	user, err := bot.Storage.GetUser(account)
+	if err != nil {
+		return err
+	}
+	altNicks := []string{}
+	for _, altNick := range user.AltNicks {
+		keep := true
+		if existing, ok := parseIdentity(altNick); ok {
+			for _, id := range ids {
+				if existing.sameAs(id) {
+					keep = false
+				}
+			}
+		}
+		if keep {
+			altNicks = append(altNicks, altNick)
+		}
+	}
+	for _, id := range ids {
+		altNicks = append(altNicks, id.String())
+	}
+	if _, err := bot.Storage.SetAltNicks(account, altNicks); err != nil {
+		return err
+	}
+	return bot.loadIdentities()
+}
+
+// unlinkIdentity removes the nick on the transport from the account.
+func (bot *Bot) unlinkIdentity(account, transportName, nick string) error {
+	user, err := bot.Storage.GetUser(account)
+	if err != nil {
+		return err
+	}
+	altNicks := []string{}
+	for _, altNick := range user.AltNicks {
+		if id, ok := parseIdentity(altNick); !ok || nickKey(id.transport, id.nick) != nickKey(transportName, nick) {
+			altNicks = append(altNicks, altNick)
+		}
+	}
+	if len(altNicks) == len(user.AltNicks) {
+		return errors.New(fmt.Sprintf("%s on %s is not linked to your account.", nick, transportName))
+	}
+	if _, err := bot.Storage.SetAltNicks(account, altNicks); err != nil {
+		return err
+	}
+	return bot.loadIdentities()
+}
+
+// linkedSession logs in the sender whose user id is linked to an account, on transports with stable user ids.
+// Must be called with authMu held.
+func (bot *Bot) linkedSession(sourceEvent *events.EventMessage, now time.Time) {
+	if !bot.hasStableUserIds(sourceEvent.TransportName) {
+		return
+	}
+	if account := bot.accountOfUserId(sourceEvent.TransportName, sourceEvent.UserId); account != "" {
+		bot.Log.Infof("Authenticating %s through the linked identity.", account)
+		bot.sessions[sourceEvent.UserId] = &session{account, sourceEvent.TransportName, sourceEvent.Nick, now, now}
+	}
+}
+
+// newLinkCode generates a random verification code.
+func newLinkCode() (string, error) {
+	number, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", number.Int64()), nil
+}
+
+// commandLinkStart sends the verification code to the identity to link.
+func commandLinkStart(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	account := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if account == "" {
+		bot.SendMessage(sourceEvent, texts.NeedsLogin)
+		return
+	}
+	transportName, nick := args.String("transport"), args.String("nick")
+	if _, exists := bot.Transports[transportName]; !exists {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempNoTransport, map[string]string{"transport": transportName}))
+		return
+	}
+	code, err := newLinkCode()
+	if err != nil {
+		bot.Log.Errorf("Can't generate link code: %s", err)
+		bot.SendMessage(sourceEvent, texts.LinkFailed)
+		return
+	}
+	bot.identitiesMu.Lock()
+	for existing, link := range bot.pendingLinks {
+		if link.account == account || time.Now().After(link.expires) {
+			delete(bot.pendingLinks, existing)
+		}
+	}
+	bot.pendingLinks[code] = &pendingLink{
+		account, bot.senderIdentity(sourceEvent), transportName, nick, time.Now().Add(linkCodeLifetime)}
+	bot.identitiesMu.Unlock()
+
+	target := &events.EventMessage{
+		transportName, events.FormatPlain, events.EventPrivateMessage, nick, "", nick, "", "", true}
+	bot.SendPrivateMessage(target, nick, utils.Format(bot.texts(target).TempLinkRequest, map[string]string{
+		"nick":      sourceEvent.Nick,
+		"transport": sourceEvent.TransportName,
+		"code":      code,
+	}))
+	bot.SendMessage(sourceEvent, utils.Format(texts.TempLinkCodeSent, map[string]string{
+		"nick":      nick,
+		"transport": transportName,
+		"valid": bot.LocalHumanizer(sourceEvent).TimeDiff(
+			time.Now(), time.Now().Add(linkCodeLifetime), false),
+	}))
+}
+
+// commandLinkConfirm links the sender to the account that sent them the code.
+func commandLinkConfirm(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	code := args.String("code")
+	bot.identitiesMu.Lock()
+	link, exists := bot.pendingLinks[code]
+	valid := exists && time.Now().Before(link.expires) && link.transport == sourceEvent.TransportName &&
+		nickKey(link.transport, link.nick) == nickKey(sourceEvent.TransportName, sourceEvent.Nick)
+	if valid {
+		delete(bot.pendingLinks, code)
+	}
+	bot.identitiesMu.Unlock()
+	texts := bot.texts(sourceEvent)
+	if !valid {
+		bot.SendMessage(sourceEvent, texts.NotRight)
+		return
+	}
+	to := bot.senderIdentity(sourceEvent)
+	if err := bot.linkIdentities(link.account, link.from, to); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempLinkConfirmFail, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.audit(link.account, "identity.link", link.account, fmt.Sprintf("%s and %s", link.from, to))
+	bot.SendMessage(sourceEvent, utils.Format(texts.TempLinked, map[string]string{"account": link.account}))
+}
+
+// commandLinkList lists the identities linked to the account.
+func commandLinkList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	account := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if account == "" {
+		bot.SendMessage(sourceEvent, texts.NeedsLogin)
+		return
+	}
+	user, err := bot.Storage.GetUser(account)
+	if err == storage.ErrNotFound || err == nil && len(user.AltNicks) == 0 {
+		bot.SendMessage(sourceEvent, texts.NoIdentities)
+		return
+	} else if err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempError, map[string]string{"error": err.Error()}))
+		return
+	}
+	names := []string{}
+	for _, altNick := range user.AltNicks {
+		if id, ok := parseIdentity(altNick); ok {
+			names = append(names, utils.Format(texts.TempIdentity, map[string]string{
+				"nick": id.nick, "transport": id.transport}))
+		}
+	}
+	bot.SendMessage(sourceEvent, utils.Format(texts.TempIdentities, map[string]string{
+		"identities": strings.Join(names, ", ")}))
+}
+
+// commandLinkRemove removes an identity from the account.
+func commandLinkRemove(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	account := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if account == "" {
+		bot.SendMessage(sourceEvent, texts.NeedsLogin)
+		return
+	}
+	if err := bot.unlinkIdentity(account, args.String("transport"), args.String("nick")); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempUnlinkFailed, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.audit(account, "identity.unlink", account, args.String("transport")+";"+args.String("nick"))
+	bot.SendMessage(sourceEvent, texts.IdentityUnlinked)
+}
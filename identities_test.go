@@ -0,0 +1,57 @@
+package papaBot_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// sentCode returns the link code sent in a message, if any.
+func (transport *testTransport) sentCode() string {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	for _, sent := range transport.sent {
+		if index := strings.Index(sent, "link confirm "); index != -1 {
+			return sent[index+len("link confirm "):]
+		}
+	}
+	return ""
+}
+
+// TestIdentityLinking tests linking a second nick to an account with the verification code.
+func TestIdentityLinking(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(nick, text string) {
+		bot.EventDispatcher.Trigger(message(events.EventPrivateMessage, nick, nick, text, false))
+	}
+
+	run("owner", "auth owner secret")
+	run("owner", "link start test boss")
+	if !transport.waitFor("boss: owner on test wants to link you") {
+		t.Fatal("Code should be sent to the other nick.")
+	}
+	code := transport.sentCode()
+	run("stranger", "link confirm "+code)
+	if !transport.waitFor("stranger: That's not right.") {
+		t.Error("Only the nick the code was sent to should confirm.")
+	}
+	run("boss", "link confirm "+code)
+	if !transport.waitFor("boss: You are now linked to the account of owner.") {
+		t.Fatal("Link should be confirmed.")
+	}
+	if !bot.AreSamePeople("test", "owner", "Boss_") || bot.AreSamePeople("test", "owner", "stranger") {
+		t.Error("Linked nicks should be the same person.")
+	}
+	if nicks := bot.LinkedNicks("test", "boss"); strings.Join(nicks, ",") != "boss,owner" {
+		t.Errorf("Unexpected linked nicks: %v", nicks)
+	}
+
+	run("owner", "link remove test boss")
+	if !transport.waitFor("owner: Identity unlinked.") || bot.AccountOf("test", "boss") != "" {
+		t.Error("Identity should be unlinked.")
+	}
+}
@@ -0,0 +1,233 @@
+package papaBot
+
+// Ignore list with masks, limited to a transport or a channel and optionally expiring.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// Entry of the ignore list with its compiled mask.
+type ignoreEntry struct {
+	storage.Ignore
+	pattern *regexp.Regexp
+}
+
+// compileMask turns the mask into a regular expression. Masks between slashes are regular expressions, others are
+// globs where * matches any text and ? any single character. Matching is case insensitive.
+func compileMask(mask string) (*regexp.Regexp, error) {
+	if mask == "" {
+		return nil, errors.New("mask can't be empty")
+	}
+	if len(mask) > 2 && strings.HasPrefix(mask, "/") && strings.HasSuffix(mask, "/") {
+		return regexp.Compile("(?i)" + mask[1:len(mask)-1])
+	}
+	glob := regexp.QuoteMeta(mask)
+	glob = strings.Replace(glob, `\*`, ".*", -1)
+	glob = strings.Replace(glob, `\?`, ".", -1)
+	return regexp.Compile("(?i)^" + glob + "$")
+}
+
+// matches checks whether the entry applies to the sender of the message. The mask is matched against the nick, the
+// user id and nick!user id.
+func (entry *ignoreEntry) matches(message events.EventMessage, now time.Time) bool {
+	if !entry.Expires.IsZero() && !now.Before(entry.Expires) {
+		return false
+	}
+	if entry.Transport != "" && entry.Transport != message.TransportName {
+		return false
+	}
+	if entry.Channel != "" && !strings.EqualFold(entry.Channel, message.Channel) {
+		return false
+	}
+	return entry.pattern.MatchString(message.Nick) || entry.pattern.MatchString(message.UserId) ||
+		entry.pattern.MatchString(message.Nick+"!"+message.UserId)
+}
+
+// describeIgnoreScope describes where the entry applies.
+func describeIgnoreScope(ignore storage.Ignore) string {
+	switch {
+	case ignore.Transport == "" && ignore.Channel == "":
+		return "everywhere"
+	case ignore.Channel == "":
+		return "on " + ignore.Transport
+	case ignore.Transport == "":
+		return "on " + ignore.Channel
+	}
+	return "on " + ignore.Transport + ";" + ignore.Channel
+}
+
+// importIgnoredVar moves the ignore list kept in the _ignored variable by older versions into the database.
+func (bot *Bot) importIgnoredVar() error {
+	ignored := strings.Fields(bot.GetVar("_ignored"))
+	for _, userId := range ignored {
+		if err := bot.Storage.AddIgnore(storage.Ignore{Mask: userId, Creator: "migration"}); err != nil {
+			return err
+		}
+	}
+	if len(ignored) > 0 {
+		bot.Log.Infof("Moved %d ignored users from the _ignored variable to the ignore list.", len(ignored))
+		bot.SetVar("_ignored", "")
+	}
+	return nil
+}
+
+// loadIgnores reads the ignore list from the database.
+func (bot *Bot) loadIgnores() error {
+	ignores, err := bot.Storage.Ignores()
+	if err != nil {
+		return err
+	}
+	entries := []*ignoreEntry{}
+	for _, ignore := range ignores {
+		pattern, err := compileMask(ignore.Mask)
+		if err != nil {
+			bot.Log.Errorf("Invalid mask %s on the ignore list: %s", ignore.Mask, err)
+			continue
+		}
+		entries = append(entries, &ignoreEntry{ignore, pattern})
+	}
+	bot.ignoreMu.Lock()
+	defer bot.ignoreMu.Unlock()
+	bot.ignores = entries
+	return nil
+}
+
+// isIgnored checks whether the message comes from an ignored person. Logged in owners are never ignored.
+func (bot *Bot) isIgnored(message events.EventMessage) bool {
+	now := time.Now()
+	matched := false
+	bot.ignoreMu.RLock()
+	for _, entry := range bot.ignores {
+		if entry.matches(message, now) {
+			matched = true
+			break
+		}
+	}
+	bot.ignoreMu.RUnlock()
+	return matched && !bot.UserIsOwner(message.UserId)
+}
+
+// pruneIgnores removes the expired entries from the ignore list.
+func (bot *Bot) pruneIgnores(now time.Time) {
+	removed, err := bot.Storage.DeleteExpiredIgnores(now)
+	if err != nil {
+		bot.Log.Errorf("Can't remove expired ignores: %s", err)
+		return
+	}
+	if removed == 0 {
+		return
+	}
+	bot.Log.Debugf("Removed %d expired ignores.", removed)
+	if err := bot.loadIgnores(); err != nil {
+		bot.Log.Errorf("Can't load the ignore list: %s", err)
+	}
+}
+
+// parseIgnoreScope reads the transport and channel of an ignore. Scope can be "everywhere", "here", a channel of the
+// current transport, transport; for the whole transport or transport;channel.
+func parseIgnoreScope(sourceEvent *events.EventMessage, scope string) (transport, channel string) {
+	switch {
+	case strings.ToLower(scope) == "everywhere":
+		return "", ""
+	case strings.ToLower(scope) == "here":
+		return sourceEvent.TransportName, sourceEvent.Channel
+	case strings.Contains(scope, ";"):
+		parts := strings.SplitN(scope, ";", 2)
+		return parts[0], parts[1]
+	}
+	return sourceEvent.TransportName, scope
+}
+
+// parseIgnoreTime reads how long the ignore lasts. Zero means forever.
+func (bot *Bot) parseIgnoreTime(text string) (time.Duration, error) {
+	if strings.ToLower(text) == "forever" {
+		return 0, nil
+	}
+	duration, err := bot.Humanizer().ParseDuration(text)
+	if err != nil {
+		duration, err = time.ParseDuration(text)
+	}
+	if err != nil || duration <= 0 {
+		return 0, errors.New(fmt.Sprintf("%s is not a duration, use e.g. 2h or \"5 days\"", text))
+	}
+	return duration, nil
+}
+
+// commandIgnoreAdd adds an entry to the ignore list.
+func commandIgnoreAdd(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	duration, err := bot.parseIgnoreTime(args.String("time"))
+	if err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempError, map[string]string{"error": err.Error() + "."}))
+		return
+	}
+	creator := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if creator == "" {
+		creator = sourceEvent.Nick
+	}
+	ignore := storage.Ignore{Mask: args.String("mask"), Reason: args.String("reason"), Creator: creator}
+	ignore.Transport, ignore.Channel = parseIgnoreScope(sourceEvent, args.String("scope"))
+	if duration > 0 {
+		ignore.Expires = time.Now().Add(duration)
+	}
+	if err := bot.AddToIgnoreList(ignore); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempIgnoreFailed, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.Audit(sourceEvent, "ignore.add", ignore.Mask, describeIgnoreScope(ignore))
+	bot.SendMessage(sourceEvent, texts.IgnoreAdded)
+}
+
+// commandIgnoreRemove removes an entry from the ignore list.
+func commandIgnoreRemove(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	id := int64(args.Int("id"))
+	removed, err := bot.RemoveFromIgnoreList(id)
+	if err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempError, map[string]string{"error": err.Error()}))
+		return
+	}
+	if !removed {
+		bot.SendMessage(sourceEvent, texts.NoIgnore)
+		return
+	}
+	bot.Audit(sourceEvent, "ignore.remove", fmt.Sprintf("%d", id), "")
+	bot.SendMessage(sourceEvent, texts.IgnoreRemoved)
+}
+
+// commandIgnoreList lists the ignore list.
+func commandIgnoreList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	ignores := bot.IgnoreList()
+	if len(ignores) == 0 {
+		bot.SendMessage(sourceEvent, texts.IgnoreListEmpty)
+		return
+	}
+	now := time.Now()
+	for _, ignore := range ignores {
+		expires := texts.IgnoreForever
+		if !ignore.Expires.IsZero() {
+			expires = utils.Format(texts.TempIgnoreEnds, map[string]string{
+				"when": bot.LocalHumanizer(sourceEvent).TimeDiff(now, ignore.Expires, false)})
+		}
+		line := utils.Format(texts.TempIgnore, map[string]string{
+			"id":      fmt.Sprintf("%d", ignore.Id),
+			"mask":    ignore.Mask,
+			"scope":   describeIgnoreScope(ignore),
+			"expires": expires,
+			"creator": ignore.Creator,
+		})
+		if ignore.Reason != "" {
+			line += utils.Format(texts.TempIgnoreReason, map[string]string{"reason": ignore.Reason})
+		}
+		bot.SendMessage(sourceEvent, line)
+	}
+}
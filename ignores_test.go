@@ -0,0 +1,52 @@
+package papaBot_test
+
+import (
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestIgnoreList tests ignoring by masks limited to a channel, the listing and the owner exemption.
+func TestIgnoreList(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, channel, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, channel, text, false))
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "auth owner secret")
+	run(events.EventPrivateMessage, "owner", "owner", "ignore add troll* #test forever flooding")
+	run(events.EventPrivateMessage, "owner", "owner", `ignore add /^spam\d+$/ everywhere 2h`)
+	run(events.EventPrivateMessage, "owner", "owner", "ignore add own* everywhere forever")
+	run(events.EventPrivateMessage, "owner", "owner", "ignore list")
+	if !transport.waitFor("owner: 1: troll* on test;#test, forever, added by owner. Reason: flooding") ||
+		!transport.waitFor(`owner: 2: /^spam\d+$/ everywhere, ends `) {
+		t.Fatal("Ignore list should show the entries.")
+	}
+
+	run(events.EventChatMessage, "troll1", "#test", ".whoami")
+	run(events.EventPrivateMessage, "spam7", "spam7", "whoami")
+	run(events.EventPrivateMessage, "troll1", "troll1", "whoami")
+	run(events.EventPrivateMessage, "owner", "owner", "whoami")
+	run(events.EventChatMessage, "bob", "#test", ".whoami")
+	if !transport.waitFor("#test: You are bob, not logged in.") || !transport.waitFor("troll1: You are troll1") {
+		t.Fatal("People not matching the ignore scope should get answers.")
+	}
+	if transport.count("#test: You are troll1") != 0 || transport.count("spam7: ") != 0 {
+		t.Error("Ignored people should get no answers.")
+	}
+	if !transport.waitFor("owner: You are logged in as owner") {
+		t.Error("Logged in owner should never be ignored.")
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "ignore remove 1")
+	if !transport.waitFor("owner: Ignore removed.") {
+		t.Fatal("Owner should remove the ignore.")
+	}
+	run(events.EventChatMessage, "troll1", "#test", ".whoami")
+	if !transport.waitFor("#test: You are troll1, not logged in.") {
+		t.Error("Removed ignore should stop working.")
+	}
+}
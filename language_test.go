@@ -0,0 +1,84 @@
+package papaBot_test
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestLanguages tests choosing the language of a channel and a user, fallback to the default texts and plural forms.
+func TestLanguages(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, channel, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, channel, text, false))
+	}
+
+	run(events.EventChatMessage, "bob", "#test", ".lang")
+	if !transport.waitFor("#test: Language: en. Available: en, pl.") {
+		t.Fatal("Languages should be listed.")
+	}
+	run(events.EventChatMessage, "bob", "#test", ".lang channel pl")
+	if !transport.waitFor("#test: bob, You can't give me orders.") {
+		t.Error("Only people with the channels permission should change the language of the channel.")
+	}
+	run(events.EventChatMessage, "bob", "#test", ".lang me xx")
+	if !transport.waitFor("#test: No texts in xx. Languages: en, pl.") {
+		t.Error("Unknown language should be refused.")
+	}
+
+	// Language of the user.
+	run(events.EventChatMessage, "bob", "#test", ".lang me pl")
+	if !transport.waitFor("#test: Twój język to teraz pl.") {
+		t.Fatal("User should choose the language.")
+	}
+	run(events.EventPrivateMessage, "bob", "bob", "frobnicate")
+	if !transport.waitFor("Szukaj pomocy. (.h)") {
+		t.Error("Replies to the user should be in their language.")
+	}
+
+	// Language of the channel comes before the user's.
+	run(events.EventPrivateMessage, "owner", "owner", "auth owner secret")
+	if !transport.waitFor("owner: You are now logged in.") {
+		t.Fatal("Owner should log in.")
+	}
+	run(events.EventChatMessage, "owner", "#test", ".lang channel pl")
+	if !transport.waitFor("#test: Język tego kanału to teraz pl.") {
+		t.Fatal("Owner should choose the language of the channel.")
+	}
+	run(events.EventChatMessage, "alice", "#test", ".lang me en")
+	run(events.EventChatMessage, "alice", "#test", ".chan list")
+	if !transport.waitFor("#test: alice, Nie będziesz mi rozkazywać.") {
+		t.Error("Replies on the channel should be in its language.")
+	}
+
+	// Texts missing in a language come from the default one, plural forms follow the language.
+	type btcTexts struct{ NoData string }
+	type duplicatesTexts struct{ TempDuplicateMulti *template.Template }
+	if err := bot.LoadTexts("btc", &btcTexts{}); err != nil {
+		t.Fatalf("Can't load texts: %s", err)
+	}
+	if err := bot.LoadTexts("duplicates", &duplicatesTexts{}); err != nil {
+		t.Fatalf("Can't load texts: %s", err)
+	}
+	sourceEvent := message(events.EventChatMessage, "alice", "#test", "", false)
+	if noData := bot.LocalTexts(&sourceEvent, "btc").(*btcTexts).NoData; noData != "Checking. Give me a moment..." {
+		t.Errorf("Missing text should come from the default language, got: %s", noData)
+	}
+	multi := bot.LocalTexts(&sourceEvent, "duplicates").(*duplicatesTexts).TempDuplicateMulti
+	forms := map[string]string{
+		"1": "1 wrzutka", "3": "3 wrzutki", "12": "12 wrzutek", "22": "22 wrzutki", "25": "25 wrzutek"}
+	for count, form := range forms {
+		buffer := &bytes.Buffer{}
+		if err := multi.Execute(buffer, map[string]string{"count": count}); err != nil {
+			t.Fatalf("Can't execute template: %s", err)
+		}
+		if !bytes.Contains(buffer.Bytes(), []byte(form)) {
+			t.Errorf("Expected %q in: %s", form, buffer.String())
+		}
+	}
+}
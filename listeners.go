@@ -5,6 +5,7 @@ package papaBot
 import (
 	"fmt"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/utils"
 	"log"
 	"mvdan.cc/xurls/v2"
@@ -20,6 +21,7 @@ var descRe = regexp.MustCompile(`(?is)(property|name)\s*?=.*?description`)
 // messageListener looks for commands in messages.
 func (bot *Bot) messageListener(message events.EventMessage) {
 	// Increase lines count for all announcements.
+	bot.urlsMu.Lock()
 	for k := range bot.lastURLAnnouncedLinesPassed {
 		bot.lastURLAnnouncedLinesPassed[k] += 1
 		// After 100 lines pass, forget it ever happened.
@@ -28,9 +30,12 @@ func (bot *Bot) messageListener(message events.EventMessage) {
 			delete(bot.lastURLAnnouncedTime, k)
 		}
 	}
+	bot.urlsMu.Unlock()
 
 	// Handles the commands.
-	if message.AtBot {
+	if command, isCommand := bot.commandTrigger(&message); isCommand {
+		message.Message = command
+		message.AtBot = true
 		bot.handleBotCommand(&message)
 	}
 }
@@ -79,13 +84,14 @@ func (bot *Bot) handleURLsListener(message events.EventMessage) {
 
 		// Insert URL into the db.
 		bot.Log.Debugf("Storing URL info for: %s", link)
-		if _, err := bot.Db.Exec(`INSERT INTO urls(transport, channel, nick, link, quote, title) VALUES(?, ?, ?, ?, ?, ?)`,
-			message.TransportName, message.Channel, message.Nick, link, message.Message, title); err != nil {
+		if err := bot.Storage.AddURL(storage.URL{
+			Transport: message.TransportName, Channel: message.Channel, Nick: message.Nick, Link: link,
+			Quote: message.Message, Title: title}); err != nil {
 			bot.Log.Warningf("Can't add url to database: %s", err)
 		}
 
-		// Trigger url found message.
-		bot.EventDispatcher.Trigger(events.EventMessage{
+		// Trigger url found message. Listeners can consume it to replace the title announcement.
+		consumed := bot.EventDispatcher.TriggerSyncFromListener(events.EventMessage{
 			message.TransportName,
 			message.TransportFormatting,
 			events.EventURLFound,
@@ -97,38 +103,44 @@ func (bot *Bot) handleURLsListener(message events.EventMessage) {
 			message.AtBot,
 		})
 
-		linkKey := link + message.Channel
-		// If we can't announce yet, skip this link.
-		if time.Since(bot.lastURLAnnouncedTime[linkKey]) < bot.Config.UrlAnnounceIntervalMinutes*time.Minute {
+		// Was the link handled by a listener? Are the announcements enabled on this channel?
+		if consumed || title == "" || !bot.ChannelAllows(message.TransportName, message.Channel, PolicyURLs, "") {
 			continue
 		}
-		if lines, exists := bot.lastURLAnnouncedLinesPassed[linkKey]; exists && lines < bot.Config.UrlAnnounceIntervalLines {
+		// If we can't announce yet, skip this link.
+		if !bot.claimURLAnnouncement(link + message.Channel) {
 			continue
 		}
 
-		// On mattermost we can skip all link info display.
-		if message.TransportName == "mattermost" {
-			return
-		}
-
 		// Announce the title, save the description.
-		if title != "" {
-			if description != "" {
-				bot.SendNotice(&message, title+" …")
-			} else {
-				bot.SendNotice(&message, title)
-			}
-			bot.lastURLAnnouncedTime[linkKey] = time.Now()
-			bot.lastURLAnnouncedLinesPassed[linkKey] = 0
-			// Keep the long info for later.
-			bot.AddMoreInfo(message.TransportName, message.Channel, description)
+		if description != "" {
+			bot.SendNotice(&message, title+" …")
+		} else {
+			bot.SendNotice(&message, title)
 		}
+		// Keep the long info for later.
+		bot.AddMoreInfo(message.TransportName, message.Channel, description)
+	}
+}
+
+// claimURLAnnouncement checks whether the link can be announced again and if so, marks it as announced now.
+func (bot *Bot) claimURLAnnouncement(linkKey string) bool {
+	bot.urlsMu.Lock()
+	defer bot.urlsMu.Unlock()
+	if time.Since(bot.lastURLAnnouncedTime[linkKey]) < bot.Config().UrlAnnounceIntervalMinutes {
+		return false
+	}
+	if lines, exists := bot.lastURLAnnouncedLinesPassed[linkKey]; exists && lines < bot.Config().UrlAnnounceIntervalLines {
+		return false
 	}
+	bot.lastURLAnnouncedTime[linkKey] = time.Now()
+	bot.lastURLAnnouncedLinesPassed[linkKey] = 0
+	return true
 }
 
 // scribe saves the message into appropriate channel log file.
 func (bot *Bot) scribeListener(message events.EventMessage) {
-	if !bot.Config.ChatLogging {
+	if !bot.Config().ChatLogging {
 		return
 	}
 	go func() {
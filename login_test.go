@@ -0,0 +1,47 @@
+package papaBot_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// TestLogin tests the upgrade of old password hashes and the lockout after failed logins.
+func TestLogin(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	auth := func(password string) {
+		bot.EventDispatcher.Trigger(message(events.EventPrivateMessage, "owner", "owner", "auth owner "+password, false))
+	}
+
+	// Hash made by the older versions of the bot.
+	legacy := base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte("secret"), []byte("secret"), 4096, sha256.Size,
+		sha256.New))
+	if _, err := bot.Storage.SetPassword("owner", legacy); err != nil {
+		t.Fatalf("Can't set password: %s", err)
+	}
+	auth("secret")
+	if !transport.waitFor("owner: You are now logged in.") {
+		t.Fatal("Old hash should still work.")
+	}
+	if user, _ := bot.Storage.GetUser("owner"); !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("Hash should be upgraded, got %s.", user.Password)
+	}
+
+	for i := 0; i < 5; i++ {
+		auth("wrong")
+	}
+	auth("secret")
+	if !transport.waitFor("owner: Too many failed logins.") || transport.count("owner: You are now logged in.") != 1 {
+		t.Error("Account should be locked after too many failed logins.")
+	}
+	if user, _ := bot.Storage.GetUser("owner"); user.LockedUntil.IsZero() {
+		t.Error("Lockout should be saved.")
+	}
+}
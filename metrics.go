@@ -0,0 +1,79 @@
+package papaBot
+
+// Bot metrics and the HTTP server exposing them.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/pawelszydlo/papa-bot/metrics"
+)
+
+// Settings read from the metrics section of the config file.
+type metricsSettings struct {
+	Enabled bool   `config:"enabled" default:"false"`
+	Listen  string `config:"listen" default:"127.0.0.1:9190"`
+}
+
+// Bot metrics.
+var (
+	commandInvocations = metrics.NewCounterVec(
+		"papabot_command_invocations_total", "Bot commands run, per command.", "command")
+	commandSeconds = metrics.NewHistogramVec(
+		"papabot_command_duration_seconds", "Time spent running bot commands.", metrics.DefBuckets, "command")
+	httpRequests = metrics.NewCounterVec(
+		"papabot_http_requests_total", "Pages fetched with GetPageBody, per host and status code.", "host", "code")
+	httpSeconds = metrics.NewHistogramVec(
+		"papabot_http_request_duration_seconds", "Time spent fetching pages, per host.", metrics.DefBuckets, "host")
+)
+
+// registerDispatcherMetrics exposes the event queue statistics.
+func (bot *Bot) registerDispatcherMetrics() {
+	metrics.NewGaugeFunc("papabot_event_queue_depth", "Events waiting for a worker.", func() float64 {
+		return float64(bot.EventDispatcher.Stats().QueueDepth)
+	})
+	metrics.NewCounterFunc("papabot_events_dropped_total", "Events dropped because of full queues.", func() float64 {
+		return float64(bot.EventDispatcher.Stats().Dropped)
+	})
+	metrics.NewCounterFunc("papabot_listener_timeouts_total", "Listeners that ran over the timeout.", func() float64 {
+		return float64(bot.EventDispatcher.Stats().TimedOut)
+	})
+}
+
+// startMetricsServer starts serving the metrics on /metrics, if enabled.
+func (bot *Bot) startMetricsServer() error {
+	settings := metricsSettings{}
+	if err := bot.loader().Load("metrics", &settings); err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		return nil
+	}
+	listener, err := net.Listen("tcp", settings.Listen)
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't listen on %s: %s", settings.Listen, err))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	bot.metricsServer = &http.Server{Handler: mux}
+	bot.Log.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := bot.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			bot.Log.Errorf("Metrics server failed: %s", err)
+		}
+	}()
+	return nil
+}
+
+// stopMetricsServer stops the metrics server, if it's running.
+func (bot *Bot) stopMetricsServer(ctx context.Context) {
+	if bot.metricsServer == nil {
+		return
+	}
+	if err := bot.metricsServer.Shutdown(ctx); err != nil {
+		bot.Log.Warningf("Error stopping the metrics server: %s", err)
+	}
+}
@@ -0,0 +1,336 @@
+// Package metrics collects counters, gauges and histograms and exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default buckets for durations, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric that can be written out by a registry.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics exposed together.
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]collector
+}
+
+// Default registry, used by the New* functions.
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]collector{}}
+}
+
+// register adds the metric to the registry. A metric registered again under the same name replaces the old one.
+func (registry *Registry) register(metric collector) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.collectors[metric.name()] = metric
+}
+
+// Write writes all the metrics in the Prometheus text format, sorted by name.
+func (registry *Registry) Write(w io.Writer) {
+	registry.mu.RLock()
+	names := make([]string, 0, len(registry.collectors))
+	for name := range registry.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, registry.collectors[name])
+	}
+	registry.mu.RUnlock()
+	for _, metric := range collectors {
+		metric.write(w)
+	}
+}
+
+// ServeHTTP serves the metrics to the Prometheus scraper.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.Write(w)
+}
+
+// Name, help and label names of a metric.
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+// writeHeader writes the HELP and TYPE lines.
+func (d *desc) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metricName, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metricName, metricType)
+}
+
+// formatLabels builds the {name="value",...} part of a sample, with optional extra label at the end.
+func (d *desc) formatLabels(values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, label := range d.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, values[i]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// key checks the label values and joins them into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// formatValue formats a sample value the way Prometheus expects.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Value of a counter or gauge with its label values.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// Set of samples per label values, shared by counters and gauges.
+type sampleVec struct {
+	desc
+	metricType string
+	mu         sync.Mutex
+	samples    map[string]*sample
+}
+
+func newSampleVec(name, help, metricType string, labels []string) *sampleVec {
+	return &sampleVec{desc: desc{name, help, labels}, metricType: metricType, samples: map[string]*sample{}}
+}
+
+// add changes the value for the label values, or sets it if replace is true.
+func (vec *sampleVec) add(delta float64, replace bool, values []string) {
+	key := vec.key(values)
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	s, ok := vec.samples[key]
+	if !ok {
+		s = &sample{labels: append([]string{}, values...)}
+		vec.samples[key] = s
+	}
+	if replace {
+		s.value = delta
+	} else {
+		s.value += delta
+	}
+}
+
+// get returns the value for the label values.
+func (vec *sampleVec) get(values []string) float64 {
+	key := vec.key(values)
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	if s, ok := vec.samples[key]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (vec *sampleVec) write(w io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	vec.writeHeader(w, vec.metricType)
+	keys := make([]string, 0, len(vec.samples))
+	for key := range vec.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := vec.samples[key]
+		fmt.Fprintf(w, "%s%s %s\n", vec.metricName, vec.formatLabels(s.labels, "", ""), formatValue(s.value))
+	}
+}
+
+// CounterVec is a set of counters, one per combination of label values.
+type CounterVec struct {
+	vec *sampleVec
+}
+
+// NewCounterVec creates a counter and registers it in the default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{newSampleVec(name, help, "counter", labels)}
+	Default.register(counter.vec)
+	return counter
+}
+
+// Inc increments the counter for the label values.
+func (counter *CounterVec) Inc(values ...string) {
+	counter.vec.add(1, false, values)
+}
+
+// Add adds a non-negative value to the counter for the label values.
+func (counter *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", counter.vec.metricName))
+	}
+	counter.vec.add(delta, false, values)
+}
+
+// Value returns the counter for the label values.
+func (counter *CounterVec) Value(values ...string) float64 {
+	return counter.vec.get(values)
+}
+
+// GaugeVec is a set of gauges, one per combination of label values.
+type GaugeVec struct {
+	vec *sampleVec
+}
+
+// NewGaugeVec creates a gauge and registers it in the default registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gauge := &GaugeVec{newSampleVec(name, help, "gauge", labels)}
+	Default.register(gauge.vec)
+	return gauge
+}
+
+// Set sets the gauge for the label values.
+func (gauge *GaugeVec) Set(value float64, values ...string) {
+	gauge.vec.add(value, true, values)
+}
+
+// Add changes the gauge for the label values.
+func (gauge *GaugeVec) Add(delta float64, values ...string) {
+	gauge.vec.add(delta, false, values)
+}
+
+// Value returns the gauge for the label values.
+func (gauge *GaugeVec) Value(values ...string) float64 {
+	return gauge.vec.get(values)
+}
+
+// Metric without labels whose value is read on every scrape.
+type funcMetric struct {
+	desc
+	metricType string
+	value      func() float64
+}
+
+func (metric *funcMetric) write(w io.Writer) {
+	metric.writeHeader(w, metric.metricType)
+	fmt.Fprintf(w, "%s %s\n", metric.metricName, formatValue(metric.value()))
+}
+
+// NewGaugeFunc registers a gauge in the default registry, whose value is read from the function on every scrape.
+func NewGaugeFunc(name, help string, value func() float64) {
+	Default.register(&funcMetric{desc{name, help, nil}, "gauge", value})
+}
+
+// NewCounterFunc registers a counter in the default registry, whose value is read from the function on every scrape.
+func NewCounterFunc(name, help string, value func() float64) {
+	Default.register(&funcMetric{desc{name, help, nil}, "counter", value})
+}
+
+// Observations of a histogram for one combination of label values.
+type histogramSample struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a set of histograms, one per combination of label values.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	samples map[string]*histogramSample
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds of buckets and registers it in the default
+// registry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	histogram := &HistogramVec{
+		desc: desc{name, help, labels}, buckets: sorted, samples: map[string]*histogramSample{}}
+	Default.register(histogram)
+	return histogram
+}
+
+// Observe adds the value to the histogram for the label values.
+func (histogram *HistogramVec) Observe(value float64, values ...string) {
+	key := histogram.key(values)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	s, ok := histogram.samples[key]
+	if !ok {
+		s = &histogramSample{labels: append([]string{}, values...), counts: make([]uint64, len(histogram.buckets))}
+		histogram.samples[key] = s
+	}
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of observations for the label values.
+func (histogram *HistogramVec) Count(values ...string) uint64 {
+	key := histogram.key(values)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	if s, ok := histogram.samples[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (histogram *HistogramVec) write(w io.Writer) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	histogram.writeHeader(w, "histogram")
+	keys := make([]string, 0, len(histogram.samples))
+	for key := range histogram.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := histogram.samples[key]
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				histogram.metricName, histogram.formatLabels(s.labels, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.metricName, histogram.formatLabels(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.metricName, histogram.formatLabels(s.labels, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.metricName, histogram.formatLabels(s.labels, "", ""), s.count)
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTextFormat(t *testing.T) {
+	registry := Default
+	Default = NewRegistry()
+	defer func() { Default = registry }()
+
+	counter := NewCounterVec("test_total", "Test counter.", "kind")
+	counter.Inc("a")
+	counter.Add(2, "a")
+	counter.Inc(`quote"d`)
+	gauge := NewGaugeVec("test_gauge", "Test gauge.")
+	gauge.Set(5)
+	gauge.Add(-1.5)
+	histogram := NewHistogramVec("test_seconds", "Test histogram.", []float64{1, 0.1}, "kind")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(3, "a")
+	NewGaugeFunc("test_func", "Test function.", func() float64 { return 7 })
+
+	recorder := httptest.NewRecorder()
+	Default.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP test_func Test function.
+# TYPE test_func gauge
+test_func 7
+# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge 3.5
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{kind="a",le="0.1"} 1
+test_seconds_bucket{kind="a",le="1"} 2
+test_seconds_bucket{kind="a",le="+Inf"} 3
+test_seconds_sum{kind="a"} 3.55
+test_seconds_count{kind="a"} 3
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a"} 3
+test_total{kind="quote\"d"} 1
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("Unexpected output:\n%s", body)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type: %s", recorder.Header().Get("Content-Type"))
+	}
+	if counter.Value("a") != 3 || histogram.Count("a") != 3 {
+		t.Errorf("Unexpected values: %v, %v", counter.Value("a"), histogram.Count("a"))
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	registry := Default
+	Default = NewRegistry()
+	defer func() { Default = registry }()
+
+	counter := NewCounterVec("test_total", "Test counter.", "kind")
+	defer func() {
+		if recover() == nil {
+			t.Error("Wrong number of label values should panic.")
+		}
+	}()
+	counter.Inc()
+}
@@ -0,0 +1,75 @@
+package papaBot
+
+// Versioned database schema migrations.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/storage"
+)
+
+// Migration is a named change of the database schema or data. Extensions that keep their own tables return them
+// from the optional Migrations() method. Use the Driver field for SQL that works only with one database.
+type Migration = storage.Migration
+
+// migrationSets lists the migrations of the bot and of all registered extensions.
+func (bot *Bot) migrationSets() []storage.MigrationSet {
+	sets := bot.Storage.BuiltinMigrations()
+	for _, ext := range bot.extensionList() {
+		if migrator, ok := ext.extension.(extensionMigrator); ok {
+			sets = append(sets, storage.MigrationSet{Owner: ext.name, Migrations: migrator.Migrations()})
+		}
+	}
+	return sets
+}
+
+// migrate applies all pending migrations. It stops on the first failed one.
+func (bot *Bot) migrate() error {
+	pending, err := bot.Storage.PendingMigrations(bot.migrationSets())
+	if err != nil {
+		return err
+	}
+	for _, migration := range pending {
+		if err := bot.Storage.ApplyMigration(migration); err != nil {
+			return errors.New(fmt.Sprintf("migration %s/%s failed: %s", migration.Owner, migration.Name, err))
+		}
+		bot.Log.Infof("Applied migration %s/%s.", migration.Owner, migration.Name)
+	}
+	return nil
+}
+
+// DryRunMigrations prints the migrations that would be applied on the next start, without changing the database.
+// Register all extensions before calling it.
+func (bot *Bot) DryRunMigrations(out io.Writer) error {
+	if bot.Storage == nil {
+		if err := bot.initDb(); err != nil {
+			return err
+		}
+		defer func() {
+			bot.Storage.Close()
+			bot.Storage = nil
+		}()
+	}
+	pending, err := bot.Storage.PendingMigrations(bot.migrationSets())
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintln(out, "No pending migrations.")
+		return nil
+	}
+	fmt.Fprintf(out, "%d pending migrations (%s):\n", len(pending), bot.Storage.Driver())
+	for _, migration := range pending {
+		fmt.Fprintf(out, "\n-- %s/%s\n", migration.Owner, migration.Name)
+		if migration.Up != "" {
+			fmt.Fprintln(out, strings.TrimSpace(migration.Up))
+		}
+		if migration.UpFunc != nil {
+			fmt.Fprintln(out, "-- (and a data migration in code)")
+		}
+	}
+	return nil
+}
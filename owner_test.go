@@ -0,0 +1,107 @@
+package papaBot_test
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+)
+
+// syncBuffer is a buffer that can be written by the bot's log and read by the test at the same time.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+// removeOwner deletes the owner created by newTestBot, so that the bot starts without one.
+func removeOwner(t *testing.T, bot *papaBot.Bot) {
+	settings := struct {
+		DSN string `config:"dsn"`
+	}{}
+	if err := bot.LoadConfig("database", &settings); err != nil {
+		t.Fatalf("Can't read database settings: %s", err)
+	}
+	store, err := storage.Open("sqlite", settings.DSN)
+	if err != nil {
+		t.Fatalf("Can't open the database: %s", err)
+	}
+	defer store.Close()
+	if _, err := store.DeleteUser("owner"); err != nil {
+		t.Fatalf("Can't delete the owner: %s", err)
+	}
+}
+
+// TestOwnerSetupToken tests claiming ownership of a bot without an owner with the token from the log.
+func TestOwnerSetupToken(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	removeOwner(t, bot)
+	log := &syncBuffer{}
+	bot.Log.SetOutput(log)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(nick, text string) {
+		bot.EventDispatcher.Trigger(message(events.EventPrivateMessage, nick, nick, text, false))
+	}
+
+	match := regexp.MustCompile(`claim ([0-9a-f]{32})`).FindStringSubmatch(log.String())
+	if match == nil {
+		t.Fatalf("Setup token should be logged, got: %s", log.String())
+	}
+	token := match[1]
+
+	run("alice", "claim "+token)
+	if !transport.waitFor("alice: Create an account with useradd or log in first.") {
+		t.Error("Claim should need an account.")
+	}
+	run("alice", "useradd alice pass")
+	if !transport.waitFor("alice: User added.") {
+		t.Fatal("User should be added.")
+	}
+	run("alice", "claim 0123")
+	if !transport.waitFor("alice: That's not right.") {
+		t.Error("Wrong token should be refused.")
+	}
+	run("alice", "claim "+token)
+	if !transport.waitFor("alice: You are now the owner.") || !bot.UserIsOwner("alice-id") {
+		t.Fatal("Right token should give the owner role.")
+	}
+
+	run("mallory", "useradd mallory pass")
+	run("mallory", "claim "+token)
+	if !transport.waitFor("mallory: That's not right.") || bot.UserIsOwner("mallory-id") {
+		t.Error("Token should work only once.")
+	}
+}
+
+// TestOwnerFromEnvironment tests creating the owner from the environment variables.
+func TestOwnerFromEnvironment(t *testing.T) {
+	t.Setenv("PAPABOT_OWNER_NICK", "boss")
+	t.Setenv("PAPABOT_OWNER_PASSWORD", "hunter2")
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	removeOwner(t, bot)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+
+	bot.EventDispatcher.Trigger(message(events.EventPrivateMessage, "boss", "boss", "auth boss hunter2", false))
+	if !transport.waitFor("boss: You are now logged in.") || !bot.UserIsOwner("boss-id") {
+		t.Error("Owner should be created from the environment.")
+	}
+}
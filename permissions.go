@@ -0,0 +1,437 @@
+package papaBot
+
+// Roles with permission sets, assigned to users globally or per channel, and the audit trail of privileged actions.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// Permissions of the bot's own commands and actions.
+const (
+	// All permissions.
+	PermAll        = "*"
+	PermVars       = "vars"
+	PermIgnore     = "ignore"
+	PermReload     = "reload"
+	PermStats      = "stats"
+	PermExtensions = "extensions"
+	PermChannels   = "channels"
+	PermRoles      = "roles"
+	PermAudit      = "audit"
+	PermSessions   = "sessions"
+	// Commands are not rate limited.
+	PermNoLimits = "limits.bypass"
+)
+
+// Role of the bot's owners. It always has all the permissions and can't be deleted.
+const OwnerRole = "owner"
+
+// Number of audit entries shown by default and at most.
+const (
+	auditDefaultEntries = 10
+	auditMaxEntries     = 50
+)
+
+// initPermissions registers the permissions of the bot's own actions.
+func (bot *Bot) initPermissions() {
+	bot.RegisterPermission(PermVars, "Read and change the custom variables.")
+	bot.RegisterPermission(PermIgnore, "Change the ignore list.")
+	bot.RegisterPermission(PermReload, "Reload the configuration and texts.")
+	bot.RegisterPermission(PermStats, "See the event queue statistics.")
+	bot.RegisterPermission(PermExtensions, "Enable and disable extensions.")
+	bot.RegisterPermission(PermChannels, "Change the settings of channels.")
+	bot.RegisterPermission(PermRoles, "Manage roles and grant them to users.")
+	bot.RegisterPermission(PermAudit, "Read the audit trail.")
+	bot.RegisterPermission(PermSessions, "See and end the sessions of users.")
+	bot.RegisterPermission(PermNoLimits, "Commands are not rate limited.")
+}
+
+// RegisterPermission declares a permission that roles can include, for the commands and actions that need it.
+func (bot *Bot) RegisterPermission(name, description string) {
+	bot.rolesMu.Lock()
+	defer bot.rolesMu.Unlock()
+	if _, exists := bot.permissions[name]; !exists {
+		bot.permissions[name] = description
+	}
+}
+
+// permissionExists checks whether the permission was registered.
+func (bot *Bot) permissionExists(name string) bool {
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	_, exists := bot.permissions[name]
+	return exists || name == PermAll
+}
+
+// loadRoles loads the roles and their assignments from the database.
+func (bot *Bot) loadRoles() error {
+	roles, err := bot.Storage.Roles()
+	if err != nil {
+		return err
+	}
+	assignments, err := bot.Storage.RoleAssignments()
+	if err != nil {
+		return err
+	}
+	rolePermissions := map[string]map[string]bool{}
+	for _, role := range roles {
+		rolePermissions[role.Name] = map[string]bool{}
+		for _, permission := range role.Permissions {
+			rolePermissions[role.Name][permission] = true
+		}
+	}
+	rolePermissions[OwnerRole] = map[string]bool{PermAll: true}
+	userRoles := map[string][]storage.RoleAssignment{}
+	for _, assignment := range assignments {
+		userRoles[assignment.Nick] = append(userRoles[assignment.Nick], assignment)
+	}
+	bot.rolesMu.Lock()
+	defer bot.rolesMu.Unlock()
+	bot.rolePermissions = rolePermissions
+	bot.userRoles = userRoles
+	return nil
+}
+
+// nickCan checks whether the user's roles on the channel, or global ones, give the permission.
+func (bot *Bot) nickCan(nick, channelId, permission string) bool {
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	for _, assignment := range bot.userRoles[nick] {
+		if assignment.ChannelId != "" && assignment.ChannelId != channelId {
+			continue
+		}
+		permissions := bot.rolePermissions[assignment.Role]
+		if permissions[PermAll] || permissions[permission] {
+			return true
+		}
+	}
+	return false
+}
+
+// UserCan checks whether the authenticated user has the permission on the channel of the event. Empty permission
+// is given to everyone.
+func (bot *Bot) UserCan(sourceEvent *events.EventMessage, permission string) bool {
+	if permission == "" {
+		return true
+	}
+	nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	return nick != "" && bot.nickCan(nick, sourceEvent.ChannelId(), permission)
+}
+
+// nickHasRole checks whether the user has the role everywhere.
+func (bot *Bot) nickHasRole(nick, role string) bool {
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	for _, assignment := range bot.userRoles[nick] {
+		if assignment.Role == role && assignment.ChannelId == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// roleExists checks whether the role was defined.
+func (bot *Bot) roleExists(name string) bool {
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	_, exists := bot.rolePermissions[name]
+	return exists
+}
+
+// rolePermissionList returns the sorted permissions of the role.
+func (bot *Bot) rolePermissionList(name string) []string {
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	permissions := []string{}
+	for permission := range bot.rolePermissions[name] {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+	return permissions
+}
+
+// userCanAllOn checks whether the user has all of the permissions on the channel, or everywhere when the channel id
+// is empty, so that nobody can give out more than they have where they give it.
+func (bot *Bot) userCanAllOn(sourceEvent *events.EventMessage, channelId string, permissions []string) bool {
+	nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if nick == "" {
+		return false
+	}
+	for _, permission := range permissions {
+		if !bot.nickCan(nick, channelId, permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// Audit records a change made with special privileges by the user of the event.
+func (bot *Bot) Audit(sourceEvent *events.EventMessage, action, target, details string) {
+	actor := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if actor == "" {
+		actor = sourceEvent.Nick
+	}
+	bot.audit(actor, action, target, details)
+}
+
+// audit records a change in the audit trail.
+func (bot *Bot) audit(actor, action, target, details string) {
+	bot.Log.Infof("Audit: %s did %s on %s (%s).", actor, action, target, details)
+	if err := bot.Storage.AddAuditEntry(storage.AuditEntry{
+		Actor: actor, Action: action, Target: target, Details: details}); err != nil {
+		bot.Log.Errorf("Can't add audit entry: %s", err)
+	}
+}
+
+// setRole creates the role or replaces its permissions.
+func (bot *Bot) setRole(name string, permissions []string) error {
+	if name == OwnerRole {
+		return errors.New("The owner role can't be changed.")
+	}
+	for _, permission := range permissions {
+		if !bot.permissionExists(permission) {
+			return errors.New(fmt.Sprintf("Unknown permission %s.", permission))
+		}
+	}
+	if err := bot.Storage.SetRole(storage.Role{Name: name, Permissions: permissions}); err != nil {
+		return err
+	}
+	return bot.loadRoles()
+}
+
+// deleteRole removes the role from the database and from the users.
+func (bot *Bot) deleteRole(name string) error {
+	if name == OwnerRole {
+		return errors.New("The owner role can't be deleted.")
+	}
+	if deleted, err := bot.Storage.DeleteRole(name); err != nil {
+		return err
+	} else if !deleted {
+		return errors.New(fmt.Sprintf("No role named %s.", name))
+	}
+	return bot.loadRoles()
+}
+
+// grantRole gives the role to the user, everywhere or on the channel.
+func (bot *Bot) grantRole(assignment storage.RoleAssignment) error {
+	if !bot.roleExists(assignment.Role) {
+		return errors.New(fmt.Sprintf("No role named %s.", assignment.Role))
+	}
+	if _, err := bot.Storage.GetUser(assignment.Nick); err == storage.ErrNotFound {
+		return errors.New(fmt.Sprintf("No user named %s.", assignment.Nick))
+	} else if err != nil {
+		return err
+	}
+	if err := bot.Storage.AssignRole(assignment); err != nil {
+		return err
+	}
+	return bot.loadRoles()
+}
+
+// isLastOwner checks whether the user is the only one with the owner role.
+func (bot *Bot) isLastOwner(nick string) bool {
+	if !bot.nickHasRole(nick, OwnerRole) {
+		return false
+	}
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	for other, assignments := range bot.userRoles {
+		for _, assignment := range assignments {
+			if other != nick && assignment.Role == OwnerRole && assignment.ChannelId == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// revokeRole takes the role from the user. The last owner can't lose the owner role.
+func (bot *Bot) revokeRole(assignment storage.RoleAssignment) error {
+	if assignment.Role == OwnerRole && assignment.ChannelId == "" && bot.isLastOwner(assignment.Nick) {
+		return errors.New("The last owner can't be removed.")
+	}
+	if revoked, err := bot.Storage.UnassignRole(assignment); err != nil {
+		return err
+	} else if !revoked {
+		return errors.New(fmt.Sprintf("%s doesn't have that role.", assignment.Nick))
+	}
+	return bot.loadRoles()
+}
+
+// nickRoles returns the descriptions of the user's roles.
+func (bot *Bot) nickRoles(nick string) []string {
+	bot.rolesMu.RLock()
+	defer bot.rolesMu.RUnlock()
+	roles := []string{}
+	for _, assignment := range bot.userRoles[nick] {
+		roles = append(roles, describeAssignment(assignment))
+	}
+	return roles
+}
+
+// describeAssignment formats the role with the channel it's limited to, e.g. "mod on irc;#bot".
+func describeAssignment(assignment storage.RoleAssignment) string {
+	if assignment.ChannelId == "" {
+		return assignment.Role
+	}
+	return assignment.Role + " on " + assignment.ChannelId
+}
+
+// assignmentFromArgs builds the role assignment from the command arguments. Channel can be given as a channel name
+// of the current transport, or as transport;channel.
+func assignmentFromArgs(sourceEvent *events.EventMessage, args *CommandArgs) storage.RoleAssignment {
+	channelId := args.String("channel")
+	if channelId != "" && !strings.Contains(channelId, ";") {
+		channelId = sourceEvent.TransportName + ";" + channelId
+	}
+	return storage.RoleAssignment{Nick: args.String("nick"), Role: args.String("role"), ChannelId: channelId}
+}
+
+// commandRoleList lists the roles with their permissions.
+func commandRoleList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	roles, err := bot.Storage.Roles()
+	if err != nil {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("Error: %s", err))
+		return
+	}
+	for _, role := range roles {
+		bot.SendMessage(sourceEvent, fmt.Sprintf(
+			"%s: %s", role.Name, strings.Join(bot.rolePermissionList(role.Name), ", ")))
+	}
+}
+
+// commandRolePermissions lists the known permissions.
+func commandRolePermissions(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	bot.rolesMu.RLock()
+	names := []string{}
+	for name := range bot.permissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s - %s", name, bot.permissions[name]))
+	}
+	bot.rolesMu.RUnlock()
+	for _, line := range lines {
+		bot.SendMessage(sourceEvent, line)
+	}
+}
+
+// commandRoleSet creates a role or replaces its permissions.
+func commandRoleSet(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	name := args.String("name")
+	permissions := strings.FieldsFunc(args.String("permissions"), func(r rune) bool { return r == ',' || r == ' ' })
+	// Roles are global, so are the permissions needed to change them. Replacing a role takes away its permissions
+	// from everyone who has it, so they are needed as well.
+	needed := append([]string{PermRoles}, permissions...)
+	needed = append(needed, bot.rolePermissionList(name)...)
+	if !bot.userCanAllOn(sourceEvent, "", needed) {
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleSetRefused)
+		return
+	}
+	if err := bot.setRole(name, permissions); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(
+			bot.texts(sourceEvent).TempRoleSetFailed, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.Audit(sourceEvent, "role.set", name, strings.Join(permissions, ", "))
+	bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleSaved)
+}
+
+// commandRoleDelete deletes a role.
+func commandRoleDelete(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	name := args.String("name")
+	if !bot.userCanAllOn(sourceEvent, "", append([]string{PermRoles}, bot.rolePermissionList(name)...)) {
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleDeleteRefused)
+		return
+	}
+	if err := bot.deleteRole(name); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(
+			bot.texts(sourceEvent).TempRoleDeleteFailed, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.Audit(sourceEvent, "role.delete", name, "")
+	bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleDeleted)
+}
+
+// commandRoleGrant gives a role to a user.
+func commandRoleGrant(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	assignment := assignmentFromArgs(sourceEvent, args)
+	needed := append([]string{PermRoles}, bot.rolePermissionList(assignment.Role)...)
+	if !bot.userCanAllOn(sourceEvent, assignment.ChannelId, needed) {
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleGrantRefused)
+		return
+	}
+	if err := bot.grantRole(assignment); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(
+			bot.texts(sourceEvent).TempRoleGrantFailed, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.Audit(sourceEvent, "role.grant", assignment.Nick, describeAssignment(assignment))
+	bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleGranted)
+}
+
+// commandRoleRevoke takes a role from a user.
+func commandRoleRevoke(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	assignment := assignmentFromArgs(sourceEvent, args)
+	needed := append([]string{PermRoles}, bot.rolePermissionList(assignment.Role)...)
+	if !bot.userCanAllOn(sourceEvent, assignment.ChannelId, needed) {
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleRevokeRefused)
+		return
+	}
+	if err := bot.revokeRole(assignment); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(
+			bot.texts(sourceEvent).TempRoleRevokeFailed, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.Audit(sourceEvent, "role.revoke", assignment.Nick, describeAssignment(assignment))
+	bot.SendMessage(sourceEvent, bot.texts(sourceEvent).RoleRevoked)
+}
+
+// commandRoleShow lists the roles of a user.
+func commandRoleShow(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	nick := args.String("nick")
+	roles := bot.nickRoles(nick)
+	if len(roles) == 0 {
+		bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempNoRoles, map[string]string{"nick": nick}))
+		return
+	}
+	bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempRoles, map[string]string{
+		"nick": nick, "roles": strings.Join(roles, ", ")}))
+}
+
+// commandAudit shows the latest entries of the audit trail.
+func commandAudit(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	count := auditDefaultEntries
+	if args.Has("count") {
+		count = args.Int("count")
+	}
+	if count < 1 || count > auditMaxEntries {
+		count = auditMaxEntries
+	}
+	entries, err := bot.Storage.AuditEntries(count)
+	if err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempError, map[string]string{"error": err.Error()}))
+		return
+	}
+	if len(entries) == 0 {
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).AuditEmpty)
+		return
+	}
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %s: %s %s", entry.Created.Format("2006-01-02 15:04:05"), entry.Actor,
+			entry.Action, entry.Target)
+		if entry.Details != "" {
+			line += " (" + entry.Details + ")"
+		}
+		bot.SendMessage(sourceEvent, line)
+	}
+}
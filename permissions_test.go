@@ -0,0 +1,116 @@
+package papaBot_test
+
+import (
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestRoles tests granting a role on a channel, the permission check and the audit trail.
+func TestRoles(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, channel, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, channel, text, false))
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "auth owner secret")
+	if !transport.waitFor("owner: You are now logged in.") {
+		t.Fatal("Owner should be logged in.")
+	}
+	run(events.EventPrivateMessage, "mod", "mod", "useradd mod pass")
+	if !transport.waitFor("mod: User added. You are now logged in.") {
+		t.Fatal("User should be added and logged in.")
+	}
+	run(events.EventPrivateMessage, "mod", "mod", "role set watcher stats")
+	if !transport.waitFor("mod: mod, You can't give me orders.") {
+		t.Error("Regular user should not manage roles.")
+	}
+	run(events.EventPrivateMessage, "owner", "owner", "role set watcher stats")
+	if !transport.waitFor("owner: Role saved.") {
+		t.Fatal("Owner should create the role.")
+	}
+	run(events.EventPrivateMessage, "owner", "owner", "role grant mod watcher #test")
+	if !transport.waitFor("owner: Role granted.") {
+		t.Fatal("Owner should grant the role.")
+	}
+	if !bot.UserCan(&events.EventMessage{TransportName: "test", Channel: "#test", UserId: "mod-id"}, "stats") ||
+		bot.UserCan(&events.EventMessage{TransportName: "test", Channel: "#other", UserId: "mod-id"}, "stats") {
+		t.Error("Role should give the permission only on its channel.")
+	}
+
+	run(events.EventChatMessage, "mod", "#other", ".stats")
+	run(events.EventChatMessage, "mod", "#test", ".stats")
+	if !transport.waitFor("#other: mod, You can't give me orders.") || !transport.waitFor("#test: Events queued") {
+		t.Error("Stats should work only on the channel of the role.")
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "v set secret hunter2")
+	if !transport.waitFor("owner: secret = hunter2") {
+		t.Fatal("Owner should set the variable.")
+	}
+	run(events.EventPrivateMessage, "owner", "owner", "audit")
+	if !transport.waitFor("owner: role.grant mod (watcher on test;#test)") ||
+		!transport.waitFor("mod: command stats") || !transport.waitFor("owner: command var (<hidden>)") {
+		t.Error("Audit trail should list the role changes and the privileged commands.")
+	}
+	if transport.count("command role") > 0 || transport.count("hunter2") > 1 {
+		t.Error("Audit trail should not repeat the role changes or show the value of the variable.")
+	}
+}
+
+// TestRoleEscalation tests that roles held on one channel can't be used to give out or change roles elsewhere.
+func TestRoleEscalation(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, channel, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, channel, text, false))
+	}
+
+	run(events.EventPrivateMessage, "owner", "owner", "auth owner secret")
+	run(events.EventPrivateMessage, "chief", "chief", "useradd chief pass")
+	run(events.EventPrivateMessage, "helper", "helper", "useradd helper pass")
+	if !transport.waitFor("chief: User added.") || !transport.waitFor("helper: User added.") {
+		t.Fatal("Users should be added.")
+	}
+	run(events.EventPrivateMessage, "owner", "owner", "role set keeper roles stats")
+	run(events.EventPrivateMessage, "owner", "owner", "role grant chief owner #test")
+	run(events.EventPrivateMessage, "owner", "owner", "role grant helper keeper #test")
+	if !transport.waitFor("owner: Role saved.") || !transport.waitForCount("owner: Role granted.", 2) {
+		t.Fatal("Owner should set up the roles.")
+	}
+
+	refused := "#test: You can't grant a role with permissions you don't have there."
+	run(events.EventChatMessage, "chief", "#test", ".role grant chief owner")
+	if !transport.waitForCount(refused, 1) || bot.UserIsOwner("chief-id") {
+		t.Error("Owner of a channel should not become a global owner.")
+	}
+	run(events.EventChatMessage, "helper", "#test", ".role grant helper keeper")
+	if !transport.waitForCount(refused, 2) {
+		t.Error("Role held on a channel should not be made global.")
+	}
+	run(events.EventChatMessage, "helper", "#test", ".role grant helper keeper #other")
+	if !transport.waitForCount(refused, 3) {
+		t.Error("Role held on a channel should not be given on another one.")
+	}
+	run(events.EventChatMessage, "helper", "#test", ".role set admin roles")
+	if !transport.waitFor("#test: You can't give out or take away permissions you don't have everywhere.") {
+		t.Error("Roles should not be changed with permissions held on a channel.")
+	}
+	run(events.EventChatMessage, "helper", "#test", ".role revoke chief owner #test")
+	if !transport.waitFor("#test: You can't revoke a role with permissions you don't have there.") {
+		t.Error("Role with more permissions should not be revoked.")
+	}
+
+	run(events.EventChatMessage, "helper", "#test", ".role grant chief keeper #test")
+	if !transport.waitFor("#test: Role granted.") {
+		t.Error("Role should be given where the user has its permissions.")
+	}
+	if bot.UserCan(&events.EventMessage{TransportName: "test", Channel: "#other", UserId: "helper-id"}, "stats") {
+		t.Error("Refused changes should not give any roles.")
+	}
+}
@@ -0,0 +1,196 @@
+package papaBot
+
+// Rate limiting of commands with token buckets, and per-command cooldowns.
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// CooldownScope tells who shares the cooldown of a command.
+type CooldownScope int
+
+const (
+	// Each user has their own cooldown, on all channels.
+	CooldownUser CooldownScope = iota
+	// Everyone on the channel shares the cooldown.
+	CooldownChannel
+	// Everyone everywhere shares the cooldown.
+	CooldownGlobal
+)
+
+// Cooldown limits how often a command can be run. Cooldowns apply to everyone, admins included.
+type Cooldown struct {
+	// Time that must pass before the command can be run again.
+	Period time.Duration
+	Scope  CooldownScope
+	// Do different parameters have separate cooldowns? E.g. asking about different nicks.
+	PerParams bool
+	// Don't tell the user about the cooldown.
+	Silent bool
+	// Returns the warning to send instead of the default one, nil for the default.
+	Warning func(sourceEvent *events.EventMessage) string
+}
+
+// Size of a token bucket and the time it takes to regain one token.
+type bucketLimit struct {
+	burst  int
+	refill time.Duration
+}
+
+// Token bucket: every use takes a token, and tokens come back with time, up to the burst.
+type tokenBucket struct {
+	limit  bucketLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens regained since the last refill.
+func (bucket *tokenBucket) refill(now time.Time) {
+	if bucket.limit.refill > 0 {
+		bucket.tokens += float64(now.Sub(bucket.last)) / float64(bucket.limit.refill)
+	} else {
+		bucket.tokens = float64(bucket.limit.burst)
+	}
+	if bucket.tokens > float64(bucket.limit.burst) {
+		bucket.tokens = float64(bucket.limit.burst)
+	}
+	bucket.last = now
+}
+
+// wait returns the time until the next token. Must be called after refill.
+func (bucket *tokenBucket) wait() time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) * float64(bucket.limit.refill))
+}
+
+// Bucket to take a token from, with the limit to create it with.
+type bucketCheck struct {
+	key   string
+	limit bucketLimit
+}
+
+// rateLimiter keeps the token buckets, per key.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// Was the user told about the limit since the bucket last allowed a use, per key.
+	warned map[string]bool
+}
+
+// newRateLimiter creates an empty rate limiter.
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}, warned: map[string]bool{}}
+}
+
+// take takes a token from each of the buckets, but only if all of them have one. Otherwise it returns the key of
+// the empty bucket, the time until it has a token again and whether it's the first refusal since the last use.
+func (limiter *rateLimiter) take(now time.Time, checks ...bucketCheck) (denied string, wait time.Duration, warn bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	buckets := make([]*tokenBucket, len(checks))
+	for i, check := range checks {
+		bucket, exists := limiter.buckets[check.key]
+		if !exists {
+			bucket = &tokenBucket{check.limit, float64(check.limit.burst), now}
+			limiter.buckets[check.key] = bucket
+		}
+		// Limits can change on reload.
+		bucket.limit = check.limit
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			warn = !limiter.warned[check.key]
+			limiter.warned[check.key] = true
+			return check.key, bucket.wait(), warn
+		}
+		buckets[i] = bucket
+	}
+	for i, bucket := range buckets {
+		bucket.tokens--
+		delete(limiter.warned, checks[i].key)
+	}
+	return "", 0, false
+}
+
+// prune forgets the buckets that are full again, as they are no different from new ones.
+func (limiter *rateLimiter) prune(now time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	for key, bucket := range limiter.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.burst) {
+			delete(limiter.buckets, key)
+			delete(limiter.warned, key)
+		}
+	}
+}
+
+// useCommand counts the use of the command towards the user, channel and command limits. It returns whether the
+// command can be run and the warning to send, if any.
+func (bot *Bot) useCommand(command string, sourceEvent *events.EventMessage) (bool, string) {
+	denied, _, warn := bot.rateLimits.take(time.Now(),
+		bucketCheck{"user:" + sourceEvent.UserId,
+			bucketLimit{bot.Config().UserCommandsBurst, bot.Config().UserCommandsRefill}},
+		bucketCheck{"channel:" + sourceEvent.ChannelId(),
+			bucketLimit{bot.Config().ChannelCommandsBurst, bot.Config().ChannelCommandsRefill}},
+		bucketCheck{"command:" + command + ":" + sourceEvent.UserId,
+			bucketLimit{bot.Config().CommandUsesBurst, bot.Config().CommandUsesRefill}},
+	)
+	if denied == "" {
+		return true, ""
+	}
+	bot.Log.Debugf("Command %s from %s refused by the %s limit.", command, sourceEvent.Nick, denied)
+	if !warn {
+		return false, ""
+	}
+	if strings.HasPrefix(denied, "channel:") {
+		return false, bot.texts(sourceEvent).ChannelLimit
+	}
+	return false, bot.texts(sourceEvent).CommandLimit
+}
+
+// cooldownKey returns the key of the command's cooldown bucket.
+func cooldownKey(cmd *BotCommand, sourceEvent *events.EventMessage, params []string) string {
+	key := "cooldown:" + cmd.CommandNames[0]
+	switch cmd.Cooldown.Scope {
+	case CooldownUser:
+		key += ":" + sourceEvent.UserId
+	case CooldownChannel:
+		key += ":" + sourceEvent.ChannelId()
+	}
+	if cmd.Cooldown.PerParams {
+		key += ":" + strings.ToLower(strings.Join(params, " "))
+	}
+	return key
+}
+
+// useCooldown checks whether the command's cooldown has passed and starts it again. It returns whether the command
+// can be run and the warning to send, if any.
+func (bot *Bot) useCooldown(cmd *BotCommand, sourceEvent *events.EventMessage, params []string) (bool, string) {
+	if cmd.Cooldown == nil {
+		return true, ""
+	}
+	now := time.Now()
+	denied, wait, warn := bot.rateLimits.take(now,
+		bucketCheck{cooldownKey(cmd, sourceEvent, params), bucketLimit{1, cmd.Cooldown.Period}})
+	if denied == "" {
+		return true, ""
+	}
+	bot.Log.Debugf("Command %s from %s is on cooldown.", cmd.CommandNames[0], sourceEvent.Nick)
+	if !warn || cmd.Cooldown.Silent {
+		return false, ""
+	}
+	if cmd.Cooldown.Warning != nil {
+		return false, cmd.Cooldown.Warning(sourceEvent)
+	}
+	return false, utils.Format(bot.texts(sourceEvent).TempCommandCooldown, map[string]string{
+		"command": cmd.CommandNames[0],
+		"wait":    bot.LocalHumanizer(sourceEvent).TimeDiff(now, now.Add(wait+time.Second), false),
+	})
+}
@@ -0,0 +1,68 @@
+package papaBot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestRateLimiter tests refilling of the buckets, taking from many buckets at once and pruning.
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Now()
+	user := bucketCheck{"user", bucketLimit{2, time.Minute}}
+	channel := bucketCheck{"channel", bucketLimit{3, time.Minute}}
+
+	for i := 0; i < 2; i++ {
+		if denied, _, _ := limiter.take(now, user, channel); denied != "" {
+			t.Fatalf("Use %d should be allowed, denied by %s.", i, denied)
+		}
+	}
+	denied, wait, warn := limiter.take(now, user, channel)
+	if denied != "user" || wait != time.Minute || !warn {
+		t.Errorf("Empty user bucket should deny with a warning, got %s, %s, %v.", denied, wait, warn)
+	}
+	if _, _, warn := limiter.take(now, user, channel); warn {
+		t.Error("Warning should be given only once.")
+	}
+	// Channel bucket must not be used when the user bucket is empty.
+	if denied, _, _ := limiter.take(now, channel); denied != "" {
+		t.Error("Channel bucket should have a token left.")
+	}
+	if denied, _, _ := limiter.take(now.Add(30*time.Second), user); denied != "user" {
+		t.Error("Half a token should not be enough.")
+	}
+	if denied, _, _ := limiter.take(now.Add(time.Minute), user); denied != "" {
+		t.Error("Token should be regained after a minute.")
+	}
+
+	limiter.prune(now.Add(2 * time.Minute))
+	if _, exists := limiter.buckets["user"]; !exists {
+		t.Error("Bucket that is not full should be kept.")
+	}
+	limiter.prune(now.Add(10 * time.Minute))
+	if len(limiter.buckets) != 0 || len(limiter.warned) != 0 {
+		t.Errorf("Full buckets should be forgotten: %v", limiter.buckets)
+	}
+}
+
+// TestCooldownKey tests the scopes of cooldowns.
+func TestCooldownKey(t *testing.T) {
+	event := &events.EventMessage{TransportName: "irc", Channel: "#chan", UserId: "id"}
+	cases := []struct {
+		cooldown Cooldown
+		expected string
+	}{
+		{Cooldown{Period: time.Minute, Scope: CooldownUser}, "cooldown:cmd:id"},
+		{Cooldown{Period: time.Minute, Scope: CooldownChannel}, "cooldown:cmd:irc;#chan"},
+		{Cooldown{Period: time.Minute, Scope: CooldownGlobal, PerParams: true}, "cooldown:cmd:some nick"},
+	}
+	for _, test := range cases {
+		cooldown := test.cooldown
+		cmd := &BotCommand{CommandNames: []string{"cmd", "alias"}, Cooldown: &cooldown}
+		if key := cooldownKey(cmd, event, []string{"Some", "Nick"}); key != test.expected {
+			t.Errorf("Expected key %s, got %s.", test.expected, key)
+		}
+	}
+}
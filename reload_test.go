@@ -0,0 +1,97 @@
+package papaBot_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot"
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// writeConfig replaces the config file of the test bot with the test config changed by the replacer.
+func writeConfig(t *testing.T, bot *papaBot.Bot, replacer *strings.Replacer) {
+	settings := struct {
+		DSN string `config:"dsn"`
+	}{}
+	if err := bot.LoadConfig("database", &settings); err != nil {
+		t.Fatalf("Can't read database settings: %s", err)
+	}
+	content := replacer.Replace(fmt.Sprintf(testConfig, settings.DSN))
+	path := filepath.Join(filepath.Dir(settings.DSN), "config.ini")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Can't write config: %s", err)
+	}
+}
+
+// TestReload tests that reload applies the new config, and that a broken config changes nothing.
+func TestReload(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(text string) {
+		bot.EventDispatcher.Trigger(message(events.EventChatMessage, "bob", "#test", text, false))
+	}
+
+	writeConfig(t, bot, strings.NewReplacer("enabled = true", "enabled = true\ncommand_prefixes = [\"!\"]",
+		`log_level = "warning"`, `log_level = "error"`))
+	if err := bot.Reload(); err != nil {
+		t.Fatalf("Can't reload: %s", err)
+	}
+	run("!ver")
+	if !transport.waitFor("#test: I am papaBot") || bot.Config().LogLevel.String() != "error" {
+		t.Error("New config should be used after reload.")
+	}
+
+	writeConfig(t, bot, strings.NewReplacer(`log_level = "warning"`, `log_level = "debug"`,
+		`token = "send-token"`, `token = ""`))
+	if err := bot.Reload(); err == nil || !strings.Contains(err.Error(), "send_tokens.ci.token must be set") {
+		t.Errorf("Broken config should not be reloaded, got: %v", err)
+	}
+	run("!ver")
+	if !transport.waitForCount("#test: I am papaBot", 2) || bot.Config().LogLevel.String() != "error" {
+		t.Error("Failed reload should keep the old config.")
+	}
+}
+
+// TestReloadConcurrent reloads the config while events are being handled. Run with -race to check the shared state.
+func TestReloadConcurrent(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	writeConfig(t, bot, strings.NewReplacer("enabled = true", "enabled = true\ncommand_prefixes = [\".\", \"!\"]"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < testWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nick := fmt.Sprintf("user%d", i)
+			trigger := bot.EventDispatcher.Trigger
+			trigger(message(events.EventPrivateMessage, nick, nick, "auth owner secret", true))
+			for j := 0; j < testRounds; j++ {
+				trigger(message(events.EventChatMessage, nick, "#test", ".lang", false))
+				trigger(message(events.EventChatMessage, nick, "#test", ".help pub", false))
+				trigger(message(events.EventPrivateMessage, nick, nick, "whoami", true))
+				trigger(message(events.EventPrivateMessage, nick, nick, "ignore add troll here 5 minutes", true))
+				trigger(message(events.EventChatMessage, nick, "#test", "!frobnicate", false))
+				trigger(message(events.EventTick, "", "", "", true))
+			}
+		}(i)
+	}
+	for i := 0; i < testRounds; i++ {
+		if err := bot.Reload(); err != nil {
+			t.Errorf("Can't reload: %s", err)
+		}
+	}
+	wg.Wait()
+	stop()
+
+	if transport.count("Language: en.") == 0 {
+		t.Error("Commands should be handled during reloads.")
+	}
+}
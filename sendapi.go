@@ -0,0 +1,104 @@
+package papaBot
+
+// Outbound send endpoint, for scripts and cron jobs posting to channels the bot is on.
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/config"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// Settings read from each send_tokens.<name> section of the config file.
+type sendTokenSettings struct {
+	Token    string   `config:"token" default:""`
+	Channels []string `config:"channels" default:""`
+}
+
+// Token allowed to send messages to some channels.
+type sendToken struct {
+	name  string
+	token string
+	// Channel ids the token can send to, in the form of transport;channel.
+	channels map[string]bool
+}
+
+// readSendTokens reads the send tokens from the config.
+func readSendTokens(loader *config.Loader) ([]*sendToken, error) {
+	tokens := []*sendToken{}
+	for _, name := range loader.Sections("send_tokens") {
+		settings := sendTokenSettings{}
+		if err := loader.Load(fmt.Sprintf("send_tokens.%q", name), &settings); err != nil {
+			return nil, err
+		}
+		if settings.Token == "" {
+			return nil, errors.New(fmt.Sprintf("send_tokens.%s.token must be set", name))
+		}
+		tokens = append(tokens, &sendToken{name, settings.Token, utils.SliceToMap(settings.Channels)})
+	}
+	return tokens, nil
+}
+
+// findSendToken returns the send token given in the Authorization header, or nil.
+func (bot *Bot) findSendToken(r *http.Request) *sendToken {
+	given := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	bot.sendTokensMu.RLock()
+	defer bot.sendTokensMu.RUnlock()
+	var found *sendToken
+	// Compare with all the tokens, so that the time doesn't tell which one matched.
+	for _, token := range bot.sendTokens {
+		if subtle.ConstantTimeCompare(given, []byte(token.token)) == 1 {
+			found = token
+		}
+	}
+	return found
+}
+
+// SendHandler returns the HTTP handler of the send endpoint, for embedding in another server.
+func (bot *Bot) SendHandler() http.Handler {
+	return http.HandlerFunc(bot.serveSend)
+}
+
+// serveSend sends the message from the request body, if the token allows sending to the channel.
+func (bot *Bot) serveSend(w http.ResponseWriter, r *http.Request) {
+	token := bot.findSendToken(r)
+	if token == nil {
+		bot.Log.Warningf("Send request with an invalid token from %s.", r.RemoteAddr)
+		writeAPIResponse(w, nil, NewAPIError(http.StatusUnauthorized, "invalid token"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIResponse(w, nil, ErrAPIMethodNotAllowed)
+		return
+	}
+	request := struct {
+		Transport, Channel, Message, Format string
+		Notice                              bool
+	}{}
+	if err := DecodeAPIRequest(r, &request); err != nil {
+		writeAPIResponse(w, nil, err)
+		return
+	}
+	channelId := request.Transport + ";" + request.Channel
+	if !token.channels[channelId] {
+		bot.Log.Warningf("Send token %s is not allowed to send to %s.", token.name, channelId)
+		writeAPIResponse(w, nil, NewAPIError(http.StatusForbidden, "token can't send to %s", channelId))
+		return
+	}
+	format, err := events.ParseFormatting(request.Format)
+	if err != nil {
+		writeAPIResponse(w, nil, NewAPIError(http.StatusBadRequest, "%s", err))
+		return
+	}
+	if err := bot.SendToChannel(request.Transport, request.Channel, request.Message, format, request.Notice); err != nil {
+		writeAPIResponse(w, nil, NewAPIError(http.StatusBadRequest, "%s", err))
+		return
+	}
+	bot.Log.Infof("Message sent to %s with send token %s.", channelId, token.name)
+	writeAPIResponse(w, nil, nil)
+}
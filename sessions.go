@@ -0,0 +1,235 @@
+package papaBot
+
+// Sessions of the authenticated users, with expiry and binding to the identity they logged in with.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/utils"
+)
+
+// Session of an authenticated user. It is bound to the transport and the chat nick used to log in, and ends when
+// the user changes nick, leaves a channel or quits.
+type session struct {
+	// Nick of the user account.
+	nick string
+	// Transport and chat nick of the person who logged in.
+	transport string
+	chatNick  string
+	created   time.Time
+	lastSeen  time.Time
+}
+
+// expired checks whether the session is past its lifetime or was idle for too long.
+func (s *session) expired(now time.Time, lifetime, idleTimeout time.Duration) bool {
+	return now.Sub(s.created) >= lifetime || now.Sub(s.lastSeen) >= idleTimeout
+}
+
+// startSession logs the sender of the event in as the user.
+func (bot *Bot) startSession(sourceEvent *events.EventMessage, nick string) {
+	now := time.Now()
+	bot.authMu.Lock()
+	defer bot.authMu.Unlock()
+	bot.sessions[sourceEvent.UserId] = &session{nick, sourceEvent.TransportName, sourceEvent.Nick, now, now}
+}
+
+// endSession logs the user out. Returns the nick of the ended session, or an empty string if there was none.
+func (bot *Bot) endSession(userId, reason string) string {
+	bot.authMu.Lock()
+	defer bot.authMu.Unlock()
+	s, exists := bot.sessions[userId]
+	if !exists {
+		return ""
+	}
+	delete(bot.sessions, userId)
+	bot.Log.Infof("Session of %s (%s) ended: %s.", s.nick, userId, reason)
+	return s.nick
+}
+
+// GetAuthenticatedNick will get authenticated user's nick by his full name.
+func (bot *Bot) GetAuthenticatedNick(userId string) string {
+	bot.authMu.RLock()
+	defer bot.authMu.RUnlock()
+	s, exists := bot.sessions[userId]
+	if !exists || s.expired(time.Now(), bot.Config().SessionLifetime, bot.Config().SessionIdleTimeout) {
+		return ""
+	}
+	return s.nick
+}
+
+// userIsAuthenticated checks if the user is authenticated with the bot.
+func (bot *Bot) UserIsAuthenticated(userId string) bool {
+	return bot.GetAuthenticatedNick(userId) != ""
+}
+
+// deauthenticateNick logs out everyone authenticated as the user, except for the given user id.
+func (bot *Bot) deauthenticateNick(nick, exceptUserId string) {
+	bot.authMu.Lock()
+	defer bot.authMu.Unlock()
+	for userId, s := range bot.sessions {
+		if s.nick == nick && userId != exceptUserId {
+			delete(bot.sessions, userId)
+		}
+	}
+}
+
+// checkSession ends the session of the sender if it expired or the sender is not the person who logged in.
+// Otherwise it marks the session as used. Senders with a linked user id get a session if they have none.
+func (bot *Bot) checkSession(sourceEvent *events.EventMessage) {
+	now := time.Now()
+	bot.authMu.Lock()
+	defer bot.authMu.Unlock()
+	s, exists := bot.sessions[sourceEvent.UserId]
+	if !exists {
+		bot.linkedSession(sourceEvent, now)
+		return
+	}
+	reason := ""
+	if s.expired(now, bot.Config().SessionLifetime, bot.Config().SessionIdleTimeout) {
+		reason = "expired"
+	} else if s.transport != sourceEvent.TransportName || s.chatNick != sourceEvent.Nick {
+		reason = fmt.Sprintf("identity changed to %s on %s", sourceEvent.Nick, sourceEvent.TransportName)
+	}
+	if reason == "" {
+		s.lastSeen = now
+		return
+	}
+	delete(bot.sessions, sourceEvent.UserId)
+	bot.Log.Infof("Session of %s (%s) ended: %s.", s.nick, sourceEvent.UserId, reason)
+}
+
+// pruneSessions forgets the expired sessions.
+func (bot *Bot) pruneSessions(now time.Time) {
+	bot.authMu.Lock()
+	defer bot.authMu.Unlock()
+	for userId, s := range bot.sessions {
+		if s.expired(now, bot.Config().SessionLifetime, bot.Config().SessionIdleTimeout) {
+			delete(bot.sessions, userId)
+			bot.Log.Debugf("Session of %s (%s) expired.", s.nick, userId)
+		}
+	}
+}
+
+// sessionsListener ends the sessions of users who left a channel, quit or changed their nick.
+func (bot *Bot) sessionsListener(message events.EventMessage) {
+	if message.AtBot { // It's the bot itself.
+		return
+	}
+	bot.authMu.RLock()
+	s, exists := bot.sessions[message.UserId]
+	bot.authMu.RUnlock()
+	if !exists || s.transport != message.TransportName {
+		return
+	}
+	bot.endSession(message.UserId, message.EventCode.String())
+}
+
+// commandLogout ends the session of the user.
+func commandLogout(bot *Bot, sourceEvent *events.EventMessage, params []string) {
+	if bot.endSession(sourceEvent.UserId, "logged out") == "" {
+		bot.SendMessage(sourceEvent, "You are not logged in.")
+		return
+	}
+	bot.SendMessage(sourceEvent, "You are now logged out.")
+}
+
+// commandPasswd changes the password of the user and ends their other sessions.
+func commandPasswd(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts := bot.texts(sourceEvent)
+	nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if nick == "" {
+		bot.SendMessage(sourceEvent, texts.NotLoggedIn)
+		return
+	}
+	_, dbPassword, _, err := bot.getUserData(nick)
+	if err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempError, map[string]string{"error": err.Error()}))
+		return
+	}
+	if matches, _ := utils.CheckPassword(args.String("old password"), dbPassword); !matches {
+		bot.SendMessage(sourceEvent, texts.NotRight)
+		return
+	}
+	newPassword := args.String("new password")
+	if newPassword == "" {
+		bot.SendMessage(sourceEvent, texts.PasswordEmpty)
+		return
+	}
+	if _, err := bot.Storage.SetPassword(nick, utils.HashPassword(newPassword)); err != nil {
+		bot.Log.Errorf("Can't change the password of %s: %s", nick, err)
+		bot.SendMessage(sourceEvent, texts.PasswordFailed)
+		return
+	}
+	bot.deauthenticateNick(nick, sourceEvent.UserId)
+	bot.audit(nick, "user.passwd", nick, "")
+	bot.SendMessage(sourceEvent, texts.PasswordChanged)
+}
+
+// commandWhoami tells the user who they are logged in as.
+func commandWhoami(bot *Bot, sourceEvent *events.EventMessage, params []string) {
+	bot.authMu.RLock()
+	s, exists := bot.sessions[sourceEvent.UserId]
+	bot.authMu.RUnlock()
+	texts := bot.texts(sourceEvent)
+	if !exists {
+		bot.SendMessage(sourceEvent, utils.Format(texts.TempWhoamiGuest, map[string]string{"nick": sourceEvent.Nick}))
+		return
+	}
+	nick, ends := s.nick, s.created.Add(bot.Config().SessionLifetime)
+	roles := bot.nickRoles(nick)
+	if len(roles) == 0 {
+		roles = []string{texts.NoRoles}
+	}
+	bot.SendMessage(sourceEvent, utils.Format(texts.TempWhoami, map[string]string{
+		"nick":  nick,
+		"roles": strings.Join(roles, ", "),
+		"ends":  bot.LocalHumanizer(sourceEvent).TimeDiff(time.Now(), ends, false),
+	}))
+}
+
+// commandSessionList lists the active sessions.
+func commandSessionList(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	texts, humanizer := bot.texts(sourceEvent), bot.LocalHumanizer(sourceEvent)
+	now := time.Now()
+	lines := []string{}
+	bot.authMu.RLock()
+	for userId, s := range bot.sessions {
+		if s.expired(now, bot.Config().SessionLifetime, bot.Config().SessionIdleTimeout) {
+			continue
+		}
+		lines = append(lines, utils.Format(texts.TempSession, map[string]string{
+			"nick":      s.nick,
+			"chatNick":  s.chatNick,
+			"transport": s.transport,
+			"userId":    userId,
+			"created":   humanizer.TimeDiff(now, s.created, false),
+			"seen":      humanizer.TimeDiff(now, s.lastSeen, false),
+		}))
+	}
+	bot.authMu.RUnlock()
+	if len(lines) == 0 {
+		bot.SendMessage(sourceEvent, texts.NoSessions)
+		return
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		bot.SendMessage(sourceEvent, line)
+	}
+}
+
+// commandSessionEnd ends all sessions of a user.
+func commandSessionEnd(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	nick := args.String("nick")
+	if _, err := bot.Storage.GetUser(nick); err == storage.ErrNotFound {
+		bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempNoUser, map[string]string{"nick": nick}))
+		return
+	}
+	bot.deauthenticateNick(nick, "")
+	bot.Audit(sourceEvent, "sessions.end", nick, "")
+	bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempSessionsEnded, map[string]string{"nick": nick}))
+}
@@ -0,0 +1,64 @@
+package papaBot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestSessions tests logging in and out, password change and the end of the session on a nick change.
+func TestSessions(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, nick, text string) {
+		bot.EventDispatcher.Trigger(message(code, nick, nick, text, false))
+	}
+
+	run(events.EventPrivateMessage, "owner", "auth owner secret")
+	run(events.EventPrivateMessage, "owner", "whoami")
+	if !transport.waitFor("owner: You are logged in as owner with roles: owner.") {
+		t.Fatal("Owner should be logged in.")
+	}
+
+	// Someone else with the same user id is not the owner.
+	impostor := message(events.EventPrivateMessage, "impostor", "impostor", "sessions", false)
+	impostor.UserId = "owner-id"
+	bot.EventDispatcher.Trigger(impostor)
+	if !transport.waitFor("impostor: impostor, You can't give me orders.") || bot.UserIsAuthenticated("owner-id") {
+		t.Error("Session should end when the nick doesn't match.")
+	}
+
+	run(events.EventPrivateMessage, "owner", "auth owner secret")
+	if !transport.waitForCount("owner: You are now logged in.", 2) {
+		t.Fatal("Owner should log in again.")
+	}
+	run(events.EventPrivateMessage, "owner", "passwd secret changed")
+	if !transport.waitFor("owner: Password changed.") {
+		t.Fatal("Password should be changed.")
+	}
+	// Events are handled concurrently, so wait for the nick change before asking.
+	bot.EventDispatcher.Trigger(message(events.EventNickChange, "owner", "", "owner_", false))
+	for deadline := time.Now().Add(5 * time.Second); bot.UserIsAuthenticated("owner-id"); {
+		if time.Now().After(deadline) {
+			t.Fatal("Nick change should end the session.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	run(events.EventPrivateMessage, "owner", "whoami")
+	if !transport.waitFor("owner: You are owner, not logged in.") {
+		t.Error("Nick change should end the session.")
+	}
+
+	run(events.EventPrivateMessage, "owner", "auth owner secret")
+	if !transport.waitFor("owner: That's not right.") {
+		t.Error("Old password should not work.")
+	}
+	run(events.EventPrivateMessage, "owner", "auth owner changed")
+	run(events.EventPrivateMessage, "owner", "logout")
+	if !transport.waitFor("owner: You are now logged out.") || bot.UserIsAuthenticated("owner-id") {
+		t.Error("User should be logged out.")
+	}
+}
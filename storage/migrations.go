@@ -0,0 +1,136 @@
+package storage
+
+// Versioned schema migrations.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Migration is a named change of the database schema or data. Migrations of each owner are applied in the order
+// they are listed, each one in its own transaction, and recorded in schema_migrations.
+type Migration struct {
+	// Name of the migration, unique within its owner. Once applied, a migration must not be changed.
+	Name string
+	// Driver the migration is for. Empty means all drivers.
+	Driver string
+	// SQL statements to execute.
+	Up string
+	// Optional function for changes that are hard to express in SQL. Run after Up, in the same transaction.
+	UpFunc func(tx *sql.Tx) error
+}
+
+// MigrationSet is the list of migrations of one owner (the bot or an extension).
+type MigrationSet struct {
+	Owner      string
+	Migrations []Migration
+}
+
+// PendingMigration is a migration that was not applied yet.
+type PendingMigration struct {
+	Migration
+	Owner string
+}
+
+// ensureMigrationsTable creates the table that keeps track of applied migrations.
+func (s *sqlStorage) ensureMigrationsTable() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			owner VARCHAR NOT NULL,
+			name VARCHAR NOT NULL,
+			applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (owner, name)
+		);`)
+	return err
+}
+
+// appliedMigrations returns the set of applied migrations, keyed by owner and name.
+func (s *sqlStorage) appliedMigrations() (map[string]bool, error) {
+	applied := map[string]bool{}
+	var exists bool
+	if err := s.db.QueryRow(s.dialect.tableExists, "schema_migrations").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	result, err := s.db.Query(`SELECT owner, name FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	for result.Next() {
+		var owner, name string
+		if err = result.Scan(&owner, &name); err != nil {
+			return nil, err
+		}
+		applied[owner+"/"+name] = true
+	}
+	return applied, result.Err()
+}
+
+// BuiltinMigrations returns the schema of the bot's own tables, including those used by built-in extensions.
+func (s *sqlStorage) BuiltinMigrations() []MigrationSet {
+	return s.dialect.migrations
+}
+
+// PendingMigrations lists the migrations for this driver that were not applied yet, in order. It doesn't change
+// the database.
+func (s *sqlStorage) PendingMigrations(sets []MigrationSet) ([]PendingMigration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	pending := []PendingMigration{}
+	for _, set := range sets {
+		names := map[string]bool{}
+		for _, migration := range set.Migrations {
+			if migration.Driver != "" && migration.Driver != s.dialect.name {
+				continue
+			}
+			if migration.Name == "" {
+				return nil, errors.New(fmt.Sprintf("migration of %s has no name", set.Owner))
+			}
+			if names[migration.Name] {
+				return nil, errors.New(fmt.Sprintf("duplicate migration %s/%s", set.Owner, migration.Name))
+			}
+			names[migration.Name] = true
+			if !applied[set.Owner+"/"+migration.Name] {
+				pending = append(pending, PendingMigration{migration, set.Owner})
+			}
+		}
+	}
+	return pending, nil
+}
+
+// ApplyMigration runs the migration and records it, all in one transaction.
+func (s *sqlStorage) ApplyMigration(migration PendingMigration) error {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return errors.New(fmt.Sprintf("can't create migrations table: %s", err))
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if migration.Up != "" {
+		if _, err := tx.Exec(migration.Up); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if migration.UpFunc != nil {
+		if err := migration.UpFunc(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		s.Rebind(`INSERT INTO schema_migrations(owner, name) VALUES(?, ?)`), migration.Owner, migration.Name,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
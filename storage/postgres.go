@@ -0,0 +1,192 @@
+package storage
+
+// PostgreSQL driver. Requires PostgreSQL 12 or newer (generated columns).
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var postgresDialect = &dialect{
+	name:                 "postgres",
+	driver:               "postgres",
+	numberedPlaceholders: true,
+	tableExists: `
+		SELECT EXISTS(
+			SELECT 1 FROM information_schema.tables WHERE table_schema=current_schema() AND table_name=$1
+		)`,
+	searchURLs: func(byChannel bool) string {
+		channelFilter := ""
+		if byChannel {
+			channelFilter = "channel=? AND "
+		}
+		// Latest post of each link, newest links first.
+		return `
+			SELECT id, transport, channel, nick, link, title, "timestamp" FROM (
+				SELECT DISTINCT ON (link) id, transport, channel, nick, link, COALESCE(title, '') AS title, "timestamp"
+				FROM urls
+				WHERE ` + channelFilter + `search @@ plainto_tsquery('simple', ?)
+				ORDER BY link, "timestamp" DESC
+			) AS found
+			ORDER BY "timestamp" DESC LIMIT ?`
+	},
+	searchExpression: func(tokens []string) string {
+		return strings.Join(tokens, " ")
+	},
+	isUniqueViolation: func(err error) bool {
+		pqErr, ok := err.(*pq.Error)
+		return ok && pqErr.Code == "23505"
+	},
+	migrations: postgresMigrations,
+}
+
+// Schema for PostgreSQL. Never change an applied migration, add a new one instead.
+var postgresMigrations = []MigrationSet{
+	{"core", []Migration{
+		{
+			Name: "create_urls",
+			Up: `
+				CREATE TABLE IF NOT EXISTS urls (
+					id SERIAL PRIMARY KEY,
+					transport VARCHAR NOT NULL,
+					channel VARCHAR NOT NULL,
+					nick VARCHAR NOT NULL,
+					link VARCHAR NOT NULL,
+					quote VARCHAR NOT NULL,
+					title VARCHAR,
+					"timestamp" TIMESTAMP DEFAULT LOCALTIMESTAMP(0),
+					search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', link || ' ' || COALESCE(title, ''))) STORED
+				);
+				CREATE INDEX IF NOT EXISTS urls_search_idx ON urls USING GIN (search);
+				CREATE INDEX IF NOT EXISTS urls_link_idx ON urls (link, channel, transport);`,
+		},
+		{
+			Name: "create_users",
+			Up: `
+				CREATE TABLE IF NOT EXISTS users (
+					nick VARCHAR PRIMARY KEY,
+					password VARCHAR,
+					alt_nicks VARCHAR,
+					owner BOOLEAN DEFAULT FALSE,
+					admin BOOLEAN DEFAULT FALSE,
+					joined TIMESTAMP DEFAULT LOCALTIMESTAMP(0)
+				);`,
+		},
+		{
+			Name: "create_vars",
+			Up: `
+				CREATE TABLE IF NOT EXISTS vars (
+					name VARCHAR PRIMARY KEY,
+					value VARCHAR
+				);`,
+		},
+		{
+			Name: "create_channel_settings",
+			Up: `
+				CREATE TABLE IF NOT EXISTS channel_settings (
+					channel_id VARCHAR NOT NULL,
+					kind VARCHAR NOT NULL,
+					name VARCHAR NOT NULL,
+					enabled BOOLEAN NOT NULL,
+					PRIMARY KEY (channel_id, kind, name)
+				);`,
+		},
+		{
+			// Owner and admin flags of the users are replaced by roles.
+			Name: "create_roles",
+			Up: `
+				CREATE TABLE IF NOT EXISTS roles (
+					name VARCHAR PRIMARY KEY,
+					permissions VARCHAR NOT NULL DEFAULT ''
+				);
+
+				CREATE TABLE IF NOT EXISTS role_assignments (
+					nick VARCHAR NOT NULL,
+					role VARCHAR NOT NULL,
+					channel_id VARCHAR NOT NULL DEFAULT '',
+					PRIMARY KEY (nick, role, channel_id)
+				);
+
+				CREATE TABLE IF NOT EXISTS audit_log (
+					id SERIAL PRIMARY KEY,
+					actor VARCHAR NOT NULL,
+					action VARCHAR NOT NULL,
+					target VARCHAR NOT NULL,
+					details VARCHAR NOT NULL,
+					created TIMESTAMP DEFAULT LOCALTIMESTAMP(0)
+				);
+
+				INSERT INTO roles(name, permissions) VALUES
+					('owner', '*'),
+					('admin', 'channels|counters|reminders.manage|limits.bypass');
+				INSERT INTO role_assignments(nick, role) SELECT nick, 'owner' FROM users WHERE owner;
+				INSERT INTO role_assignments(nick, role) SELECT nick, 'admin' FROM users WHERE admin;`,
+		},
+		{
+			// Failed login counting and lockout.
+			Name: "add_login_lockout",
+			Up: `
+				ALTER TABLE users
+					ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0,
+					ADD COLUMN locked_until TIMESTAMP;`,
+		},
+		{
+			// Ignore list moves out of the _ignored var, which the bot converts on start.
+			Name: "create_ignores",
+			Up: `
+				CREATE TABLE IF NOT EXISTS ignores (
+					id SERIAL PRIMARY KEY,
+					mask VARCHAR NOT NULL,
+					transport VARCHAR NOT NULL DEFAULT '',
+					channel VARCHAR NOT NULL DEFAULT '',
+					reason VARCHAR NOT NULL DEFAULT '',
+					creator VARCHAR NOT NULL DEFAULT '',
+					created TIMESTAMP DEFAULT LOCALTIMESTAMP(0),
+					expires TIMESTAMP
+				);`,
+		},
+		{
+			Name: "create_languages",
+			Up: `
+				CREATE TABLE IF NOT EXISTS languages (
+					kind VARCHAR NOT NULL,
+					name VARCHAR NOT NULL,
+					language VARCHAR NOT NULL,
+					PRIMARY KEY (kind, name)
+				);`,
+		},
+	}},
+	{"counters", []Migration{
+		{
+			Name: "create_counters",
+			Up: `
+				CREATE TABLE IF NOT EXISTS counters (
+					id SERIAL PRIMARY KEY,
+					transport VARCHAR NOT NULL,
+					channel VARCHAR NOT NULL,
+					creator VARCHAR NOT NULL REFERENCES users(nick),
+					announce_text VARCHAR NOT NULL,
+					"interval" INTEGER NOT NULL,
+					target_date TIMESTAMP NOT NULL,
+					created TIMESTAMP DEFAULT LOCALTIMESTAMP(0)
+				);`,
+		},
+	}},
+	{"reminders", []Migration{
+		{
+			Name: "create_reminders",
+			Up: `
+				CREATE TABLE IF NOT EXISTS reminders (
+					id SERIAL PRIMARY KEY,
+					transport VARCHAR NOT NULL,
+					channel VARCHAR NOT NULL,
+					creator VARCHAR NOT NULL,
+					announce_text VARCHAR NOT NULL,
+					announced BOOLEAN DEFAULT FALSE,
+					target_time TIMESTAMP NOT NULL,
+					created_time TIMESTAMP NOT NULL
+				);`,
+		},
+	}},
+}
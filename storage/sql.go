@@ -0,0 +1,657 @@
+package storage
+
+// Storage implementation shared by the SQL drivers.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Format of dates kept as text.
+const dateFormat = "2006-01-02 15:04:05"
+
+// dialect describes the differences between the SQL drivers.
+type dialect struct {
+	// Name used in the config and in migrations.
+	name string
+	// Name of the database/sql driver.
+	driver string
+	// Does the driver use numbered placeholders ($1, $2...) instead of "?"?
+	numberedPlaceholders bool
+	// Query checking whether a table exists, with the table name as the only parameter.
+	tableExists string
+	// Full-text search query. Parameters: [channel], tokens, limit.
+	searchURLs func(byChannel bool) string
+	// Format of the search expression built from the tokens.
+	searchExpression func(tokens []string) string
+	// Checks whether the error means a unique constraint violation.
+	isUniqueViolation func(err error) bool
+	// Schema of the bot's tables.
+	migrations []MigrationSet
+}
+
+// sqlStorage implements Storage on top of database/sql.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect *dialect
+}
+
+// timestamp scans a date column. Depending on the driver and the column type it comes as time.Time or as text.
+// Dates are kept as local wall clock time, so the result is always in the local timezone.
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), 0, time.Local)
+	case []byte:
+		return t.Scan(string(v))
+	case string:
+		for _, layout := range []string{dateFormat, time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if parsed, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return t.Scan(parsed)
+			}
+		}
+		return errors.New(fmt.Sprintf("can't parse date %q", v))
+	default:
+		return errors.New(fmt.Sprintf("unsupported date type %T", value))
+	}
+	return nil
+}
+
+func (s *sqlStorage) Driver() string {
+	return s.dialect.name
+}
+
+func (s *sqlStorage) DB() *sql.DB {
+	return s.db
+}
+
+func (s *sqlStorage) Rebind(query string) string {
+	if !s.dialect.numberedPlaceholders {
+		return query
+	}
+	var rebound strings.Builder
+	number := 0
+	// Quote character of the string literal or identifier we are in, if any.
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote { // Doubled quotes inside just close and open again.
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			number++
+			rebound.WriteString(fmt.Sprintf("$%d", number))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+// exec runs a statement written with "?" placeholders.
+func (s *sqlStorage) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.Rebind(query), args...)
+}
+
+// deleteWith runs the cleanup statement and then the delete, both with the same arguments, in one transaction.
+// Returns whether the delete removed anything.
+func (s *sqlStorage) deleteWith(cleanup, query string, args ...interface{}) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(s.Rebind(cleanup), args...); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	result, err := tx.Exec(s.Rebind(query), args...)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return deleted > 0, tx.Commit()
+}
+
+// query runs a query written with "?" placeholders.
+func (s *sqlStorage) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.Rebind(query), args...)
+}
+
+// queryRow runs a single row query written with "?" placeholders.
+func (s *sqlStorage) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.Rebind(query), args...)
+}
+
+func (s *sqlStorage) AddURL(url URL) error {
+	if !url.Timestamp.IsZero() {
+		_, err := s.exec(`
+			INSERT INTO urls(transport, channel, nick, link, quote, title, "timestamp") VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			url.Transport, url.Channel, url.Nick, url.Link, url.Quote, url.Title, url.Timestamp.Format(dateFormat))
+		return err
+	}
+	_, err := s.exec(`INSERT INTO urls(transport, channel, nick, link, quote, title) VALUES(?, ?, ?, ?, ?, ?)`,
+		url.Transport, url.Channel, url.Nick, url.Link, url.Quote, url.Title)
+	return err
+}
+
+func (s *sqlStorage) URLs() ([]URL, error) {
+	result, err := s.query(`
+		SELECT id, transport, channel, nick, link, quote, COALESCE(title, ''), "timestamp" FROM urls ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	urls := []URL{}
+	for result.Next() {
+		var url URL
+		var posted timestamp
+		if err := result.Scan(&url.Id, &url.Transport, &url.Channel, &url.Nick, &url.Link, &url.Quote, &url.Title,
+			&posted); err != nil {
+			return nil, err
+		}
+		url.Timestamp = posted.Time
+		urls = append(urls, url)
+	}
+	return urls, result.Err()
+}
+
+func (s *sqlStorage) URLHistory(transport, channel, link string) (int, *URL, error) {
+	var count int
+	if err := s.queryRow(`SELECT count(*) FROM urls WHERE link=? AND channel=? AND transport=?`,
+		link, channel, transport).Scan(&count); err != nil {
+		return 0, nil, err
+	}
+	if count < 2 {
+		return count, nil, nil
+	}
+	url := URL{Transport: transport, Channel: channel, Link: link}
+	var posted timestamp
+	if err := s.queryRow(`
+		SELECT id, nick, quote, COALESCE(title, ''), "timestamp" FROM urls
+		WHERE link=? AND channel=? AND transport=?
+		ORDER BY "timestamp" DESC, id DESC LIMIT 1 OFFSET 1`,
+		link, channel, transport).Scan(&url.Id, &url.Nick, &url.Quote, &url.Title, &posted); err != nil {
+		return count, nil, err
+	}
+	url.Timestamp = posted.Time
+	return count, &url, nil
+}
+
+func (s *sqlStorage) SearchURLs(channel string, tokens []string, limit int) ([]URL, error) {
+	args := []interface{}{}
+	if channel != "" {
+		args = append(args, channel)
+	}
+	args = append(args, s.dialect.searchExpression(tokens), limit)
+	result, err := s.query(s.dialect.searchURLs(channel != ""), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	urls := []URL{}
+	for result.Next() {
+		var url URL
+		var posted timestamp
+		if err := result.Scan(&url.Id, &url.Transport, &url.Channel, &url.Nick, &url.Link, &url.Title,
+			&posted); err != nil {
+			return nil, err
+		}
+		url.Timestamp = posted.Time
+		urls = append(urls, url)
+	}
+	return urls, result.Err()
+}
+
+func (s *sqlStorage) AddUser(user User) error {
+	if _, err := s.exec(`INSERT INTO users(nick, password, alt_nicks) VALUES(?, ?, ?)`,
+		user.Nick, user.Password, strings.Join(user.AltNicks, "|")); err != nil {
+		if s.dialect.isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
+}
+
+// Columns read by scanUser.
+const userColumns = `nick, COALESCE(password, ''), COALESCE(alt_nicks, ''), joined, failed_logins, locked_until`
+
+// scanUser reads a user from a row with userColumns.
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	user := User{}
+	var altNicks string
+	var joined, lockedUntil timestamp
+	if err := row.Scan(
+		&user.Nick, &user.Password, &altNicks, &joined, &user.FailedLogins, &lockedUntil); err != nil {
+		return user, err
+	}
+	user.Joined = joined.Time
+	user.LockedUntil = lockedUntil.Time
+	user.AltNicks = []string{}
+	for _, altNick := range strings.Split(altNicks, "|") {
+		if altNick != "" {
+			user.AltNicks = append(user.AltNicks, altNick)
+		}
+	}
+	return user, nil
+}
+
+func (s *sqlStorage) GetUser(nick string) (User, error) {
+	user, err := scanUser(s.queryRow(`SELECT `+userColumns+` FROM users WHERE nick=?`, nick))
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *sqlStorage) Users() ([]User, error) {
+	result, err := s.query(`SELECT ` + userColumns + ` FROM users ORDER BY nick`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	users := []User{}
+	for result.Next() {
+		user, err := scanUser(result)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, result.Err()
+}
+
+func (s *sqlStorage) SetPassword(nick, password string) (bool, error) {
+	result, err := s.exec(`UPDATE users SET password=? WHERE nick=?`, password, nick)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *sqlStorage) SetAltNicks(nick string, altNicks []string) (bool, error) {
+	result, err := s.exec(`UPDATE users SET alt_nicks=? WHERE nick=?`, strings.Join(altNicks, "|"), nick)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+func (s *sqlStorage) SetLoginFailures(nick string, failures int, lockedUntil time.Time) error {
+	var locked interface{}
+	if !lockedUntil.IsZero() {
+		locked = lockedUntil.Format(dateFormat)
+	}
+	_, err := s.exec(`UPDATE users SET failed_logins=?, locked_until=? WHERE nick=?`, failures, locked, nick)
+	return err
+}
+
+func (s *sqlStorage) DeleteUser(nick string) (bool, error) {
+	return s.deleteWith(`DELETE FROM role_assignments WHERE nick=?`, `DELETE FROM users WHERE nick=?`, nick)
+}
+
+func (s *sqlStorage) OwnerExists() (bool, error) {
+	var exists bool
+	err := s.queryRow(`SELECT EXISTS(SELECT 1 FROM role_assignments WHERE role=?)`, "owner").Scan(&exists)
+	return exists, err
+}
+
+func (s *sqlStorage) Roles() ([]Role, error) {
+	result, err := s.query(`SELECT name, permissions FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	roles := []Role{}
+	for result.Next() {
+		var role Role
+		var permissions string
+		if err := result.Scan(&role.Name, &permissions); err != nil {
+			return nil, err
+		}
+		role.Permissions = []string{}
+		for _, permission := range strings.Split(permissions, "|") {
+			if permission != "" {
+				role.Permissions = append(role.Permissions, permission)
+			}
+		}
+		roles = append(roles, role)
+	}
+	return roles, result.Err()
+}
+
+func (s *sqlStorage) SetRole(role Role) error {
+	_, err := s.exec(`
+		INSERT INTO roles(name, permissions) VALUES(?, ?)
+		ON CONFLICT(name) DO UPDATE SET permissions=excluded.permissions`,
+		role.Name, strings.Join(role.Permissions, "|"))
+	return err
+}
+
+func (s *sqlStorage) DeleteRole(name string) (bool, error) {
+	return s.deleteWith(`DELETE FROM role_assignments WHERE role=?`, `DELETE FROM roles WHERE name=?`, name)
+}
+
+func (s *sqlStorage) RoleAssignments() ([]RoleAssignment, error) {
+	result, err := s.query(`SELECT nick, role, channel_id FROM role_assignments ORDER BY nick, role, channel_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	assignments := []RoleAssignment{}
+	for result.Next() {
+		var assignment RoleAssignment
+		if err := result.Scan(&assignment.Nick, &assignment.Role, &assignment.ChannelId); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, assignment)
+	}
+	return assignments, result.Err()
+}
+
+func (s *sqlStorage) AssignRole(assignment RoleAssignment) error {
+	_, err := s.exec(`
+		INSERT INTO role_assignments(nick, role, channel_id) VALUES(?, ?, ?)
+		ON CONFLICT(nick, role, channel_id) DO NOTHING`,
+		assignment.Nick, assignment.Role, assignment.ChannelId)
+	return err
+}
+
+func (s *sqlStorage) UnassignRole(assignment RoleAssignment) (bool, error) {
+	result, err := s.exec(`DELETE FROM role_assignments WHERE nick=? AND role=? AND channel_id=?`,
+		assignment.Nick, assignment.Role, assignment.ChannelId)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (s *sqlStorage) AddAuditEntry(entry AuditEntry) error {
+	_, err := s.exec(`INSERT INTO audit_log(actor, action, target, details) VALUES(?, ?, ?, ?)`,
+		entry.Actor, entry.Action, entry.Target, entry.Details)
+	return err
+}
+
+func (s *sqlStorage) AuditEntries(limit int) ([]AuditEntry, error) {
+	result, err := s.query(
+		`SELECT id, actor, action, target, details, created FROM audit_log ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	entries := []AuditEntry{}
+	for result.Next() {
+		var entry AuditEntry
+		var created timestamp
+		if err := result.Scan(
+			&entry.Id, &entry.Actor, &entry.Action, &entry.Target, &entry.Details, &created); err != nil {
+			return nil, err
+		}
+		entry.Created = created.Time
+		entries = append(entries, entry)
+	}
+	return entries, result.Err()
+}
+
+func (s *sqlStorage) AddIgnore(ignore Ignore) error {
+	var expires interface{}
+	if !ignore.Expires.IsZero() {
+		expires = ignore.Expires.Format(dateFormat)
+	}
+	_, err := s.exec(`INSERT INTO ignores(mask, transport, channel, reason, creator, expires) VALUES(?, ?, ?, ?, ?, ?)`,
+		ignore.Mask, ignore.Transport, ignore.Channel, ignore.Reason, ignore.Creator, expires)
+	return err
+}
+
+func (s *sqlStorage) Ignores() ([]Ignore, error) {
+	result, err := s.query(
+		`SELECT id, mask, transport, channel, reason, creator, created, expires FROM ignores ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	ignores := []Ignore{}
+	for result.Next() {
+		var ignore Ignore
+		var created, expires timestamp
+		if err := result.Scan(&ignore.Id, &ignore.Mask, &ignore.Transport, &ignore.Channel, &ignore.Reason,
+			&ignore.Creator, &created, &expires); err != nil {
+			return nil, err
+		}
+		ignore.Created = created.Time
+		ignore.Expires = expires.Time
+		ignores = append(ignores, ignore)
+	}
+	return ignores, result.Err()
+}
+
+func (s *sqlStorage) DeleteIgnore(id int64) (bool, error) {
+	result, err := s.exec(`DELETE FROM ignores WHERE id=?`, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (s *sqlStorage) DeleteExpiredIgnores(now time.Time) (int64, error) {
+	result, err := s.exec(`DELETE FROM ignores WHERE expires IS NOT NULL AND expires<=?`, now.Format(dateFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStorage) Vars() (map[string]string, error) {
+	result, err := s.query(`SELECT name, COALESCE(value, '') FROM vars`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	vars := map[string]string{}
+	for result.Next() {
+		var name, value string
+		if err := result.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		vars[name] = value
+	}
+	return vars, result.Err()
+}
+
+func (s *sqlStorage) SetVar(name, value string) error {
+	_, err := s.exec(
+		`INSERT INTO vars(name, value) VALUES(?, ?) ON CONFLICT(name) DO UPDATE SET value=excluded.value`,
+		name, value)
+	return err
+}
+
+func (s *sqlStorage) DeleteVar(name string) error {
+	_, err := s.exec(`DELETE FROM vars WHERE name=?`, name)
+	return err
+}
+
+func (s *sqlStorage) ChannelSettings() ([]ChannelSetting, error) {
+	result, err := s.query(`SELECT channel_id, kind, name, enabled FROM channel_settings`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	settings := []ChannelSetting{}
+	for result.Next() {
+		var setting ChannelSetting
+		if err := result.Scan(&setting.ChannelId, &setting.Kind, &setting.Name, &setting.Enabled); err != nil {
+			return nil, err
+		}
+		settings = append(settings, setting)
+	}
+	return settings, result.Err()
+}
+
+func (s *sqlStorage) SetChannelSetting(setting ChannelSetting) error {
+	_, err := s.exec(`
+		INSERT INTO channel_settings(channel_id, kind, name, enabled) VALUES(?, ?, ?, ?)
+		ON CONFLICT(channel_id, kind, name) DO UPDATE SET enabled=excluded.enabled`,
+		setting.ChannelId, setting.Kind, setting.Name, setting.Enabled)
+	return err
+}
+
+func (s *sqlStorage) DeleteChannelSetting(channelId, kind, name string) error {
+	_, err := s.exec(`DELETE FROM channel_settings WHERE channel_id=? AND kind=? AND name=?`, channelId, kind, name)
+	return err
+}
+
+func (s *sqlStorage) Languages() ([]LanguageChoice, error) {
+	result, err := s.query(`SELECT kind, name, language FROM languages`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	choices := []LanguageChoice{}
+	for result.Next() {
+		var choice LanguageChoice
+		if err := result.Scan(&choice.Kind, &choice.Name, &choice.Language); err != nil {
+			return nil, err
+		}
+		choices = append(choices, choice)
+	}
+	return choices, result.Err()
+}
+
+func (s *sqlStorage) SetLanguage(choice LanguageChoice) error {
+	_, err := s.exec(`
+		INSERT INTO languages(kind, name, language) VALUES(?, ?, ?)
+		ON CONFLICT(kind, name) DO UPDATE SET language=excluded.language`,
+		choice.Kind, choice.Name, choice.Language)
+	return err
+}
+
+func (s *sqlStorage) DeleteLanguage(kind, name string) error {
+	_, err := s.exec(`DELETE FROM languages WHERE kind=? AND name=?`, kind, name)
+	return err
+}
+
+func (s *sqlStorage) AddReminder(reminder Reminder) error {
+	_, err := s.exec(`
+		INSERT INTO reminders(transport, channel, creator, announce_text, announced, target_time, created_time)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		reminder.Transport, reminder.Channel, reminder.Creator, reminder.Text, reminder.Announced,
+		reminder.TargetTime.Format(dateFormat), reminder.CreatedTime.Format(dateFormat))
+	return err
+}
+
+func (s *sqlStorage) PendingReminders() ([]Reminder, error) {
+	result, err := s.query(`
+		SELECT id, transport, channel, creator, announce_text, announced, target_time, created_time
+		FROM reminders WHERE announced=? ORDER BY id ASC`, false)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	reminders := []Reminder{}
+	for result.Next() {
+		var reminder Reminder
+		var targetTime, createdTime timestamp
+		if err := result.Scan(&reminder.Id, &reminder.Transport, &reminder.Channel, &reminder.Creator,
+			&reminder.Text, &reminder.Announced, &targetTime, &createdTime); err != nil {
+			return nil, err
+		}
+		reminder.TargetTime = targetTime.Time
+		reminder.CreatedTime = createdTime.Time
+		reminders = append(reminders, reminder)
+	}
+	return reminders, result.Err()
+}
+
+func (s *sqlStorage) MarkReminderAnnounced(id int64) error {
+	_, err := s.exec(`UPDATE reminders SET announced=? WHERE id=?`, true, id)
+	return err
+}
+
+func (s *sqlStorage) DeleteReminder(id int64) error {
+	_, err := s.exec(`DELETE FROM reminders WHERE id=?`, id)
+	return err
+}
+
+func (s *sqlStorage) AddCounter(counter Counter) error {
+	_, err := s.exec(`
+		INSERT INTO counters(transport, channel, creator, announce_text, "interval", target_date)
+		VALUES(?, ?, ?, ?, ?, ?)`,
+		counter.Transport, counter.Channel, counter.Creator, counter.Text, counter.Interval,
+		counter.Date.Format(dateFormat))
+	return err
+}
+
+func (s *sqlStorage) Counters() ([]Counter, error) {
+	result, err := s.query(`
+		SELECT id, transport, channel, creator, announce_text, "interval", target_date, created
+		FROM counters ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	counters := []Counter{}
+	for result.Next() {
+		var counter Counter
+		var date, created timestamp
+		if err := result.Scan(&counter.Id, &counter.Transport, &counter.Channel, &counter.Creator, &counter.Text,
+			&counter.Interval, &date, &created); err != nil {
+			return nil, err
+		}
+		counter.Date = date.Time
+		counter.Created = created.Time
+		counters = append(counters, counter)
+	}
+	return counters, result.Err()
+}
+
+func (s *sqlStorage) DeleteCounter(id int64, creator string) (bool, error) {
+	var result sql.Result
+	var err error
+	if creator == "" {
+		result, err = s.exec(`DELETE FROM counters WHERE id=?`, id)
+	} else {
+		result, err = s.exec(`DELETE FROM counters WHERE id=? AND creator=?`, id, creator)
+	}
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
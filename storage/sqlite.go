@@ -0,0 +1,220 @@
+package storage
+
+// SQLite driver.
+
+import (
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = &dialect{
+	name:        "sqlite",
+	driver:      "sqlite3",
+	tableExists: `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type='table' AND name=?)`,
+	searchURLs: func(byChannel bool) string {
+		channelFilter := ""
+		if byChannel {
+			channelFilter = "u.channel=? AND "
+		}
+		return `
+			SELECT u.id, u.transport, u.channel, u.nick, u.link, COALESCE(u.title, ''), u."timestamp"
+			FROM urls_search s JOIN urls u ON u.id = s.docid
+			WHERE ` + channelFilter + `s.search MATCH ?
+			GROUP BY u.link ORDER BY u."timestamp" DESC LIMIT ?`
+	},
+	searchExpression: func(tokens []string) string {
+		return strings.Join(tokens, " AND ")
+	},
+	isUniqueViolation: func(err error) bool {
+		sqliteErr, ok := err.(sqlite3.Error)
+		return ok && sqliteErr.Code == sqlite3.ErrConstraint
+	},
+	migrations: sqliteMigrations,
+}
+
+// Schema for SQLite. Never change an applied migration, add a new one instead.
+var sqliteMigrations = []MigrationSet{
+	{"core", []Migration{
+		{
+			Name: "create_urls",
+			Up: `
+				-- Main URLs table.
+				CREATE TABLE IF NOT EXISTS "urls" (
+					"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
+					"transport" VARCHAR NOT NULL,
+					"channel" VARCHAR NOT NULL,
+					"nick" VARCHAR NOT NULL,
+					"link" VARCHAR NOT NULL,
+					"quote" VARCHAR NOT NULL,
+					"title" VARCHAR,
+					"timestamp" DATETIME DEFAULT (datetime('now','localtime'))
+				);
+
+				-- Virtual table for FTS.
+				CREATE VIRTUAL TABLE IF NOT EXISTS urls_search
+				USING fts4(transport, channel, nick, link, title, timestamp, search);
+
+				-- Triggers for FTS updating.
+				CREATE TRIGGER IF NOT EXISTS url_add AFTER INSERT ON urls BEGIN
+					INSERT INTO urls_search(transport, channel, nick, link, title, timestamp, search)
+					VALUES(new.transport, new.channel, new.nick, new.link, new.title, new.timestamp, new.link || ' ' || new.title);
+				END;
+
+				CREATE TRIGGER IF NOT EXISTS url_update AFTER UPDATE ON urls BEGIN
+					UPDATE urls_search SET title = new.title, search = new.link || ' ' || new.title
+					WHERE timestamp = new.timestamp;
+				END;`,
+		},
+		{
+			Name: "create_users",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "users" (
+					"nick" VARCHAR PRIMARY KEY NOT NULL UNIQUE,
+					"password" VARCHAR,
+					"alt_nicks" VARCHAR,
+					"owner" boolean DEFAULT 0,
+					"admin" boolean DEFAULT 0,
+					"joined" DATETIME DEFAULT (datetime('now','localtime'))
+				);`,
+		},
+		{
+			Name: "create_vars",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "vars" (
+					"name" VARCHAR PRIMARY KEY NOT NULL UNIQUE,
+					"value" VARCHAR
+				);`,
+		},
+		{
+			Name: "create_channel_settings",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "channel_settings" (
+					"channel_id" VARCHAR NOT NULL,
+					"kind" VARCHAR NOT NULL,
+					"name" VARCHAR NOT NULL,
+					"enabled" boolean NOT NULL,
+					PRIMARY KEY ("channel_id", "kind", "name")
+				);`,
+		},
+		{
+			// Search entries were matched by timestamp, so all URLs posted in the same second got the same title.
+			// Link them by id instead and rebuild the index.
+			Name: "link_urls_search_by_id",
+			Up: `
+				DROP TRIGGER IF EXISTS url_add;
+				DROP TRIGGER IF EXISTS url_update;
+
+				CREATE TRIGGER url_add AFTER INSERT ON urls BEGIN
+					INSERT INTO urls_search(docid, transport, channel, nick, link, title, timestamp, search)
+					VALUES(new.id, new.transport, new.channel, new.nick, new.link, new.title, new.timestamp,
+						new.link || ' ' || new.title);
+				END;
+
+				CREATE TRIGGER url_update AFTER UPDATE ON urls BEGIN
+					UPDATE urls_search SET title = new.title, search = new.link || ' ' || new.title
+					WHERE docid = new.id;
+				END;
+
+				DELETE FROM urls_search;
+				INSERT INTO urls_search(docid, transport, channel, nick, link, title, timestamp, search)
+				SELECT id, transport, channel, nick, link, title, timestamp, link || ' ' || title FROM urls;`,
+		},
+		{
+			// Owner and admin flags of the users are replaced by roles.
+			Name: "create_roles",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "roles" (
+					"name" VARCHAR PRIMARY KEY NOT NULL,
+					"permissions" VARCHAR NOT NULL DEFAULT ''
+				);
+
+				CREATE TABLE IF NOT EXISTS "role_assignments" (
+					"nick" VARCHAR NOT NULL,
+					"role" VARCHAR NOT NULL,
+					"channel_id" VARCHAR NOT NULL DEFAULT '',
+					PRIMARY KEY ("nick", "role", "channel_id")
+				);
+
+				CREATE TABLE IF NOT EXISTS "audit_log" (
+					"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
+					"actor" VARCHAR NOT NULL,
+					"action" VARCHAR NOT NULL,
+					"target" VARCHAR NOT NULL,
+					"details" VARCHAR NOT NULL,
+					"created" DATETIME DEFAULT (datetime('now','localtime'))
+				);
+
+				INSERT INTO roles(name, permissions) VALUES
+					('owner', '*'),
+					('admin', 'channels|counters|reminders.manage|limits.bypass');
+				INSERT INTO role_assignments(nick, role) SELECT nick, 'owner' FROM users WHERE owner;
+				INSERT INTO role_assignments(nick, role) SELECT nick, 'admin' FROM users WHERE admin;`,
+		},
+		{
+			// Failed login counting and lockout.
+			Name: "add_login_lockout",
+			Up: `
+				ALTER TABLE "users" ADD COLUMN "failed_logins" INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE "users" ADD COLUMN "locked_until" DATETIME;`,
+		},
+		{
+			// Ignore list moves out of the _ignored var, which the bot converts on start.
+			Name: "create_ignores",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "ignores" (
+					"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
+					"mask" VARCHAR NOT NULL,
+					"transport" VARCHAR NOT NULL DEFAULT '',
+					"channel" VARCHAR NOT NULL DEFAULT '',
+					"reason" VARCHAR NOT NULL DEFAULT '',
+					"creator" VARCHAR NOT NULL DEFAULT '',
+					"created" DATETIME DEFAULT (datetime('now','localtime')),
+					"expires" DATETIME
+				);`,
+		},
+		{
+			Name: "create_languages",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "languages" (
+					"kind" VARCHAR NOT NULL,
+					"name" VARCHAR NOT NULL,
+					"language" VARCHAR NOT NULL,
+					PRIMARY KEY ("kind", "name")
+				);`,
+		},
+	}},
+	{"counters", []Migration{
+		{
+			Name: "create_counters",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "counters" (
+					"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
+					"transport" VARCHAR NOT NULL,
+					"channel" VARCHAR NOT NULL,
+					"creator" VARCHAR NOT NULL,
+					"announce_text" VARCHAR NOT NULL,
+					"interval" INTEGER NOT NULL,
+					"target_date" VARCHAR NOT NULL,
+					"created" DATETIME DEFAULT (datetime('now','localtime')),
+					FOREIGN KEY(creator) REFERENCES users(nick)
+				);`,
+		},
+	}},
+	{"reminders", []Migration{
+		{
+			Name: "create_reminders",
+			Up: `
+				CREATE TABLE IF NOT EXISTS "reminders" (
+					"id" INTEGER PRIMARY KEY  AUTOINCREMENT  NOT NULL,
+					"transport" VARCHAR NOT NULL,
+					"channel" VARCHAR NOT NULL,
+					"creator" VARCHAR NOT NULL,
+					"announce_text" VARCHAR NOT NULL,
+					"announced" INTEGER DEFAULT 0,
+					"target_time" VARCHAR NOT NULL,
+					"created_time" VARCHAR NOT NULL
+				);`,
+		},
+	}},
+}
@@ -0,0 +1,240 @@
+// Package storage provides the bot's persistent data store, with SQLite and PostgreSQL drivers.
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by the storage.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrUserExists = errors.New("user already exists")
+)
+
+// Storage is the interface to the bot's data. Both drivers share the same schema, apart from full-text search.
+type Storage interface {
+	// Name of the driver ("sqlite" or "postgres").
+	Driver() string
+	// Raw database connection, for extensions that keep their own tables.
+	DB() *sql.DB
+	// Rebind rewrites a query with "?" placeholders into the form used by the driver. Question marks inside quoted
+	// strings and identifiers are left alone, but the PostgreSQL operators containing "?" can't be used.
+	Rebind(query string) string
+	// Close closes the database.
+	Close() error
+
+	// Schema migrations.
+	BuiltinMigrations() []MigrationSet
+	PendingMigrations(sets []MigrationSet) ([]PendingMigration, error)
+	ApplyMigration(migration PendingMigration) error
+
+	// URLs.
+	// AddURL saves the link. Zero timestamp means now.
+	AddURL(url URL) error
+	// URLs returns all links, in the order they were posted.
+	URLs() ([]URL, error)
+	// URLHistory returns how many times the link was posted on the channel, and the second latest post, if any.
+	URLHistory(transport, channel, link string) (count int, previous *URL, err error)
+	// SearchURLs finds links containing all the tokens. Empty channel searches everywhere.
+	SearchURLs(channel string, tokens []string, limit int) ([]URL, error)
+
+	// Users.
+	AddUser(user User) error
+	GetUser(nick string) (User, error)
+	// Users returns all users, sorted by nick.
+	Users() ([]User, error)
+	// SetPassword replaces the user's password hash. Returns false if there was no such user.
+	SetPassword(nick, password string) (bool, error)
+	// SetAltNicks replaces the identities linked to the user. Returns false if there was no such user.
+	SetAltNicks(nick string, altNicks []string) (bool, error)
+	// SetLoginFailures saves the failed login count and the lockout time, zero for none.
+	SetLoginFailures(nick string, failures int, lockedUntil time.Time) error
+	// DeleteUser removes the user and their roles. Returns false if there was no such user.
+	DeleteUser(nick string) (bool, error)
+	// OwnerExists checks whether anyone has the owner role.
+	OwnerExists() (bool, error)
+
+	// Roles and permissions.
+	Roles() ([]Role, error)
+	// SetRole creates the role or replaces its permissions.
+	SetRole(role Role) error
+	// DeleteRole removes the role and its assignments. Returns false if there was no such role.
+	DeleteRole(name string) (bool, error)
+	RoleAssignments() ([]RoleAssignment, error)
+	AssignRole(assignment RoleAssignment) error
+	// UnassignRole returns false if the user didn't have the role.
+	UnassignRole(assignment RoleAssignment) (bool, error)
+
+	// Audit trail.
+	AddAuditEntry(entry AuditEntry) error
+	// AuditEntries returns the latest entries, newest first.
+	AuditEntries(limit int) ([]AuditEntry, error)
+
+	// Ignore list.
+	AddIgnore(ignore Ignore) error
+	// Ignores returns all entries of the ignore list, in the order they were added.
+	Ignores() ([]Ignore, error)
+	// DeleteIgnore removes the entry. Returns false if there was no such entry.
+	DeleteIgnore(id int64) (bool, error)
+	// DeleteExpiredIgnores removes the entries that expired before the time. Returns the number removed.
+	DeleteExpiredIgnores(now time.Time) (int64, error)
+
+	// Custom variables.
+	Vars() (map[string]string, error)
+	SetVar(name, value string) error
+	DeleteVar(name string) error
+
+	// Per-channel settings.
+	ChannelSettings() ([]ChannelSetting, error)
+	SetChannelSetting(setting ChannelSetting) error
+	DeleteChannelSetting(channelId, kind, name string) error
+
+	// Languages chosen by channels and users.
+	Languages() ([]LanguageChoice, error)
+	SetLanguage(choice LanguageChoice) error
+	DeleteLanguage(kind, name string) error
+
+	// Reminders.
+	AddReminder(reminder Reminder) error
+	PendingReminders() ([]Reminder, error)
+	MarkReminderAnnounced(id int64) error
+	DeleteReminder(id int64) error
+
+	// Counters.
+	AddCounter(counter Counter) error
+	Counters() ([]Counter, error)
+	// DeleteCounter removes the counter. If creator is not empty, only a counter created by that user is removed.
+	DeleteCounter(id int64, creator string) (bool, error)
+}
+
+// URL posted on a channel.
+type URL struct {
+	Id        int64
+	Transport string
+	Channel   string
+	Nick      string
+	Link      string
+	Quote     string
+	Title     string
+	Timestamp time.Time
+}
+
+// User account. Privileges come from the roles assigned to the user.
+type User struct {
+	Nick string
+	// Password hash, with the algorithm and its parameters.
+	Password string
+	// Identities on the transports linked to the account, as transport;nick or transport;nick;user id.
+	AltNicks []string
+	Joined   time.Time
+	// Failed logins since the last successful one or the last lockout.
+	FailedLogins int
+	// Time until which logging in is blocked, zero if it's not.
+	LockedUntil time.Time
+}
+
+// Role is a named set of permissions.
+type Role struct {
+	Name        string
+	Permissions []string
+}
+
+// RoleAssignment gives the role to the user, everywhere or on one channel.
+type RoleAssignment struct {
+	Nick string
+	Role string
+	// Channel id the role is limited to, empty for all channels.
+	ChannelId string
+}
+
+// Ignore is an entry of the ignore list.
+type Ignore struct {
+	Id int64
+	// Glob with * and ?, or a regular expression between slashes.
+	Mask string
+	// Transport and channel the entry is limited to, empty for all.
+	Transport string
+	Channel   string
+	Reason    string
+	Creator   string
+	Created   time.Time
+	// Time when the entry stops working, zero for never.
+	Expires time.Time
+}
+
+// AuditEntry records a change made with special privileges.
+type AuditEntry struct {
+	Id int64
+	// Nick of the user who made the change.
+	Actor   string
+	Action  string
+	Target  string
+	Details string
+	Created time.Time
+}
+
+// ChannelSetting switches an extension, command or URL announcements on or off for a channel.
+type ChannelSetting struct {
+	ChannelId string
+	Kind      string
+	Name      string
+	Enabled   bool
+}
+
+// LanguageChoice is the language of the bot's messages picked for a channel or a user.
+type LanguageChoice struct {
+	// "channel" or "user".
+	Kind string
+	// Channel id or user name.
+	Name     string
+	Language string
+}
+
+// Reminder set by a user.
+type Reminder struct {
+	Id          int64
+	Transport   string
+	Channel     string
+	Creator     string
+	Text        string
+	Announced   bool
+	TargetTime  time.Time
+	CreatedTime time.Time
+}
+
+// Counter announced periodically on a channel.
+type Counter struct {
+	Id        int64
+	Transport string
+	Channel   string
+	Creator   string
+	Text      string
+	Interval  int // Hours.
+	Date      time.Time
+	Created   time.Time
+}
+
+// Open connects to the database using the driver ("sqlite" or "postgres") and data source name.
+func Open(driver, dsn string) (Storage, error) {
+	var d *dialect
+	switch driver {
+	case "sqlite", "sqlite3":
+		d = sqliteDialect
+	case "postgres", "postgresql":
+		d = postgresDialect
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown database driver: %s", driver))
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStorage{db, d}, nil
+}
@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSQLite runs the storage tests against a temporary SQLite database.
+func TestSQLite(t *testing.T) {
+	store, err := Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Can't open the database: %s", err)
+	}
+	defer store.Close()
+	testStorage(t, store)
+}
+
+// TestPostgres runs the storage tests against the PostgreSQL database from PAPABOT_TEST_POSTGRES_DSN, in a new
+// schema that is dropped afterwards.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("PAPABOT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("PAPABOT_TEST_POSTGRES_DSN not set.")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Can't open the database: %s", err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("papabot_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("Can't create test schema: %s", err)
+	}
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	store, err := Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatalf("Can't open the database: %s", err)
+	}
+	defer store.Close()
+	testStorage(t, store)
+}
+
+// withSearchPath adds the search_path parameter to the DSN, which can be a URL or a list of key=value pairs.
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		parsed, err := url.Parse(dsn)
+		if err == nil {
+			query := parsed.Query()
+			query.Set("search_path", schema)
+			parsed.RawQuery = query.Encode()
+			return parsed.String()
+		}
+	}
+	return dsn + " search_path=" + schema
+}
+
+// testStorage runs all the tests on a fresh database.
+func testStorage(t *testing.T, store Storage) {
+	t.Run("Migrations", func(t *testing.T) { testMigrations(t, store) })
+	t.Run("Vars", func(t *testing.T) { testVars(t, store) })
+	t.Run("Users", func(t *testing.T) { testUsers(t, store) })
+	t.Run("Roles", func(t *testing.T) { testRoles(t, store) })
+	t.Run("Audit", func(t *testing.T) { testAudit(t, store) })
+	t.Run("Ignores", func(t *testing.T) { testIgnores(t, store) })
+	t.Run("URLs", func(t *testing.T) { testURLs(t, store) })
+	t.Run("ChannelSettings", func(t *testing.T) { testChannelSettings(t, store) })
+	t.Run("Languages", func(t *testing.T) { testLanguages(t, store) })
+	t.Run("Reminders", func(t *testing.T) { testReminders(t, store) })
+	t.Run("Counters", func(t *testing.T) { testCounters(t, store) })
+}
+
+func testMigrations(t *testing.T, store Storage) {
+	extension := MigrationSet{"test", []Migration{
+		{Name: "create_test", Up: `CREATE TABLE test_table (id INTEGER PRIMARY KEY, value VARCHAR)`},
+		{Name: "only_other", Driver: "other", Up: `THIS IS NOT SQL`},
+	}}
+	sets := append(store.BuiltinMigrations(), extension)
+
+	pending, err := store.PendingMigrations(sets)
+	if err != nil {
+		t.Fatalf("Can't list migrations: %s", err)
+	}
+	for _, migration := range pending {
+		if migration.Driver != "" && migration.Driver != store.Driver() {
+			t.Errorf("Migration %s/%s is for another driver.", migration.Owner, migration.Name)
+		}
+		if err := store.ApplyMigration(migration); err != nil {
+			t.Fatalf("Migration %s/%s failed: %s", migration.Owner, migration.Name, err)
+		}
+	}
+	if pending, err = store.PendingMigrations(sets); err != nil || len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %d (%v).", len(pending), err)
+	}
+
+	// Failed migration is rolled back and not recorded.
+	broken := MigrationSet{"test", []Migration{{Name: "broken", Up: `INSERT INTO test_table(id, value) VALUES(1, 'a');
+		INSERT INTO no_such_table VALUES(1);`}}}
+	pending, _ = store.PendingMigrations([]MigrationSet{broken})
+	if len(pending) != 1 || store.ApplyMigration(pending[0]) == nil {
+		t.Fatal("Broken migration should fail.")
+	}
+	var count int
+	if err := store.DB().QueryRow(`SELECT count(*) FROM test_table`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("Broken migration was not rolled back: %d rows (%v).", count, err)
+	}
+
+	// Duplicate names are an error.
+	duplicate := MigrationSet{"test", []Migration{{Name: "a", Up: ";"}, {Name: "a", Up: ";"}}}
+	if _, err := store.PendingMigrations([]MigrationSet{duplicate}); err == nil {
+		t.Error("Duplicate migrations should be reported.")
+	}
+}
+
+func testVars(t *testing.T, store Storage) {
+	if err := store.SetVar("a", "1"); err != nil {
+		t.Fatalf("Can't set var: %s", err)
+	}
+	if err := store.SetVar("a", "2"); err != nil {
+		t.Fatalf("Can't overwrite var: %s", err)
+	}
+	store.SetVar("b", "3")
+	if err := store.DeleteVar("b"); err != nil {
+		t.Fatalf("Can't delete var: %s", err)
+	}
+	vars, err := store.Vars()
+	if err != nil {
+		t.Fatalf("Can't load vars: %s", err)
+	}
+	if len(vars) != 1 || vars["a"] != "2" {
+		t.Errorf("Unexpected vars: %v", vars)
+	}
+}
+
+func testUsers(t *testing.T, store Storage) {
+	if err := store.AddUser(User{Nick: "owner", Password: "hash", AltNicks: []string{"o1", "o2"}}); err != nil {
+		t.Fatalf("Can't add user: %s", err)
+	}
+	if err := store.AddUser(User{Nick: "owner", Password: "other"}); err != ErrUserExists {
+		t.Errorf("Expected ErrUserExists, got %v.", err)
+	}
+	user, err := store.GetUser("owner")
+	if err != nil {
+		t.Fatalf("Can't get user: %s", err)
+	}
+	if user.Password != "hash" || strings.Join(user.AltNicks, ",") != "o1,o2" {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+	if user.Joined.IsZero() {
+		t.Error("Join date not set.")
+	}
+	if _, err := store.GetUser("nobody"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v.", err)
+	}
+	if updated, err := store.SetPassword("owner", "new hash"); err != nil || !updated {
+		t.Errorf("Password should be changed (%v).", err)
+	}
+	if user, _ := store.GetUser("owner"); user.Password != "new hash" {
+		t.Errorf("Unexpected password: %s", user.Password)
+	}
+	if updated, err := store.SetPassword("nobody", "hash"); err != nil || updated {
+		t.Errorf("Password of a missing user should not be changed (%v).", err)
+	}
+	if updated, err := store.SetAltNicks("owner", []string{"irc;own", "mattermost;own;abc"}); err != nil || !updated {
+		t.Errorf("Alt nicks should be changed (%v).", err)
+	}
+	if user, _ := store.GetUser("owner"); strings.Join(user.AltNicks, ",") != "irc;own,mattermost;own;abc" {
+		t.Errorf("Unexpected alt nicks: %v", user.AltNicks)
+	}
+	lockedUntil := time.Date(2030, 1, 2, 3, 4, 5, 0, time.Local)
+	if err := store.SetLoginFailures("owner", 3, lockedUntil); err != nil {
+		t.Errorf("Can't set login failures: %s", err)
+	}
+	if user, _ := store.GetUser("owner"); user.FailedLogins != 3 || !user.LockedUntil.Equal(lockedUntil) {
+		t.Errorf("Unexpected login failures: %d, %s", user.FailedLogins, user.LockedUntil)
+	}
+	store.SetLoginFailures("owner", 0, time.Time{})
+	if user, _ := store.GetUser("owner"); user.FailedLogins != 0 || !user.LockedUntil.IsZero() {
+		t.Errorf("Login failures not cleared: %d, %s", user.FailedLogins, user.LockedUntil)
+	}
+
+	store.AddUser(User{Nick: "admin", Password: "hash"})
+	users, err := store.Users()
+	if err != nil || len(users) != 2 || users[0].Nick != "admin" || users[1].Nick != "owner" {
+		t.Errorf("Unexpected users: %+v (%v)", users, err)
+	}
+	if deleted, err := store.DeleteUser("admin"); err != nil || !deleted {
+		t.Errorf("User should be deleted (%v).", err)
+	}
+	if deleted, err := store.DeleteUser("admin"); err != nil || deleted {
+		t.Errorf("User should not be deleted twice (%v).", err)
+	}
+}
+
+func testRoles(t *testing.T, store Storage) {
+	// Built-in roles are created by the migrations.
+	roles, err := store.Roles()
+	if err != nil || len(roles) != 2 || roles[0].Name != "admin" || roles[1].Name != "owner" ||
+		strings.Join(roles[1].Permissions, ",") != "*" {
+		t.Errorf("Unexpected roles: %+v (%v)", roles, err)
+	}
+	if exists, err := store.OwnerExists(); err != nil || exists {
+		t.Errorf("Expected no owner, got %v (%v).", exists, err)
+	}
+	if err := store.SetRole(Role{"mod", []string{"reminders.manage", "ignore"}}); err != nil {
+		t.Fatalf("Can't add role: %s", err)
+	}
+	store.SetRole(Role{"mod", []string{"reminders.manage"}})
+	if roles, _ := store.Roles(); len(roles) != 3 || strings.Join(roles[1].Permissions, ",") != "reminders.manage" {
+		t.Errorf("Role permissions should be replaced: %+v", roles)
+	}
+
+	store.AddUser(User{Nick: "boss", Password: "hash"})
+	for _, assignment := range []RoleAssignment{
+		{"boss", "owner", ""}, {"someone", "mod", "irc;#a"}, {"someone", "mod", "irc;#b"}, {"someone", "mod", "irc;#a"},
+	} {
+		if err := store.AssignRole(assignment); err != nil {
+			t.Fatalf("Can't assign role: %s", err)
+		}
+	}
+	if exists, err := store.OwnerExists(); err != nil || !exists {
+		t.Errorf("Expected an owner, got %v (%v).", exists, err)
+	}
+	assignments, err := store.RoleAssignments()
+	if err != nil || len(assignments) != 3 || assignments[0] != (RoleAssignment{"boss", "owner", ""}) {
+		t.Errorf("Unexpected assignments: %+v (%v)", assignments, err)
+	}
+	if removed, err := store.UnassignRole(RoleAssignment{"someone", "mod", "irc;#b"}); err != nil || !removed {
+		t.Errorf("Role should be unassigned (%v).", err)
+	}
+	if removed, _ := store.UnassignRole(RoleAssignment{"someone", "mod", "irc;#b"}); removed {
+		t.Error("Role should not be unassigned twice.")
+	}
+	if deleted, err := store.DeleteRole("mod"); err != nil || !deleted {
+		t.Errorf("Role should be deleted (%v).", err)
+	}
+	store.DeleteUser("boss")
+	if assignments, _ := store.RoleAssignments(); len(assignments) != 0 {
+		t.Errorf("Assignments of deleted roles and users should be removed: %+v", assignments)
+	}
+}
+
+func testAudit(t *testing.T, store Storage) {
+	for i := 0; i < 3; i++ {
+		if err := store.AddAuditEntry(AuditEntry{
+			Actor: "boss", Action: "role.grant", Target: fmt.Sprintf("user%d", i), Details: "mod"}); err != nil {
+			t.Fatalf("Can't add audit entry: %s", err)
+		}
+	}
+	entries, err := store.AuditEntries(2)
+	if err != nil || len(entries) != 2 || entries[0].Target != "user2" || entries[1].Target != "user1" {
+		t.Errorf("Unexpected audit entries: %+v (%v)", entries, err)
+	}
+	if entries[0].Created.IsZero() {
+		t.Error("Audit entry time not set.")
+	}
+}
+
+func testIgnores(t *testing.T, store Storage) {
+	now := time.Now()
+	store.AddIgnore(Ignore{Mask: "*@*.badisp.net", Reason: "spam", Creator: "boss"})
+	store.AddIgnore(Ignore{Mask: "troll", Transport: "irc", Channel: "#a", Expires: now.Add(-time.Minute)})
+	store.AddIgnore(Ignore{Mask: "/^bot[0-9]+$/", Expires: now.Add(time.Hour)})
+	ignores, err := store.Ignores()
+	if err != nil || len(ignores) != 3 || ignores[0].Mask != "*@*.badisp.net" || ignores[0].Reason != "spam" ||
+		ignores[1].Channel != "#a" || !ignores[0].Expires.IsZero() || ignores[2].Expires.IsZero() {
+		t.Errorf("Unexpected ignores: %+v (%v)", ignores, err)
+	}
+	if removed, err := store.DeleteExpiredIgnores(now); err != nil || removed != 1 {
+		t.Errorf("Expected one expired ignore removed, got %d (%v).", removed, err)
+	}
+	if deleted, err := store.DeleteIgnore(ignores[0].Id); err != nil || !deleted {
+		t.Errorf("Ignore should be deleted (%v).", err)
+	}
+	if ignores, _ := store.Ignores(); len(ignores) != 1 || ignores[0].Mask != "/^bot[0-9]+$/" {
+		t.Errorf("Unexpected ignores: %+v", ignores)
+	}
+}
+
+func testURLs(t *testing.T, store Storage) {
+	for _, url := range []URL{
+		{Transport: "irc", Channel: "#a", Nick: "first", Link: "http://example.com/go", Quote: "q", Title: "Go language"},
+		{Transport: "irc", Channel: "#a", Nick: "second", Link: "http://example.com/go", Quote: "q", Title: "Go language"},
+		{Transport: "irc", Channel: "#b", Nick: "third", Link: "http://example.com/rust", Quote: "q", Title: "Rust language"},
+	} {
+		if err := store.AddURL(url); err != nil {
+			t.Fatalf("Can't add URL: %s", err)
+		}
+	}
+
+	count, previous, err := store.URLHistory("irc", "#a", "http://example.com/go")
+	if err != nil {
+		t.Fatalf("Can't get URL history: %s", err)
+	}
+	if count != 2 || previous == nil || previous.Nick != "first" || previous.Timestamp.IsZero() {
+		t.Errorf("Unexpected history: %d, %+v", count, previous)
+	}
+	if count, previous, _ = store.URLHistory("irc", "#b", "http://example.com/rust"); count != 1 || previous != nil {
+		t.Errorf("Unexpected history: %d, %+v", count, previous)
+	}
+
+	found, err := store.SearchURLs("", []string{"language"}, 5)
+	if err != nil {
+		t.Fatalf("Can't search URLs: %s", err)
+	}
+	if len(found) != 2 {
+		t.Errorf("Expected 2 links, got %+v", found)
+	}
+	if found, _ = store.SearchURLs("#a", []string{"language"}, 5); len(found) != 1 || found[0].Title != "Go language" {
+		t.Errorf("Expected one link from #a, got %+v", found)
+	}
+	if found, _ = store.SearchURLs("", []string{"rust", "language"}, 5); len(found) != 1 || found[0].Nick != "third" {
+		t.Errorf("Expected the rust link, got %+v", found)
+	}
+	if found, _ = store.SearchURLs("", []string{"python"}, 5); len(found) != 0 {
+		t.Errorf("Expected no links, got %+v", found)
+	}
+
+	posted := time.Date(2020, 5, 1, 12, 30, 0, 0, time.Local)
+	if err := store.AddURL(URL{Transport: "irc", Channel: "#b", Nick: "old", Link: "http://example.com/old",
+		Quote: "q", Title: "Old news", Timestamp: posted}); err != nil {
+		t.Fatalf("Can't add URL: %s", err)
+	}
+	all, err := store.URLs()
+	if err != nil {
+		t.Fatalf("Can't list URLs: %s", err)
+	}
+	if len(all) != 4 || all[0].Nick != "first" || !all[3].Timestamp.Equal(posted) || all[3].Quote != "q" {
+		t.Errorf("Unexpected links: %+v", all)
+	}
+	if found, _ = store.SearchURLs("", []string{"news"}, 5); len(found) != 1 || !found[0].Timestamp.Equal(posted) {
+		t.Errorf("Expected the imported link, got %+v", found)
+	}
+}
+
+func testChannelSettings(t *testing.T, store Storage) {
+	store.SetChannelSetting(ChannelSetting{"irc;#a", "extension", "btc", true})
+	store.SetChannelSetting(ChannelSetting{"irc;#a", "extension", "btc", false})
+	store.SetChannelSetting(ChannelSetting{"irc;#a", "urls", "", false})
+	if err := store.DeleteChannelSetting("irc;#a", "urls", ""); err != nil {
+		t.Fatalf("Can't delete setting: %s", err)
+	}
+	settings, err := store.ChannelSettings()
+	if err != nil {
+		t.Fatalf("Can't load settings: %s", err)
+	}
+	if len(settings) != 1 || settings[0] != (ChannelSetting{"irc;#a", "extension", "btc", false}) {
+		t.Errorf("Unexpected settings: %+v", settings)
+	}
+}
+
+func testLanguages(t *testing.T, store Storage) {
+	store.SetLanguage(LanguageChoice{"channel", "irc;#a", "en"})
+	store.SetLanguage(LanguageChoice{"channel", "irc;#a", "pl"})
+	store.SetLanguage(LanguageChoice{"user", "alice", "pl"})
+	if err := store.DeleteLanguage("user", "alice"); err != nil {
+		t.Fatalf("Can't delete language: %s", err)
+	}
+	choices, err := store.Languages()
+	if err != nil {
+		t.Fatalf("Can't load languages: %s", err)
+	}
+	if len(choices) != 1 || choices[0] != (LanguageChoice{"channel", "irc;#a", "pl"}) {
+		t.Errorf("Unexpected languages: %+v", choices)
+	}
+}
+
+func testReminders(t *testing.T, store Storage) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	target := created.Add(time.Hour)
+	for _, text := range []string{"one", "two"} {
+		if err := store.AddReminder(Reminder{Transport: "irc", Channel: "#a", Creator: "owner", Text: text,
+			TargetTime: target, CreatedTime: created}); err != nil {
+			t.Fatalf("Can't add reminder: %s", err)
+		}
+	}
+	reminders, err := store.PendingReminders()
+	if err != nil || len(reminders) != 2 {
+		t.Fatalf("Expected 2 reminders, got %d (%v).", len(reminders), err)
+	}
+	if !reminders[0].TargetTime.Equal(target) || !reminders[0].CreatedTime.Equal(created) {
+		t.Errorf("Unexpected dates: %s, %s", reminders[0].TargetTime, reminders[0].CreatedTime)
+	}
+	store.MarkReminderAnnounced(reminders[0].Id)
+	store.DeleteReminder(reminders[1].Id)
+	if reminders, _ = store.PendingReminders(); len(reminders) != 0 {
+		t.Errorf("Expected no pending reminders, got %+v", reminders)
+	}
+}
+
+func testCounters(t *testing.T, store Storage) {
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	if err := store.AddCounter(Counter{Transport: "irc", Channel: "#a", Creator: "owner", Text: "{{ .days }}",
+		Interval: 24, Date: date}); err != nil {
+		t.Fatalf("Can't add counter: %s", err)
+	}
+	counters, err := store.Counters()
+	if err != nil || len(counters) != 1 {
+		t.Fatalf("Expected 1 counter, got %d (%v).", len(counters), err)
+	}
+	if counters[0].Interval != 24 || !counters[0].Date.Equal(date) || counters[0].Created.IsZero() {
+		t.Errorf("Unexpected counter: %+v", counters[0])
+	}
+	if deleted, err := store.DeleteCounter(counters[0].Id, "someone"); err != nil || deleted {
+		t.Errorf("Counter of another user should not be deleted (%v).", err)
+	}
+	if deleted, err := store.DeleteCounter(counters[0].Id, "owner"); err != nil || !deleted {
+		t.Errorf("Counter should be deleted (%v).", err)
+	}
+}
+
+// TestRebind tests numbering the placeholders, skipping question marks in quotes.
+func TestRebind(t *testing.T) {
+	store := &sqlStorage{dialect: postgresDialect}
+	tests := map[string]string{
+		`SELECT a FROM t WHERE b=? AND c=?`:            `SELECT a FROM t WHERE b=$1 AND c=$2`,
+		`SELECT '?', "what?" FROM t WHERE b=?`:         `SELECT '?', "what?" FROM t WHERE b=$1`,
+		`UPDATE t SET a='it''s ?' WHERE b=? AND c='?'`: `UPDATE t SET a='it''s ?' WHERE b=$1 AND c='?'`,
+		`INSERT INTO t(a, "b""?") VALUES(?, '"?', ?)`:  `INSERT INTO t(a, "b""?") VALUES($1, '"?', $2)`,
+	}
+	for query, expected := range tests {
+		if rebound := store.Rebind(query); rebound != expected {
+			t.Errorf("Expected %s, got %s", expected, rebound)
+		}
+	}
+}
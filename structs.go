@@ -4,14 +4,17 @@ package papaBot
 
 import (
 	"database/sql"
-	"github.com/pelletier/go-toml"
+	"github.com/pawelszydlo/papa-bot/config"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"regexp"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/pawelszydlo/humanize"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/transports"
 )
 
@@ -19,7 +22,9 @@ import (
 type Bot struct {
 	// Was initialization complete?
 	initDone bool
-	// Database connection.
+	// Storage for all bot's data.
+	Storage storage.Storage
+	// Raw database connection, for extensions that keep their own tables. Use Storage.Rebind for the queries.
 	Db *sql.DB
 	// HTTP client.
 	HTTPClient *http.Client
@@ -27,42 +32,109 @@ type Bot struct {
 	Log *logrus.Logger
 	// Event dispatcher instance.
 	EventDispatcher *events.EventDispatcher
-	// Full config file tree.
-	fullConfig *toml.Tree
-	// Full texts file tree.
-	fullTexts *toml.Tree
+	// Guards config and configLoader. Reload replaces them as a whole, read them with Config and loader.
+	configMu sync.RWMutex
+	// Loader for the config file.
+	configLoader *config.Loader
 	// Bot's configuration.
-	Config *Configuration
-	// Bot texts struct.
-	Texts *botTexts
-	// Values humanizer.
-	Humanizer *humanize.Humanizer
-	// Currently authenticated users.
-	authenticatedUsers  map[string]string
-	authenticatedAdmins map[string]string
-	authenticatedOwners map[string]string
+	config *Configuration
+	// Guards textBundles, localTexts, humanizers and languages.
+	textsMu sync.RWMutex
+	// Texts files, per language.
+	textBundles *textBundles
+	// Texts loaded with LoadTexts, per section and language. Bot's own texts are in the "bot" section.
+	localTexts map[string]map[string]interface{}
+	// Value humanizers, per language.
+	humanizers map[string]*humanize.Humanizer
+	// Languages chosen by channels and users, per kind:name.
+	languages map[string]string
+	// Paths of the files the config and texts were loaded from.
+	configFile string
+	textsFile  string
+	// Guards the failed login counting.
+	loginMu sync.Mutex
+	// Guards sessions and setupToken.
+	authMu sync.RWMutex
+	// Sessions of the authenticated users, per user id.
+	sessions map[string]*session
+	// One-time token for claiming ownership of a bot without an owner, empty when there is none.
+	setupToken string
+	// Guards permissions, rolePermissions and userRoles.
+	rolesMu sync.RWMutex
+	// Descriptions of the registered permissions, per name.
+	permissions map[string]string
+	// Permissions of each role, per role name.
+	rolePermissions map[string]map[string]bool
+	// Roles given to each user, per nick.
+	userRoles map[string][]storage.RoleAssignment
+	// Guards identityNicks, identityUserIds and pendingLinks.
+	identitiesMu sync.RWMutex
+	// Accounts linked to the nicks, per transport;nick.
+	identityNicks map[string]string
+	// Accounts linked to the user ids on transports with stable ids, per transport;user id.
+	identityUserIds map[string]string
+	// Links waiting for verification, per code.
+	pendingLinks map[string]*pendingLink
+	// Guards commands, commandOwners and disabledCommands.
+	commandsMu sync.RWMutex
 	// Registered bot commands.
 	commands map[string]*BotCommand
-	// Number of uses per command.
-	commandUseLimit map[string]int
-	// Was the warning sent, per command.
-	commandWarn map[string]bool
-	// Commands that will not have their params listed in the logs (auth etc.)
+	// Name of the extension that registered the command, per command name. Empty for built-in commands.
+	commandOwners map[string]string
+	// Commands of disabled extensions, per extension name.
+	disabledCommands map[string]map[string]*BotCommand
+	// Token buckets limiting the use of commands, and the commands' cooldowns.
+	rateLimits *rateLimiter
+	// Commands that will not have their params listed in the logs (auth etc.), or "command subcommand" pairs.
 	commandsHideParams map[string]bool
+	// Commands that write their own audit entries, so they don't need the generic one.
+	commandsAuditSelf map[string]bool
 	// Custom variables for use in extensions.
 	customVars map[string]string
+	varsMu     sync.RWMutex
+	// Ignore list, with compiled masks.
+	ignores []*ignoreEntry
+	// Guards ignores.
+	ignoreMu sync.RWMutex
 	// Registered bot extensions,
-	extensions []extension
+	extensions []*registeredExtension
+	// Guards extensions and their enabled state.
+	extensionsMu sync.RWMutex
+	// Name of the extension that is currently being initialized.
+	initializingExtension string
 	// Enabled transports.
 	Transports map[string]transports.Transport
+	// Guards lastURLAnnouncedTime, lastURLAnnouncedLinesPassed and urlMoreInfo.
+	urlsMu sync.Mutex
 	// Time when URL info was last announced, per channel + link.
 	lastURLAnnouncedTime map[string]time.Time
 	// Lines passed since URL info was last announced, per channel + link.
 	lastURLAnnouncedLinesPassed map[string]int
 	// More information to give about last link, per channel.
 	urlMoreInfo map[string]string
+	// Guards channelPolicies and transportPolicies.
+	policiesMu sync.RWMutex
+	// Per-channel settings, per channel id.
+	channelPolicies map[string]channelPolicy
+	// Per-transport defaults for channel settings, per transport name.
+	transportPolicies map[string]channelPolicy
+	// Command trigger settings, per transport name and per channel id.
+	commandTriggers map[string]*triggerSettings
+	triggersMu      sync.RWMutex
 	// Time for next daily tick.
 	nextDailyTick time.Time
+	tickMu        sync.Mutex
+	// Server exposing the metrics, if enabled.
+	metricsServer *http.Server
+	// Admin API server, if enabled.
+	apiServer *http.Server
+	// Admin API handlers, per resource.
+	apiHandlers map[string]*apiHandler
+	apiMu       sync.RWMutex
+	// Token required by the admin API and the tokens of the send endpoint. Both change on reload.
+	apiToken     string
+	sendTokens   []*sendToken
+	sendTokensMu sync.RWMutex
 	// Regular expression for extracting sample text from website.
 	webContentSampleRe *regexp.Regexp
 }
@@ -72,37 +144,99 @@ type extension interface {
 	Init(bot *Bot) error
 }
 
+// Extension registered with the bot.
+type registeredExtension struct {
+	extension
+	name    string
+	enabled bool
+}
+
+// Optional interface for extensions that want to choose their own name. Otherwise name is derived from the type.
+type extensionNamer interface {
+	Name() string
+}
+
+// Optional interface for extensions that need to clean up when the bot stops.
+type extensionShutdowner interface {
+	Shutdown(bot *Bot) error
+}
+
+// Optional interface for extensions that can reload their texts and settings on bot's reload.
+type extensionReloader interface {
+	Reload(bot *Bot) error
+}
+
+// Optional interface for extensions that keep their own tables. Migrations are applied before the extension's Init.
+type extensionMigrator interface {
+	Migrations() []Migration
+}
+
 // Bot's commands.
 type BotCommand struct {
 	// Names of the command (main and aliases).
 	CommandNames []string
 	// Does this command require private query?
 	Private bool
-	// This command can only be run by the owner?
-	Owner bool
-	// This command can only be run by an admin?
-	Admin bool
-	// Help string showing possible parameters.
+	// Permission needed to run the command, empty if everyone can run it.
+	Permission string
+	// Help string showing possible parameters. Generated from the spec when empty.
 	HelpParams string
 	// Help string with the description.
 	HelpDescription string
-	// Function to be executed.
+	// Function to be executed with the words given after the command.
 	CommandFunc func(bot *Bot, sourceEvent *events.EventMessage, params []string)
+	// Arguments of the command. When set, the arguments are parsed and passed to the spec instead of CommandFunc.
+	Spec *CommandSpec
+	// How often the command can be run, nil for no limit other than the bot's rate limits.
+	Cooldown *Cooldown
 }
 
-// Bot's configuration. It will be loaded from the provided file on New(), overwriting any defaults.
+// Bot's configuration. It will be loaded from the bot section of the provided file on New().
+// Defaults are defined in the tags.
 type Configuration struct {
-	Name                       string
-	Language                   string
-	ChatLogging                bool
-	CommandsPer5               int
-	UrlAnnounceIntervalMinutes time.Duration
-	UrlAnnounceIntervalLines   int
-	PageBodyMaxSize            uint
-	HttpDefaultUserAgent       string
-	DailyTickHour              int
-	DailyTickMinute            int
-	LogLevel                   logrus.Level
+	Name                       string        `config:"name" default:"papaBot"`
+	Language                   string        `config:"language" default:"en"`
+	ChatLogging                bool          `config:"chat_logging" default:"true"`
+	UserCommandsBurst          int           `config:"user_commands_burst" default:"10" min:"1"`
+	UserCommandsRefill         time.Duration `config:"user_commands_refill_seconds" default:"30" unit:"s"`
+	ChannelCommandsBurst       int           `config:"channel_commands_burst" default:"30" min:"1"`
+	ChannelCommandsRefill      time.Duration `config:"channel_commands_refill_seconds" default:"4" unit:"s"`
+	CommandUsesBurst           int           `config:"command_uses_burst" default:"5" min:"1"`
+	CommandUsesRefill          time.Duration `config:"command_uses_refill_seconds" default:"60" unit:"s"`
+	UrlAnnounceIntervalMinutes time.Duration `config:"url_announce_interval_minutes" default:"15" unit:"m"`
+	UrlAnnounceIntervalLines   int           `config:"url_announce_interval_lines" default:"50" min:"0"`
+	PageBodyMaxSize            uint          `config:"page_body_max_size" default:"1048576" min:"1"`
+	HttpDefaultUserAgent       string        `config:"http_user_agent" default:"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"`
+	DailyTickHour              int           `config:"daily_tick_hour" default:"8" min:"0" max:"23"`
+	DailyTickMinute            int           `config:"daily_tick_minute" default:"0" min:"0" max:"59"`
+	ShutdownTimeout            time.Duration `config:"shutdown_timeout_seconds" default:"10" unit:"s"`
+	SessionLifetime            time.Duration `config:"session_lifetime_hours" default:"24" unit:"h"`
+	SessionIdleTimeout         time.Duration `config:"session_idle_minutes" default:"60" unit:"m"`
+	LoginFailuresMax           int           `config:"login_failures_max" default:"5" min:"1"`
+	LoginLockout               time.Duration `config:"login_lockout_minutes" default:"15" unit:"m"`
+	LogLevel                   logrus.Level  `config:"log_level" default:"debug"`
+}
+
+// Database connection settings.
+type databaseSettings struct {
+	Driver string `config:"driver" default:"sqlite"`
+	DSN    string `config:"dsn" default:"papabot.db"`
+}
+
+// Event handling settings. Changes require a restart.
+type eventSettings struct {
+	Workers         int           `config:"workers" default:"4" min:"1"`
+	QueueSize       int           `config:"queue_size" default:"100" min:"1"`
+	QueueTimeout    time.Duration `config:"queue_timeout_seconds" default:"5" unit:"s"`
+	ListenerTimeout time.Duration `config:"listener_timeout_seconds" default:"30" unit:"s"`
+}
+
+// Settings the bot reads from each transport's section of the config file.
+type transportSettings struct {
+	Enabled            bool     `config:"enabled" default:"false"`
+	DisabledExtensions []string `config:"disabled_extensions" default:""`
+	DisabledCommands   []string `config:"disabled_commands" default:""`
+	AnnounceURLs       bool     `config:"announce_urls" default:"true"`
 }
 
 // Bot's core texts.
@@ -114,7 +248,77 @@ type botTexts struct {
 	SearchNoResults     string
 	SearchPrivateNotice string
 	CommandLimit        string
+	ChannelLimit        string
 	NothingToAdd        string
 	WrongCommand        []string
 	SeeHelp             string
+	TempDidYouMean      *template.Template
+	TempCommandCooldown *template.Template
+	TempError           *template.Template
+
+	// Accounts and sessions.
+	NotRight            string
+	LoggedIn            string
+	AlreadyLoggedIn     string
+	NotLoggedIn         string
+	NeedsLogin          string
+	UserAdded           string
+	TempUserAddFailed   *template.Template
+	TempLoginLocked     *template.Template
+	PasswordEmpty       string
+	PasswordFailed      string
+	PasswordChanged     string
+	NoRoles             string
+	TempWhoami          *template.Template
+	TempWhoamiGuest     *template.Template
+	NoSessions          string
+	TempSession         *template.Template
+	TempNoUser          *template.Template
+	TempSessionsEnded   *template.Template
+	TempNoTransport     *template.Template
+	LinkFailed          string
+	TempLinkRequest     *template.Template
+	TempLinkCodeSent    *template.Template
+	TempLinkConfirmFail *template.Template
+	TempLinked          *template.Template
+	NoIdentities        string
+	TempIdentity        *template.Template
+	TempIdentities      *template.Template
+	TempUnlinkFailed    *template.Template
+	IdentityUnlinked    string
+
+	// Ignore list.
+	TempIgnoreFailed *template.Template
+	IgnoreAdded      string
+	NoIgnore         string
+	IgnoreRemoved    string
+	IgnoreListEmpty  string
+	IgnoreForever    string
+	TempIgnoreEnds   *template.Template
+	TempIgnore       *template.Template
+	TempIgnoreReason *template.Template
+
+	// Roles and the audit trail.
+	RoleSetRefused       string
+	RoleDeleteRefused    string
+	RoleGrantRefused     string
+	RoleRevokeRefused    string
+	TempRoleSetFailed    *template.Template
+	TempRoleDeleteFailed *template.Template
+	TempRoleGrantFailed  *template.Template
+	TempRoleRevokeFailed *template.Template
+	RoleSaved            string
+	RoleDeleted          string
+	RoleGranted          string
+	RoleRevoked          string
+	TempNoRoles          *template.Template
+	TempRoles            *template.Template
+	AuditEmpty           string
+
+	// Languages.
+	TempNoLanguage      *template.Template
+	TempLanguages       *template.Template
+	TempUserLanguage    *template.Template
+	TempChannelLanguage *template.Template
+	UseOnChannel        string
 }
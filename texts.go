@@ -0,0 +1,391 @@
+package papaBot
+
+// Texts in several languages, with the language picked per channel and per user.
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pawelszydlo/humanize"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
+	"github.com/pawelszydlo/papa-bot/utils"
+	"github.com/pelletier/go-toml"
+)
+
+// Kinds of language choices.
+const (
+	LanguageChannel = "channel"
+	LanguageUser    = "user"
+)
+
+// Language code in the name of a texts file, as in texts.pl.ini.
+var textsLanguageRe = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// Texts files, per language.
+type textBundles struct {
+	defaultLanguage string
+	trees           map[string]*toml.Tree
+}
+
+// loadTextBundles reads the texts file of the default language and the files with other languages next to it. They
+// are named like the texts file, with the language code before the extension: texts.ini, texts.pl.ini, texts.de.ini.
+func loadTextBundles(textsFile, defaultLanguage string) (*textBundles, error) {
+	defaultTexts, err := toml.LoadFile(textsFile)
+	if err != nil {
+		return nil, err
+	}
+	bundles := &textBundles{defaultLanguage, map[string]*toml.Tree{defaultLanguage: defaultTexts}}
+
+	ext := filepath.Ext(textsFile)
+	base := strings.TrimSuffix(textsFile, ext)
+	if language := filepath.Ext(base); textsLanguageRe.MatchString(strings.TrimPrefix(language, ".")) {
+		base = strings.TrimSuffix(base, language)
+	}
+	files, err := filepath.Glob(base + ".*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		language := strings.TrimSuffix(strings.TrimPrefix(file, base+"."), ext)
+		if file == textsFile || language == defaultLanguage || !textsLanguageRe.MatchString(language) {
+			continue
+		}
+		if bundles.trees[language], err = toml.LoadFile(file); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", file, err))
+		}
+	}
+	return bundles, nil
+}
+
+// text returns the text under the key in the language, or in the default language if the language doesn't have it.
+func (bundles *textBundles) text(language, key string) (interface{}, bool) {
+	if tree, exists := bundles.trees[language]; exists && tree.Has(key) {
+		return tree.Get(key), true
+	}
+	if tree := bundles.trees[bundles.defaultLanguage]; tree.Has(key) {
+		return tree.Get(key), true
+	}
+	return nil, false
+}
+
+// languages returns the languages that have texts, default first.
+func (bundles *textBundles) languages() []string {
+	languages := []string{}
+	for language := range bundles.trees {
+		if language != bundles.defaultLanguage {
+			languages = append(languages, language)
+		}
+	}
+	sort.Strings(languages)
+	return append([]string{bundles.defaultLanguage}, languages...)
+}
+
+// pluralForm returns which plural form to use for the count: 0 for one, 1 for few (or other, in languages with two
+// forms), 2 for many.
+func pluralForm(language string, count int64) int {
+	if count < 0 {
+		count = -count
+	}
+	switch language {
+	case "pl":
+		if count == 1 {
+			return 0
+		}
+		if count%10 >= 2 && count%10 <= 4 && (count%100 < 12 || count%100 > 14) {
+			return 1
+		}
+		return 2
+	case "fr":
+		if count <= 1 {
+			return 0
+		}
+		return 1
+	}
+	if count == 1 {
+		return 0
+	}
+	return 1
+}
+
+// templateFuncs returns the functions available in the templates of the language. Use plural to pick the word
+// form for a number: {{plural .count "minute" "minutes"}}, or {{plural .count "minuta" "minuty" "minut"}} in Polish.
+func templateFuncs(language string) template.FuncMap {
+	return template.FuncMap{
+		"plural": func(count interface{}, forms ...string) (string, error) {
+			if len(forms) == 0 {
+				return "", errors.New("plural needs the word forms")
+			}
+			number, err := strconv.ParseFloat(fmt.Sprint(count), 64)
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("plural needs a number, got %v", count))
+			}
+			form := pluralForm(language, int64(number))
+			if number != float64(int64(number)) { // Fractions use the "few" form in Polish, and plural in English.
+				form = 1
+			}
+			if form >= len(forms) {
+				form = len(forms) - 1
+			}
+			return forms[form], nil
+		},
+	}
+}
+
+// bundles returns the texts files currently loaded.
+func (bot *Bot) bundles() *textBundles {
+	bot.textsMu.RLock()
+	defer bot.textsMu.RUnlock()
+	return bot.textBundles
+}
+
+// loadTexts loads a section of texts in all languages. Data is filled with the texts of the default language, the
+// returned map has them per language.
+func (bot *Bot) loadTexts(bundles *textBundles, section string, data interface{}) (map[string]interface{}, error) {
+	if err := bot.loadTextsFor(bundles, bundles.defaultLanguage, section, data); err != nil {
+		return nil, err
+	}
+	texts := map[string]interface{}{bundles.defaultLanguage: data}
+	for _, language := range bundles.languages()[1:] {
+		local := reflect.New(reflect.TypeOf(data).Elem()).Interface()
+		if err := bot.loadTextsFor(bundles, language, section, local); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s (%s)", err, language))
+		}
+		texts[language] = local
+	}
+	return texts, nil
+}
+
+// loadTextsFor loads texts of the language from a section into a struct, auto handling templates and lists.
+func (bot *Bot) loadTextsFor(bundles *textBundles, language, section string, data interface{}) error {
+	reflectedData := reflect.ValueOf(data).Elem()
+
+	for i := 0; i < reflectedData.NumField(); i++ {
+		fieldDef := reflectedData.Type().Field(i)
+		// Get the field name.
+		fieldName := fieldDef.Name
+		// Get the field type name.
+		fieldType := fmt.Sprint(fieldDef.Type)
+		// Get the field itself.
+		field := reflectedData.FieldByName(fieldName)
+		if !field.CanSet() {
+			bot.Log.Fatalf("Field %s is not settable.", fieldName)
+		}
+
+		// Load configured text for the field.
+		key := fmt.Sprintf("%s.%s", section, fieldName)
+		value, exists := bundles.text(language, key)
+		if !exists {
+			return errors.New(fmt.Sprintf("couldn't load text for field %s, key %s", fieldName, key))
+		}
+
+		if fieldType == "*template.Template" { // This field is a template.
+			text, ok := value.(string)
+			if !ok {
+				return errors.New(fmt.Sprintf("key %s must be a string", key))
+			}
+			temp, err := template.New(fieldName).Funcs(templateFuncs(language)).Parse(text)
+			if err != nil {
+				return errors.New(fmt.Sprintf("can't parse template %s (%s): %s", key, language, err))
+			}
+			field.Set(reflect.ValueOf(temp))
+		} else if fieldType == "string" { // Regular text field.
+			text, ok := value.(string)
+			if !ok {
+				return errors.New(fmt.Sprintf("key %s must be a string", key))
+			}
+			field.Set(reflect.ValueOf(text))
+		} else if fieldType == "[]string" {
+			texts, ok := value.([]interface{})
+			if !ok {
+				return errors.New(fmt.Sprintf("key %s must be a list of strings", key))
+			}
+			field.Set(reflect.ValueOf(utils.ToStringSlice(texts)))
+		} else {
+			bot.Log.Fatalf("Unsupported type of text field: %s", fieldType)
+		}
+	}
+
+	return nil
+}
+
+// newHumanizers creates the humanizers for the languages with texts. Languages the humanizer doesn't know use the
+// default one.
+func (bot *Bot) newHumanizers(bundles *textBundles) (map[string]*humanize.Humanizer, error) {
+	defaultHumanizer, err := humanize.New(bundles.defaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+	humanizers := map[string]*humanize.Humanizer{bundles.defaultLanguage: defaultHumanizer}
+	for _, language := range bundles.languages()[1:] {
+		if humanizer, err := humanize.New(language); err != nil {
+			bot.Log.Warningf("Can't init humanizer for %s, using the default one: %s", language, err)
+			humanizers[language] = defaultHumanizer
+		} else {
+			humanizers[language] = humanizer
+		}
+	}
+	return humanizers, nil
+}
+
+// loadLanguages reads the languages chosen by channels and users.
+func (bot *Bot) loadLanguages() error {
+	choices, err := bot.Storage.Languages()
+	if err != nil {
+		return err
+	}
+	languages := map[string]string{}
+	for _, choice := range choices {
+		languages[choice.Kind+":"+choice.Name] = choice.Language
+	}
+	bot.textsMu.Lock()
+	defer bot.textsMu.Unlock()
+	bot.languages = languages
+	return nil
+}
+
+// userLanguageName returns the name under which the sender's language is kept: the account if they are logged in,
+// or their nick on the transport.
+func (bot *Bot) userLanguageName(sourceEvent *events.EventMessage) string {
+	if nick := bot.GetAuthenticatedNick(sourceEvent.UserId); nick != "" {
+		return nick
+	}
+	return nickKey(sourceEvent.TransportName, sourceEvent.Nick)
+}
+
+// Language returns the language of the replies to the event. On channels the language of the channel is used, if it
+// was chosen. Otherwise it's the language chosen by the user, or the default one.
+func (bot *Bot) Language(sourceEvent *events.EventMessage) string {
+	keys := []string{}
+	if sourceEvent == nil {
+		sourceEvent = &events.EventMessage{}
+	}
+	if sourceEvent.Channel != "" && !sourceEvent.IsPrivate() {
+		keys = append(keys, LanguageChannel+":"+sourceEvent.ChannelId())
+	}
+	if sourceEvent.Nick != "" {
+		keys = append(keys, LanguageUser+":"+bot.userLanguageName(sourceEvent))
+	}
+	bot.textsMu.RLock()
+	defer bot.textsMu.RUnlock()
+	for _, key := range keys {
+		if language, chosen := bot.languages[key]; chosen && bot.textBundles.trees[language] != nil {
+			return language
+		}
+	}
+	return bot.textBundles.defaultLanguage
+}
+
+// LocalTexts returns the texts loaded from the section with LoadTexts, in the language of the replies to the event.
+// Type-assert the result to the struct given to LoadTexts.
+func (bot *Bot) LocalTexts(sourceEvent *events.EventMessage, section string) interface{} {
+	language := bot.Language(sourceEvent)
+	bot.textsMu.RLock()
+	defer bot.textsMu.RUnlock()
+	if texts, exists := bot.localTexts[section][language]; exists {
+		return texts
+	}
+	return bot.localTexts[section][bot.textBundles.defaultLanguage]
+}
+
+// LocalHumanizer returns the humanizer for the language of the replies to the event.
+func (bot *Bot) LocalHumanizer(sourceEvent *events.EventMessage) *humanize.Humanizer {
+	language := bot.Language(sourceEvent)
+	bot.textsMu.RLock()
+	defer bot.textsMu.RUnlock()
+	if humanizer, exists := bot.humanizers[language]; exists {
+		return humanizer
+	}
+	return bot.humanizers[bot.textBundles.defaultLanguage]
+}
+
+// Humanizer returns the humanizer of the default language.
+func (bot *Bot) Humanizer() *humanize.Humanizer {
+	return bot.LocalHumanizer(nil)
+}
+
+// texts returns the bot's texts in the language of the replies to the event.
+func (bot *Bot) texts(sourceEvent *events.EventMessage) *botTexts {
+	return bot.LocalTexts(sourceEvent, "bot").(*botTexts)
+}
+
+// setLanguage saves the language chosen for a channel or a user. Empty language goes back to the default.
+func (bot *Bot) setLanguage(kind, name, language string) error {
+	if language == "" {
+		if err := bot.Storage.DeleteLanguage(kind, name); err != nil {
+			return err
+		}
+	} else if err := bot.Storage.SetLanguage(
+		storage.LanguageChoice{Kind: kind, Name: name, Language: language}); err != nil {
+		return err
+	}
+	return bot.loadLanguages()
+}
+
+// languageFromArgs reads the language argument, checking that there are texts for it. "default" gives an empty
+// language. If there are no texts, the reply to the event is returned as the error.
+func (bot *Bot) languageFromArgs(sourceEvent *events.EventMessage, args *CommandArgs) (string, error) {
+	language := strings.ToLower(args.String("language"))
+	if language == "default" {
+		return "", nil
+	}
+	for _, known := range bot.bundles().languages() {
+		if known == language {
+			return language, nil
+		}
+	}
+	return "", errors.New(utils.Format(bot.texts(sourceEvent).TempNoLanguage, map[string]string{
+		"language": language, "languages": strings.Join(bot.bundles().languages(), ", ")}))
+}
+
+// commandLanguageShow shows the language of the replies and the available ones.
+func commandLanguageShow(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempLanguages, map[string]string{
+		"language": bot.Language(sourceEvent), "languages": strings.Join(bot.bundles().languages(), ", ")}))
+}
+
+// commandLanguageUser sets the language of the user. The reply is in the new language.
+func commandLanguageUser(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	language, err := bot.languageFromArgs(sourceEvent, args)
+	if err != nil {
+		bot.SendMessage(sourceEvent, err.Error())
+		return
+	}
+	if err := bot.setLanguage(LanguageUser, bot.userLanguageName(sourceEvent), language); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempError, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempUserLanguage, map[string]string{
+		"language": bot.Language(sourceEvent)}))
+}
+
+// commandLanguageChannel sets the language of the channel. The reply is in the new language.
+func commandLanguageChannel(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	if sourceEvent.IsPrivate() {
+		bot.SendMessage(sourceEvent, bot.texts(sourceEvent).UseOnChannel)
+		return
+	}
+	if !bot.UserCan(sourceEvent, PermChannels) {
+		bot.SendMessage(sourceEvent, fmt.Sprintf("%s, %s", sourceEvent.Nick, bot.texts(sourceEvent).NeedsAdmin))
+		return
+	}
+	language, err := bot.languageFromArgs(sourceEvent, args)
+	if err != nil {
+		bot.SendMessage(sourceEvent, err.Error())
+		return
+	}
+	if err := bot.setLanguage(LanguageChannel, sourceEvent.ChannelId(), language); err != nil {
+		bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempError, map[string]string{"error": err.Error()}))
+		return
+	}
+	bot.Audit(sourceEvent, "language.channel", sourceEvent.ChannelId(), language)
+	bot.SendMessage(sourceEvent, utils.Format(bot.texts(sourceEvent).TempChannelLanguage, map[string]string{
+		"language": bot.Language(sourceEvent)}))
+}
@@ -35,6 +35,10 @@ func (transport *IRCTransport) assignEventHandlers() {
 	transport.registerIrcEventHandler(irc.TOPIC, handlerTopic)
 	// Kick from channel
 	transport.registerIrcEventHandler(irc.KICK, handlerKick)
+	// Quit from the server
+	transport.registerIrcEventHandler(irc.QUIT, handlerQuit)
+	// Nick change
+	transport.registerIrcEventHandler(irc.NICK, handlerNick)
 	// Message on channel
 	transport.registerIrcEventHandler(irc.PRIVMSG, handlerMsg)
 	// Notice
@@ -43,10 +47,15 @@ func (transport *IRCTransport) assignEventHandlers() {
 	transport.registerIrcEventHandler(irc.ERROR, handlerError)
 }
 
+// userId returns the id of the user who sent the message, in user@host form.
+func userId(m *irc.Message) string {
+	return m.Prefix.User + "@" + m.Prefix.Host
+}
+
 func handlerConnect(transport *IRCTransport, m *irc.Message) {
 	transport.log.Infof("I have connected. Joining channels...")
 	transport.SendRawMessage(irc.JOIN, transport.channels, "")
-	transport.sendEvent(events.EventConnected, true, "", transport.name, transport.user, "")
+	transport.sendEvent(events.EventConnected, true, "", transport.nick(), transport.user, "")
 }
 
 func handlerPing(transport *IRCTransport, m *irc.Message) {
@@ -54,9 +63,12 @@ func handlerPing(transport *IRCTransport, m *irc.Message) {
 }
 
 func handlerNickTaken(transport *IRCTransport, m *irc.Message) {
+	transport.connectionMu.Lock()
 	transport.name = transport.name + "_"
+	nick := transport.name
+	transport.connectionMu.Unlock()
 	transport.log.Warningf(
-		"Server at %s said that my nick is already taken. Changing nick to %s", m.Prefix.Name, transport.name)
+		"Server at %s said that my nick is already taken. Changing nick to %s", m.Prefix.Name, nick)
 }
 
 func handlerCantJoin(transport *IRCTransport, m *irc.Message) {
@@ -76,12 +88,28 @@ func handlerBadNick(transport *IRCTransport, m *irc.Message) {
 
 func handlerPart(transport *IRCTransport, m *irc.Message) {
 	if transport.NickIsMe(m.Prefix.Name) {
-		delete(transport.onChannel, m.Params[0])
+		transport.setOnChannel(m.Params[0], false)
 	}
 	transport.log.Infof("%s has left %s: %s", m.Prefix.Name, m.Params[0], m.Trailing)
 	transport.sendEvent(
 		events.EventPartChannel, transport.NickIsMe(m.Prefix.Name),
-		m.Params[0], m.Prefix.Name, m.Prefix.User, m.Trailing)
+		m.Params[0], m.Prefix.Name, userId(m), m.Trailing)
+}
+
+func handlerQuit(transport *IRCTransport, m *irc.Message) {
+	transport.log.Infof("%s has quit: %s", m.Prefix.Name, m.Trailing)
+	transport.sendEvent(
+		events.EventUserQuit, transport.NickIsMe(m.Prefix.Name), "", m.Prefix.Name, userId(m), m.Trailing)
+}
+
+func handlerNick(transport *IRCTransport, m *irc.Message) {
+	newNick := m.Trailing
+	if len(m.Params) > 0 {
+		newNick = m.Params[0]
+	}
+	transport.log.Infof("%s is now known as %s", m.Prefix.Name, newNick)
+	transport.sendEvent(
+		events.EventNickChange, transport.NickIsMe(m.Prefix.Name), "", m.Prefix.Name, userId(m), newNick)
 }
 
 func handlerError(transport *IRCTransport, m *irc.Message) {
@@ -96,16 +124,16 @@ func handlerJoin(transport *IRCTransport, m *irc.Message) {
 	if transport.NickIsMe(m.Prefix.Name) {
 		if transport.kickedFrom[m.Trailing] {
 			transport.log.Infof("I have rejoined %s", m.Trailing)
-			transport.sendEvent(events.EventReJoinedChannel, true, m.Trailing, transport.name, transport.user, "")
+			transport.sendEvent(events.EventReJoinedChannel, true, m.Trailing, transport.nick(), transport.user, "")
 			delete(transport.kickedFrom, m.Trailing)
 		} else {
 			transport.log.Infof("I have joined %s", m.Trailing)
-			transport.sendEvent(events.EventJoinedChannel, true, m.Trailing, transport.name, transport.user, "")
+			transport.sendEvent(events.EventJoinedChannel, true, m.Trailing, transport.nick(), transport.user, "")
 		}
-		transport.onChannel[m.Trailing] = true
+		transport.setOnChannel(m.Trailing, true)
 	} else {
 		transport.log.Infof("%s has joined %s", m.Prefix.Name, m.Trailing)
-		transport.sendEvent(events.EventJoinedChannel, false, m.Trailing, m.Prefix.Name, m.Prefix.User, "")
+		transport.sendEvent(events.EventJoinedChannel, false, m.Trailing, m.Prefix.Name, userId(m), "")
 	}
 }
 
@@ -124,7 +152,7 @@ func handlerKick(transport *IRCTransport, m *irc.Message) {
 		transport.log.Infof("I was kicked from %s by %s for: %s", m.Params[0], m.Prefix.Name, m.Trailing)
 		transport.sendEvent(events.EventKickedFromChannel, true, m.Params[0], m.Prefix.Name, m.Prefix.User, m.Trailing)
 		transport.kickedFrom[m.Params[0]] = true
-		delete(transport.onChannel, m.Params[0])
+		transport.setOnChannel(m.Params[0], false)
 		// Rejoin
 		timer := time.NewTimer(transport.rejoinDelay)
 		go func() {
@@ -143,7 +171,7 @@ func handlerMsg(transport *IRCTransport, m *irc.Message) {
 		return
 	}
 	nick := m.Prefix.Name
-	user := m.Prefix.User + "@" + m.Prefix.Host
+	user := userId(m)
 	channel := m.Params[0]
 
 	if transport.NickIsMe(nick) { // It's the transport talking
@@ -170,18 +198,8 @@ func handlerMsg(transport *IRCTransport, m *irc.Message) {
 		return
 	}
 
-	direct := false
-	if strings.HasPrefix(msg, transport.name) { // Is someone talking to the bot?
-		msg = strings.TrimLeft(msg[len(transport.name):], ",:; ")
-		if msg != "" {
-			direct = true
-		}
-	} else if strings.HasPrefix(msg, ".") { // Maybe a dot command?
-		msg = strings.TrimPrefix(msg, ".")
-		if msg != "" {
-			direct = true
-		}
-	}
+	// Is someone talking about the bot?
+	mentioned := strings.Contains(msg, transport.nick())
 
 	eventCode := events.EventChatMessage
 	if !strings.HasPrefix(channel, "#") { // no # prefix means private message.
@@ -189,5 +207,5 @@ func handlerMsg(transport *IRCTransport, m *irc.Message) {
 	}
 
 	// Message on a channel.
-	transport.sendEvent(eventCode, direct, channel, nick, user, msg)
+	transport.sendEvent(eventCode, mentioned, channel, nick, user, msg)
 }
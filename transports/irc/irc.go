@@ -1,7 +1,10 @@
 package ircTransport
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"github.com/pawelszydlo/papa-bot/transports"
 	"github.com/sorcix/irc"
 	"net"
 	"time"
@@ -23,33 +26,53 @@ func (transport *IRCTransport) connect() error {
 		return err
 	}
 
-	// Store connection.
+	// Store connection, unless the transport was shut down in the meantime.
+	transport.connectionMu.Lock()
+	if transport.isStopping() {
+		transport.connectionMu.Unlock()
+		conn.Close()
+		return errors.New("transport is shutting down")
+	}
 	transport.connection = conn
 	transport.decoder = irc.NewDecoder(conn)
 	transport.encoder = irc.NewEncoder(conn)
+	transport.connectionMu.Unlock()
 
 	// Send initial messages.
 	if transport.password != "" {
 		transport.SendRawMessage(irc.PASS, []string{transport.password}, "")
 	}
-	transport.SendRawMessage(irc.NICK, []string{transport.name}, "")
+	transport.SendRawMessage(irc.NICK, []string{transport.nick()}, "")
 	transport.SendRawMessage(irc.USER, []string{transport.user, "0", "*"}, transport.user)
 
 	transport.log.Debugf("Succesfully connected.")
+	transports.ConnectedMetric.Set(1, transport.Name())
 	return nil
 }
 
 // receiverLoop attempts to read from the IRC server and keep the connection open.
 func (transport *IRCTransport) receiverLoop() {
 	for {
-		transport.connection.SetDeadline(time.Now().Add(300 * time.Second))
-		msg, err := transport.decoder.Decode()
+		transport.connectionMu.Lock()
+		connection, decoder := transport.connection, transport.decoder
+		transport.connectionMu.Unlock()
+		connection.SetDeadline(time.Now().Add(300 * time.Second))
+		msg, err := decoder.Decode()
 		if err != nil { // Error or timeout.
+			if transport.isStopping() {
+				return
+			}
 			transport.log.Warningf("Disconnected from server.")
-			transport.connection.Close()
+			transports.ConnectedMetric.Set(0, transport.Name())
+			transports.ReconnectsMetric.Inc(transport.Name())
+			connection.Close()
 			retries := 0
 			for {
-				time.Sleep(time.Duration(retries*retries) * time.Second)
+				select {
+				case <-transport.quit:
+					return
+				case <-time.After(time.Duration(retries*retries) * time.Second):
+				}
 				transport.log.Infof("Reconnecting...")
 				if err := transport.connect(); err == nil {
 					break
@@ -57,11 +80,25 @@ func (transport *IRCTransport) receiverLoop() {
 				retries += 1
 			}
 		} else {
-			transport.messages <- msg
+			select {
+			case transport.messages <- msg:
+			case <-transport.quit:
+				return
+			}
 		}
 	}
 }
 
+// isStopping will tell if the transport is shutting down.
+func (transport *IRCTransport) isStopping() bool {
+	select {
+	case <-transport.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 // resetFloodSemaphore flushes transport's flood semaphore.
 func (transport *IRCTransport) resetFloodSemaphore() {
 	for {
@@ -74,19 +111,11 @@ func (transport *IRCTransport) resetFloodSemaphore() {
 	}
 }
 
-// cleanUp cleans up after the transport.
-func (transport *IRCTransport) cleanUp() {
-	close(transport.messages)
-	close(transport.floodSemaphore)
-}
-
 // Run starts the transport's main loop.
 func (transport *IRCTransport) Run() {
-	defer transport.cleanUp()
-
 	// Connect to server.
 	if err := transport.connect(); err != nil {
-		transport.log.Fatalf("Error creating connection: ", err)
+		transport.log.Fatalf("Error creating connection: %s", err)
 	}
 
 	// Receiver loop.
@@ -96,27 +125,53 @@ func (transport *IRCTransport) Run() {
 	ticker := time.NewTicker(time.Second * time.Duration(transport.antiFloodDelay))
 	defer ticker.Stop()
 	go func() {
-		for range ticker.C {
-			transport.resetFloodSemaphore()
+		for {
+			select {
+			case <-ticker.C:
+				transport.resetFloodSemaphore()
+			case <-transport.quit:
+				return
+			}
 		}
 	}()
 
 	// Main loop.
 	for {
 		select {
-		case msg, ok := <-transport.messages:
-			if ok {
-				// Are there any handlers registered for this IRC event?
-				if handlers, exists := transport.ircEventHandlers[msg.Command]; exists {
-					for _, handler := range handlers {
-						handler(transport, msg)
-					}
+		case msg := <-transport.messages:
+			// Are there any handlers registered for this IRC event?
+			if handlers, exists := transport.ircEventHandlers[msg.Command]; exists {
+				for _, handler := range handlers {
+					handler(transport, msg)
 				}
-			} else {
-				break
 			}
+		case <-transport.quit:
+			transport.log.Infof("IRC transport exiting...")
+			return
 		}
 	}
+}
 
-	transport.log.Infof("IRC transport exiting...")
+// Shutdown sends QUIT to the server and closes the connection, which makes Run return. Only the first call does
+// anything.
+func (transport *IRCTransport) Shutdown(ctx context.Context) error {
+	var err error
+	transport.quitOnce.Do(func() {
+		transport.log.Infof("Disconnecting from %s...", transport.server)
+		// Closed under the lock, so that a reconnect can't store a new connection after this.
+		transport.connectionMu.Lock()
+		close(transport.quit)
+		connection := transport.connection
+		transport.connectionMu.Unlock()
+		transports.ConnectedMetric.Set(0, transport.Name())
+		if connection == nil {
+			return
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			connection.SetWriteDeadline(deadline)
+		}
+		transport.SendRawMessage(irc.QUIT, []string{}, transport.quitMessage)
+		err = connection.Close()
+	})
+	return err
 }
@@ -4,24 +4,44 @@ package ircTransport
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	"crypto/tls"
 	"net"
 
+	"errors"
 	"fmt"
+	"github.com/pawelszydlo/papa-bot/config"
 	"github.com/pawelszydlo/papa-bot/events"
-	"github.com/pawelszydlo/papa-bot/utils"
-	"github.com/pelletier/go-toml"
+	"github.com/pawelszydlo/papa-bot/metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/sorcix/irc"
 )
 
 const MsgLengthLimit = 440 // IRC message length limit.
 
+// Flood protection metrics.
+var (
+	floodWaits = metrics.NewCounterVec(
+		"papabot_flood_waits_total", "Messages that had to wait for the flood semaphore.", "transport")
+	floodWaitSeconds = metrics.NewHistogramVec(
+		"papabot_flood_wait_seconds", "Time spent waiting for the flood semaphore.", metrics.DefBuckets, "transport")
+)
+
 // Interface for IRC event handler function.
 type ircEvenHandlerFunc func(transport *IRCTransport, m *irc.Message)
 
+// Settings read from the irc section of the config file.
+type ircSettings struct {
+	Server        string   `config:"server" default:"localhost:6667"`
+	User          string   `config:"user" default:"papaBot"`
+	Password      string   `config:"password" default:""`
+	Channels      []string `config:"channels" default:"#papabot"`
+	UseTLS        bool     `config:"use_tls" default:"false"`
+	TLSSkipVerify bool     `config:"tls_skip_verify" default:"false"`
+}
+
 type IRCTransport struct {
 	// Settings.
 
@@ -36,6 +56,8 @@ type IRCTransport struct {
 	antiFloodDelay int
 	// Delay between rejoin attempts.
 	rejoinDelay time.Duration
+	// Message sent with QUIT when shutting down.
+	quitMessage string
 
 	// Provided by the bot.
 
@@ -53,6 +75,8 @@ type IRCTransport struct {
 	// IO.
 	decoder *irc.Decoder
 	encoder *irc.Encoder
+	// Guards connection, decoder, encoder and name, which change on reconnect and when the nick is taken.
+	connectionMu sync.Mutex
 	// TLS config.
 	tlsConfig *tls.Config
 	// Anti flood buffered semaphore
@@ -60,44 +84,55 @@ type IRCTransport struct {
 	// Channels bot was kicked from.
 	kickedFrom map[string]bool
 	// Channels the bot is on.
-	onChannel map[string]bool
+	onChannel   map[string]bool
+	onChannelMu sync.RWMutex
 	// Registered event handlers.
 	ircEventHandlers map[string][]ircEvenHandlerFunc
+	// Closed when the transport is shutting down.
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 // Init initializes a transport instance.
-func (transport *IRCTransport) Init(botName string, fullConfig *toml.Tree, logger *logrus.Logger,
+func (transport *IRCTransport) Init(botName string, cfg *config.Loader, logger *logrus.Logger,
 	eventDispatcher *events.EventDispatcher,
-) {
+) error {
+	settings := ircSettings{}
+	if err := cfg.Load(transport.Name(), &settings); err != nil {
+		return errors.New(fmt.Sprintf("invalid configuration: %s", err))
+	}
 
 	// Init the transport struct.
 	transport.messages = make(chan *irc.Message)
 	transport.antiFloodDelay = 5
 	transport.rejoinDelay = 15 * time.Second
+	transport.quitMessage = fmt.Sprintf("%s is shutting down.", botName)
 	transport.name = botName
-	transport.user = fullConfig.GetDefault("irc.user", "papaBot").(string)
-	transport.password = fullConfig.GetDefault("irc.password", "").(string)
-	transport.server = fullConfig.GetDefault("irc.server", "localhost:6667").(string)
-	transport.channels = utils.ToStringSlice(fullConfig.GetDefault("irc.channels", []string{"#papabot"}).([]interface{}))
+	transport.user = settings.User
+	transport.password = settings.Password
+	transport.server = settings.Server
+	transport.channels = settings.Channels
 	// State.
 	transport.floodSemaphore = make(chan int, 5)
 	transport.kickedFrom = map[string]bool{}
 	transport.onChannel = map[string]bool{}
 	transport.ircEventHandlers = make(map[string][]ircEvenHandlerFunc)
+	transport.quit = make(chan struct{})
 	// Utility objects.
 	transport.log = logger
 	transport.eventDispatcher = eventDispatcher
 
 	// Prepare TLS config if needed.
-	if fullConfig.GetDefault("irc.use_tls", false).(bool) {
+	if settings.UseTLS {
 		transport.tlsConfig = &tls.Config{}
-		if fullConfig.GetDefault("irc.tls_skip_verify", false).(bool) {
+		if settings.TLSSkipVerify {
 			transport.tlsConfig.InsecureSkipVerify = true
 		}
 	}
 
 	// Attach event handlers.
 	transport.assignEventHandlers()
+	return nil
 }
 
 // Name of the transport.
@@ -105,6 +140,11 @@ func (transport *IRCTransport) Name() string {
 	return "irc"
 }
 
+// Formatting of the messages accepted by the transport.
+func (transport *IRCTransport) Formatting() events.Formatting {
+	return events.FormatIRC
+}
+
 // registerIrcEventHandler will register a new handler for the given IRC event.
 func (transport *IRCTransport) registerIrcEventHandler(event string, handler ircEvenHandlerFunc) {
 	transport.ircEventHandlers[event] = append(transport.ircEventHandlers[event], handler)
@@ -112,6 +152,12 @@ func (transport *IRCTransport) registerIrcEventHandler(event string, handler irc
 
 // sendRawMessage sends raw command to the server.
 func (transport *IRCTransport) SendRawMessage(command string, params []string, trailing string) {
+	transport.connectionMu.Lock()
+	defer transport.connectionMu.Unlock()
+	if transport.encoder == nil {
+		transport.log.Errorf("Can't send message %s: not connected", command)
+		return
+	}
 	if err := transport.encoder.Encode(&irc.Message{
 		Command:  command,
 		Params:   params,
@@ -164,18 +210,44 @@ func (transport *IRCTransport) sendFloodProtected(mType, channel, message string
 				if upperLimit > len(messages[i]) {
 					upperLimit = len(messages[i])
 				}
-				transport.floodSemaphore <- 1
+				if !transport.waitForFloodSemaphore() {
+					return
+				}
 				transport.SendRawMessage(mType, []string{channel}, messages[i][n:upperLimit])
 			}
 			return
 		}
-		transport.floodSemaphore <- 1
+		if !transport.waitForFloodSemaphore() {
+			return
+		}
 		transport.SendRawMessage(mType, []string{channel}, messages[i])
 	}
 }
 
+// waitForFloodSemaphore blocks until a message can be sent. Returns false if the transport is shutting down.
+func (transport *IRCTransport) waitForFloodSemaphore() bool {
+	select {
+	case transport.floodSemaphore <- 1:
+		return true
+	default:
+	}
+	floodWaits.Inc(transport.Name())
+	start := time.Now()
+	defer func() {
+		floodWaitSeconds.Observe(time.Since(start).Seconds(), transport.Name())
+	}()
+	select {
+	case transport.floodSemaphore <- 1:
+		return true
+	case <-transport.quit:
+		return false
+	}
+}
+
 // GetChannelsOn will return a list of channels the transport is currently on.
 func (transport *IRCTransport) GetChannelsOn() []string {
+	transport.onChannelMu.RLock()
+	defer transport.onChannelMu.RUnlock()
 	channelsOn := []string{}
 	for channel, on := range transport.onChannel {
 		if on {
@@ -187,12 +259,32 @@ func (transport *IRCTransport) GetChannelsOn() []string {
 
 // isOnChannel will check if transport is on the given channel.
 func (transport *IRCTransport) isOnChannel(channel string) bool {
+	transport.onChannelMu.RLock()
+	defer transport.onChannelMu.RUnlock()
 	return transport.onChannel[channel]
 }
 
+// setOnChannel marks whether the transport is on the given channel.
+func (transport *IRCTransport) setOnChannel(channel string, on bool) {
+	transport.onChannelMu.Lock()
+	defer transport.onChannelMu.Unlock()
+	if on {
+		transport.onChannel[channel] = true
+	} else {
+		delete(transport.onChannel, channel)
+	}
+}
+
 // NickIsMe checks if the sender is the transport.
 func (transport *IRCTransport) NickIsMe(nick string) bool {
-	return nick == transport.name
+	return nick == transport.nick()
+}
+
+// nick returns the bot's current nick.
+func (transport *IRCTransport) nick() string {
+	transport.connectionMu.Lock()
+	defer transport.connectionMu.Unlock()
+	return transport.name
 }
 
 // sendEvent triggers an event for the bot.
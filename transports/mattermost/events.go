@@ -28,41 +28,38 @@ func (transport *MattermostTransport) postedHandler(event *model.WebSocketEvent)
 		return
 	}
 	// Did the message come from one of the channels bot is on?
-	if channel, exists := transport.onChannel[post.ChannelId]; exists {
-		processedMsg, direct := transport.directMessage(post.Message)
-
-		event := events.EventChatMessage
+	if channel, exists := transport.getChannel(post.ChannelId); exists {
+		eventCode := events.EventChatMessage
 		if channel.Type == model.CHANNEL_DIRECT {
-			event = events.EventPrivateMessage
+			eventCode = events.EventPrivateMessage
 		}
 
 		transport.sendEvent(
-			event,
+			eventCode,
 			post.Id,
-			direct,
+			transport.mentionsMe(event, post.Message),
 			channel.Name,
 			transport.userIdToNick(post.UserId),
 			post.UserId,
-			processedMsg)
+			post.Message)
 
 	} else { // Some other message. Check, maybe it is a new private chat.
 		if channel, response := transport.client.GetChannel(post.ChannelId, ""); response.Error != nil {
 			transport.log.Warnf("Couldn't get info for channel %s %s", post.ChannelId, response.Error)
 		} else {
 			if channel.Type == model.CHANNEL_DIRECT {
-				processedMsg, _ := transport.directMessage(post.Message)
 				// Add the channel to the ones bot is on.
 				sender := transport.userIdToNick(post.UserId)
-				transport.onChannel[channel.Id] = channel
+				transport.addChannel(channel)
 				transport.log.Warnf("Added new chanel: %s", channel.Name)
 				transport.sendEvent(
 					events.EventPrivateMessage,
 					post.Id,
-					true,
+					transport.mentionsMe(event, post.Message),
 					channel.Name,
 					sender,
 					post.UserId,
-					processedMsg)
+					post.Message)
 			}
 		}
 	}
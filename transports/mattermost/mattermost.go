@@ -1,15 +1,21 @@
 package mattermostTransport
 
 import (
+	"context"
+
 	"github.com/mattermost/mattermost-server/model"
 	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/transports"
 	"time"
 )
 
 // connect will establish a connection to the server.
 func (transport *MattermostTransport) connect() {
 	// Create the client.
-	transport.client = model.NewAPIv4Client(transport.server)
+	client := model.NewAPIv4Client(transport.server)
+	transport.connectionMu.Lock()
+	transport.client = client
+	transport.connectionMu.Unlock()
 
 	// Check server connection
 	if props, response := transport.client.GetOldClientConfig(""); response.Error != nil {
@@ -28,18 +34,32 @@ func (transport *MattermostTransport) connect() {
 	transport.sendEvent(events.EventConnected, "", true, "", transport.botName, transport.mmUser.Id, "")
 }
 
-// create a websocket connection and set it for the client.
-func (transport *MattermostTransport) connectWebsocket() {
+// create a websocket connection and set it for the client. Returns false if transport is shutting down.
+func (transport *MattermostTransport) connectWebsocket() bool {
 	// Retry loop.
 	retries := 0
 	for {
-		time.Sleep(time.Duration(retries*retries) * time.Second)
+		select {
+		case <-transport.quit:
+			return false
+		case <-time.After(time.Duration(retries*retries) * time.Second):
+		}
 		transport.log.Infof("Connecting websocket...")
 		// Start websocket for communication.
 		retries += 1
 		webClient, err := model.NewWebSocketClient4(transport.websocket, transport.client.AuthToken)
 		if err == nil {
+			// Store the client, unless the transport was shut down in the meantime.
+			transport.connectionMu.Lock()
+			select {
+			case <-transport.quit:
+				transport.connectionMu.Unlock()
+				webClient.Close()
+				return false
+			default:
+			}
 			transport.webSocketClient = webClient
+			transport.connectionMu.Unlock()
 			break
 		} else {
 			transport.log.Errorf(
@@ -47,6 +67,8 @@ func (transport *MattermostTransport) connectWebsocket() {
 		}
 	}
 	transport.webSocketClient.Listen()
+	transports.ConnectedMetric.Set(1, transport.Name())
+	return true
 }
 
 // Run will execute the main loop.
@@ -62,7 +84,9 @@ func (transport *MattermostTransport) Run() {
 	transport.registerAllEventHandlers()
 
 	// Connect websocket for actual message transfer.
-	transport.connectWebsocket()
+	if !transport.connectWebsocket() {
+		return
+	}
 
 	// Main loop.
 	for {
@@ -76,7 +100,11 @@ func (transport *MattermostTransport) Run() {
 				}
 				transport.log.Errorf(
 					"Mattermost disconnected: %s.", errorMsg)
-				transport.connectWebsocket()
+				transports.ConnectedMetric.Set(0, transport.Name())
+				transports.ReconnectsMetric.Inc(transport.Name())
+				if !transport.connectWebsocket() {
+					return
+				}
 			}
 		case event, ok := <-transport.webSocketClient.EventChannel:
 			if ok {
@@ -88,11 +116,33 @@ func (transport *MattermostTransport) Run() {
 				} else { // No handler for this type of event.
 					// transport.log.Debugf("No handler for event: %s", event.Event)
 				}
-			} else {
-				break
 			}
+		case <-transport.quit:
+			transport.log.Infof("Mattermost transport exiting...")
+			return
 		}
 	}
+}
 
-	transport.log.Infof("Mattermost transport exiting...")
+// Shutdown will close the websocket and log out, which makes Run return. Only the first call does anything.
+func (transport *MattermostTransport) Shutdown(ctx context.Context) error {
+	var err error
+	transport.quitOnce.Do(func() {
+		transport.log.Infof("Disconnecting from %s...", transport.server)
+		// Closed under the lock, so that a reconnect can't store a new websocket after this.
+		transport.connectionMu.Lock()
+		close(transport.quit)
+		client, webSocketClient := transport.client, transport.webSocketClient
+		transport.connectionMu.Unlock()
+		transports.ConnectedMetric.Set(0, transport.Name())
+		if webSocketClient != nil {
+			webSocketClient.Close()
+		}
+		if client != nil && client.AuthToken != "" {
+			if _, response := client.Logout(); response.Error != nil {
+				err = response.Error
+			}
+		}
+	})
+	return err
 }
@@ -1,16 +1,27 @@
 package mattermostTransport
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mattermost/mattermost-server/model"
+	"github.com/pawelszydlo/papa-bot/config"
 	"github.com/pawelszydlo/papa-bot/events"
-	"github.com/pawelszydlo/papa-bot/utils"
-	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Settings read from the mattermost section of the config file.
+type mattermostSettings struct {
+	Server    string   `config:"server" default:"localhost:8065"`
+	Websocket string   `config:"websocket" default:"ws://localhost:8065"`
+	User      string   `config:"user" default:"papaBot"`
+	Password  string   `config:"password" default:""`
+	Team      string   `config:"team" default:"team"`
+	Channels  []string `config:"channels" default:"#papabot"`
+}
+
 type MattermostTransport struct {
 	// Settings.
 
@@ -51,30 +62,43 @@ type MattermostTransport struct {
 	eventHandlers map[string][]eventHandlerFunc
 	// User identification cache userId -> nick
 	users map[string]string
+	// Guards onChannel and users.
+	stateMu sync.RWMutex
+	// Guards client and webSocketClient, which are replaced on (re)connect.
+	connectionMu sync.Mutex
+	// Closed when the transport is shutting down.
+	quit chan struct{}
+	// Makes sure the shutdown runs only once.
+	quitOnce sync.Once
 }
 
 // Init initializes a transport instance.
-func (transport *MattermostTransport) Init(botName string, fullConfig *toml.Tree, logger *logrus.Logger,
+func (transport *MattermostTransport) Init(botName string, cfg *config.Loader, logger *logrus.Logger,
 	eventDispatcher *events.EventDispatcher,
-) {
+) error {
+	settings := mattermostSettings{}
+	if err := cfg.Load(transport.Name(), &settings); err != nil {
+		return errors.New(fmt.Sprintf("invalid configuration: %s", err))
+	}
 	// Init the transport struct.
 	transport.antiFloodDelay = 5
 	transport.rejoinDelay = 15 * time.Second
 	transport.botName = botName
-	transport.user = fullConfig.GetDefault("mattermost.user", "papaBot").(string)
-	transport.password = fullConfig.GetDefault("mattermost.password", "").(string)
-	transport.team = fullConfig.GetDefault("mattermost.team", "team").(string)
-	transport.websocket = fullConfig.GetDefault("mattermost.websocket", "ws://localhost:8065").(string)
-	transport.server = fullConfig.GetDefault("mattermost.server", "localhost:8065").(string)
-	transport.channels = utils.ToStringSlice(
-		fullConfig.GetDefault("mattermost.channels", []string{"#papabot"}).([]interface{}))
+	transport.user = settings.User
+	transport.password = settings.Password
+	transport.team = settings.Team
+	transport.websocket = settings.Websocket
+	transport.server = settings.Server
+	transport.channels = settings.Channels
 	// State.
 	transport.onChannel = map[string]*model.Channel{}
 	transport.eventHandlers = map[string][]eventHandlerFunc{}
 	transport.users = map[string]string{}
+	transport.quit = make(chan struct{})
 	// Utility objects.
 	transport.log = logger
 	transport.eventDispatcher = eventDispatcher
+	return nil
 }
 
 // Name of the transport.
@@ -82,10 +106,32 @@ func (transport *MattermostTransport) Name() string {
 	return "mattermost"
 }
 
+// Formatting of the messages accepted by the transport.
+func (transport *MattermostTransport) Formatting() events.Formatting {
+	return events.FormatMarkdown
+}
+
+// StableUserIds tells the bot that user ids are Mattermost account ids.
+func (transport *MattermostTransport) StableUserIds() bool {
+	return true
+}
+
+// PrivateMessagesAreCommands tells the bot that direct chats are for giving it commands.
+func (transport *MattermostTransport) PrivateMessagesAreCommands() bool {
+	return true
+}
+
 // typingListener will pretend that the bot is typing.
 func (transport *MattermostTransport) typingListener(message events.EventMessage) {
-	if message.TransportName == transport.Name() {
-		transport.webSocketClient.UserTyping(transport.channelNameToId(message.Channel), message.Context)
+	if message.TransportName != transport.Name() {
+		return
+	}
+	channelId := transport.channelNameToId(message.Channel)
+	// Held while sending, as the websocket doesn't allow concurrent writes.
+	transport.connectionMu.Lock()
+	defer transport.connectionMu.Unlock()
+	if transport.webSocketClient != nil {
+		transport.webSocketClient.UserTyping(channelId, message.Context)
 	}
 }
 
@@ -140,7 +186,7 @@ func (transport *MattermostTransport) joinChannels() {
 			channelName, transport.mmTeam.Id, ""); response.Error != nil {
 			transport.log.Fatalf("Failed to get info for channel '%s' %s.", channelName, response.Error)
 		} else {
-			transport.onChannel[channel.Id] = channel
+			transport.addChannel(channel)
 			transport.sendEvent(
 				events.EventJoinedChannel, "", true, channelName, transport.botName, transport.mmUser.Id, "")
 			transport.log.Infof("Joined channel '%s'", channelName)
@@ -150,14 +196,40 @@ func (transport *MattermostTransport) joinChannels() {
 
 // imOnChannel will tell if the transport is listening on that channel.
 func (transport *MattermostTransport) imOnChannel(channelId string) bool {
-	if _, ok := transport.onChannel[channelId]; ok {
-		return true
+	_, ok := transport.getChannel(channelId)
+	return ok
+}
+
+// getChannel returns the channel the bot is on by its id.
+func (transport *MattermostTransport) getChannel(channelId string) (*model.Channel, bool) {
+	transport.stateMu.RLock()
+	defer transport.stateMu.RUnlock()
+	channel, ok := transport.onChannel[channelId]
+	return channel, ok
+}
+
+// addChannel adds the channel to the ones bot is on.
+func (transport *MattermostTransport) addChannel(channel *model.Channel) {
+	transport.stateMu.Lock()
+	defer transport.stateMu.Unlock()
+	transport.onChannel[channel.Id] = channel
+}
+
+// channelList returns the channels the bot is on.
+func (transport *MattermostTransport) channelList() []*model.Channel {
+	transport.stateMu.RLock()
+	defer transport.stateMu.RUnlock()
+	channels := make([]*model.Channel, 0, len(transport.onChannel))
+	for _, channel := range transport.onChannel {
+		channels = append(channels, channel)
 	}
-	return false
+	return channels
 }
 
 // channelNameToId converts channel name to it's id.
 func (transport *MattermostTransport) channelNameToId(channelName string) string {
+	transport.stateMu.RLock()
+	defer transport.stateMu.RUnlock()
 	for id, channel := range transport.onChannel {
 		if channel.Name == channelName {
 			return id
@@ -176,54 +248,62 @@ func (transport *MattermostTransport) openPrivateChannel(nick string) (string, e
 		return "", response.Error
 	} else {
 		transport.log.Infof("Opened a new private channel %s.", newChannel.Name)
-		transport.onChannel[newChannel.Id] = newChannel
+		transport.addChannel(newChannel)
 		return newChannel.Name, nil
 	}
 }
 
 // userIdToNick returns the nick matching the id.
 func (transport *MattermostTransport) userIdToNick(userId string) string {
-	if nick, exists := transport.users[userId]; exists {
+	transport.stateMu.RLock()
+	nick, exists := transport.users[userId]
+	transport.stateMu.RUnlock()
+	if exists {
 		return nick
 	} else {
 		if user, response := transport.client.GetUser(userId, ""); response.Error != nil {
 			transport.log.Warnf("Failed to get user info for %s", userId)
 			return "[unknown]"
 		} else {
-			transport.users[userId] = user.Username
+			transport.addUser(user)
 			return user.Username
 		}
 	}
 }
 
+// addUser adds the user to the identification cache.
+func (transport *MattermostTransport) addUser(user *model.User) {
+	transport.stateMu.Lock()
+	defer transport.stateMu.Unlock()
+	transport.users[user.Id] = user.Username
+}
+
 // userNickToId returns the id matching the nick.
 func (transport *MattermostTransport) userNickToId(nick string) string {
+	transport.stateMu.RLock()
 	for userId, userName := range transport.users {
 		if userName == nick {
+			transport.stateMu.RUnlock()
 			return userId
 		}
 	}
+	transport.stateMu.RUnlock()
 	// Nick not found.
 	if user, response := transport.client.GetUserByUsername(nick, ""); response.Error != nil {
 		transport.log.Warnf("Failed to get user info for %s", nick)
 		return "[unknown]"
 	} else {
-		transport.users[user.Id] = user.Username
+		transport.addUser(user)
 		return user.Id
 	}
 }
 
-// directMessage checks whether the message was directed at the bot.
-func (transport *MattermostTransport) directMessage(message string) (string, bool) {
-	for _, prefix := range []string{".", transport.user, "@" + transport.user} {
-		if strings.HasPrefix(message, prefix) { // Is someone talking to the bot?
-			message = strings.TrimLeft(message[len(prefix):], ",:; ")
-			if message != "" {
-				return message, true
-			}
-		}
+// mentionsMe checks whether the post mentions the bot, either according to the server or by name.
+func (transport *MattermostTransport) mentionsMe(event *model.WebSocketEvent, message string) bool {
+	if mentions, ok := event.Data["mentions"].(string); ok && strings.Contains(mentions, transport.mmUser.Id) {
+		return true
 	}
-	return message, false
+	return strings.Contains(message, transport.mmUser.Username)
 }
 
 // NickIsMe will do pure magic.
@@ -261,7 +341,7 @@ func (transport *MattermostTransport) SendNotice(sourceEvent *events.EventMessag
 }
 
 func (transport *MattermostTransport) SendMassNotice(message string) {
-	for _, channel := range transport.onChannel {
+	for _, channel := range transport.channelList() {
 		if channel.Type != model.CHANNEL_DIRECT { // Do not send notices to private chats.
 			transport.postMessage(channel.Name, message, "")
 		}
@@ -271,7 +351,7 @@ func (transport *MattermostTransport) SendMassNotice(message string) {
 // GetChannelsOn returns a list of names of channels the bot is on.
 func (transport *MattermostTransport) GetChannelsOn() []string {
 	channels := []string{}
-	for _, c := range transport.onChannel {
+	for _, c := range transport.channelList() {
 		channels = append(channels, c.Name)
 	}
 	return channels
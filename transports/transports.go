@@ -1,27 +1,42 @@
 package transports
 
 import (
+	"context"
+
+	"github.com/pawelszydlo/papa-bot/config"
 	"github.com/pawelszydlo/papa-bot/events"
-	"github.com/pelletier/go-toml"
+	"github.com/pawelszydlo/papa-bot/metrics"
 	"github.com/sirupsen/logrus"
 )
 
 // Transport definition and related types.
 // It is up to the transport to connect, join channels and stay on them (handle kicks etc.).
 
+// Metrics that transports should keep up to date, labelled with the transport name.
+var (
+	ConnectedMetric = metrics.NewGaugeVec(
+		"papabot_transport_connected", "Whether the transport is connected (1) or not (0).", "transport")
+	ReconnectsMetric = metrics.NewCounterVec(
+		"papabot_transport_reconnects_total", "Times the transport lost the connection and reconnected.", "transport")
+)
+
 // Transport interface.
 type Transport interface {
 	// Name should return the transport's name. This can be called before init!
 	Name() string
-	// Init will always be called after a transport instance is created.
+	// Init will always be called after a transport instance is created. Settings should be read from the section
+	// named after the transport, using the config loader. Returned error will stop the bot.
 	Init(
 		botName string,
-		fullConfig *toml.Tree,
+		cfg *config.Loader,
 		logger *logrus.Logger,
 		eventDispatcher *events.EventDispatcher,
-	)
-	// Will be called once, when the bot starts, and should contain the main loop.
+	) error
+	// Will be called once, when the bot starts, and should contain the main loop. Must return after Shutdown.
 	Run()
+	// Will be called once, when the bot stops. Should disconnect from the server and make Run return.
+	// The context carries the shutdown deadline.
+	Shutdown(ctx context.Context) error
 	// Check whether a given nick is the transports name for the bot.
 	NickIsMe(nick string) bool
 	// Gets a list of channels the bot is on.
@@ -37,3 +52,20 @@ type Transport interface {
 	// Send notice to all the channels the transport is on.
 	SendMassNotice(message string)
 }
+
+// Optional interface for transports whose user ids belong to one person for good, like account ids. Identities
+// linked on such transports are recognized by the user id and log the person in without a password.
+type StableUserIds interface {
+	StableUserIds() bool
+}
+
+// Optional interface for transports whose private chats are made for talking to the bot, so every private message
+// is a command unless the config says otherwise. Elsewhere private messages need a prefix or a mention by default.
+type PrivateMessagesAreCommands interface {
+	PrivateMessagesAreCommands() bool
+}
+
+// Optional interface for transports that tell which message formatting they accept. Plain text is assumed otherwise.
+type Formatter interface {
+	Formatting() events.Formatting
+}
@@ -0,0 +1,151 @@
+package papaBot
+
+// Command triggers: prefixes, mentions of the bot and private messages, configured per transport and channel.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pawelszydlo/papa-bot/config"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/transports"
+)
+
+// Modes of handling private messages.
+const (
+	// Every private message is a command.
+	PrivateCommandsAlways = "always"
+	// Private messages need a prefix or a mention, like on channels.
+	PrivateCommandsPrefix = "prefix"
+)
+
+// Settings of the command triggers, read from the transport's section and overridden by its
+// channel_settings."<channel>" sections. Keys missing from the config keep the value they were loaded with.
+type triggerSettings struct {
+	CommandPrefixes []string `config:"command_prefixes"`
+	MentionTrigger  bool     `config:"mention_trigger"`
+	PrivateCommands string   `config:"private_commands"`
+}
+
+// Triggers used when the config doesn't say otherwise. Transports can make every private message a command by
+// default, see defaultPrivateCommands.
+var defaultTriggers = triggerSettings{[]string{"."}, true, PrivateCommandsPrefix}
+
+// validate checks the trigger settings read from the section.
+func (settings *triggerSettings) validate(section string) error {
+	for _, prefix := range settings.CommandPrefixes {
+		if strings.TrimSpace(prefix) == "" {
+			return errors.New(fmt.Sprintf("%s.command_prefixes can't contain empty prefixes", section))
+		}
+	}
+	if settings.PrivateCommands != PrivateCommandsAlways && settings.PrivateCommands != PrivateCommandsPrefix {
+		return errors.New(fmt.Sprintf(
+			"%s.private_commands must be %q or %q", section, PrivateCommandsAlways, PrivateCommandsPrefix))
+	}
+	return nil
+}
+
+// loadCommandTriggers loads the trigger settings of transports and channels from the config file.
+func (bot *Bot) loadCommandTriggers() error {
+	triggers, err := bot.readCommandTriggers(bot.loader())
+	if err != nil {
+		return err
+	}
+	bot.triggersMu.Lock()
+	defer bot.triggersMu.Unlock()
+	bot.commandTriggers = triggers
+	return nil
+}
+
+// readCommandTriggers reads the trigger settings of transports and channels from the config.
+func (bot *Bot) readCommandTriggers(loader *config.Loader) (map[string]*triggerSettings, error) {
+	triggers := map[string]*triggerSettings{}
+	for name := range bot.Transports {
+		transportTriggers := defaultTriggers
+		transportTriggers.PrivateCommands = bot.defaultPrivateCommands(name)
+		if err := loader.Load(name, &transportTriggers); err != nil {
+			return nil, err
+		}
+		if err := transportTriggers.validate(name); err != nil {
+			return nil, err
+		}
+		triggers[name] = &transportTriggers
+		for _, channel := range loader.Sections(name + ".channel_settings") {
+			section := fmt.Sprintf("%s.channel_settings.%q", name, channel)
+			channelTriggers := transportTriggers
+			if err := loader.Load(section, &channelTriggers); err != nil {
+				return nil, err
+			}
+			if err := channelTriggers.validate(section); err != nil {
+				return nil, err
+			}
+			triggers[name+";"+channel] = &channelTriggers
+		}
+	}
+	return triggers, nil
+}
+
+// defaultPrivateCommands returns how the transport's private messages are handled when the config doesn't say.
+func (bot *Bot) defaultPrivateCommands(transportName string) string {
+	if transport, ok := bot.Transports[transportName].(transports.PrivateMessagesAreCommands); ok &&
+		transport.PrivateMessagesAreCommands() {
+		return PrivateCommandsAlways
+	}
+	return defaultTriggers.PrivateCommands
+}
+
+// triggersFor returns the trigger settings of the channel.
+func (bot *Bot) triggersFor(transportName, channel string) triggerSettings {
+	bot.triggersMu.RLock()
+	defer bot.triggersMu.RUnlock()
+	if triggers, exists := bot.commandTriggers[transportName+";"+channel]; exists {
+		return *triggers
+	}
+	if triggers, exists := bot.commandTriggers[transportName]; exists {
+		return *triggers
+	}
+	return defaultTriggers
+}
+
+// commandTrigger checks whether the chat message is a command for the bot. Returns the command line with the
+// trigger removed.
+func (bot *Bot) commandTrigger(message *events.EventMessage) (string, bool) {
+	triggers := bot.triggersFor(message.TransportName, message.Channel)
+	text := strings.TrimSpace(message.Message)
+
+	// Is someone talking to the bot?
+	if triggers.MentionTrigger && message.AtBot {
+		if command, mentioned := bot.stripMention(message.TransportName, text); mentioned {
+			return command, command != ""
+		}
+	}
+	// Maybe a prefixed command?
+	for _, prefix := range triggers.CommandPrefixes {
+		if strings.HasPrefix(text, prefix) {
+			command := strings.TrimSpace(text[len(prefix):])
+			return command, command != ""
+		}
+	}
+	if message.IsPrivate() && triggers.PrivateCommands == PrivateCommandsAlways {
+		return text, text != ""
+	}
+	return "", false
+}
+
+// stripMention removes the bot's name from the start of the text, as in "papaBot: help" or "@papaBot help".
+func (bot *Bot) stripMention(transportName, text string) (string, bool) {
+	transport, exists := bot.Transports[transportName]
+	if !exists {
+		return "", false
+	}
+	text = strings.TrimPrefix(text, "@")
+	end := strings.IndexAny(text, " \t,:;")
+	if end == -1 {
+		end = len(text)
+	}
+	if end == 0 || !transport.NickIsMe(text[:end]) {
+		return "", false
+	}
+	return strings.TrimLeft(text[end:], " \t,:;"), true
+}
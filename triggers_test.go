@@ -0,0 +1,55 @@
+package papaBot_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pawelszydlo/papa-bot/events"
+)
+
+// TestCommandTriggers tests the prefixes and mentions, with the per-channel overrides from the config.
+func TestCommandTriggers(t *testing.T) {
+	transport := &testTransport{started: make(chan struct{}), quit: make(chan struct{})}
+	bot := newTestBot(t, transport)
+	stop := runTestBot(t, bot, transport)
+	defer stop()
+	run := func(code events.EventCode, channel, text string, mentioned bool) {
+		bot.EventDispatcher.Trigger(message(code, "user", channel, text, mentioned))
+	}
+
+	run(events.EventChatMessage, "#test", "papaBot, help find", true)
+	run(events.EventChatMessage, "#test", "@papaBot help more", true)
+	run(events.EventChatMessage, "#test", "what is papaBot doing?", true)
+	run(events.EventChatMessage, "#test", "!help version", false)
+	if !transport.waitFor("#test: f, find") || !transport.waitFor("#test: m, more") {
+		t.Error("Mention of the bot should trigger a command.")
+	}
+	run(events.EventChatMessage, "#quiet", ".help find", false)
+	run(events.EventChatMessage, "#quiet", "papaBot: help find", true)
+	run(events.EventChatMessage, "#quiet", "!help more", false)
+	if !transport.waitFor("#quiet: m, more") {
+		t.Error("Channel prefix should trigger a command.")
+	}
+	run(events.EventPrivateMessage, "user", "help find", false)
+	if !transport.waitFor("user: f, find") {
+		t.Error("Private message should be a command.")
+	}
+	if transport.count("#quiet: f, find") != 0 || transport.count("#test: ver, version") != 0 ||
+		transport.count("doing") != 0 {
+		t.Error("Only the configured triggers should work.")
+	}
+
+	// Like on IRC, private messages need a prefix when the transport and the config don't say otherwise.
+	writeConfig(t, bot, strings.NewReplacer("private_commands = \"always\"\n", ""))
+	if err := bot.Reload(); err != nil {
+		t.Fatalf("Can't reload: %s", err)
+	}
+	run(events.EventPrivateMessage, "user", "help version", false)
+	run(events.EventPrivateMessage, "user", ".help more", false)
+	if !transport.waitForCount("user: m, more", 1) {
+		t.Error("Prefixed private message should be a command.")
+	}
+	if transport.count("user: ver, version") != 0 {
+		t.Error("Private message without a prefix should not be a command by default.")
+	}
+}
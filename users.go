@@ -4,198 +4,275 @@ package papaBot
 
 import (
 	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/mattn/go-sqlite3"
+	"github.com/pawelszydlo/papa-bot/events"
+	"github.com/pawelszydlo/papa-bot/storage"
 	"github.com/pawelszydlo/papa-bot/utils"
 	"os"
 	"os/exec"
-	"strings"
 	"syscall"
+	"time"
 )
 
-// ensureOwnerExists makes sure that at least one owner exists in the database.
+// Settings read from the owner section of the config file, for creating the first owner without a terminal.
+type ownerSettings struct {
+	Nick     string `config:"nick" default:""`
+	Password string `config:"password" default:""`
+	// Ask for the owner on the terminal, when there is one.
+	Prompt bool `config:"prompt" default:"true"`
+}
+
+// Environment variables with the credentials of the first owner. They take precedence over the config file.
+const (
+	ownerNickEnv     = "PAPABOT_OWNER_NICK"
+	ownerPasswordEnv = "PAPABOT_OWNER_PASSWORD"
+)
+
+// ensureOwnerExists makes sure that at least one owner exists in the database. The owner is created from the
+// credentials in the environment or the config file, or from the answers on the terminal. Without either, a setup
+// token is logged, that the first user can claim ownership with.
 func (bot *Bot) ensureOwnerExists() {
-	result, err := bot.Db.Query(`SELECT EXISTS(SELECT 1 FROM users WHERE owner=1 LIMIT 1);`)
+	settings := ownerSettings{}
+	if err := bot.LoadConfig("owner", &settings); err != nil {
+		bot.Log.Fatalf("Invalid config: %s", err)
+	}
+	ownerExists, err := bot.Storage.OwnerExists()
 	if err != nil {
 		bot.Log.Fatalf("Can't check if owner exists: %s", err)
 	}
-	defer result.Close()
+	if ownerExists {
+		return
+	}
+	bot.Log.Warningf("No owner found in the database. Must create one.")
 
-	if result.Next() {
-		var ownerExists bool
-		if err = result.Scan(&ownerExists); err != nil {
-			bot.Log.Fatalf("Can't check if owner exists: %s", err)
-		}
-		if !ownerExists {
-			bot.Log.Warningf("No owner found in the database. Must create one.")
-
-			stty, _ := exec.LookPath("stty")
-			sttyArgs := syscall.ProcAttr{
-				"",
-				[]string{},
-				[]uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()},
-				nil,
-			}
-			reader := bufio.NewReader(os.Stdin)
-
-			fmt.Print("Enter owner's nick: ")
-			nick, _ := reader.ReadString('\n')
-
-			// Disable echo.
-			if stty != "" {
-				syscall.ForkExec(stty, []string{"stty", "-echo"}, &sttyArgs)
-			}
-
-			// Get password.
-			fmt.Print("Enter owner's password: ")
-			pass1, _ := reader.ReadString('\n')
-			fmt.Print("\nConfirm owner's password: ")
-			pass2, _ := reader.ReadString('\n')
-			if pass1 != pass2 {
-				bot.Log.Fatal("Passwords don't match.")
-			}
-			fmt.Print("\n")
-
-			// Enable echo.
-			if stty != "" {
-				syscall.ForkExec(stty, []string{"stty", "echo"}, &sttyArgs)
-			}
-
-			result.Close()
-
-			if bot.addUser(utils.CleanString(nick, false), utils.CleanString(pass1, false), true, true); err != nil {
-				bot.Log.Fatalf("%s", err)
-			}
+	if nick := os.Getenv(ownerNickEnv); nick != "" {
+		settings.Nick, settings.Password = nick, os.Getenv(ownerPasswordEnv)
+	}
+	if settings.Nick != "" {
+		if err := bot.addUser(settings.Nick, settings.Password, []string{OwnerRole}); err != nil {
+			bot.Log.Fatalf("Can't create owner %s: %s", settings.Nick, err)
 		}
+		bot.Log.Infof("Created owner %s.", settings.Nick)
+		return
 	}
+	if settings.Prompt && stdinIsTerminal() {
+		bot.promptForOwner()
+		return
+	}
+	bot.createSetupToken()
+}
+
+// stdinIsTerminal checks whether the bot can ask questions on the terminal.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-// addUser adds new user to bot's database.
-func (bot *Bot) addUser(nick, password string, owner, admin bool) error {
+// promptForOwner asks for the owner's credentials on the terminal.
+func (bot *Bot) promptForOwner() {
+	stty, _ := exec.LookPath("stty")
+	sttyArgs := syscall.ProcAttr{
+		"",
+		[]string{},
+		[]uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()},
+		nil,
+	}
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Print("Enter owner's nick: ")
+	nick, _ := reader.ReadString('\n')
+
+	// Disable echo.
+	if stty != "" {
+		syscall.ForkExec(stty, []string{"stty", "-echo"}, &sttyArgs)
+	}
+
+	// Get password.
+	fmt.Print("Enter owner's password: ")
+	pass1, _ := reader.ReadString('\n')
+	fmt.Print("\nConfirm owner's password: ")
+	pass2, _ := reader.ReadString('\n')
+	if pass1 != pass2 {
+		bot.Log.Fatal("Passwords don't match.")
+	}
+	fmt.Print("\n")
+
+	// Enable echo.
+	if stty != "" {
+		syscall.ForkExec(stty, []string{"stty", "echo"}, &sttyArgs)
+	}
+
+	if err := bot.addUser(utils.CleanString(nick, false), utils.CleanString(pass1, false), []string{OwnerRole}); err != nil {
+		bot.Log.Fatalf("%s", err)
+	}
+}
+
+// createSetupToken creates the one-time token for claiming ownership of the bot, and logs it.
+func (bot *Bot) createSetupToken() {
+	code := make([]byte, 16)
+	if _, err := rand.Read(code); err != nil {
+		bot.Log.Fatalf("Can't create setup token: %s", err)
+	}
+	token := hex.EncodeToString(code)
+	bot.authMu.Lock()
+	bot.setupToken = token
+	bot.authMu.Unlock()
+	bot.Log.Warningf("To become the owner, create an account with useradd and send \"claim %s\" to the bot "+
+		"in a private message.", token)
+}
+
+// claimOwnership gives the owner role to the user, if the setup token is right. The token can only be used once.
+func (bot *Bot) claimOwnership(nick, token string) bool {
+	bot.authMu.Lock()
+	valid := bot.setupToken != "" && subtle.ConstantTimeCompare([]byte(bot.setupToken), []byte(token)) == 1
+	if valid {
+		bot.setupToken = ""
+	}
+	bot.authMu.Unlock()
+	if !valid {
+		return false
+	}
+	if err := bot.grantRole(storage.RoleAssignment{Nick: nick, Role: OwnerRole}); err != nil {
+		bot.Log.Errorf("Can't make %s the owner: %s", nick, err)
+		return false
+	}
+	bot.audit(nick, "owner.claim", nick, "")
+	return true
+}
+
+// commandClaim makes the user the owner, with the setup token from the log.
+func commandClaim(bot *Bot, sourceEvent *events.EventMessage, args *CommandArgs) {
+	nick := bot.GetAuthenticatedNick(sourceEvent.UserId)
+	if nick == "" {
+		bot.SendMessage(sourceEvent, "Create an account with useradd or log in first.")
+		return
+	}
+	if !bot.claimOwnership(nick, args.String("token")) {
+		bot.SendMessage(sourceEvent, "That's not right.")
+		return
+	}
+	bot.SendMessage(sourceEvent, "You are now the owner.")
+}
+
+// addUser adds new user to bot's database, with the roles given everywhere.
+func (bot *Bot) addUser(nick, password string, roles []string) error {
 	if password == "" {
 		return errors.New("Password can't be empty.")
 	}
+	for _, role := range roles {
+		if !bot.roleExists(role) {
+			return errors.New(fmt.Sprintf("No role named %s.", role))
+		}
+	}
 	// Insert user into the db.
-	if _, err := bot.Db.Exec(`INSERT INTO users(nick, password, owner, admin) VALUES(?, ?, ?, ?)`,
-		nick, utils.HashPassword(password), owner, admin); err != nil {
-		// Get exact error.
-		driverErr := err.(sqlite3.Error)
-		if driverErr.Code == sqlite3.ErrConstraint {
+	if err := bot.Storage.AddUser(storage.User{Nick: nick, Password: utils.HashPassword(password)}); err != nil {
+		if err == storage.ErrUserExists {
 			return errors.New("User already exists.")
 		}
+		bot.Log.Errorf("Can't add user %s: %s", nick, err)
 		return errors.New("Error while adding new user!")
 	}
+	for _, role := range roles {
+		if err := bot.Storage.AssignRole(storage.RoleAssignment{Nick: nick, Role: role}); err != nil {
+			bot.Log.Errorf("Can't give role %s to %s: %s", role, nick, err)
+			return errors.New("Error while adding new user!")
+		}
+	}
+	if len(roles) > 0 {
+		return bot.loadRoles()
+	}
 	return nil
 }
 
-// getUserData fetches user information from database.
-func (bot *Bot) getUserData(nick string) (
-	dbNick, password string, altNicks map[string]bool, owner, admin bool, err error) {
+// Error returned when logging in is blocked after too many failures.
+type loginLockedError struct {
+	until time.Time
+}
 
-	altNicks = map[string]bool{}
-	result, err := bot.Db.Query(`
-		SELECT nick, password, IFNULL(alt_nicks, ""), owner, admin
-		FROM users WHERE nick=? LIMIT 1`, nick)
-	if err != nil {
-		return
-	}
-	defer result.Close()
+func (err loginLockedError) Error() string {
+	return fmt.Sprintf("login locked until %s", err.until.Format("2006-01-02 15:04:05"))
+}
 
-	// Get user data.
-	if result.Next() {
-		var altNicksStr string
-		if err = result.Scan(&dbNick, &password, &altNicksStr, &owner, &admin); err != nil {
-			return
-		}
-		for _, altNick := range strings.Split(altNicksStr, "|") {
-			altNicks[altNick] = true
-		}
+// loginFailed counts the failed login, and blocks logging in to the account when there were too many.
+func (bot *Bot) loginFailed(user storage.User, now time.Time) {
+	failures, lockedUntil := user.FailedLogins+1, time.Time{}
+	if failures >= bot.Config().LoginFailuresMax {
+		bot.Log.Warningf("Too many failed logins to %s. Locking for %s.", user.Nick, bot.Config().LoginLockout)
+		failures, lockedUntil = 0, now.Add(bot.Config().LoginLockout)
+		bot.audit(user.Nick, "user.locked", user.Nick, fmt.Sprintf("until %s", lockedUntil.Format("15:04:05")))
+	}
+	if err := bot.Storage.SetLoginFailures(user.Nick, failures, lockedUntil); err != nil {
+		bot.Log.Errorf("Can't count the failed login of %s: %s", user.Nick, err)
 	}
+}
 
-	// Check if the nick is indeed what we want.
-	if dbNick != nick {
+// getUserData fetches user information from database.
+func (bot *Bot) getUserData(nick string) (
+	dbNick, password string, altNicks map[string]bool, err error) {
+
+	altNicks = map[string]bool{}
+	user, err := bot.Storage.GetUser(nick)
+	if err == storage.ErrNotFound {
 		err = errors.New("User not in the database.")
 		return
+	} else if err != nil {
+		return
 	}
-
-	return
+	for _, altNick := range user.AltNicks {
+		altNicks[altNick] = true
+	}
+	return user.Nick, user.Password, altNicks, nil
 }
 
-// authenticateUser authenticates the user as an owner or admin
-// Authentication is done on the basis of userId, which is assumed to be globally unique.
-func (bot *Bot) authenticateUser(nick, userId, password string) error {
-	_, dbPassword, _, owner, admin, err := bot.getUserData(nick)
+// authenticateUser checks the password and starts a session for the sender of the event. What they can do then
+// depends on their roles.
+func (bot *Bot) authenticateUser(sourceEvent *events.EventMessage, nick, password string) error {
+	bot.loginMu.Lock()
+	defer bot.loginMu.Unlock()
+	user, err := bot.Storage.GetUser(nick)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error when getting user data for %s: %s", nick, err))
 	}
+	now := time.Now()
+	if now.Before(user.LockedUntil) {
+		return loginLockedError{user.LockedUntil}
+	}
 	// Check the password
-	if utils.HashPassword(password) != dbPassword {
+	matches, outdated := utils.CheckPassword(password, user.Password)
+	if !matches {
+		bot.loginFailed(user, now)
 		return errors.New("Invalid password for user")
 	}
-	// Check if user has any privileges
-	if owner {
-		bot.Log.Infof("Authenticating %s as an owner.", nick)
-		bot.authenticatedOwners[userId] = nick
-	}
-	if admin {
-		bot.Log.Infof("Authenticating %s as an admin.", nick)
-		bot.authenticatedAdmins[userId] = nick
+	if user.FailedLogins > 0 || !user.LockedUntil.IsZero() {
+		if err := bot.Storage.SetLoginFailures(nick, 0, time.Time{}); err != nil {
+			bot.Log.Errorf("Can't reset failed logins of %s: %s", nick, err)
+		}
 	}
-	if !admin && !owner {
-		bot.Log.Infof("Authenticating %s with no special privileges.", nick)
-		bot.authenticatedUsers[userId] = nick
+	// Hashes made with an old algorithm or parameters are replaced, now that the password is known.
+	if outdated {
+		if _, err := bot.Storage.SetPassword(nick, utils.HashPassword(password)); err != nil {
+			bot.Log.Errorf("Can't upgrade password hash of %s: %s", nick, err)
+		} else {
+			bot.Log.Infof("Upgraded password hash of %s.", nick)
+		}
 	}
-	// TODO: There is a possible vulnerability here if authenticated user quits
-	// and someone else join who has exact same username.
+	bot.Log.Infof("Authenticating %s.", nick)
+	bot.startSession(sourceEvent, nick)
 	return nil
 }
 
-// GetAuthenticatedNick will get authenticated user's nick by his full name.
-func (bot *Bot) GetAuthenticatedNick(userId string) string {
-	if bot.authenticatedOwners[userId] != "" {
-		return bot.authenticatedOwners[userId]
-	}
-	if bot.authenticatedAdmins[userId] != "" {
-		return bot.authenticatedAdmins[userId]
-	}
-	if bot.authenticatedUsers[userId] != "" {
-		return bot.authenticatedUsers[userId]
-	}
-	return ""
-}
-
 // NickIsMe checks if the sender is the bot.
 func (bot *Bot) NickIsMe(transportName, nick string) bool {
 	transport := bot.getTransportOrDie(transportName)
 	return transport.NickIsMe(nick)
 }
 
-// userIsAuthenticated checks if the user is authenticated with the bot.
-func (bot *Bot) UserIsAuthenticated(userId string) bool {
-	return bot.authenticatedOwners[userId] != "" || bot.authenticatedAdmins[userId] != "" ||
-		bot.authenticatedUsers[userId] != ""
-}
-
-// userIsOwner checks if the user is an authenticated owner.
+// userIsOwner checks if the user is authenticated and has the owner role.
 func (bot *Bot) UserIsOwner(userId string) bool {
-	return bot.authenticatedOwners[userId] != ""
-}
-
-// userIsOwner checks if the user is an authenticated admin.
-func (bot *Bot) UserIsAdmin(userId string) bool {
-	return bot.authenticatedAdmins[userId] != ""
-}
-
-// areSamePeople checks if two nicks belong to the same person.
-func (bot *Bot) AreSamePeople(nick1, nick2 string) bool {
-	// TODO: make this function actually work by using alias lists.
-	nick1 = strings.Trim(nick1, "_~")
-	nick2 = strings.Trim(nick2, "_~")
-	return nick1 == nick2
-}
-
-// isOwnerOrAdmin will check whether user has privileges.
-func (bot *Bot) UserIsOwnerOrAdmin(userId string) bool {
-	return bot.UserIsOwner(userId) || bot.UserIsAdmin(userId)
+	nick := bot.GetAuthenticatedNick(userId)
+	return nick != "" && bot.nickHasRole(nick, OwnerRole)
 }
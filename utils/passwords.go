@@ -0,0 +1,72 @@
+package utils
+
+// Password hashing with argon2id, and checking of the hashes made by the older versions of the bot.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Parameters of the argon2id hashes.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonSaltLen = 16
+	argonKeyLen  = 32
+)
+
+// HashPassword hashes a password with a random salt. The result holds the algorithm and its parameters, in the
+// form $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>.
+func HashPassword(password string) string {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		panic(fmt.Sprintf("can't generate salt: %s", err))
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// CheckPassword checks the password against the hash, in constant time. It also tells whether the hash should be
+// replaced, because it uses an old algorithm or different parameters.
+func CheckPassword(password, hash string) (matches, outdated bool) {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		legacy := base64.StdEncoding.EncodeToString(
+			pbkdf2.Key([]byte(password), []byte(password), 4096, sha256.Size, sha256.New))
+		return subtle.ConstantTimeCompare([]byte(legacy), []byte(hash)) == 1, true
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	var version, iterations, threads int
+	var memory uint32
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil ||
+		iterations < 1 || threads < 1 || threads > 255 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false
+	}
+	computed := argon2.IDKey([]byte(password), salt, uint32(iterations), memory, uint8(threads), uint32(len(key)))
+	matches = subtle.ConstantTimeCompare(computed, key) == 1
+	outdated = memory != argonMemory || iterations != argonTime || threads != argonThreads ||
+		len(salt) != argonSaltLen || len(key) != argonKeyLen
+	return matches, outdated
+}
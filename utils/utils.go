@@ -3,14 +3,12 @@ package utils
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
-	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/net/idna"
 	"html"
 	"log"
 	"os"
+	"regexp"
 	"strings"
 	"text/template"
 	"time"
@@ -36,6 +34,22 @@ func StripTags(text string) string {
 	return output.String()
 }
 
+var ircFormattingRe = regexp.MustCompile(`\x03(\d{1,2}(,\d{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]`)
+
+// StripIRCFormatting removes IRC color and formatting codes from text.
+func StripIRCFormatting(text string) string {
+	return ircFormattingRe.ReplaceAllString(text, "")
+}
+
+var markdownLinkRe = regexp.MustCompile(`\[([^\]]*)\]\(([^)]*)\)`)
+var markdownEmphasisRe = regexp.MustCompile("\\*\\*|__|~~|`")
+
+// StripMarkdown removes basic Markdown markup from text. Links are changed to "text (url)".
+func StripMarkdown(text string) string {
+	text = markdownLinkRe.ReplaceAllString(text, "$1 ($2)")
+	return markdownEmphasisRe.ReplaceAllString(text, "")
+}
+
 // MustForceLocalTimezone adds current timezone to passed date, without recalculating the date.
 func MustForceLocalTimezone(date time.Time) time.Time {
 	// Hack to force the time to be from the same timezone as now
@@ -147,12 +161,6 @@ func RemoveFromSlice(slice []string, item string) []string {
 	return slice
 }
 
-// HashPassword hashes a password.
-func HashPassword(password string) string {
-	return base64.StdEncoding.EncodeToString(
-		pbkdf2.Key([]byte(password), []byte(password), 4096, sha256.Size, sha256.New))
-}
-
 // ToStringSlice converts arbitrary interface slice into a string slice.
 func ToStringSlice(elements []interface{}) []string {
 	strs := make([]string, len(elements), len(elements))
@@ -161,3 +169,31 @@ func ToStringSlice(elements []interface{}) []string {
 	}
 	return strs
 }
+
+// EditDistance returns the Levenshtein distance between two strings, counted in runes.
+func EditDistance(a, b string) int {
+	first, second := []rune(a), []rune(b)
+	previous := make([]int, len(second)+1)
+	current := make([]int, len(second)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(first); i++ {
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i-1] == second[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(second)]
+}